@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
@@ -18,8 +19,11 @@ import (
 	"github.com/pynezz/bivrost/internal/api"
 	"github.com/pynezz/bivrost/internal/config"
 	"github.com/pynezz/bivrost/internal/database"
+	"github.com/pynezz/bivrost/internal/export"
 	"github.com/pynezz/bivrost/internal/fswatcher"
+	"github.com/pynezz/bivrost/internal/ipc"
 	"github.com/pynezz/bivrost/internal/ipc/ipcserver"
+	"github.com/pynezz/bivrost/internal/live"
 	"github.com/pynezz/bivrost/internal/middleware"
 	"github.com/pynezz/bivrost/internal/tui"
 	"github.com/pynezz/bivrost/internal/util/flags"
@@ -46,6 +50,9 @@ import (
 
 var dbCreateBatchSize = 100
 
+// shutdownTimeout is how long open requests, such as live tails, get to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func Execute(isPackage bool, buildVersion string) {
 	// Parse the command line arguments (flags)
 	if !isPackage {
@@ -56,16 +63,11 @@ func Execute(isPackage bool, buildVersion string) {
 	ansi.PrintInfo(" > Config path: " + *args.ConfigPath)
 	ansi.PrintInfo(" > Log path: " + *args.LogPath)
 
-	// Setting up signal handling to catch CTRL+C and other termination signals
+	// Setting up signal handling to catch CTRL+C and other termination signals.
+	// They shut the web server down once it's up, so the deferred cleanup below gets to run
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	go func() {
-		sig := <-sigChan
-		fmt.Printf("Received signal: %s\n", sig)
-		os.Exit(0)
-	}()
-
 	termiui := tui.NewTui(buildVersion)
 	termiui.Header.Color = ansi.Cyan
 	termiui.Header.PrintHeader()
@@ -127,7 +129,8 @@ func Execute(isPackage bool, buildVersion string) {
 		return
 	}
 
-	err = modules.LoadModules(*cfg)
+	registry := modules.NewRegistry()
+	err = registry.Load(*cfg, buildVersion)
 	if err != nil {
 		ansi.PrintError("[bivrost|main.go] Failed to load modules: " + err.Error())
 		return
@@ -145,7 +148,38 @@ func Execute(isPackage bool, buildVersion string) {
 	}
 
 	// Run the IPC goroutine
-	go unixDomainSockets()
+	ipcServer := ipcserver.NewIPCServer("bivrost", "bivrost", registry)
+	ipcServer.SetHeartbeat(
+		time.Duration(cfg.IPC.HeartbeatInterval)*time.Second,
+		time.Duration(cfg.IPC.PeerTimeout)*time.Second)
+	ipcServer.SetTransfer(cfg.IPC.MaxChunkSize, cfg.IPC.MaxMessageSize, cfg.IPC.Compression)
+	ipcServer.SetStores(s)
+	ipcServer.SetModuleTables(s.ModuleTables)
+	var eventQueue *database.EventQueue
+	if cfg.IPC.Events.Persist {
+		eventQueue = s.EventQueue
+	}
+	if err := ipcServer.SetEvents(eventQueue, cfg.IPC.Events.MaxQueue, time.Duration(cfg.IPC.Events.AckTimeout)*time.Second); err != nil {
+		ansi.PrintError("[bivrost|main.go] Failed to load the event queue: " + err.Error())
+		return
+	}
+	if cfg.IPC.Capture.Enabled {
+		if _, err := ipcServer.StartCapture(cfg.IPC.Capture.Dir, cfg.IPC.Capture.Modules); err != nil {
+			ansi.PrintError("[bivrost|main.go] Failed to start capturing IPC frames: " + err.Error())
+		}
+		defer ipcServer.StopCapture()
+	}
+	go unixDomainSockets(ipcServer)
+
+	// Start the module binaries. Modules built with pkg/module retry until the socket is up
+	// Sandboxed modules must not be able to read the users database or the signing keys
+	supervisor := modules.NewSupervisor()
+	supervisor.Protect(cfg.Database.Path, cfg.Auth.KeyFile, os.Getenv(middleware.ENV_JWT_KEY_FILE))
+	supervisor.StartAll(registry.Modules())
+	defer supervisor.StopAll()
+	if cfg.IPC.TLS.Listen != "" {
+		go remoteModules(ipcServer, cfg)
+	}
 
 	// Connect to database
 	db, err := middleware.NewDBService().Connect(cfg.Database.Path)
@@ -154,18 +188,91 @@ func Execute(isPackage bool, buildVersion string) {
 		return
 	}
 
+	// Keys the tokens are signed with, reloaded on SIGHUP to rotate them
+	loadKeys := func() error { return middleware.LoadSigningKeys(cfg.Auth.KeyFile) }
+	if err := loadKeys(); err != nil {
+		ansi.PrintError("Main function: " + err.Error())
+		return
+	}
+
 	port := 3300
 	if cfg.Network.Port != 0 {
 		port = cfg.Network.Port
 	}
 
+	// Reload the modules on SIGHUP, or through the API
+	reload := moduleReloader(*flags.Params.ConfigPath, buildVersion, registry, supervisor, ipcServer)
+	go reloadOnHangup(reload, loadKeys)
+
+	// Stream new rows to the live tail clients
+	hub := live.NewHub(s.Feed, cfg.Network.LiveBuffer)
+	defer hub.Close()
+
+	// Run the exports too large to stream in the background
+	exports, err := export.NewJobs(s, cfg.Export.Dir, time.Duration(cfg.Export.TTL)*time.Hour, cfg.Export.Concurrency)
+	if err != nil {
+		ansi.PrintError("Background exports are disabled: " + err.Error())
+	} else {
+		defer exports.Close()
+	}
+
+	// Changes of the config through the API, applied live where possible
+	configManager, err := config.NewManager(*flags.Params.ConfigPath, cfg)
+	if err != nil {
+		ansi.PrintError("Config management is disabled: " + err.Error())
+	} else {
+		configManager.Validator(func(next *config.Cfg) error {
+			return modules.Validate(*next, buildVersion)
+		})
+		configManager.Live("sources", func(*config.Cfg) error {
+			_, err := reload() // Reads the config file written by the manager
+			return err
+		})
+		configManager.Live("network.live_buffer", func(next *config.Cfg) error {
+			hub.SetBuffer(next.Network.LiveBuffer)
+			return nil
+		})
+		configManager.Live("ipc.capture", func(next *config.Cfg) error {
+			return applyCapture(ipcServer, next)
+		})
+		configManager.Validator(func(next *config.Cfg) error {
+			if next.Auth.KeyFile == "" || next.Auth.KeyFile == cfg.Auth.KeyFile {
+				return nil
+			}
+			_, err := middleware.ReadKeySet(next.Auth.KeyFile)
+			return err
+		})
+		configManager.Live("auth", func(next *config.Cfg) error {
+			supervisor.Protect(next.Auth.KeyFile)
+			return middleware.LoadSigningKeys(next.Auth.KeyFile)
+		})
+	}
+
 	// Create the web server
-	app := api.NewServer(cfg)
-	app.Listen(":" + strconv.Itoa(port))
+	app := api.NewServer(cfg, api.Backends{IPC: ipcServer, Modules: supervisor, Registry: registry, Stores: s, Live: hub, Exports: exports, Config: configManager, ReloadModules: reload, Version: buildVersion})
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		ansi.PrintError("Main function: " + err.Error())
+		return
+	}
+
+	go func() {
+		sig := <-sigChan
+		fmt.Printf("Received signal: %s\n", sig)
+		if err := app.ShutdownWithTimeout(shutdownTimeout); err != nil {
+			ansi.PrintError("[main.go] Failed to shut down the web server: " + err.Error())
+		}
+		ln.Close() // In case the server wasn't serving yet
+	}()
+
+	ansi.PrintItalic("[main.go] Press Ctrl+C to exit.")
+	if err := app.Listener(ln); err != nil {
+		ansi.PrintError("[main.go] " + err.Error())
+	}
 
-	ansi.PrintItalic("[main.go] Waiting for SIGINT or SIGTERM... Press Ctrl+C to exit.")
-	<-sigChan
+	// The modules are stopped before the deferred closes of the stores they write to
 	ansi.PrintItalic("[main.go] Exiting...")
+	supervisor.StopAll()
 	if err := db.Driver.Close(); err != nil {
 		ansi.PrintItalic("[+] db driver closed")
 		time.Sleep(time.Second * 3)
@@ -197,6 +304,10 @@ func testDbConnection() {
 		ansi.PrintError(err.Error())
 		return
 	}
+	if err := usersDb.Upgrade(); err != nil {
+		ansi.PrintError(err.Error())
+		return
+	}
 
 	ansi.PrintInfo("Testing db connection...")
 	err = db.Ping()
@@ -207,12 +318,11 @@ func testDbConnection() {
 	ansi.PrintColorBold(ansi.LightGreen, "🎉 Database connected!")
 }
 
-func unixDomainSockets() {
+func unixDomainSockets(ipcServer *ipcserver.IPCServer) {
 	ansi.PrintInfo("Testing UNIX domain socket connection...")
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	ipcServer := ipcserver.NewIPCServer("bivrost", "bivrost")
 	ok := ipcServer.InitServerSocket()
 	if !ok {
 		return
@@ -229,6 +339,61 @@ func unixDomainSockets() {
 	fmt.Println("Done cleaning up. Exiting...")
 }
 
+// moduleReloader returns a function that re-reads the config file and applies the module changes
+func moduleReloader(configPath, version string, registry *modules.Registry, supervisor *modules.Supervisor, ipcServer *ipcserver.IPCServer) func() (*modules.ReloadResult, error) {
+	var mu sync.Mutex // One reload at a time
+	return func() (*modules.ReloadResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		return registry.Reload(*cfg, version, supervisor, func(identifier string) {
+			ipcServer.Disconnect(identifier)
+		})
+	}
+}
+
+func reloadOnHangup(reload func() (*modules.ReloadResult, error), loadKeys func() error) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		ansi.PrintInfo("Received SIGHUP, reloading modules and signing keys...")
+		if _, err := reload(); err != nil {
+			ansi.PrintError("Module reload failed: " + err.Error())
+		}
+		if err := loadKeys(); err != nil {
+			ansi.PrintError("Signing key reload failed, keeping the current keys: " + err.Error())
+		}
+	}
+}
+
+// applyCapture restarts the capture of IPC frames with the capture settings of the config, or stops it if disabled
+func applyCapture(ipcServer *ipcserver.IPCServer, cfg *config.Cfg) error {
+	if _, ok := ipcServer.Capture(); ok {
+		if _, err := ipcServer.StopCapture(); err != nil {
+			return err
+		}
+	}
+	if !cfg.IPC.Capture.Enabled {
+		return nil
+	}
+	_, err := ipcServer.StartCapture(cfg.IPC.Capture.Dir, cfg.IPC.Capture.Modules)
+	return err
+}
+
+// remoteModules accepts modules on other hosts over TCP with mutual TLS
+func remoteModules(ipcServer *ipcserver.IPCServer, cfg *config.Cfg) {
+	tlsConfig, err := ipc.ServerTLSConfig(cfg.IPC.TLS.Cert, cfg.IPC.TLS.Key, cfg.IPC.TLS.ClientCA)
+	if err != nil {
+		ansi.PrintError("Remote modules disabled: " + err.Error())
+		return
+	}
+	ipcServer.ListenTLS(cfg.IPC.TLS.Listen, tlsConfig)
+}
+
 func logalyzer(data chan string, lineChan chan string, log string, nginxLogStore *database.DataStore[models.NginxLog]) {
 	ansi.PrintInfo("Starting the file watcher...")
 	var wg sync.WaitGroup
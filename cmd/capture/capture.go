@@ -0,0 +1,241 @@
+// Package capture implements the `bivrost capture` commands, to read and replay captures of IPC connections
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/pynezzentials/ansi"
+)
+
+const usage = `Usage: bivrost capture <command> [options] FILE
+
+Captures are recorded by bivrost when ipc.capture is enabled in the config, or through the API
+(POST /api/v1/ipc/capture).
+
+Commands:
+  print [options] FILE		Pretty print the frames of a capture
+  replay [options] FILE		Replay a connection of the capture against a server or a module
+
+Options of print:
+  -conn N			Only frames of the connection N
+  -module ID			Only frames of the module with the identifier
+  -type LIST			Only frames of the comma separated message types, ex: msg,error
+  -from SIDE			Only frames sent by the module or the server
+  -method METHOD		Only requests with the method, ex: POST
+  -table TABLE			Only requests to the table
+  -data N			Print at most N bytes of data per frame, 0 for all (default 512)
+  -json				Print the frames as JSON lines, a capture of its own
+
+Options of replay:
+  -server SOCKET		Play the module's part against the server listening on the unix socket
+  -module SOCKET		Listen on the unix socket, and play the server's part against the module that connects
+  -conn N			Connection of the capture to replay, defaults to the first one
+  -timing			Keep the delays between the frames
+  -timeout DURATION		How long to wait for each expected frame (default 10s)
+  -v				Print the frames as they are sent and received
+
+  Example:
+  bivrost capture print -module thrt -type msg,error captures/capture-20240501-120000.jsonl
+  bivrost capture replay -server /tmp/bivrost/bivrost.sock -conn 2 captures/capture-20240501-120000.jsonl`
+
+// Execute runs the capture command in args, and returns the exit code
+func Execute(args []string) int {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return 2
+	}
+	switch args[0] {
+	case "print":
+		return printFrames(args[1:])
+	case "replay":
+		return replay(args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Println(usage)
+		return 0
+	default:
+		ansi.PrintError("Unknown capture command: " + args[0])
+		fmt.Println(usage)
+		return 2
+	}
+}
+
+// parse parses the options, which may come before or after the capture file, and reads the capture
+func parse(fs *flag.FlagSet, args []string) ([]ipc.Frame, bool) {
+	file := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		file, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false
+	}
+	if file == "" && fs.NArg() > 0 {
+		file = fs.Arg(0)
+	}
+	if file == "" {
+		ansi.PrintError("Missing the capture file")
+		fmt.Println(usage)
+		return nil, false
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		ansi.PrintError(err.Error())
+		return nil, false
+	}
+	defer f.Close()
+	frames, err := ipc.ReadCapture(f)
+	if err != nil {
+		ansi.PrintError(fmt.Sprintf("%s: %v", file, err))
+		return nil, false
+	}
+	return frames, true
+}
+
+// filter selects the frames to print
+type filter struct {
+	conn   uint64
+	module string
+	types  map[byte]bool
+	from   string
+	method string
+	table  string
+}
+
+func (f filter) match(frame ipc.Frame) bool {
+	switch {
+	case f.conn != 0 && frame.Conn != f.conn,
+		f.module != "" && frame.Identifier != f.module,
+		len(f.types) > 0 && !f.types[frame.MessageType],
+		f.from != "" && frame.From != f.from:
+		return false
+	}
+	if f.method != "" && (frame.Metadata == nil || !strings.EqualFold(frame.Metadata.Method, f.method)) {
+		return false
+	}
+	if f.table != "" && (frame.Metadata == nil || frame.Metadata.Destination.Object.Database.Table != f.table) {
+		return false
+	}
+	return true
+}
+
+func printFrames(args []string) int {
+	var f filter
+	fs := flag.NewFlagSet("bivrost capture print", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	fs.Uint64Var(&f.conn, "conn", 0, "")
+	fs.StringVar(&f.module, "module", "", "")
+	types := fs.String("type", "", "")
+	fs.StringVar(&f.from, "from", "", "")
+	fs.StringVar(&f.method, "method", "", "")
+	fs.StringVar(&f.table, "table", "", "")
+	maxData := fs.Int("data", 512, "")
+	asJSON := fs.Bool("json", false, "")
+
+	frames, ok := parse(fs, args)
+	if !ok {
+		return 2
+	}
+	if f.from != "" && f.from != ipc.FROM_MODULE && f.from != ipc.FROM_SERVER {
+		ansi.PrintError(fmt.Sprintf("-from must be %s or %s", ipc.FROM_MODULE, ipc.FROM_SERVER))
+		return 2
+	}
+	if *types != "" {
+		f.types = make(map[byte]bool)
+		for _, name := range strings.Split(*types, ",") {
+			t, ok := ipc.MSGTYPE[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				ansi.PrintError(fmt.Sprintf("Unknown message type %q", name))
+				return 2
+			}
+			f.types[t] = true
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	shown := 0
+	for _, frame := range frames {
+		if !f.match(frame) {
+			continue
+		}
+		shown++
+		if *asJSON {
+			enc.Encode(frame)
+			continue
+		}
+		fmt.Println(frame.Format(*maxData))
+	}
+	if !*asJSON {
+		ansi.PrintInfo(fmt.Sprintf("%d of %d frames", shown, len(frames)))
+	}
+	return 0
+}
+
+func replay(args []string) int {
+	var opts ipc.ReplayOptions
+	fs := flag.NewFlagSet("bivrost capture replay", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	server := fs.String("server", "", "")
+	module := fs.String("module", "", "")
+	fs.Uint64Var(&opts.Conn, "conn", 0, "")
+	fs.BoolVar(&opts.Timing, "timing", false, "")
+	fs.DurationVar(&opts.Timeout, "timeout", 0, "")
+	verbose := fs.Bool("v", false, "")
+
+	frames, ok := parse(fs, args)
+	if !ok {
+		return 2
+	}
+	if (*server == "") == (*module == "") {
+		ansi.PrintError("Either -server or -module is required")
+		return 2
+	}
+	if *verbose {
+		opts.OnFrame = func(f ipc.Frame) { fmt.Println(f.Format(512)) }
+	}
+
+	var mismatches []ipc.Mismatch
+	var err error
+	ctx := context.Background()
+	if *server != "" {
+		var c net.Conn
+		c, err = net.DialTimeout("unix", *server, 5*time.Second)
+		if err != nil {
+			ansi.PrintError(err.Error())
+			return 1
+		}
+		ansi.PrintInfo("Replaying the module's part against " + *server)
+		mismatches, err = ipc.ReplayToServer(ctx, c, frames, opts)
+	} else {
+		var l net.Listener
+		l, err = net.Listen("unix", *module)
+		if err != nil {
+			ansi.PrintError(err.Error())
+			return 1
+		}
+		defer l.Close()
+		ansi.PrintInfo("Waiting for the module to connect to " + *module + " (BIVROST_SOCKET)...")
+		mismatches, err = ipc.ReplayToModule(ctx, l, frames, opts)
+	}
+
+	for _, m := range mismatches {
+		ansi.PrintWarning(m.String())
+	}
+	if err != nil {
+		ansi.PrintError(err.Error())
+		return 1
+	}
+	if len(mismatches) > 0 {
+		ansi.PrintError(fmt.Sprintf("%d mismatches", len(mismatches)))
+		return 1
+	}
+	ansi.PrintSuccess("The replay matched the capture")
+	return 0
+}
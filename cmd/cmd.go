@@ -6,9 +6,31 @@ import (
 	"strings"
 
 	"github.com/pynezz/bivrost/cmd/bivrost"
+	"github.com/pynezz/bivrost/cmd/capture"
+	"github.com/pynezz/bivrost/cmd/export"
+	"github.com/pynezz/bivrost/cmd/keys"
+	"github.com/pynezz/bivrost/cmd/module"
+	"github.com/pynezz/bivrost/cmd/openapi"
 )
 
 func Execute(buildVersion string) {
+	// Subcommands, before the flags of the server are parsed
+	if len(os.Args) > 1 && os.Args[1] == "module" {
+		os.Exit(module.Execute(os.Args[2:], buildVersion))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "capture" {
+		os.Exit(capture.Execute(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(export.Execute(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(keys.Execute(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		os.Exit(openapi.Execute(os.Args[2:], buildVersion))
+	}
+
 	path, err := os.Getwd()
 	if err != nil {
 		panic(err)
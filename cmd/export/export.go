@@ -0,0 +1,218 @@
+// Package export implements the `bivrost export` command, to export logs and module results through the API
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pynezz/pynezzentials/ansi"
+
+	"github.com/pynezz/bivrost/internal/export"
+)
+
+const usage = `Usage: bivrost export [options] TABLE [FILTER ...]
+
+Exports the rows of a table from a running bivrost, as CSV, NDJSON or Parquet.
+Filters are the query parameters of the data API: COLUMN=VALUE, or COLUMN[OP]=VALUE
+with OP one of eq, ne, lt, lte, gt, gte, like, in.
+
+Options:
+  -server URL			Address of the bivrost API (default $BIVROST_SERVER, or http://localhost:3330)
+  -token TOKEN			Bearer token of the API (default $BIVROST_TOKEN)
+  -format FORMAT		csv, ndjson or parquet (default csv)
+  -gzip				Compress the export
+  -columns LIST			Comma separated columns to export, all if empty
+  -since TIME			Rows created at or after the RFC 3339 time
+  -until TIME			Rows created before the RFC 3339 time
+  -sort COLUMN			Sort by the column, descending with a leading -
+  -o FILE			Write the export to the file, - for stdout (default -, or the job's file name with -job)
+  -job				Run the export as a background job on the server, for large exports, and download it when done
+  -poll DURATION		How often to check on the job (default 2s)
+
+  Example:
+  bivrost export -format parquet -columns remote_addr,status,created_at nginx_logs 'status[gte]=400'
+  bivrost export -job -gzip -format ndjson -since 2024-05-01T00:00:00Z mod_thrt_hits`
+
+type options struct {
+	server, token string
+	output        string
+	job           bool
+	poll          time.Duration
+}
+
+// Execute runs the export command in args, and returns the exit code
+func Execute(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	server := os.Getenv("BIVROST_SERVER")
+	if server == "" {
+		server = "http://localhost:3330"
+	}
+	var o options
+	fs.StringVar(&o.server, "server", server, "")
+	fs.StringVar(&o.token, "token", os.Getenv("BIVROST_TOKEN"), "")
+	format := fs.String("format", export.FORMAT_CSV, "")
+	gz := fs.Bool("gzip", false, "")
+	columns := fs.String("columns", "", "")
+	since := fs.String("since", "", "")
+	until := fs.String("until", "", "")
+	sort := fs.String("sort", "", "")
+	fs.StringVar(&o.output, "o", "", "")
+	fs.BoolVar(&o.job, "job", false, "")
+	fs.DurationVar(&o.poll, "poll", 2*time.Second, "")
+
+	// Options may come before or after the table
+	table := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		table, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	filters := fs.Args()
+	if table == "" && len(filters) > 0 {
+		table, filters = filters[0], filters[1:]
+	}
+	if table == "" {
+		fmt.Println(usage)
+		return 2
+	}
+
+	params := url.Values{}
+	params.Set("format", *format)
+	if *gz {
+		params.Set("gzip", "true")
+	}
+	for k, v := range map[string]string{"columns": *columns, "since": *since, "until": *until, "sort": *sort} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	for _, f := range filters {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			ansi.PrintError(fmt.Sprintf("Malformed filter %q, expected COLUMN=VALUE or COLUMN[OP]=VALUE", f))
+			return 2
+		}
+		params.Add(k, v)
+	}
+
+	o.server = strings.TrimSuffix(o.server, "/")
+	endpoint := o.server + "/api/v1/export/" + url.PathEscape(table) + "?" + params.Encode()
+	var err error
+	if o.job {
+		err = runJob(o, endpoint)
+	} else {
+		err = download(o, endpoint, o.output)
+	}
+	if err != nil {
+		ansi.PrintError(err.Error())
+		return 1
+	}
+	return 0
+}
+
+func request(o options, method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// download writes the body of the url to the file, or stdout
+func download(o options, url, file string) error {
+	resp, err := request(o, http.MethodGet, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out io.Writer = os.Stdout
+	if file != "" && file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	n, err := io.Copy(out, resp.Body)
+	if err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		ansi.PrintSuccess(fmt.Sprintf("Wrote %d bytes to %s", n, file))
+	}
+	return nil
+}
+
+// runJob starts a background export, waits for it, downloads it and removes it from the server
+func runJob(o options, endpoint string) error {
+	resp, err := request(o, http.MethodPost, endpoint)
+	if err != nil {
+		return err
+	}
+	var job export.Job
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	jobURL := o.server + "/api/v1/export/jobs/" + job.ID
+	ansi.PrintInfo(fmt.Sprintf("Started export %s of %s", job.ID, job.Table))
+
+	for job.State == export.JOB_QUEUED || job.State == export.JOB_RUNNING {
+		time.Sleep(o.poll)
+		resp, err := request(o, http.MethodGet, jobURL)
+		if err != nil {
+			return err
+		}
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\r%s: %d rows, %d bytes", job.State, job.Rows, job.Bytes)
+	}
+	fmt.Fprintln(os.Stderr)
+	if job.State != export.JOB_DONE {
+		return fmt.Errorf("export %s %s: %s", job.ID, job.State, job.Error)
+	}
+
+	file := o.output
+	if file == "" {
+		file = job.Filename
+	}
+	if err := download(o, jobURL+"/download", file); err != nil {
+		return err
+	}
+	resp, err = request(o, http.MethodDelete, jobURL)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,163 @@
+// Package keys implements the `bivrost keys` commands, to make and rotate the keys the tokens are signed with
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pynezz/pynezzentials/ansi"
+
+	"github.com/pynezz/bivrost/internal/middleware"
+)
+
+const usage = `Usage: bivrost keys <command> [options] FILE
+
+The key set FILE holds the keys the tokens are signed with. The active key signs, the others only verify tokens
+signed before they were rotated out. Point auth.key_file in the config, or BIVROST_JWT_KEY_FILE, at it.
+bivrost reads it again on SIGHUP, so keys are rotated without a restart, and without logging anyone out.
+
+Commands:
+  generate [options] FILE	Make a key set with a new key
+  rotate [options] FILE		Add a new key to the key set and make it the active one, then send SIGHUP to bivrost
+  list FILE			List the keys of the key set
+  jwks FILE			Print the public keys of the key set as a JWKS, as served at /.well-known/jwks.json
+
+Options of generate and rotate:
+  -alg ALG			EdDSA, ES256 or HS256 (default EdDSA)
+
+Options of generate:
+  -force			Replace the key set if the file exists, which logs everyone out
+
+Options of rotate:
+  -keep N			Keys to keep, the new one included. Keep at least 2 so the tokens signed with the
+				previous key stay valid until they expire (default 2)
+
+  Example:
+  bivrost keys generate -alg ES256 /etc/bivrost/keys.json
+  bivrost keys rotate /etc/bivrost/keys.json && pkill -HUP bivrost`
+
+// Execute runs the keys command in args, and returns the exit code
+func Execute(args []string) int {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return 2
+	}
+	switch args[0] {
+	case "generate", "rotate", "list", "jwks":
+		return run(args[0], args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Println(usage)
+		return 0
+	default:
+		ansi.PrintError("Unknown keys command: " + args[0])
+		fmt.Println(usage)
+		return 2
+	}
+}
+
+func run(command string, args []string) int {
+	fs := flag.NewFlagSet("keys "+command, flag.ContinueOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	alg := fs.String("alg", middleware.ALG_EDDSA, "")
+	force := fs.Bool("force", false, "")
+	keep := fs.Int("keep", middleware.DEFAULT_KEEP, "")
+
+	// Options may come before or after the file
+	path := ""
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		path, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if path == "" && fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+	if path == "" {
+		ansi.PrintError("The key set file is required")
+		fmt.Println(usage)
+		return 2
+	}
+
+	var err error
+	switch command {
+	case "generate":
+		err = generate(path, *alg, *force)
+	case "rotate":
+		err = rotate(path, *alg, *keep)
+	case "list":
+		err = list(path)
+	case "jwks":
+		err = jwks(path)
+	}
+	if err != nil {
+		ansi.PrintError(err.Error())
+		return 1
+	}
+	return 0
+}
+
+func generate(path, alg string, force bool) error {
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s exists, rotate it, or replace it with -force", path)
+	}
+	ks, err := middleware.NewKeySet(alg)
+	if err != nil {
+		return err
+	}
+	if err := ks.Write(path); err != nil {
+		return err
+	}
+	ansi.PrintSuccess(fmt.Sprintf("Made the key set %s, signing with the %s key %s", path, alg, ks.Active))
+	return nil
+}
+
+func rotate(path, alg string, keep int) error {
+	ks, err := middleware.ReadKeySet(path)
+	if err != nil {
+		return err
+	}
+	previous := ks.Active
+	key, err := ks.Rotate(alg, keep)
+	if err != nil {
+		return err
+	}
+	if err := ks.Write(path); err != nil {
+		return err
+	}
+	ansi.PrintSuccess(fmt.Sprintf("Rotated %s: signing with the %s key %s instead of %s, %d keys kept",
+		path, alg, key.ID, previous, len(ks.Keys)))
+	ansi.PrintInfo("Send SIGHUP to bivrost to use it")
+	return nil
+}
+
+func list(path string) error {
+	ks, err := middleware.ReadKeySet(path)
+	if err != nil {
+		return err
+	}
+	for _, key := range ks.Keys {
+		active := ""
+		if key.ID == ks.Active {
+			active = "active"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", key.ID, key.Alg, key.CreatedAt, active)
+	}
+	return nil
+}
+
+func jwks(path string) error {
+	ks, err := middleware.ReadKeySet(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ks.JWKS())
+}
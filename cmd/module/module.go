@@ -0,0 +1,182 @@
+// Package module implements the `bivrost module` commands, for module authors
+package module
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pynezz/bivrost/pkg/moduletest"
+	"github.com/pynezz/pynezzentials/ansi"
+)
+
+const usage = `Usage: bivrost module <command> [options]
+
+Commands:
+  test [options] CONFIG		Run the conformance checks against the module with the config.yaml
+
+Options of test:
+  -fixture TABLE=FILE		Seed the table with the rows in FILE, one JSON object per line. Repeatable
+  -expect TABLE=FILE		Expect the module to post the rows in FILE to the table. Rows match posted rows
+				with the same values for every field they have. Repeatable
+  -checks LIST			Comma separated checks to run, defaults to all:
+				handshake,posts,checksum,error,reconnect
+  -timeout DURATION		How long to wait for the module at each step (default 10s)
+  -settle DURATION		How long the module must be quiet before it's considered done (default 2s)
+
+  Example:
+  bivrost module test -fixture nginx_logs=testdata/logs.jsonl -expect threat_records=testdata/threats.jsonl modules/threat/config.yaml`
+
+// tableFiles is a repeatable TABLE=FILE flag
+type tableFiles [][2]string
+
+func (t *tableFiles) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *tableFiles) Set(v string) error {
+	table, file, ok := strings.Cut(v, "=")
+	if !ok || table == "" || file == "" {
+		return fmt.Errorf("expected TABLE=FILE, got %q", v)
+	}
+	*t = append(*t, [2]string{table, file})
+	return nil
+}
+
+// Execute runs the module command in args, and returns the exit code
+func Execute(args []string, buildVersion string) int {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return 2
+	}
+	switch args[0] {
+	case "test":
+		return test(args[1:], buildVersion)
+	case "-h", "-help", "--help", "help":
+		fmt.Println(usage)
+		return 0
+	default:
+		ansi.PrintError("Unknown module command: " + args[0])
+		fmt.Println(usage)
+		return 2
+	}
+}
+
+func test(args []string, buildVersion string) int {
+	var fixtures, expects tableFiles
+	fs := flag.NewFlagSet("bivrost module test", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	fs.Var(&fixtures, "fixture", "")
+	fs.Var(&expects, "expect", "")
+	checks := fs.String("checks", "", "")
+	timeout := fs.Duration("timeout", 0, "")
+	settle := fs.Duration("settle", 0, "")
+
+	// The config may come before or after the options
+	manifest := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		manifest, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if manifest == "" && fs.NArg() > 0 {
+		manifest = fs.Arg(0)
+	}
+	if manifest == "" {
+		ansi.PrintError("Missing the module's config.yaml")
+		fmt.Println(usage)
+		return 2
+	}
+
+	selected, err := selectChecks(*checks, expects)
+	if err != nil {
+		ansi.PrintError(err.Error())
+		return 2
+	}
+
+	h, err := moduletest.New(moduletest.Options{
+		Manifest: manifest,
+		Version:  buildVersion,
+		Timeout:  *timeout,
+		Settle:   *settle,
+	})
+	if err != nil {
+		ansi.PrintError(err.Error())
+		return 1
+	}
+	defer h.Close()
+
+	for _, f := range fixtures {
+		file, err := os.Open(f[1])
+		if err != nil {
+			ansi.PrintError(err.Error())
+			return 1
+		}
+		err = h.SeedJSONL(f[0], file)
+		file.Close()
+		if err != nil {
+			ansi.PrintError(fmt.Sprintf("%s: %v", f[1], err))
+			return 1
+		}
+		ansi.PrintInfo("Seeded " + f[0] + " from " + f[1])
+	}
+
+	ansi.PrintBold(fmt.Sprintf("Testing module %s (%s)...", h.Manifest().Name, h.Identifier()))
+	failed := 0
+	for _, r := range h.Run(context.Background(), selected...) {
+		switch {
+		case r.Passed():
+			ansi.PrintSuccess(r.Check + ": ok")
+		case r.Skipped():
+			ansi.PrintWarning(r.Check + ": " + r.Err.Error())
+		default:
+			failed++
+			ansi.PrintError(r.Check + ": " + r.Err.Error())
+		}
+	}
+	if failed > 0 {
+		ansi.PrintError(fmt.Sprintf("%d check(s) failed", failed))
+		return 1
+	}
+	ansi.PrintSuccess("The module passed")
+	return 0
+}
+
+// selectChecks returns the conformance checks named in the comma separated list, or all of them if it's empty
+func selectChecks(list string, expects tableFiles) ([]moduletest.Check, error) {
+	var expect []moduletest.Expectation
+	for _, e := range expects {
+		file, err := os.Open(e[1])
+		if err != nil {
+			return nil, err
+		}
+		rows, err := moduletest.ReadJSONL(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e[1], err)
+		}
+		expect = append(expect, moduletest.Expectation{Table: e[0], Rows: rows})
+	}
+
+	all := moduletest.Conformance(expect...)
+	if list == "" {
+		return all, nil
+	}
+	var selected []moduletest.Check
+	for _, name := range strings.Split(list, ",") {
+		found := false
+		for _, c := range all {
+			if c.Name == strings.TrimSpace(name) {
+				selected = append(selected, c)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown check %q", name)
+		}
+	}
+	return selected, nil
+}
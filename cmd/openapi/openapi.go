@@ -0,0 +1,90 @@
+// Package openapi implements the `bivrost openapi` command, to write the OpenAPI document and check that every route is documented
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pynezz/pynezzentials/ansi"
+
+	"github.com/pynezz/bivrost/internal/api"
+	"github.com/pynezz/bivrost/internal/config"
+)
+
+const usage = `Usage: bivrost openapi [options]
+
+Writes the OpenAPI document of the API, as served at /api/v1/openapi.json.
+
+Options:
+  -o FILE		Write the document to the file, - for stdout (default -)
+  -check		Exit with 1 if a route isn't documented, or a documented route isn't registered, for CI.
+			The document is only written with -o, as the routes are registered by starting up the API server
+
+  Example:
+  bivrost openapi -check -o openapi.json`
+
+// Execute runs the openapi command in args, and returns the exit code
+func Execute(args []string, buildVersion string) int {
+	fs := flag.NewFlagSet("openapi", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	output := fs.String("o", "", "")
+	check := fs.Bool("check", false, "")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	code := 0
+	if *check {
+		// The routes are registered without any backends, the server isn't started
+		app := api.NewServer(&config.Cfg{}, api.Backends{})
+		undocumented, stale := api.UndocumentedRoutes(app)
+		for _, route := range undocumented {
+			ansi.PrintError("Undocumented route: " + route)
+		}
+		for _, route := range stale {
+			ansi.PrintError("Documented route isn't registered: " + route)
+		}
+		if len(undocumented) > 0 || len(stale) > 0 {
+			code = 1
+		} else {
+			ansi.PrintSuccess("Every route is documented")
+		}
+	}
+
+	if *output == "" {
+		if *check {
+			return code
+		}
+		*output = "-"
+	}
+
+	doc, err := api.GenerateOpenAPI(buildVersion)
+	if err != nil {
+		ansi.PrintError(err.Error())
+		return 1
+	}
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			ansi.PrintError(err.Error())
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		ansi.PrintError(err.Error())
+		return 1
+	}
+	return code
+}
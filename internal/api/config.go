@@ -0,0 +1,160 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pynezz/bivrost/internal/config"
+	"github.com/pynezz/bivrost/internal/middleware"
+)
+
+// ConfigResponse is a version of the config. Settings are named as in the config file
+type ConfigResponse struct {
+	Version int            `json:"version"`
+	Config  map[string]any `json:"config"`
+}
+
+// ConfigErrorResponse answers changes of the config that aren't valid
+type ConfigErrorResponse struct {
+	Error  string                   `json:"error"`
+	Errors []config.ValidationError `json:"errors,omitempty"` // Every invalid setting, if the config parsed
+}
+
+// configUpdate reads the dry run and If-Match version of a change
+func configUpdate(c *fiber.Ctx, action string) (config.Update, error) {
+	u := config.Update{Action: action, User: middleware.Subject(c)}
+	if s := c.Query("dry_run"); s != "" {
+		dryRun, err := strconv.ParseBool(s)
+		if err != nil {
+			return u, errors.New("dry_run must be true or false")
+		}
+		u.DryRun = dryRun
+	}
+	if s := strings.Trim(c.Get(fiber.HeaderIfMatch), `"`); s != "" {
+		version, err := strconv.Atoi(s)
+		if err != nil {
+			return u, errors.New("If-Match must be a config version")
+		}
+		u.IfVersion = version
+	}
+	return u, nil
+}
+
+func configResult(c *fiber.Ctx, res *config.Result, err error) error {
+	var invalid config.ValidationErrors
+	switch {
+	case err == nil:
+		c.Set(fiber.HeaderETag, strconv.Quote(strconv.Itoa(res.Version)))
+		return c.JSON(res)
+	case errors.As(err, &invalid):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(ConfigErrorResponse{Error: config.ErrInvalid.Error(), Errors: invalid})
+	case errors.Is(err, config.ErrInvalid):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(ConfigErrorResponse{Error: err.Error()})
+	case errors.Is(err, config.ErrConflict):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	case errors.Is(err, config.ErrNoSuchVersion):
+		return c.Status(fiber.StatusNotFound).SendString(err.Error())
+	default:
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+}
+
+func configResponse(c *fiber.Ctx, cfg *config.Cfg, version int) error {
+	settings, err := config.ToMap(cfg)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+	return c.JSON(ConfigResponse{Version: version, Config: settings})
+}
+
+// setupConfigRoutes reads and changes the config of bivrost through the config.Manager, see routeDocs.
+// Changes answer with what changed, what was applied live, and what needs a restart
+func setupConfigRoutes(app *fiber.App, backends Backends) {
+	app.Use(protectedApi+"/config", middleware.Require(middleware.PERM_CONFIG))
+
+	app.Use(protectedApi+"/config", func(c *fiber.Ctx) error {
+		if backends.Config == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Config management is not available")
+		}
+		return c.Next()
+	})
+
+	app.Get(protectedApi+"/config", func(c *fiber.Ctx) error {
+		cfg, version := backends.Config.Current()
+		c.Set(fiber.HeaderETag, strconv.Quote(strconv.Itoa(version))) // For If-Match
+		return configResponse(c, cfg, version)
+	})
+
+	app.Put(protectedApi+"/config", func(c *fiber.Ctx) error {
+		u, err := configUpdate(c, config.ACTION_PUT)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		next, err := config.Parse(c.Body())
+		if err != nil {
+			return configResult(c, nil, err)
+		}
+		res, err := backends.Config.Replace(next, u)
+		return configResult(c, res, err)
+	})
+
+	app.Patch(protectedApi+"/config", func(c *fiber.Ctx) error {
+		u, err := configUpdate(c, config.ACTION_PATCH)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		res, err := backends.Config.Patch(c.Body(), u)
+		return configResult(c, res, err)
+	})
+
+	app.Post(protectedApi+"/config/add_source", func(c *fiber.Ctx) error {
+		u, err := configUpdate(c, config.ACTION_PATCH)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		var sources []config.Sources // YAML or JSON
+		if err := yaml.Unmarshal(c.Body(), &sources); err != nil || len(sources) == 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("The body must be a list of sources")
+		}
+		next, version := backends.Config.Current()
+		if u.IfVersion == 0 {
+			u.IfVersion = version // Don't lose a change made in between
+		}
+		next.Sources = append(next.Sources, sources...)
+		res, err := backends.Config.Replace(next, u)
+		return configResult(c, res, err)
+	})
+
+	app.Get(protectedApi+"/config/history", func(c *fiber.Ctx) error {
+		return c.JSON(backends.Config.History())
+	})
+
+	app.Get(protectedApi+"/config/history/:version", func(c *fiber.Ctx) error {
+		version, err := c.ParamsInt("version")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("version must be a number")
+		}
+		cfg, err := backends.Config.Get(version)
+		if err != nil {
+			return configResult(c, nil, err)
+		}
+		return configResponse(c, cfg, version)
+	})
+
+	app.Post(protectedApi+"/config/history/:version/rollback", func(c *fiber.Ctx) error {
+		version, err := c.ParamsInt("version")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("version must be a number")
+		}
+		u, err := configUpdate(c, config.ACTION_ROLLBACK)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		res, err := backends.Config.Rollback(version, u)
+		return configResult(c, res, err)
+	})
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"github.com/pynezz/bivrost/internal/database"
+	"github.com/pynezz/bivrost/internal/middleware"
+)
+
+// reservedParams are the query parameters that aren't column filters
+var reservedParams = map[string]bool{
+	"limit": true, "cursor": true, "sort": true, "since": true, "until": true, "columns": true,
+	"format": true, "gzip": true, // Of exports, see export.go
+}
+
+// parseQuery reads a query from the query string. Its strings are copies, so it can outlive the request:
+//
+//	?remote_addr=10.0.0.1          column equals the value
+//	?status[gte]=400               column compared with an operator: eq, ne, lt, lte, gt, gte, like, in
+//	?request[like]=wp-login        column contains the value
+//	?status[in]=401,403            column is one of the values
+//	?since=2024-05-01T00:00:00Z    created at or after (RFC 3339), until is before
+//	?sort=-created_at              sort by a column, descending with a leading -. Defaults to id
+//	?limit=100&cursor=...          page size, and the next_cursor of the previous page
+//	?columns=remote_addr,status    columns to return, all if empty. The id is always returned
+func parseQuery(c *fiber.Ctx) (database.Query, error) {
+	var q database.Query
+	var err error
+	c.Context().QueryArgs().VisitAll(func(k, v []byte) {
+		key, value := string(k), string(v)
+		if reservedParams[key] {
+			return
+		}
+		column, op := key, ""
+		if i := strings.IndexByte(key, '['); i > 0 && strings.HasSuffix(key, "]") {
+			column, op = key[:i], key[i+1:len(key)-1]
+		}
+		q.Filters = append(q.Filters, database.Filter{Column: column, Op: op, Value: value})
+	})
+
+	if s := c.Query("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 {
+			return q, errors.New("limit must be a positive number")
+		}
+	}
+	if s := c.Query("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, errors.New("since must be an RFC 3339 time, ex: 2024-05-01T00:00:00Z")
+		}
+	}
+	if s := c.Query("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, errors.New("until must be an RFC 3339 time, ex: 2024-05-01T00:00:00Z")
+		}
+	}
+	q.Sort = strings.Clone(c.Query("sort"))
+	if strings.HasPrefix(q.Sort, "-") {
+		q.Sort, q.Desc = q.Sort[1:], true
+	}
+	q.Cursor = strings.Clone(c.Query("cursor"))
+	if s := strings.Clone(c.Query("columns")); s != "" {
+		for _, col := range strings.Split(s, ",") {
+			if col = strings.TrimSpace(col); col != "" {
+				q.Columns = append(q.Columns, col)
+			}
+		}
+	}
+	return q, nil
+}
+
+// dataError answers with the status matching the error of a query
+func dataError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, database.ErrUnknownTable), errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).SendString(err.Error())
+	case errors.Is(err, database.ErrInvalidQuery):
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	default:
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+}
+
+// setupDataRoutes gives read only access to the logs and the module results, table by table, see routeDocs.
+// Rows are returned as column name to value maps, with the id of each row
+func setupDataRoutes(app *fiber.App, backends Backends) {
+	app.Use(protectedApi+"/data", middleware.Require(middleware.PERM_READ))
+
+	// Every route needs the stores
+	app.Use(protectedApi+"/data", func(c *fiber.Ctx) error {
+		if backends.Stores == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Data stores are not available")
+		}
+		return c.Next()
+	})
+
+	app.Get(protectedApi+"/data", func(c *fiber.Ctx) error {
+		return c.JSON(backends.Stores.Tables())
+	})
+
+	app.Get(protectedApi+"/data/:table", func(c *fiber.Ctx) error {
+		q, err := parseQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		page, err := backends.Stores.Query(c.Params("table"), q)
+		if err != nil {
+			return dataError(c, err)
+		}
+		return c.JSON(page)
+	})
+
+	app.Get(protectedApi+"/data/:table/:id", func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("id must be a number")
+		}
+		row, err := backends.Stores.Row(c.Params("table"), id)
+		if err != nil {
+			return dataError(c, err)
+		}
+		return c.JSON(row)
+	})
+}
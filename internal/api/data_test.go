@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/pynezz/bivrost/internal/database"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    database.Query
+		wantErr bool
+	}{
+		{"empty", "", database.Query{}, false},
+		{
+			name:  "filters",
+			query: "remote_addr=10.0.0.1&status[gte]=400&request[like]=wp-login&status[in]=401,403",
+			want: database.Query{Filters: []database.Filter{
+				{Column: "remote_addr", Value: "10.0.0.1"},
+				{Column: "status", Op: database.OP_GTE, Value: "400"},
+				{Column: "request", Op: database.OP_LIKE, Value: "wp-login"},
+				{Column: "status", Op: database.OP_IN, Value: "401,403"},
+			}},
+		},
+		{
+			name:  "paging and sorting",
+			query: "sort=-created_at&limit=50&cursor=abc&columns=remote_addr,+status,",
+			want:  database.Query{Sort: "created_at", Desc: true, Limit: 50, Cursor: "abc", Columns: []string{"remote_addr", "status"}},
+		},
+		{
+			name:  "time range",
+			query: "since=2024-05-01T00:00:00Z&until=2024-05-02T00:00:00Z",
+			want:  database.Query{Since: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), Until: time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)},
+		},
+		{"export parameters aren't filters", "format=csv&gzip=1", database.Query{}, false},
+		{"limit not a number", "limit=many", database.Query{}, true},
+		{"limit not positive", "limit=0", database.Query{}, true},
+		{"since not a time", "since=yesterday", database.Query{}, true},
+		{"until not a time", "until=2024-05-02", database.Query{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got database.Query
+			var err error
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				got, err = parseQuery(c)
+				return nil
+			})
+			if _, e := app.Test(httptest.NewRequest("GET", "/?"+tt.query, nil)); e != nil {
+				t.Fatal(e)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsed %q as %+v, want an error", tt.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsed %q as %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/pynezz/bivrost/internal/config"
+	"github.com/pynezz/bivrost/internal/database"
+	"github.com/pynezz/bivrost/internal/database/models"
+	"github.com/pynezz/bivrost/internal/export"
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/bivrost/internal/ipc/ipcserver"
+	"github.com/pynezz/bivrost/internal/live"
+	"github.com/pynezz/bivrost/internal/middleware"
+	"github.com/pynezz/bivrost/modules"
+)
+
+// tableModels are the models of the tables of the data API, for the schemas of their rows.
+// Module tables are created by the modules at runtime, so their rows aren't documented
+var tableModels = append([]any{&models.NginxLog{}}, models.GetModuleModels()...)
+
+// messageTypes are sent over WebSockets rather than in the bodies of routes, but are documented as schemas
+var messageTypes = []any{LiveRequest{}, live.Message{}}
+
+// Query parameters of the data and export APIs, see parseQuery
+var queryParams = []ParamDoc{
+	{Name: "sort", Description: "Column to sort by, descending with a leading -. Defaults to id"},
+	{Name: "since", Description: "Rows created at or after the RFC 3339 time"},
+	{Name: "until", Description: "Rows created before the RFC 3339 time"},
+	{Name: "columns", Description: "Comma separated columns to return, all if empty"},
+}
+
+const filterDescription = "Other query parameters filter the rows by column: `column=value`, or `column[op]=value` " +
+	"with op one of eq, ne, lt, lte, gt, gte, like (contains) and in (comma separated values)."
+
+var exportParams = append([]ParamDoc{
+	{Name: "format", Description: "csv, ndjson or parquet. Defaults to csv"},
+	{Name: "gzip", Description: "Compress the export", Type: false},
+}, queryParams...)
+
+const configChangeDescription = "Send the version of the config as If-Match to fail with 409 if it was changed since. " +
+	"Invalid configs answer 422 with the invalid settings. " +
+	"Answers with the changes, the settings applied live, and the settings that need a restart."
+
+var configParams = []ParamDoc{{Name: "dry_run", Description: "Only validate, and answer with the changes that would be made", Type: false}}
+
+var configErrors = []int{400, 409, 500, 503}
+
+var configErrorBodies = map[int]any{fiber.StatusUnprocessableEntity: ConfigErrorResponse{}}
+
+var userErrors = []int{400, 500, 503}
+
+const rolesDescription = "viewer, analyst, module-operator or admin"
+
+// routeDocs documents every route registered in NewServer, in the order of the OpenAPI document.
+// Add the docs of a route along with it, or the server complains when it starts
+var routeDocs = []RouteDoc{
+	/* SERVER */
+	{Method: fiber.MethodGet, Path: "/", Tag: "server", Summary: "Check that the server is up", Public: true, Response: ""},
+	{Method: fiber.MethodGet, Path: openapiPath, Tag: "server", Summary: "This OpenAPI document", Public: true, Response: map[string]any{}},
+	{Method: fiber.MethodGet, Path: jwksPath, Tag: "server", Summary: "The public keys the tokens are signed with, as a JWKS",
+		Description: "Tokens name their key with kid. Keys are rotated, so fetch the keys again when a kid isn't known. " +
+			"HS256 keys are secret, and aren't included.",
+		Public: true, Response: middleware.JWKS{}},
+	{Method: fiber.MethodGet, Path: "/dashboard/settings", Tag: "server", Permission: middleware.PERM_READ, Summary: "Settings page of the dashboard", Response: ""},
+
+	/* AUTHENTICATION */
+	{Method: fiber.MethodPost, Path: "/login", Tag: "auth", Public: true, Summary: "Log in with a password, and get an access and a refresh token",
+		Body: middleware.LoginRequest{}, Response: middleware.CreateUserResponse{}, Errors: []int{400, 401, 403, 500}},
+	{Method: fiber.MethodPost, Path: "/register", Tag: "auth", Public: true, Summary: "Register a user with a password and an invitation",
+		Description: "The invitation decides the role, see POST /api/v1/users/invitations. The first user registers without one, and is an admin.",
+		Body:        middleware.PasswordRegisterRequest{}, Response: "", Errors: []int{400, 403, 500}},
+	{Method: fiber.MethodPost, Path: "/refresh", Tag: "auth", Public: true, Summary: "Exchange a refresh token for new tokens",
+		Description: "The refresh token is rotated, the one sent can't be used again. Using it again revokes the session.",
+		Body:        middleware.RefreshRequest{}, Response: middleware.UserSession{}, Errors: []int{400, 401, 500}},
+	{Method: fiber.MethodPost, Path: "/logout", Tag: "auth", Summary: "Revoke the session of the access token",
+		Description: "Its access and refresh tokens stop working at once.", Status: fiber.StatusNoContent, Errors: []int{400, 404, 500}},
+	{Method: fiber.MethodGet, Path: "/auth", Tag: "auth", Summary: "Redirects to the login when not authenticated", Status: fiber.StatusFound},
+	{Method: fiber.MethodGet, Path: "/auth/:id", Tag: "auth", Summary: "Not implemented, always answers 401", Status: fiber.StatusUnauthorized,
+		Query: []ParamDoc{{Name: "key"}}},
+	{Method: fiber.MethodPost, Path: unprotectedApi + "/antiphishing", Tag: "auth", Summary: "Check the anti-phishing hash of the client",
+		Public: true, Description: "The hash is sent in the anti-phish header.", Errors: []int{401}},
+
+	/* CONFIG */
+	{Method: fiber.MethodGet, Path: protectedApi + "/config", Tag: "config", Permission: middleware.PERM_CONFIG, Summary: "The current config, and its version",
+		Description: "The version is also sent in the ETag header, for the If-Match header of changes.",
+		Response:    ConfigResponse{}, Errors: []int{500, 503}},
+	{Method: fiber.MethodPut, Path: protectedApi + "/config", Tag: "config", Permission: middleware.PERM_CONFIG, Summary: "Replace the config, as YAML or JSON",
+		Description: configChangeDescription, Query: configParams,
+		Body: map[string]any{}, Response: config.Result{}, Errors: configErrors, ErrorBodies: configErrorBodies},
+	{Method: fiber.MethodPatch, Path: protectedApi + "/config", Tag: "config", Permission: middleware.PERM_CONFIG, Summary: "Change settings, with a JSON merge patch (RFC 7386)",
+		Description: "Settings set to null are removed, lists are replaced as a whole. " + configChangeDescription, Query: configParams,
+		Body: map[string]any{}, Response: config.Result{}, Errors: configErrors, ErrorBodies: configErrorBodies},
+	{Method: fiber.MethodPost, Path: protectedApi + "/config/add_source", Tag: "config", Permission: middleware.PERM_CONFIG, Summary: "Add log sources",
+		Description: configChangeDescription, Query: configParams,
+		Body: []map[string]any{}, Response: config.Result{}, Errors: configErrors, ErrorBodies: configErrorBodies},
+	{Method: fiber.MethodGet, Path: protectedApi + "/config/history", Tag: "config", Permission: middleware.PERM_CONFIG, Summary: "The versions of the config, the latest last",
+		Response: []config.Version{}, Errors: []int{503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/config/history/:version", Tag: "config", Permission: middleware.PERM_CONFIG, Summary: "A version of the config",
+		Response: ConfigResponse{}, Errors: []int{400, 404, 500, 503}},
+	{Method: fiber.MethodPost, Path: protectedApi + "/config/history/:version/rollback", Tag: "config", Permission: middleware.PERM_CONFIG, Summary: "Make a version the current config",
+		Description: "The rollback is a new version. " + configChangeDescription, Query: configParams,
+		Response: config.Result{}, Errors: append([]int{404}, configErrors...), ErrorBodies: configErrorBodies},
+
+	/* INTEL */
+	{Method: fiber.MethodPost, Path: protectedApi + "/intel/", Tag: "intel", Permission: middleware.PERM_ANALYZE, Summary: "Look up threat intel on an IP",
+		Body: IntelRequest{}, Response: IntelRequest{}},
+	{Method: fiber.MethodGet, Path: unprotectedApi + "/facts", Tag: "intel", Summary: "A random fact", Public: true, Response: ""},
+
+	/* DATA */
+	{Method: fiber.MethodGet, Path: protectedApi + "/data", Tag: "data", Permission: middleware.PERM_READ, Summary: "The tables of logs and module results",
+		Response: []string{}, Errors: []int{503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/data/:table", Tag: "data", Permission: middleware.PERM_READ, Summary: "A page of the rows of a table",
+		Description: "Rows are column name to value maps, see the row schemas of the tables. " + filterDescription,
+		Query: append([]ParamDoc{
+			{Name: "limit", Description: "Rows per page, at most 1000. Defaults to 100", Type: 0},
+			{Name: "cursor", Description: "The next_cursor of the previous page"},
+		}, queryParams...),
+		Response: database.Page{}, Errors: []int{400, 404, 500, 503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/data/:table/:id", Tag: "data", Permission: middleware.PERM_READ, Summary: "A row of a table",
+		Response: map[string]any{}, Errors: []int{400, 404, 500, 503}},
+
+	/* EXPORT */
+	{Method: fiber.MethodGet, Path: protectedApi + "/export/:table", Tag: "export", Permission: middleware.PERM_ANALYZE, Summary: "Stream the rows of a table as a file",
+		Description: "Streams must finish before the write timeout of the server, start a job for large exports. " + filterDescription,
+		Query:       exportParams, Response: []byte{}, ContentType: "application/octet-stream", Errors: []int{400, 404, 500, 503}},
+	{Method: fiber.MethodPost, Path: protectedApi + "/export/:table", Tag: "export", Permission: middleware.PERM_ANALYZE, Summary: "Export the rows of a table in the background",
+		Description: filterDescription, Query: exportParams,
+		Status: fiber.StatusAccepted, Response: export.Job{}, Errors: []int{400, 404, 500, 503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/export/jobs", Tag: "export", Permission: middleware.PERM_ANALYZE, Summary: "The background exports",
+		Response: []export.Job{}, Errors: []int{503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/export/jobs/:id", Tag: "export", Permission: middleware.PERM_ANALYZE, Summary: "A background export",
+		Response: export.Job{}, Errors: []int{404, 503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/export/jobs/:id/download", Tag: "export", Permission: middleware.PERM_ANALYZE, Summary: "Download a finished export",
+		Response: []byte{}, ContentType: "application/octet-stream", Errors: []int{404, 409, 503}},
+	{Method: fiber.MethodDelete, Path: protectedApi + "/export/jobs/:id", Tag: "export", Permission: middleware.PERM_ANALYZE, Summary: "Cancel an export, and remove its file",
+		Status: fiber.StatusNoContent, Errors: []int{404, 503}},
+
+	/* LIVE */
+	{Method: fiber.MethodGet, Path: "/ws", Tag: "live", Permission: middleware.PERM_READ, Summary: "Live tail of the new rows, over a WebSocket",
+		Description: "The client sends LiveRequest's as JSON text messages, and gets Message's back, see live.go. " +
+			"Browsers may pass the token as the access_token query parameter.",
+		Query:  []ParamDoc{{Name: "access_token", Description: "Token, when the Authorization header can't be set"}},
+		Status: fiber.StatusSwitchingProtocols, Response: live.Message{}},
+
+	/* IPC */
+	{Method: fiber.MethodGet, Path: protectedApi + "/ipc/connections", Tag: "ipc", Permission: middleware.PERM_READ, Summary: "Modules connected to the IPC server",
+		Response: []ipcserver.ModuleConn{}, Errors: []int{503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/ipc/subscriptions", Tag: "ipc", Permission: middleware.PERM_READ, Summary: "Event bus subscriptions of the modules",
+		Response: []ipcserver.SubscriptionInfo{}, Errors: []int{503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/ipc/capture", Tag: "ipc", Permission: middleware.PERM_READ, Summary: "The running capture of IPC frames",
+		Response: ipc.CaptureInfo{}, Errors: []int{404, 503}},
+	{Method: fiber.MethodPost, Path: protectedApi + "/ipc/capture", Tag: "ipc", Permission: middleware.PERM_MODULES, Summary: "Start capturing IPC frames",
+		Body: CaptureRequest{}, Status: fiber.StatusCreated, Response: ipc.CaptureInfo{}, Errors: []int{400, 409, 500, 503}},
+	{Method: fiber.MethodDelete, Path: protectedApi + "/ipc/capture", Tag: "ipc", Permission: middleware.PERM_MODULES, Summary: "Stop capturing IPC frames",
+		Response: ipc.CaptureInfo{}, Errors: []int{404, 500, 503}},
+
+	/* MODULES */
+	{Method: fiber.MethodGet, Path: protectedApi + "/modules/status", Tag: "modules", Permission: middleware.PERM_READ, Summary: "Module processes run by bivrost",
+		Response: []modules.Status{}, Errors: []int{503}},
+	{Method: fiber.MethodPost, Path: protectedApi + "/modules/reload", Tag: "modules", Permission: middleware.PERM_MODULES, Summary: "Apply the modules of the config file",
+		Response: modules.ReloadResult{}, Errors: []int{422, 500, 503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/modules/:name/events", Tag: "modules", Permission: middleware.PERM_READ, Summary: "Sandbox violations and other events of a module",
+		Response: []modules.Event{}, Errors: []int{404, 503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/modules", Tag: "modules", Permission: middleware.PERM_READ, Summary: "Every module in the config, with its state",
+		Description: "The state is the state of the process when bivrost runs the module, else disabled, external (started by hand) " +
+			"or not_loaded (enabled in the config file, but not reloaded yet).",
+		Response: []ModuleInfo{}, Errors: []int{503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/modules/:name", Tag: "modules", Permission: middleware.PERM_READ, Summary: "A module, with its state",
+		Response: ModuleInfo{}, Errors: []int{404, 503}},
+	{Method: fiber.MethodPost, Path: protectedApi + "/modules/:name/start", Tag: "modules", Permission: middleware.PERM_MODULES, Summary: "Start a module bivrost runs",
+		Response: ModuleInfo{}, Errors: []int{404, 409, 500, 503}},
+	{Method: fiber.MethodPost, Path: protectedApi + "/modules/:name/stop", Tag: "modules", Permission: middleware.PERM_MODULES, Summary: "Stop a module bivrost runs",
+		Description: "The module stays stopped until it's started or restarted, or bivrost restarts. Disable it to keep it stopped.",
+		Response:    ModuleInfo{}, Errors: []int{404, 409, 500, 503}},
+	{Method: fiber.MethodPost, Path: protectedApi + "/modules/:name/restart", Tag: "modules", Permission: middleware.PERM_MODULES, Summary: "Restart a module bivrost runs",
+		Response: ModuleInfo{}, Errors: []int{404, 409, 500, 503}},
+	{Method: fiber.MethodPost, Path: protectedApi + "/modules/:name/enable", Tag: "modules", Permission: middleware.PERM_MODULES, Summary: "Enable a module in the config, and start it",
+		Description: "A change of the config, see PATCH /api/v1/config. Dry runs answer with the changes.", Query: configParams,
+		Response: ModuleInfo{}, Errors: append([]int{404}, configErrors...), ErrorBodies: configErrorBodies},
+	{Method: fiber.MethodPost, Path: protectedApi + "/modules/:name/disable", Tag: "modules", Permission: middleware.PERM_MODULES, Summary: "Disable a module in the config, stop and disconnect it",
+		Description: "A change of the config, see PATCH /api/v1/config. Dry runs answer with the changes.", Query: configParams,
+		Response: ModuleInfo{}, Errors: append([]int{404}, configErrors...), ErrorBodies: configErrorBodies},
+	{Method: fiber.MethodDelete, Path: protectedApi + "/modules/:name/cursors/:table", Tag: "modules", Permission: middleware.PERM_MODULES, Summary: "Make a module read a table from the start again",
+		Status: fiber.StatusNoContent, Errors: []int{404, 503}},
+	{Method: fiber.MethodGet, Path: protectedApi + "/modules/:name/logs", Tag: "modules", Permission: middleware.PERM_READ, Summary: "The latest output of a module bivrost runs",
+		Query:    []ParamDoc{{Name: "limit", Description: "Latest lines to return, all that are kept (500) if 0", Type: 0}},
+		Response: []modules.LogLine{}, Errors: []int{400, 404, 503}},
+
+	/* USERS */
+	{Method: fiber.MethodGet, Path: protectedApi + "/users", Tag: "users", Permission: middleware.PERM_USERS, Summary: "Every user",
+		Response: []middleware.User{}, Errors: userErrors},
+	{Method: fiber.MethodPost, Path: protectedApi + "/users", Tag: "users", Permission: middleware.PERM_USERS, Summary: "Create a user with a password",
+		Description: "The display name is the username, and the role one of " + rolesDescription + ".",
+		Body:        middleware.CreateUserRequest{}, Status: fiber.StatusCreated, Response: middleware.User{}, Errors: userErrors},
+	{Method: fiber.MethodGet, Path: protectedApi + "/users/invitations", Tag: "users", Permission: middleware.PERM_USERS, Summary: "Every invitation, without the tokens",
+		Response: []middleware.Invitation{}, Errors: userErrors},
+	{Method: fiber.MethodPost, Path: protectedApi + "/users/invitations", Tag: "users", Permission: middleware.PERM_USERS, Summary: "Invite someone to register with a role",
+		Description: "The token is only in this answer, and is sent as invitation to /register. The role defaults to viewer.",
+		Body:        InvitationRequest{}, Status: fiber.StatusCreated, Response: middleware.Invitation{}, Errors: userErrors},
+	{Method: fiber.MethodDelete, Path: protectedApi + "/users/invitations/:id", Tag: "users", Permission: middleware.PERM_USERS, Summary: "Revoke an invitation",
+		Status: fiber.StatusNoContent, Errors: append([]int{404}, userErrors...)},
+	{Method: fiber.MethodGet, Path: protectedApi + "/users/:id", Tag: "users", Permission: middleware.PERM_USERS, Summary: "A user",
+		Response: middleware.User{}, Errors: append([]int{404}, userErrors...)},
+	{Method: fiber.MethodPatch, Path: protectedApi + "/users/:id", Tag: "users", Permission: middleware.PERM_USERS, Summary: "Change the role, name or password of a user, or disable it",
+		Description: "Fields that are left out aren't changed. Answers 409 if it would leave no enabled admin.",
+		Body:        middleware.UserUpdate{}, Response: middleware.User{}, Errors: append([]int{404, 409}, userErrors...)},
+	{Method: fiber.MethodDelete, Path: protectedApi + "/users/:id", Tag: "users", Permission: middleware.PERM_USERS, Summary: "Delete a user and its credentials",
+		Description: "Answers 409 if it would leave no enabled admin.",
+		Status:      fiber.StatusNoContent, Errors: append([]int{404, 409}, userErrors...)},
+
+	{Method: fiber.MethodGet, Path: protectedApi + "/users/:id/sessions", Tag: "users", Permission: middleware.PERM_USERS, Summary: "The sessions of a user that haven't expired",
+		Response: []middleware.Session{}, Errors: append([]int{404}, userErrors...)},
+	{Method: fiber.MethodDelete, Path: protectedApi + "/users/:id/sessions", Tag: "users", Permission: middleware.PERM_USERS, Summary: "Revoke every session of a user",
+		Description: "Logs the user out everywhere. The access tokens of the sessions stop working at once.",
+		Response:    RevokedSessionsResponse{}, Errors: append([]int{404}, userErrors...)},
+
+	/* API KEYS */
+	{Method: fiber.MethodGet, Path: protectedApi + "/keys", Tag: "keys", Summary: "The API keys of the user, without their secrets",
+		Description: "Not with an API key.", Query: []ParamDoc{{Name: "all", Description: "Every key, with the users permission", Type: false}},
+		Response: []middleware.APIKey{}, Errors: append([]int{403}, userErrors...)},
+	{Method: fiber.MethodPost, Path: protectedApi + "/keys", Tag: "keys", Summary: "Create an API key",
+		Description: "The key is only in this answer, and is sent as a bearer token. The scopes are permissions granted by the role of the user. " +
+			"Not with an API key.",
+		Body: APIKeyRequest{}, Status: fiber.StatusCreated, Response: middleware.APIKey{}, Errors: append([]int{403, 404}, userErrors...)},
+	{Method: fiber.MethodDelete, Path: protectedApi + "/keys/:id", Tag: "keys", Summary: "Revoke an API key",
+		Description: "Any key with the users permission, otherwise a key of the user. Not with an API key.",
+		Status:      fiber.StatusNoContent, Errors: append([]int{403, 404}, userErrors...)},
+}
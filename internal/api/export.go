@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pynezz/pynezzentials/ansi"
+
+	"github.com/pynezz/bivrost/internal/database"
+	"github.com/pynezz/bivrost/internal/export"
+	"github.com/pynezz/bivrost/internal/middleware"
+)
+
+// exportOptions reads the format and compression of an export from the query string
+func exportOptions(c *fiber.Ctx) (export.Options, error) {
+	opts := export.Options{Format: strings.Clone(c.Query("format", export.FORMAT_CSV))}
+	if s := c.Query("gzip"); s != "" {
+		gz, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, errors.New("gzip must be true or false")
+		}
+		opts.Gzip = gz
+	}
+	return opts, opts.Validate()
+}
+
+// exportRequest reads the query and options of an export, and checks the query against the table.
+// They outlive the request, as the export is written after the handler returns
+func exportRequest(c *fiber.Ctx, backends Backends, table string) (database.Query, export.Options, error) {
+	opts, err := exportOptions(c)
+	if err != nil {
+		return database.Query{}, opts, fmt.Errorf("%w: %s", database.ErrInvalidQuery, err)
+	}
+	q, err := parseQuery(c)
+	if err != nil {
+		return q, opts, fmt.Errorf("%w: %s", database.ErrInvalidQuery, err)
+	}
+	check := q
+	check.Limit = 1
+	_, err = backends.Stores.Query(table, check) // Errors must be answered before the export starts streaming
+	return q, opts, err
+}
+
+func exportJobError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, export.ErrNoSuchJob):
+		return c.Status(fiber.StatusNotFound).SendString(err.Error())
+	case errors.Is(err, export.ErrNotReady):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	default:
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+}
+
+// setupExportRoutes exports every row of a table matching the query parameters of the data API (see parseQuery),
+// streamed or as a background job, see routeDocs. Streamed exports must finish before the write timeout
+// of the server, larger exports should run as jobs
+func setupExportRoutes(app *fiber.App, backends Backends) {
+	app.Use(protectedApi+"/export", middleware.Require(middleware.PERM_ANALYZE))
+
+	app.Use(protectedApi+"/export", func(c *fiber.Ctx) error {
+		if backends.Stores == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Data stores are not available")
+		}
+		return c.Next()
+	})
+
+	// Jobs are registered first, so jobs isn't taken for a table
+	jobs := app.Group(protectedApi+"/export/jobs", func(c *fiber.Ctx) error {
+		if backends.Exports == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Background exports are not available")
+		}
+		return c.Next()
+	})
+
+	jobs.Get("", func(c *fiber.Ctx) error {
+		return c.JSON(backends.Exports.List())
+	})
+
+	jobs.Get("/:id", func(c *fiber.Ctx) error {
+		job, err := backends.Exports.Get(c.Params("id"))
+		if err != nil {
+			return exportJobError(c, err)
+		}
+		return c.JSON(job)
+	})
+
+	jobs.Get("/:id/download", func(c *fiber.Ctx) error {
+		path, job, err := backends.Exports.File(c.Params("id"))
+		if err != nil {
+			return exportJobError(c, err)
+		}
+		c.Set(fiber.HeaderContentType, export.Options{Format: job.Format, Gzip: job.Gzip}.ContentType())
+		return c.Download(path, job.Filename)
+	})
+
+	jobs.Delete("/:id", func(c *fiber.Ctx) error {
+		if err := backends.Exports.Remove(c.Params("id")); err != nil {
+			return exportJobError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get(protectedApi+"/export/:table", func(c *fiber.Ctx) error {
+		table := strings.Clone(c.Params("table"))
+		q, opts, err := exportRequest(c, backends, table)
+		if err != nil {
+			return dataError(c, err)
+		}
+
+		c.Set(fiber.HeaderContentType, opts.ContentType())
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", opts.Filename(table)))
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			rows, err := export.Export(ctx, backends.Stores, table, q, opts, w, func(int64) {
+				if w.Flush() != nil { // Sends every page as it's written, and stops when the client is gone
+					cancel()
+				}
+			})
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil { // Too late to answer with an error, the client gets a truncated file
+				ansi.PrintError(fmt.Sprintf("[EXPORT] %s after %d rows: %s", table, rows, err))
+			}
+		})
+		return nil
+	})
+
+	app.Post(protectedApi+"/export/:table", func(c *fiber.Ctx) error {
+		if backends.Exports == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Background exports are not available")
+		}
+		table := strings.Clone(c.Params("table"))
+		q, opts, err := exportRequest(c, backends, table)
+		if err != nil {
+			return dataError(c, err)
+		}
+		job, err := backends.Exports.Start(table, q, opts)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+		c.Location(protectedApi + "/export/jobs/" + job.ID)
+		return c.Status(fiber.StatusAccepted).JSON(job)
+	})
+}
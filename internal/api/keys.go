@@ -0,0 +1,86 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/pynezz/bivrost/internal/middleware"
+)
+
+// APIKeyRequest makes an API key
+type APIKeyRequest struct {
+	Name   string                  `json:"name"`
+	Scopes []middleware.Permission `json:"scopes"` // Permissions of the key, granted by the role of the user
+	TTL    int                     `json:"ttl"`    // Days the key is valid for, forever if 0
+}
+
+func keyError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, middleware.ErrNoSuchKey) {
+		return c.Status(fiber.StatusNotFound).SendString(err.Error())
+	}
+	return userError(c, err)
+}
+
+// setupKeyRoutes lets users make API keys for their automation, with a subset of the permissions of their role,
+// see routeDocs. Keys are managed with a password login, requests with an API key answer 403
+func setupKeyRoutes(app *fiber.App) {
+	app.Use(protectedApi+"/keys", func(c *fiber.Ctx) error {
+		if middleware.Scopes(c) != nil {
+			return c.Status(fiber.StatusForbidden).SendString("API keys can't manage API keys")
+		}
+		// 0 is every user for the functions of the keys
+		if id, err := strconv.ParseUint(middleware.Subject(c), 10, 64); err != nil || id == 0 {
+			return c.Status(fiber.StatusForbidden).SendString("The token has no user")
+		}
+		return c.Next()
+	})
+
+	app.Get(protectedApi+"/keys", func(c *fiber.Ctx) error {
+		owner, _ := strconv.ParseUint(middleware.Subject(c), 10, 64)
+		if c.QueryBool("all") {
+			if !middleware.RoleHas(middleware.Role(c), middleware.PERM_USERS) {
+				return c.Status(fiber.StatusForbidden).SendString("Forbidden: requires the users permission")
+			}
+			owner = 0
+		}
+		keys, err := middleware.ListAPIKeys(owner)
+		if err != nil {
+			return keyError(c, err)
+		}
+		return c.JSON(keys)
+	})
+
+	app.Post(protectedApi+"/keys", func(c *fiber.Ctx) error {
+		var req APIKeyRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if req.TTL < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("ttl must not be negative")
+		}
+		owner, _ := strconv.ParseUint(middleware.Subject(c), 10, 64)
+		key, err := middleware.CreateAPIKey(owner, req.Name, req.Scopes, time.Duration(req.TTL)*24*time.Hour)
+		if err != nil {
+			return keyError(c, err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(key)
+	})
+
+	app.Delete(protectedApi+"/keys/:id", func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("id must be a number")
+		}
+		owner, _ := strconv.ParseUint(middleware.Subject(c), 10, 64)
+		if middleware.RoleHas(middleware.Role(c), middleware.PERM_USERS) {
+			owner = 0
+		}
+		if err := middleware.RevokeAPIKey(id, owner); err != nil {
+			return keyError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
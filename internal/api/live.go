@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/pynezz/pynezzentials/ansi"
+
+	"github.com/pynezz/bivrost/internal/live"
+)
+
+const (
+	liveWriteTimeout  = 10 * time.Second
+	livePingInterval  = 30 * time.Second
+	liveNoticeTick    = time.Second // Dropped rows are reported at least this often
+	liveMaxRequestLen = 16 * 1024
+)
+
+// LiveRequest is sent by live tail clients as a JSON text message, ex:
+//
+//	{"action": "subscribe", "id": "wall", "tables": ["nginx_logs", "threat_records"], "filter": "status >= 400"}
+//	{"action": "unsubscribe", "id": "wall"}
+//
+// Clients get live.Message's back: the answers to their requests, the new rows, and notices of dropped rows
+type LiveRequest struct {
+	Action string `json:"action"` // subscribe or unsubscribe
+	live.Subscription
+}
+
+// liveHandler streams new rows to the client as they're committed. Browsers can't set headers on WebSocket
+// connections, so the token may be passed as ?access_token= instead
+func liveHandler(hub *live.Hub) func(*websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		if hub == nil {
+			conn.WriteJSON(live.Message{Type: live.MSG_ERROR, Error: "live tail is not available", Time: time.Now()})
+			return
+		}
+		client := hub.Join()
+		defer client.Close()
+		conn.SetReadLimit(liveMaxRequestLen)
+
+		quit, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			liveWriter(conn, client, quit)
+			conn.Close() // Unblocks the reader
+		}()
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			var req LiveRequest
+			if err := json.Unmarshal(msg, &req); err != nil {
+				client.Error("", fmt.Errorf("malformed request: %w", err))
+				continue
+			}
+			switch req.Action {
+			case "subscribe":
+				client.Subscribe(req.Subscription)
+			case "unsubscribe":
+				client.Unsubscribe(req.ID)
+			default:
+				client.Error(req.ID, fmt.Errorf("unknown action %q, expected subscribe or unsubscribe", req.Action))
+			}
+		}
+		close(quit)
+		<-done
+	}
+}
+
+// liveWriter writes the client's messages to the connection, until it fails or quit is closed
+func liveWriter(conn *websocket.Conn, client *live.Client, quit <-chan struct{}) {
+	write := func(m live.Message) bool {
+		conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+		if err := conn.WriteJSON(m); err != nil {
+			ansi.PrintDebug("[LIVE] client gone: " + err.Error())
+			return false
+		}
+		return true
+	}
+	notice := func() bool {
+		if n := client.TakeDropped(); n > 0 {
+			return write(live.Message{Type: live.MSG_DROPPED, Dropped: n, Time: time.Now()})
+		}
+		return true
+	}
+
+	ticker := time.NewTicker(liveNoticeTick)
+	defer ticker.Stop()
+	lastPing := time.Now()
+	for {
+		select {
+		case <-quit:
+			return
+		case m := <-client.Control():
+			if !write(m) {
+				return
+			}
+		case m := <-client.Events():
+			if !notice() || !write(m) {
+				return
+			}
+		case now := <-ticker.C:
+			if !notice() {
+				return
+			}
+			if now.Sub(lastPing) >= livePingInterval {
+				lastPing = now
+				if err := conn.WriteControl(websocket.PingMessage, nil, now.Add(liveWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
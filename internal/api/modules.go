@@ -0,0 +1,281 @@
+package api
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/pynezz/bivrost/internal/config"
+	"github.com/pynezz/bivrost/internal/ipc/ipcserver"
+	"github.com/pynezz/bivrost/internal/middleware"
+	"github.com/pynezz/bivrost/modules"
+)
+
+// Module states, besides the process states of the supervisor (modules.STATE_*)
+const (
+	MODULE_DISABLED   = "disabled"   // Disabled in the config
+	MODULE_EXTERNAL   = "external"   // No binary, started by hand
+	MODULE_NOT_LOADED = "not_loaded" // Enabled, but not loaded yet, ex: the config file was changed by hand
+)
+
+// ModuleInfo describes a module
+type ModuleInfo struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Identifier  string                 `json:"identifier"`
+	ConfigPath  string                 `json:"config_path"`
+	Enabled     bool                   `json:"enabled"`
+	State       string                 `json:"state"`             // A process state, or MODULE_*
+	Process     *modules.Status        `json:"process,omitempty"` // If bivrost runs the module
+	Connected   bool                   `json:"connected"`
+	Connections []ipcserver.ModuleConn `json:"connections"`
+	Cursors     map[string]int         `json:"cursors"` // ID of the last row sent to the module, by table
+	Errors      ipcserver.ModuleErrors `json:"errors"`  // Requests of the module answered with an error
+}
+
+// moduleInfo describes the loaded module m. The IPC server and supervisor may be nil
+func moduleInfo(m modules.Module, backends Backends) ModuleInfo {
+	info := ModuleInfo{
+		Name:        m.Name,
+		Description: m.Description,
+		ConfigPath:  m.ConfigPath,
+		Enabled:     true,
+		State:       MODULE_EXTERNAL,
+		Connections: []ipcserver.ModuleConn{},
+		Cursors:     map[string]int{},
+		Errors:      ipcserver.ModuleErrors{ByCode: map[string]uint64{}},
+	}
+	if m.Config != nil {
+		info.Identifier = m.Config.Identifier
+	}
+	if backends.Modules != nil {
+		for _, status := range backends.Modules.Status() {
+			if status.Name == m.Name {
+				status := status
+				info.Process, info.State = &status, status.State
+			}
+		}
+	}
+	if backends.IPC != nil && info.Identifier != "" {
+		for _, conn := range backends.IPC.Connections() {
+			if conn.Identifier == info.Identifier {
+				info.Connections = append(info.Connections, conn)
+			}
+		}
+		info.Connected = len(info.Connections) > 0
+		info.Cursors = backends.IPC.Cursors(info.Identifier)
+		info.Errors = backends.IPC.Errors(info.Identifier)
+	}
+	return info
+}
+
+// moduleInfos describes every module source in the config, ordered by name. Disabled modules aren't loaded,
+// so they're only known from the config
+func moduleInfos(backends Backends) []ModuleInfo {
+	loaded := backends.Registry.Modules()
+	infos := make([]ModuleInfo, 0, len(loaded))
+	for _, m := range loaded {
+		infos = append(infos, moduleInfo(m, backends))
+	}
+	if backends.Config != nil {
+		cfg, _ := backends.Config.Current()
+		for _, source := range cfg.Sources {
+			if _, ok := loaded[source.Name]; ok || source.Type != "module" {
+				continue
+			}
+			info := ModuleInfo{Name: source.Name, Description: source.Description, ConfigPath: source.Config,
+				Enabled: !source.Disabled, State: MODULE_NOT_LOADED, Connections: []ipcserver.ModuleConn{},
+				Cursors: map[string]int{}, Errors: ipcserver.ModuleErrors{ByCode: map[string]uint64{}}}
+			if source.Disabled {
+				info.State = MODULE_DISABLED
+			}
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func findModule(backends Backends, name string) (ModuleInfo, bool) {
+	for _, info := range moduleInfos(backends) {
+		if info.Name == name {
+			return info, true
+		}
+	}
+	return ModuleInfo{}, false
+}
+
+func moduleError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, modules.ErrNotSupervised), errors.Is(err, modules.ErrNoBinary), errors.Is(err, modules.ErrAlreadyRunning):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	default:
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+}
+
+// setModuleEnabled enables or disables the module source in the config. The config manager applies the change
+// to the sources live, which loads and starts, or stops and disconnects, the module
+func setModuleEnabled(c *fiber.Ctx, backends Backends, name string, enabled bool) error {
+	if backends.Config == nil {
+		return c.Status(fiber.StatusServiceUnavailable).SendString("Config management is not available")
+	}
+	u, err := configUpdate(c, config.ACTION_PATCH)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	next, version := backends.Config.Current()
+	if u.IfVersion == 0 {
+		u.IfVersion = version
+	}
+	found := false
+	for i, source := range next.Sources {
+		if source.Name == name && source.Type == "module" {
+			next.Sources[i].Disabled, found = !enabled, true
+		}
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).SendString("No module named " + name)
+	}
+	res, err := backends.Config.Replace(next, u)
+	if err != nil || u.DryRun {
+		return configResult(c, res, err)
+	}
+	if msg, ok := res.Errors["sources"]; ok {
+		return c.Status(fiber.StatusInternalServerError).SendString(msg)
+	}
+	info, _ := findModule(backends, name)
+	return c.JSON(info)
+}
+
+// setupModuleRoutes operates the modules without shell access, see routeDocs.
+// Modules without a binary are started by hand, and are only connected or not
+func setupModuleRoutes(app *fiber.App, backends Backends) {
+	// Reading the state of the modules needs the read permission, operating them the modules permission
+	app.Use(protectedApi+"/modules", middleware.Require(middleware.PERM_READ))
+	operate := middleware.Require(middleware.PERM_MODULES)
+
+	// Module processes run by bivrost
+	app.Get(protectedApi+"/modules/status", func(c *fiber.Ctx) error {
+		if backends.Modules == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Module supervisor is not running")
+		}
+		return c.JSON(backends.Modules.Status())
+	})
+
+	// Start, stop and restart modules to match the config file
+	app.Post(protectedApi+"/modules/reload", operate, func(c *fiber.Ctx) error {
+		if backends.ReloadModules == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Module reloading is not available")
+		}
+		result, err := backends.ReloadModules()
+		if result == nil {
+			return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"result": result, "error": err.Error()})
+		}
+		return c.JSON(result)
+	})
+
+	// Sandbox violations and other events of a module
+	app.Get(protectedApi+"/modules/:name/events", func(c *fiber.Ctx) error {
+		if backends.Modules == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Module supervisor is not running")
+		}
+		events, err := backends.Modules.Events(c.Params("name"))
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString(err.Error())
+		}
+		return c.JSON(events)
+	})
+
+	// After the permission, so the routes answer 403 rather than 503 to those who can't use them anyway
+	loaded := func(c *fiber.Ctx) error {
+		if backends.Registry == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Modules are not loaded")
+		}
+		return c.Next()
+	}
+	modulesApi := app.Group(protectedApi + "/modules")
+
+	modulesApi.Get("", loaded, func(c *fiber.Ctx) error {
+		return c.JSON(moduleInfos(backends))
+	})
+
+	modulesApi.Get("/:name", loaded, func(c *fiber.Ctx) error {
+		info, ok := findModule(backends, c.Params("name"))
+		if !ok {
+			return c.Status(fiber.StatusNotFound).SendString("No module named " + c.Params("name"))
+		}
+		return c.JSON(info)
+	})
+
+	// Starting, stopping and restarting only last until bivrost restarts, see enable and disable
+	for _, action := range []string{"start", "stop", "restart"} {
+		action := action
+		modulesApi.Post("/:name/"+action, operate, loaded, func(c *fiber.Ctx) error {
+			if backends.Modules == nil {
+				return c.Status(fiber.StatusServiceUnavailable).SendString("Module supervisor is not running")
+			}
+			m, ok := backends.Registry.Module(c.Params("name"))
+			if !ok {
+				return c.Status(fiber.StatusNotFound).SendString("No loaded module named " + c.Params("name"))
+			}
+			var err error
+			switch action {
+			case "start":
+				err = backends.Modules.Start(m)
+			case "stop":
+				err = backends.Modules.Stop(m.Name)
+			case "restart":
+				err = backends.Modules.Restart(m.Name)
+			}
+			if err != nil {
+				return moduleError(c, err)
+			}
+			return c.JSON(moduleInfo(m, backends))
+		})
+	}
+
+	modulesApi.Post("/:name/enable", operate, loaded, func(c *fiber.Ctx) error {
+		return setModuleEnabled(c, backends, c.Params("name"), true)
+	})
+
+	modulesApi.Post("/:name/disable", operate, loaded, func(c *fiber.Ctx) error {
+		return setModuleEnabled(c, backends, c.Params("name"), false)
+	})
+
+	modulesApi.Delete("/:name/cursors/:table", operate, loaded, func(c *fiber.Ctx) error {
+		if backends.IPC == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("IPC server is not running")
+		}
+		m, ok := backends.Registry.Module(c.Params("name"))
+		if !ok {
+			return c.Status(fiber.StatusNotFound).SendString("No loaded module named " + c.Params("name"))
+		}
+		if !backends.IPC.ResetCursor(m.Config.Identifier, c.Params("table")) {
+			return c.Status(fiber.StatusNotFound).SendString("The module hasn't read " + c.Params("table"))
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	modulesApi.Get("/:name/logs", loaded, func(c *fiber.Ctx) error {
+		if backends.Modules == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Module supervisor is not running")
+		}
+		limit := c.QueryInt("limit", 0)
+		if limit < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("limit must not be negative")
+		}
+		lines, err := backends.Modules.Logs(c.Params("name"))
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString(err.Error())
+		}
+		if limit > 0 && len(lines) > limit {
+			lines = lines[len(lines)-limit:]
+		}
+		return c.JSON(lines)
+	})
+}
@@ -0,0 +1,424 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/pynezz/bivrost/internal/middleware"
+)
+
+const openapiPath = protectedApi + "/openapi.json"
+
+// RouteDoc documents a route
+type RouteDoc struct {
+	Method      string
+	Path        string // As registered with Fiber, ex: /api/v1/data/:table. Path parameters are documented from it
+	Tag         string
+	Summary     string
+	Description string
+	Public      bool                  // Not behind the Bouncer
+	Permission  middleware.Permission // Required by the route, see middleware.Require
+	Query       []ParamDoc            // Query parameters
+	Body        any                   // A value of the type of the request body, nil if none. Strings are text/plain
+	Status      int                   // Of a successful answer, defaults to 200
+	Response    any                   // A value of the type of the answer. Strings are text/plain, []byte other content types
+	ContentType string                // Of the answer, when it's []byte
+	Errors      []int                 // Error statuses, answered as text/plain
+	ErrorBodies map[int]any           // Error statuses answered with a body of another type, as Response
+}
+
+// ParamDoc documents a query parameter
+type ParamDoc struct {
+	Name        string
+	Description string
+	Type        any // A value of the type of the parameter, string if nil
+}
+
+// OpenAPI document, as far as bivrost uses it
+type OpenAPI struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       OpenAPIInfo                     `json:"info"`
+	Paths      map[string]map[string]Operation `json:"paths"`
+	Components Components                      `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+type Operation struct {
+	Tags        []string              `json:"tags,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	OperationID string                `json:"operationId"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security"` // Empty for public routes
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema, as far as OpenAPI 3.0 goes
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"` // *Schema or bool
+}
+
+// schemas derives the schemas of Go types, and collects the named ones as components
+type schemas struct {
+	components map[string]*Schema
+	names      map[reflect.Type]string
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	durationType  = reflect.TypeOf(time.Duration(0))
+	deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+	bytesType     = reflect.TypeOf([]byte(nil))
+)
+
+// of returns the schema of the type, a reference for named structs
+func (s *schemas) of(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case deletedAtType:
+		return &Schema{Type: "string", Format: "date-time", Nullable: true}
+	case durationType:
+		return &Schema{Type: "integer", Format: "int64", Description: "Nanoseconds"}
+	case bytesType:
+		return &Schema{Type: "string", Format: "byte"}
+	}
+
+	zero := 0.0
+	switch t.Kind() {
+	case reflect.Pointer:
+		elem := *s.of(t.Elem())
+		if elem.Ref != "" { // $ref can't have siblings in OpenAPI 3.0
+			return &Schema{Ref: elem.Ref}
+		}
+		elem.Nullable = true
+		return &elem
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Uint, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64", Minimum: &zero}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32", Minimum: &zero}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: s.of(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: s.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + s.component(t, func() *Schema { return s.object(t) })}
+	}
+	return &Schema{} // Any value
+}
+
+// component names the schema of a type, and adds it to the components the first time
+func (s *schemas) component(t reflect.Type, build func() *Schema) string {
+	if name, ok := s.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, taken := s.components[name]; taken { // Same name in another package
+		name = strings.ReplaceAll(t.String(), ".", "_")
+	}
+	s.names[t] = name
+	s.components[name] = &Schema{} // Placeholder, for recursive types
+	*s.components[name] = *build()
+	return name
+}
+
+// object is the schema of a struct, with the properties of its JSON encoding
+func (s *schemas) object(t reflect.Type) *Schema {
+	obj := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" { // Embedded fields are flattened, as encoding/json does
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for k, v := range s.object(ft).Properties {
+					if _, shadowed := obj.Properties[k]; !shadowed {
+						obj.Properties[k] = v
+					}
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		obj.Properties[name] = s.of(f.Type) // Outer fields shadow embedded ones
+	}
+	return obj
+}
+
+// row is the schema of a row of the model's table, as the data API returns it: column names to values
+func (s *schemas) row(model any) (string, error) {
+	sch, err := schema.Parse(model, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		return "", err
+	}
+	t := reflect.Indirect(reflect.ValueOf(model)).Type()
+	name := s.component(t, func() *Schema {
+		obj := &Schema{Type: "object", Description: "A row of " + sch.Table, Properties: make(map[string]*Schema)}
+		for _, f := range sch.Fields {
+			if f.DBName != "" {
+				obj.Properties[f.DBName] = s.of(f.FieldType)
+			}
+		}
+		return obj
+	})
+	return name, nil
+}
+
+// operation documents the route
+func (s *schemas) operation(d RouteDoc) Operation {
+	op := Operation{
+		Summary:     d.Summary,
+		Description: d.Description,
+		OperationID: operationID(d.Method, d.Path),
+		Responses:   make(map[string]Response),
+		Security:    []map[string][]string{},
+	}
+	if d.Tag != "" {
+		op.Tags = []string{d.Tag}
+	}
+	if !d.Public {
+		op.Security = []map[string][]string{{"bearerAuth": {}}}
+	}
+	if d.Permission != "" {
+		op.Description = strings.TrimSpace(op.Description + " Requires the " + string(d.Permission) + " permission.")
+	}
+
+	for _, seg := range strings.Split(d.Path, "/") {
+		if strings.HasPrefix(seg, ":") {
+			name := strings.TrimSuffix(strings.TrimPrefix(seg, ":"), "?")
+			op.Parameters = append(op.Parameters, Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+	}
+	for _, q := range d.Query {
+		sch := &Schema{Type: "string"}
+		if q.Type != nil {
+			sch = s.of(reflect.TypeOf(q.Type))
+		}
+		op.Parameters = append(op.Parameters, Parameter{Name: q.Name, In: "query", Description: q.Description, Schema: sch})
+	}
+
+	if d.Body != nil {
+		op.RequestBody = &RequestBody{Required: true, Content: s.content(d.Body, "")}
+	}
+	status := d.Status
+	if status == 0 {
+		status = fiber.StatusOK
+	}
+	ok := Response{Description: http.StatusText(status)}
+	if d.Response != nil {
+		ok.Content = s.content(d.Response, d.ContentType)
+	}
+	op.Responses[fmt.Sprint(status)] = ok
+	for _, code := range d.Errors {
+		op.Responses[fmt.Sprint(code)] = Response{
+			Description: http.StatusText(code),
+			Content:     map[string]MediaType{fiber.MIMETextPlainCharsetUTF8: {Schema: &Schema{Type: "string"}}},
+		}
+	}
+	for code, body := range d.ErrorBodies {
+		op.Responses[fmt.Sprint(code)] = Response{Description: http.StatusText(code), Content: s.content(body, "")}
+	}
+	if _, ok := op.Responses["403"]; !ok && d.Permission != "" {
+		op.Responses["403"] = Response{Description: "The role of the user doesn't grant the " + string(d.Permission) + " permission"}
+	}
+	if _, ok := op.Responses["401"]; !ok && !d.Public {
+		op.Responses["401"] = Response{Description: "Missing or invalid token"}
+	}
+	return op
+}
+
+// content describes a body of the type of v
+func (s *schemas) content(v any, contentType string) map[string]MediaType {
+	switch v.(type) {
+	case string:
+		return map[string]MediaType{fiber.MIMETextPlainCharsetUTF8: {Schema: &Schema{Type: "string"}}}
+	case []byte:
+		return map[string]MediaType{contentType: {Schema: &Schema{Type: "string", Format: "binary"}}}
+	}
+	return map[string]MediaType{fiber.MIMEApplicationJSON: {Schema: s.of(reflect.TypeOf(v))}}
+}
+
+// operationID names an operation after its method and path, ex: getApiV1DataTable
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, seg := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '_' || r == '.' || r == ':' || r == '?' }) {
+		b.WriteString(strings.ToUpper(seg[:1]) + seg[1:])
+	}
+	return b.String()
+}
+
+// openapiPathOf converts a Fiber path to an OpenAPI path, ex: /data/:table to /data/{table}
+func openapiPathOf(path string) string {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if strings.HasPrefix(seg, ":") {
+			segs[i] = "{" + strings.TrimSuffix(seg[1:], "?") + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// GenerateOpenAPI builds the OpenAPI 3 document from the route docs, served at /api/v1/openapi.json.
+// Schemas are derived from the Go types of the bodies through their JSON tags, and from the models for the rows of the tables
+func GenerateOpenAPI(version string) (*OpenAPI, error) {
+	s := &schemas{components: make(map[string]*Schema), names: make(map[reflect.Type]string)}
+	doc := &OpenAPI{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:       "Bivrost API",
+			Version:     version,
+			Description: "Routes under " + protectedApi + " need a bearer token from the login, unless they're marked public.",
+		},
+		Paths: make(map[string]map[string]Operation),
+		Components: Components{
+			Schemas:         s.components,
+			SecuritySchemes: map[string]SecurityScheme{"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"}},
+		},
+	}
+	for _, model := range tableModels {
+		if _, err := s.row(model); err != nil {
+			return nil, fmt.Errorf("schema of %T: %w", model, err)
+		}
+	}
+	for _, v := range messageTypes {
+		s.of(reflect.TypeOf(v))
+	}
+	for _, d := range routeDocs {
+		path := openapiPathOf(d.Path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]Operation)
+		}
+		doc.Paths[path][strings.ToLower(d.Method)] = s.operation(d)
+	}
+	return doc, nil
+}
+
+// UndocumentedRoutes returns the routes of the app without docs, and the docs of routes the app doesn't have.
+// They're reported when the server starts, and fail `bivrost openapi -check`, for CI
+func UndocumentedRoutes(app *fiber.App) (undocumented, stale []string) {
+	documented := make(map[string]bool, len(routeDocs))
+	for _, d := range routeDocs {
+		documented[d.Method+" "+d.Path] = true
+	}
+	registered := make(map[string]bool)
+	for _, r := range app.GetRoutes(true) { // Without the middleware
+		if r.Method == fiber.MethodHead { // Added by Fiber for every GET
+			continue
+		}
+		key := r.Method + " " + r.Path
+		registered[key] = true
+		if !documented[key] {
+			undocumented = append(undocumented, key)
+		}
+	}
+	for key := range documented {
+		if !registered[key] {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(undocumented)
+	sort.Strings(stale)
+	return undocumented, stale
+}
+
+// openapiHandler serves the OpenAPI document, generated on the first request
+func openapiHandler(version string) fiber.Handler {
+	var once sync.Once
+	var body []byte
+	var err error
+	return func(c *fiber.Ctx) error {
+		once.Do(func() {
+			var doc *OpenAPI
+			if doc, err = GenerateOpenAPI(version); err == nil {
+				body, err = json.Marshal(doc)
+			}
+		})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(body)
+	}
+}
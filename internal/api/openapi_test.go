@@ -0,0 +1,23 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/pynezz/bivrost/internal/config"
+)
+
+// Every route must be in the OpenAPI document, and every documented route must exist
+func TestRoutesDocumented(t *testing.T) {
+	app := NewServer(&config.Cfg{}, Backends{})
+	undocumented, stale := UndocumentedRoutes(app)
+	for _, route := range undocumented {
+		t.Errorf("undocumented route: %s, see docs.go", route)
+	}
+	for _, route := range stale {
+		t.Errorf("documented route isn't registered: %s", route)
+	}
+
+	if _, err := GenerateOpenAPI("test"); err != nil {
+		t.Fatal(err)
+	}
+}
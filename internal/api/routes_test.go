@@ -0,0 +1,90 @@
+package api
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/pynezz/bivrost/internal/config"
+	"github.com/pynezz/bivrost/internal/middleware"
+)
+
+// usersDB connects a users database in a temporary directory, made by the migration scripts and upgraded
+func usersDB(t *testing.T) {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range []string{"001_create_users_table.sql", "002_create_auth_tables.sql"} {
+		query, err := os.ReadFile(filepath.Join("..", "..", "db", "migrations", script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Exec(string(query)); err != nil {
+			t.Fatalf("%s: %v", script, err)
+		}
+	}
+	previous := middleware.DBInstance
+	db := middleware.InitDatabaseDriver(conn)
+	t.Cleanup(func() {
+		middleware.DBInstance = previous
+		conn.Close()
+	})
+	if err := db.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var pathParam = regexp.MustCompile(`:[a-z]+`)
+
+// Every route answers 403 exactly to the roles without the permission it's documented with
+func TestRoutePermissions(t *testing.T) {
+	usersDB(t)
+	app := NewServer(&config.Cfg{}, Backends{})
+
+	keys := make(map[string]string) // Role to an API key of a user with it, with every scope of the role
+	for _, role := range middleware.ROLES {
+		u, err := middleware.CreateUser(middleware.CreateUserRequest{DisplayName: role, Password: "correct horse battery", Role: role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var scopes []middleware.Permission
+		for _, perm := range middleware.PERMISSIONS {
+			if middleware.RoleHas(role, perm) {
+				scopes = append(scopes, perm)
+			}
+		}
+		key, err := middleware.CreateAPIKey(u.UserID, "test", scopes, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = key.Key
+	}
+
+	for _, d := range routeDocs {
+		if d.Public || d.Permission == "" {
+			continue
+		}
+		d := d
+		t.Run(d.Method+" "+d.Path, func(t *testing.T) {
+			for _, role := range middleware.ROLES {
+				req := httptest.NewRequest(d.Method, pathParam.ReplaceAllString(d.Path, "1"), nil)
+				req.Header.Set("Authorization", "Bearer "+keys[role])
+				res, err := app.Test(req, -1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if forbidden := res.StatusCode == fiber.StatusForbidden; forbidden == middleware.RoleHas(role, d.Permission) {
+					t.Errorf("%s answered %d, and the role grants %s: %v", role, res.StatusCode, d.Permission, middleware.RoleHas(role, d.Permission))
+				}
+			}
+		})
+	}
+}
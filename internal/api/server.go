@@ -2,7 +2,6 @@ package api
 
 import (
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/pynezz/bivrost/internal/config"
@@ -27,20 +26,25 @@ type IntelRequest struct {
 	Ip string `json:"ip"`
 }
 
-type ConfigRequest struct {
-	Fields config.Cfg `text:"id" json:"id" yaml:"id"`
-}
-
 const (
 	protectedApi   = "/api/v1"
 	unprotectedApi = "/api/v3"
+	jwksPath       = "/.well-known/jwks.json"
 )
 
+// publicPaths don't need a token
+var publicPaths = map[string]bool{
+	"/":         true,
+	"/login":    true,
+	"/register": true,
+	"/refresh":  true,
+	openapiPath: true,
+	jwksPath:    true,
+}
+
 // NewServer initializes a new API server with the provided configuration.
 // Renamed config.Config to config.Cfg to avoid confusion with the Fiber Config struct
-func NewServer(cfg *config.Cfg) *fiber.App {
-	argon2Instance := middleware.NewArgon2().InitArgonWithSalt(middleware.GetSecretKey(), "saltsalt")
-
+func NewServer(cfg *config.Cfg, backends Backends) *fiber.App {
 	// Configure the fiber server with values from the config file
 	app := fiber.New(fiber.Config{
 		ReadTimeout:  time.Duration(cfg.Network.ReadTimeout) * time.Second,  // Convert seconds to time.Duration
@@ -56,13 +60,8 @@ func NewServer(cfg *config.Cfg) *fiber.App {
 	// Middleware
 	app.Use(logger.New()) // Log every request
 
-	fmt.Printf("Secret key: %s%s%s\n",
-		ansi.LightYellow, argon2Instance.GetPrintableKeyWithSalt(argon2Instance.Salt), ansi.Reset)
-
-	fmt.Printf("Argon2 hash: %s%s%s\n", ansi.LightYellow, argon2Instance.GetEncodedHash(), ansi.Reset)
-
 	// Group routes for the dashboard and every child route
-	protectedDash := app.Group("/dashboard", middleware.Bouncer())
+	protectedDash := app.Group("/dashboard", middleware.Bouncer(), middleware.Require(middleware.PERM_READ))
 	// app.Group(protectedApi, middleware.Bouncer())
 
 	protectedDash.Get("/settings", settingsHandler)
@@ -73,16 +72,25 @@ func NewServer(cfg *config.Cfg) *fiber.App {
 		return c.SendString(getRandomJoke())
 	})
 
-	// For every path except the root, check if the user is authenticated
+	// For every path except the public ones, check if the user is authenticated
 	app.Use(func(c *fiber.Ctx) error {
-		if c.Path() != "/" && c.Path() != protectedApi+"/login" && c.Path() != protectedApi+"/register" {
+		if !publicPaths[c.Path()] {
 			return middleware.Bouncer()(c)
 		}
 		return c.Next()
 	})
 
 	// Setup routes
-	setupRoutes(app, cfg)
+	setupRoutes(app, cfg, backends)
+
+	// Every route should be in the OpenAPI document, see docs.go
+	undocumented, stale := UndocumentedRoutes(app)
+	for _, route := range undocumented {
+		ansi.PrintWarning("Undocumented route: " + route)
+	}
+	for _, route := range stale {
+		ansi.PrintWarning("Documented route isn't registered: " + route)
+	}
 
 	return app
 }
@@ -116,30 +124,19 @@ func antiphishingHandler(c *fiber.Ctx) error {
 }
 
 // setupRoutes configures all the routes for the API server.
-func setupRoutes(app *fiber.App, cfg *config.Cfg) {
-	app.Get("/", indexHandler)               // Root path
-	app.Get("/ws", websocket.New(wsHandler)) // WebSockets
-
-	app.Post(protectedApi+"/config/add_source", func(c *fiber.Ctx) error {
-		c.Accepts("application/yaml", "application/json")
-		// Serialize the request body to a struct
-		var configRequest ConfigRequest
-		if err := c.BodyParser(&configRequest.Fields.Sources); err != nil {
-			ansi.PrintError("Error parsing request body: " + err.Error())
-			return err
-		}
+func setupRoutes(app *fiber.App, cfg *config.Cfg, backends Backends) {
+	app.Get("/", indexHandler)                             // Root path
+	app.Get(openapiPath, openapiHandler(backends.Version)) // See openapi.go
+	app.Get(jwksPath, jwksHandler)                         // Public keys of the tokens
 
-		updatedFields := c.Body()
+	// Live tail, see live.go
+	app.Get("/ws", middleware.Require(middleware.PERM_READ), websocket.New(liveHandler(backends.Live)))
 
-		fmt.Println("ID" + ansi.ColorF(ansi.DarkYellow, "%s", updatedFields))
-
-		// TODO: Check if this works
-		config.WriteConfig(cfg, "config.yaml")
-
-		return c.SendString("Configuration updated")
-	})
+	// Changes of the config, with validation and history, see config.go
+	setupConfigRoutes(app, backends)
 
 	// For the ThreatIntel module
+	app.Use(protectedApi+"/intel", middleware.Require(middleware.PERM_ANALYZE))
 	app.Post(protectedApi+"/intel/", func(c *fiber.Ctx) error {
 		c.AcceptsEncodings("application/json")
 		payload := new(IntelRequest)
@@ -150,6 +147,87 @@ func setupRoutes(app *fiber.App, cfg *config.Cfg) {
 		return c.JSON(payload)
 	})
 
+	// The logs and the module results, see data.go
+	setupDataRoutes(app, backends)
+	setupExportRoutes(app, backends)
+
+	// Reading the state of the IPC server needs the read permission, changing it the modules permission
+	app.Use(protectedApi+"/ipc", middleware.Require(middleware.PERM_READ))
+
+	// Modules currently connected to the IPC server
+	app.Get(protectedApi+"/ipc/connections", func(c *fiber.Ctx) error {
+		if backends.IPC == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("IPC server is not running")
+		}
+		return c.JSON(backends.IPC.Connections())
+	})
+
+	// Event bus subscriptions, and how many events are waiting in their queues
+	app.Get(protectedApi+"/ipc/subscriptions", func(c *fiber.Ctx) error {
+		if backends.IPC == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("IPC server is not running")
+		}
+		return c.JSON(backends.IPC.Subscriptions())
+	})
+
+	// Recording of the frames on module connections to a capture file in the configured directory, see `bivrost capture`
+	app.Get(protectedApi+"/ipc/capture", func(c *fiber.Ctx) error {
+		if backends.IPC == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("IPC server is not running")
+		}
+		info, ok := backends.IPC.Capture()
+		if !ok {
+			return c.Status(fiber.StatusNotFound).SendString("Not capturing")
+		}
+		return c.JSON(info)
+	})
+
+	app.Post(protectedApi+"/ipc/capture", middleware.Require(middleware.PERM_MODULES), func(c *fiber.Ctx) error {
+		if backends.IPC == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("IPC server is not running")
+		}
+		payload := new(CaptureRequest)
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(payload); err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+			}
+		}
+		if payload.Modules == nil {
+			payload.Modules = cfg.IPC.Capture.Modules
+		}
+		info, err := backends.IPC.StartCapture(cfg.IPC.Capture.Dir, payload.Modules)
+		if err != nil {
+			if info.Path != "" {
+				return c.Status(fiber.StatusConflict).SendString(err.Error())
+			}
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+		return c.Status(fiber.StatusCreated).JSON(info)
+	})
+
+	app.Delete(protectedApi+"/ipc/capture", middleware.Require(middleware.PERM_MODULES), func(c *fiber.Ctx) error {
+		if backends.IPC == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("IPC server is not running")
+		}
+		if _, ok := backends.IPC.Capture(); !ok {
+			return c.Status(fiber.StatusNotFound).SendString("Not capturing")
+		}
+		info, err := backends.IPC.StopCapture()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"capture": info, "error": err.Error()})
+		}
+		return c.JSON(info)
+	})
+
+	// Modules, and operating them, see modules.go
+	setupModuleRoutes(app, backends)
+
+	// Users and invitations, for the admins, see users.go
+	setupUserRoutes(app)
+
+	// API keys of the users, see keys.go
+	setupKeyRoutes(app)
+
 	// Auth route
 	// For this to work, the client must send a GET request to /auth/<id>
 	// With body: Bearer Token <key>
@@ -169,6 +247,8 @@ func setupRoutes(app *fiber.App, cfg *config.Cfg) {
 
 	app.Post("/login", middleware.BeginLogin)
 	app.Post("/register", middleware.BeginRegistration)
+	app.Post("/refresh", middleware.Refresh) // See middleware/sessions.go
+	app.Post("/logout", middleware.Logoff)
 	app.Get("/auth", handleAuth)
 }
 
@@ -195,6 +275,11 @@ func updateConfigHandler(c *fiber.Ctx) error {
 	return c.SendString("Configuration updated")
 }
 
+// jwksHandler answers with the public keys the tokens are verified with, see middleware/signing.go
+func jwksHandler(c *fiber.Ctx) error {
+	return c.JSON(middleware.CurrentJWKS())
+}
+
 // indexHandler handles the root path.
 func indexHandler(c *fiber.Ctx) error {
 	c.Accepts("html")                           // "html"
@@ -206,30 +291,6 @@ func indexHandler(c *fiber.Ctx) error {
 	return c.SendString("Bivrost Fiber API Server is up and running!")
 }
 
-// wsHandler handles WebSocket connections.
-func wsHandler(c *websocket.Conn) {
-	// WebSocket connection handling logic here
-	fmt.Println("WebSocket Connected")
-
-	// Example: Echo received message back to the client
-	var (
-		mt  int
-		msg []byte
-		err error
-	)
-	for {
-		if mt, msg, err = c.ReadMessage(); err != nil {
-			log.Println("read:", err)
-			break
-		}
-		log.Printf("recv: %s", msg)
-		if err = c.WriteMessage(mt, msg); err != nil {
-			log.Println("write:", err)
-			break
-		}
-	}
-}
-
 // func newRoute(method string, path string, handler func(*fiber.Ctx) error) *fiber.Route {
 // 	return &fiber.Route{
 // 		Method:  method,
@@ -3,3 +3,31 @@ package api
 /* API Types
  * This file contains the types for the API such as the server and the routes.
  */
+
+import (
+	"github.com/pynezz/bivrost/internal/config"
+	"github.com/pynezz/bivrost/internal/database/stores"
+	"github.com/pynezz/bivrost/internal/export"
+	"github.com/pynezz/bivrost/internal/ipc/ipcserver"
+	"github.com/pynezz/bivrost/internal/live"
+	"github.com/pynezz/bivrost/modules"
+)
+
+// Backends holds the services running alongside the API server, which the routes expose over HTTP
+type Backends struct {
+	IPC      *ipcserver.IPCServer // The IPC server modules connect to
+	Modules  *modules.Supervisor  // Runs the module processes
+	Registry *modules.Registry    // The loaded modules
+	Stores   *stores.Stores       // The logs and the module results
+	Live     *live.Hub            // Streams new rows to the live tail clients
+	Exports  *export.Jobs         // Runs the background exports
+	Config   *config.Manager      // Changes the config, and keeps its history
+
+	ReloadModules func() (*modules.ReloadResult, error) // Re-reads the config and applies the module changes
+	Version       string                                // Of bivrost, for the OpenAPI document
+}
+
+// CaptureRequest starts a capture of the IPC frames. Modules are identifiers, all modules are captured if empty
+type CaptureRequest struct {
+	Modules []string `json:"modules"`
+}
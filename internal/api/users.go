@@ -0,0 +1,173 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/pynezz/bivrost/internal/middleware"
+)
+
+// InvitationRequest makes an invitation
+type InvitationRequest struct {
+	Role string `json:"role"`
+	TTL  int    `json:"ttl"` // Hours the invitation is valid for, 72 if 0
+}
+
+// RevokedSessionsResponse is how many sessions were revoked
+type RevokedSessionsResponse struct {
+	Revoked int64 `json:"revoked"`
+}
+
+func userError(c *fiber.Ctx, err error) error {
+	var invalid *middleware.UserValidationError
+	switch {
+	case errors.As(err, &invalid):
+		return c.Status(fiber.StatusBadRequest).SendString(invalid.Error())
+	case errors.Is(err, middleware.ErrNoSuchUser), errors.Is(err, middleware.ErrNoSuchInvitation), errors.Is(err, middleware.ErrNoSuchSession):
+		return c.Status(fiber.StatusNotFound).SendString(err.Error())
+	case errors.Is(err, middleware.ErrLastAdmin):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	case errors.Is(err, middleware.ErrNoUsersDatabase):
+		return c.Status(fiber.StatusServiceUnavailable).SendString(err.Error())
+	default:
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+}
+
+func userID(c *fiber.Ctx) (uint64, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return 0, middleware.NewUserValidationError("id must be a number")
+	}
+	return id, nil
+}
+
+// setupUserRoutes lets the admins manage the users and invitations, see routeDocs.
+// There is always an enabled admin left, changes that would remove the last one answer 409
+func setupUserRoutes(app *fiber.App) {
+	app.Use(protectedApi+"/users", middleware.Require(middleware.PERM_USERS))
+
+	app.Get(protectedApi+"/users", func(c *fiber.Ctx) error {
+		users, err := middleware.ListUsers()
+		if err != nil {
+			return userError(c, err)
+		}
+		return c.JSON(users)
+	})
+
+	app.Post(protectedApi+"/users", func(c *fiber.Ctx) error {
+		var req middleware.CreateUserRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		u, err := middleware.CreateUser(req)
+		if err != nil {
+			return userError(c, err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(u)
+	})
+
+	// Invitations are registered first, so invitations isn't taken for an ID
+	app.Get(protectedApi+"/users/invitations", func(c *fiber.Ctx) error {
+		invitations, err := middleware.ListInvitations()
+		if err != nil {
+			return userError(c, err)
+		}
+		return c.JSON(invitations)
+	})
+
+	app.Post(protectedApi+"/users/invitations", func(c *fiber.Ctx) error {
+		req := InvitationRequest{Role: middleware.ROLE_VIEWER}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+			}
+		}
+		if req.TTL < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("ttl must not be negative")
+		}
+		createdBy, _ := strconv.ParseUint(middleware.Subject(c), 10, 64)
+		inv, err := middleware.CreateInvitation(req.Role, createdBy, time.Duration(req.TTL)*time.Hour)
+		if err != nil {
+			return userError(c, err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(inv)
+	})
+
+	app.Delete(protectedApi+"/users/invitations/:id", func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("id must be a number")
+		}
+		if err := middleware.DeleteInvitation(id); err != nil {
+			return userError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get(protectedApi+"/users/:id", func(c *fiber.Ctx) error {
+		id, err := userID(c)
+		if err != nil {
+			return userError(c, err)
+		}
+		u, err := middleware.LookupUser(id)
+		if err != nil {
+			return userError(c, err)
+		}
+		return c.JSON(u)
+	})
+
+	app.Patch(protectedApi+"/users/:id", func(c *fiber.Ctx) error {
+		id, err := userID(c)
+		if err != nil {
+			return userError(c, err)
+		}
+		var update middleware.UserUpdate
+		if err := c.BodyParser(&update); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		u, err := middleware.UpdateUser(id, update)
+		if err != nil {
+			return userError(c, err)
+		}
+		return c.JSON(u)
+	})
+
+	app.Delete(protectedApi+"/users/:id", func(c *fiber.Ctx) error {
+		id, err := userID(c)
+		if err != nil {
+			return userError(c, err)
+		}
+		if err := middleware.DeleteUser(id); err != nil {
+			return userError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get(protectedApi+"/users/:id/sessions", func(c *fiber.Ctx) error {
+		id, err := userID(c)
+		if err != nil {
+			return userError(c, err)
+		}
+		sessions, err := middleware.ListSessions(id)
+		if err != nil {
+			return userError(c, err)
+		}
+		return c.JSON(sessions)
+	})
+
+	app.Delete(protectedApi+"/users/:id/sessions", func(c *fiber.Ctx) error {
+		id, err := userID(c)
+		if err != nil {
+			return userError(c, err)
+		}
+		revoked, err := middleware.RevokeUserSessions(id)
+		if err != nil {
+			return userError(c, err)
+		}
+		return c.JSON(RevokedSessionsResponse{Revoked: revoked})
+	})
+}
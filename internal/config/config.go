@@ -17,6 +17,7 @@ type Sources struct {
 	Config      string   `yaml:"config"`
 	Format      string   `yaml:"format,omitempty"`
 	Tags        []string `yaml:"tags"`
+	Disabled    bool     `yaml:"disabled,omitempty"` // Modules only: not started, and not allowed to connect
 }
 
 type Cfg struct {
@@ -25,10 +26,51 @@ type Cfg struct {
 		ReadTimeout  int `yaml:"read_timeout,omitempty"`
 		WriteTimeout int `yaml:"write_timeout,omitempty"`
 		Port         int `yaml:"port,omitempty"`
+		LiveBuffer   int `yaml:"live_buffer,omitempty"` // Rows queued per live tail client before they're dropped
 	} `yaml:"network"`
 	Database struct {
 		Path string `yaml:"path"`
 	} `yaml:"users_database"`
+	// Keys the tokens are signed with, see `bivrost keys`
+	Auth struct {
+		KeyFile string `yaml:"key_file,omitempty"` // Key set made with `bivrost keys generate`. Overridden by BIVROST_JWT_KEYS and BIVROST_JWT_KEY_FILE
+	} `yaml:"auth,omitempty"`
+	// Background exports of the logs and module results, see `bivrost export`
+	Export struct {
+		Dir         string `yaml:"dir,omitempty"`         // Directory of the export files, defaults to exports
+		TTL         int    `yaml:"ttl,omitempty"`         // Hours a finished export can be downloaded, defaults to 24
+		Concurrency int    `yaml:"concurrency,omitempty"` // Exports running at the same time, defaults to 2
+	} `yaml:"export,omitempty"`
+	IPC struct {
+		HeartbeatInterval int `yaml:"heartbeat_interval,omitempty"` // Seconds between pings to connected modules
+		PeerTimeout       int `yaml:"peer_timeout,omitempty"`       // Seconds a module may stay silent before it's dropped
+
+		MaxChunkSize   int      `yaml:"max_chunk_size,omitempty"`   // Largest chunk sent to a module, in bytes
+		MaxMessageSize int      `yaml:"max_message_size,omitempty"` // Largest message accepted from a module, in bytes
+		Compression    []string `yaml:"compression,omitempty"`      // Allowed compression (zstd, gzip), in order of preference
+
+		// Module event bus
+		Events struct {
+			Persist    bool `yaml:"persist,omitempty"`     // Keep subscriptions and undelivered events in the database across restarts
+			MaxQueue   int  `yaml:"max_queue,omitempty"`   // Events queued per subscription before the oldest are dropped
+			AckTimeout int  `yaml:"ack_timeout,omitempty"` // Seconds a module has to acknowledge an event before it's sent again
+		} `yaml:"events,omitempty"`
+
+		// Optional TCP listener with mutual TLS, for modules running on other hosts
+		TLS struct {
+			Listen   string `yaml:"listen,omitempty"`    // Address to listen on, ex: 0.0.0.0:50052. Disabled if empty
+			Cert     string `yaml:"cert,omitempty"`      // Server certificate (PEM)
+			Key      string `yaml:"key,omitempty"`       // Server private key (PEM)
+			ClientCA string `yaml:"client_ca,omitempty"` // CA that signs the module certificates (PEM)
+		} `yaml:"tls,omitempty"`
+
+		// Recording of the frames on module connections, to reproduce problems with a module
+		Capture struct {
+			Enabled bool     `yaml:"enabled,omitempty"` // Start capturing when bivrost starts
+			Dir     string   `yaml:"dir,omitempty"`     // Directory of the capture files, defaults to captures
+			Modules []string `yaml:"modules,omitempty"` // Identifiers of the modules to capture, all if empty
+		} `yaml:"capture,omitempty"`
+	} `yaml:"ipc,omitempty"`
 }
 
 // LoadConfig loads the configuration from the given path
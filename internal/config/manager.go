@@ -0,0 +1,443 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/util"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	HISTORY_DIR  = "config-history" // Next to the config file
+	MAX_VERSIONS = 100              // Versions kept in the history
+	historyIndex = "history.jsonl"
+)
+
+// Actions that make a version
+const (
+	ACTION_INITIAL  = "initial"  // The config when the history was started
+	ACTION_FILE     = "file"     // The config file was edited while bivrost wasn't running
+	ACTION_PUT      = "put"      // Replaced through the API
+	ACTION_PATCH    = "patch"    // Patched through the API
+	ACTION_ROLLBACK = "rollback" // Rolled back to a previous version
+)
+
+var (
+	ErrNoSuchVersion = errors.New("no such config version")
+	ErrConflict      = errors.New("the config was changed since that version")
+)
+
+// Change is a setting that changed
+type Change struct {
+	Path string `json:"path"` // Dotted, ex: network.port. Lists change as a whole, ex: sources
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+// Version is a version of the config in the history
+type Version struct {
+	Version    int       `json:"version"`
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	Action     string    `json:"action"`
+	RollbackOf int       `json:"rollback_of,omitempty"` // The version rolled back to
+	Changes    []Change  `json:"changes"`
+}
+
+// Result of a change of the config
+type Result struct {
+	Version int               `json:"version"` // Of the config after the change, or the current one for dry runs
+	DryRun  bool              `json:"dry_run,omitempty"`
+	Changes []Change          `json:"changes"`
+	Applied []string          `json:"applied"`          // Changed settings applied live, or that would be
+	Restart []string          `json:"restart"`          // Changed settings that take effect when bivrost restarts
+	Errors  map[string]string `json:"errors,omitempty"` // Settings that failed to apply live, to their error
+}
+
+// Update describes a change of the config
+type Update struct {
+	Action     string
+	User       string
+	DryRun     bool // Only report the changes
+	IfVersion  int  // Fail with ErrConflict unless it's the current version, if set
+	RollbackOf int
+}
+
+type liveSetting struct {
+	path  string
+	apply func(cfg *Cfg) error
+}
+
+// Manager owns the loaded config, and changes it for the config API: it validates the new config, writes it
+// to the config file, keeps the previous versions in a history directory next to the file, and applies the
+// changed settings registered with Live. Every other changed setting needs a restart.
+// Comments in the config file aren't kept
+type Manager struct {
+	mu         sync.Mutex
+	path       string
+	historyDir string
+	cfg        *Cfg // Updated in place, so the holders of the pointer see the changes
+	versions   []Version
+	live       []liveSetting
+	validators []func(cfg *Cfg) error
+}
+
+// NewManager manages the config loaded from path. The current config is added to the history
+// if it isn't the latest version, ex: the first time, or after the file was edited
+func NewManager(path string, cfg *Cfg) (*Manager, error) {
+	m := &Manager{path: path, historyDir: filepath.Join(filepath.Dir(path), HISTORY_DIR), cfg: cfg}
+	if err := os.MkdirAll(m.historyDir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := m.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	if len(m.versions) == 0 {
+		return m, m.record(Version{Action: ACTION_INITIAL, Changes: []Change{}}, cfg)
+	}
+	last, err := m.load(m.versions[len(m.versions)-1].Version)
+	if err != nil {
+		return nil, err
+	}
+	if changes := Diff(last, cfg); len(changes) > 0 {
+		return m, m.record(Version{Action: ACTION_FILE, Changes: changes}, cfg)
+	}
+	return m, nil
+}
+
+// Live registers a function that applies the settings under the path while bivrost runs, ex: "sources".
+// It's called with the new config after it's written, whenever a setting under the path changed
+func (m *Manager) Live(path string, apply func(cfg *Cfg) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.live = append(m.live, liveSetting{path: path, apply: apply})
+}
+
+// Validator registers a check of new configs, on top of Cfg.Validate, ex: that the module manifests load
+func (m *Manager) Validator(fn func(cfg *Cfg) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.validators = append(m.validators, fn)
+}
+
+// Current returns a copy of the config, and its version
+func (m *Manager) Current() (*Cfg, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.copy(m.cfg), m.version()
+}
+
+func (m *Manager) version() int {
+	if len(m.versions) == 0 {
+		return 0
+	}
+	return m.versions[len(m.versions)-1].Version
+}
+
+// History returns the versions of the config, the latest last
+func (m *Manager) History() []Version {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Version(nil), m.versions...)
+}
+
+// Get returns a version of the config
+func (m *Manager) Get(version int) (*Cfg, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.load(version)
+}
+
+// Replace validates the config and makes it the current one
+func (m *Manager) Replace(next *Cfg, u Update) (*Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.update(next, u)
+}
+
+// Patch applies a JSON merge patch (RFC 7386) to the current config. Lists are replaced as a whole
+func (m *Manager) Patch(patch []byte, u Update) (*Result, error) {
+	var p any
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, err := ToMap(m.cfg)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := yaml.Marshal(mergePatch(current, p))
+	if err != nil {
+		return nil, err
+	}
+	next, err := Parse(merged)
+	if err != nil {
+		return nil, err
+	}
+	return m.update(next, u)
+}
+
+// Rollback makes a previous version the current config, as a new version
+func (m *Manager) Rollback(version int, u Update) (*Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next, err := m.load(version)
+	if err != nil {
+		return nil, err
+	}
+	u.Action, u.RollbackOf = ACTION_ROLLBACK, version
+	return m.update(next, u)
+}
+
+func (m *Manager) update(next *Cfg, u Update) (*Result, error) {
+	if u.IfVersion != 0 && u.IfVersion != m.version() {
+		return nil, fmt.Errorf("%w: %d is not the current version %d", ErrConflict, u.IfVersion, m.version())
+	}
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	for _, validate := range m.validators {
+		if err := validate(next); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+		}
+	}
+
+	res := &Result{Version: m.version(), DryRun: u.DryRun, Changes: Diff(m.cfg, next), Applied: []string{}, Restart: []string{}}
+	apply := m.sort(res)
+	if u.DryRun || len(res.Changes) == 0 {
+		return res, nil
+	}
+
+	if err := m.write(next); err != nil {
+		return nil, err
+	}
+	if err := m.record(Version{User: u.User, Action: u.Action, RollbackOf: u.RollbackOf, Changes: res.Changes}, next); err != nil {
+		util.PrintError("Failed to record the config version: " + err.Error())
+	}
+	res.Version = m.version()
+	*m.cfg = *next
+
+	for _, s := range apply {
+		if err := s.apply(m.copy(next)); err != nil {
+			if res.Errors == nil {
+				res.Errors = make(map[string]string)
+			}
+			res.Errors[s.path] = err.Error()
+			util.PrintError(fmt.Sprintf("Failed to apply %s: %s", s.path, err))
+		}
+	}
+	util.PrintSuccess(fmt.Sprintf("Config version %d: %d changes, %d applied, %d need a restart",
+		res.Version, len(res.Changes), len(res.Applied), len(res.Restart)))
+	return res, nil
+}
+
+// sort sorts the changes of the result into the settings applied live and those that need a restart,
+// and returns the live settings to apply
+func (m *Manager) sort(res *Result) []liveSetting {
+	var apply []liveSetting
+	for _, s := range m.live {
+		for _, c := range res.Changes {
+			if c.Path == s.path || strings.HasPrefix(c.Path, s.path+".") {
+				apply = append(apply, s)
+				break
+			}
+		}
+	}
+	for _, c := range res.Changes {
+		live := false
+		for _, s := range m.live {
+			if c.Path == s.path || strings.HasPrefix(c.Path, s.path+".") {
+				live = true
+			}
+		}
+		if live {
+			res.Applied = append(res.Applied, c.Path)
+		} else {
+			res.Restart = append(res.Restart, c.Path)
+		}
+	}
+	return apply
+}
+
+// write writes the config file, through a temporary file so it's never half written
+func (m *Manager) write(cfg *Cfg) error {
+	buf, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func (m *Manager) copy(cfg *Cfg) *Cfg {
+	buf, _ := yaml.Marshal(cfg)
+	c, err := Parse(buf)
+	if err != nil { // Never, it was written by yaml
+		return cfg
+	}
+	return c
+}
+
+/* HISTORY */
+
+// versionFile is the YAML file of the version in the history directory, where history.jsonl lists the versions
+func (m *Manager) versionFile(version int) string {
+	return filepath.Join(m.historyDir, fmt.Sprintf("%06d.yaml", version))
+}
+
+func (m *Manager) loadIndex() error {
+	f, err := os.Open(filepath.Join(m.historyDir, historyIndex))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var v Version
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			return fmt.Errorf("%s: %w", historyIndex, err)
+		}
+		m.versions = append(m.versions, v)
+	}
+	return scanner.Err()
+}
+
+// record adds the config to the history, as the next version, and forgets the oldest versions past MAX_VERSIONS
+func (m *Manager) record(v Version, cfg *Cfg) error {
+	v.Version = m.version() + 1
+	v.Time = time.Now()
+	buf, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.versionFile(v.Version), buf, 0o600); err != nil {
+		return err
+	}
+	m.versions = append(m.versions, v)
+	for len(m.versions) > MAX_VERSIONS {
+		os.Remove(m.versionFile(m.versions[0].Version))
+		m.versions = m.versions[1:]
+	}
+
+	var index strings.Builder
+	for _, v := range m.versions {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		index.Write(line)
+		index.WriteByte('\n')
+	}
+	tmp := filepath.Join(m.historyDir, historyIndex+".tmp")
+	if err := os.WriteFile(tmp, []byte(index.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.historyDir, historyIndex))
+}
+
+func (m *Manager) load(version int) (*Cfg, error) {
+	found := false
+	for _, v := range m.versions {
+		found = found || v.Version == version
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %d", ErrNoSuchVersion, version)
+	}
+	buf, err := os.ReadFile(m.versionFile(version))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(buf)
+}
+
+/* DIFF */
+
+// ToMap converts the config to setting names to values, as in the config file
+func ToMap(cfg *Cfg) (map[string]any, error) {
+	buf, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]any)
+	return out, yaml.Unmarshal(buf, &out)
+}
+
+// Diff returns the settings that differ between the configs, sorted by path
+func Diff(old, new *Cfg) []Change {
+	a, errA := ToMap(old)
+	b, errB := ToMap(new)
+	if errA != nil || errB != nil {
+		return nil
+	}
+	changes := []Change{}
+	diff("", a, b, &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diff(prefix string, a, b map[string]any, changes *[]Change) {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range keys {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		am, aIsMap := a[k].(map[string]any)
+		bm, bIsMap := b[k].(map[string]any)
+		switch {
+		case aIsMap && bIsMap:
+			diff(path, am, bm, changes)
+		case aIsMap && b[k] == nil: // A section was removed, report its settings
+			diff(path, am, map[string]any{}, changes)
+		case bIsMap && a[k] == nil:
+			diff(path, map[string]any{}, bm, changes)
+		case !reflect.DeepEqual(a[k], b[k]):
+			*changes = append(*changes, Change{Path: path, Old: a[k], New: b[k]})
+		}
+	}
+}
+
+// mergePatch applies a JSON merge patch to the target, see RFC 7386
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
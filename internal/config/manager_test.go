@@ -0,0 +1,223 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testConfig = `sources:
+  - name: nginx
+    type: directory
+network:
+  port: 3000
+  read_timeout: 10
+users_database:
+  path: users.db
+`
+
+// testManager writes the test config to a temporary directory, and manages it.
+// Network settings are applied live, recording the configs they were applied with
+func testManager(t *testing.T) (*Manager, *[]*Cfg) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []*Cfg
+	m.Live("network", func(cfg *Cfg) error {
+		applied = append(applied, cfg)
+		if cfg.Network.LiveBuffer == 13 {
+			return errors.New("unlucky")
+		}
+		return nil
+	})
+	return m, &applied
+}
+
+// paths returns the paths of the changed settings
+func paths(changes []Change) []string {
+	list := []string{}
+	for _, c := range changes {
+		list = append(list, c.Path)
+	}
+	return list
+}
+
+func TestPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patch    string
+		update   Update
+		want     *Result // Nil if the patch fails
+		wantErr  error
+		wantPort int // Of the current config after the patch
+	}{
+		{
+			name:  "applied live",
+			patch: `{"network": {"port": 8080}}`,
+			want: &Result{Version: 2, Changes: []Change{{Path: "network.port", Old: 3000, New: 8080}},
+				Applied: []string{"network.port"}, Restart: []string{}},
+			wantPort: 8080,
+		},
+		{
+			name:  "needs a restart",
+			patch: `{"users_database": {"path": "other.db"}, "network": {"read_timeout": null}}`,
+			want: &Result{Version: 2, Changes: []Change{{Path: "network.read_timeout", Old: 10, New: nil}, {Path: "users_database.path", Old: "users.db", New: "other.db"}},
+				Applied: []string{"network.read_timeout"}, Restart: []string{"users_database.path"}},
+			wantPort: 3000,
+		},
+		{
+			name:  "failed to apply",
+			patch: `{"network": {"live_buffer": 13}}`,
+			want: &Result{Version: 2, Changes: []Change{{Path: "network.live_buffer", Old: nil, New: 13}},
+				Applied: []string{"network.live_buffer"}, Restart: []string{}, Errors: map[string]string{"network": "unlucky"}},
+			wantPort: 3000,
+		},
+		{
+			name:     "nothing changed",
+			patch:    `{"network": {"port": 3000}}`,
+			want:     &Result{Version: 1, Changes: []Change{}, Applied: []string{}, Restart: []string{}},
+			wantPort: 3000,
+		},
+		{
+			name:   "dry run",
+			patch:  `{"network": {"port": 8080}}`,
+			update: Update{DryRun: true},
+			want: &Result{Version: 1, DryRun: true, Changes: []Change{{Path: "network.port", Old: 3000, New: 8080}},
+				Applied: []string{"network.port"}, Restart: []string{}},
+			wantPort: 3000,
+		},
+		{"invalid setting", `{"network": {"port": 70000}}`, Update{}, nil, ErrInvalid, 3000},
+		{"unknown setting", `{"network": {"prot": 8080}}`, Update{}, nil, ErrInvalid, 3000},
+		{"wrong type", `{"network": {"port": "http"}}`, Update{}, nil, ErrInvalid, 3000},
+		{"not JSON", `port: 8080`, Update{}, nil, ErrInvalid, 3000},
+		{"stale version", `{"network": {"port": 8080}}`, Update{IfVersion: 7}, nil, ErrConflict, 3000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, applied := testManager(t)
+			tt.update.Action = ACTION_PATCH
+			res, err := m.Patch([]byte(tt.patch), tt.update)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(res, tt.want) {
+				t.Errorf("got %+v, want %+v", res, tt.want)
+			}
+
+			cfg, version := m.Current()
+			if cfg.Network.Port != tt.wantPort {
+				t.Errorf("the port is %d after the patch, want %d", cfg.Network.Port, tt.wantPort)
+			}
+			written, err := LoadConfig(m.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written.Network.Port != tt.wantPort {
+				t.Errorf("the config file has port %d, want %d", written.Network.Port, tt.wantPort)
+			}
+			changed := tt.want != nil && !tt.want.DryRun && len(tt.want.Changes) > 0
+			if wantVersion := map[bool]int{false: 1, true: 2}[changed]; version != wantVersion || len(m.History()) != wantVersion {
+				t.Errorf("version %d with %d in the history, want %d", version, len(m.History()), wantVersion)
+			}
+			if wantApplied := map[bool]int{false: 0, true: 1}[changed && len(tt.want.Applied) > 0]; len(*applied) != wantApplied {
+				t.Errorf("applied live %d times, want %d", len(*applied), wantApplied)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	m, applied := testManager(t)
+	for _, patch := range []string{`{"network": {"port": 8080}}`, `{"network": {"port": 9090}, "sources": []}`} {
+		if _, err := m.Patch([]byte(patch), Update{Action: ACTION_PATCH, User: "admin"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := m.Rollback(1, Update{User: "admin", IfVersion: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"network.port", "sources"}; res.Version != 4 || !reflect.DeepEqual(paths(res.Changes), want) {
+		t.Errorf("rollback made version %d changing %v, want version 4 changing %v", res.Version, paths(res.Changes), want)
+	}
+	cfg, _ := m.Current()
+	if cfg.Network.Port != 3000 || len(cfg.Sources) != 1 || len(*applied) != 3 {
+		t.Errorf("rolled back to port %d with %d sources, applied %d times", cfg.Network.Port, len(cfg.Sources), len(*applied))
+	}
+	if last := m.History()[3]; last.Action != ACTION_ROLLBACK || last.RollbackOf != 1 || last.User != "admin" {
+		t.Errorf("the rollback was recorded as %+v", last)
+	}
+
+	if _, err := m.Rollback(2, Update{IfVersion: 3}); !errors.Is(err, ErrConflict) {
+		t.Errorf("rollback of a stale version: got %v, want %v", err, ErrConflict)
+	}
+	if _, err := m.Rollback(42, Update{}); !errors.Is(err, ErrNoSuchVersion) {
+		t.Errorf("rollback to a missing version: got %v, want %v", err, ErrNoSuchVersion)
+	}
+	if old, err := m.Get(2); err != nil || old.Network.Port != 8080 {
+		t.Errorf("version 2 has port %d, error %v", old.Network.Port, err)
+	}
+}
+
+// The history outlives the manager, and edits of the file while bivrost wasn't running are recorded
+func TestHistoryReloaded(t *testing.T) {
+	m, _ := testManager(t)
+	if _, err := m.Patch([]byte(`{"network": {"port": 8080}}`), Update{Action: ACTION_PATCH}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		edit    string // Replaces the config file, if set
+		want    []string
+		changes []string // Of the latest version
+	}{
+		{"unchanged", "", []string{ACTION_INITIAL, ACTION_PATCH}, []string{"network.port"}},
+		{"edited", "network:\n  port: 8081\n", []string{ACTION_INITIAL, ACTION_PATCH, ACTION_FILE},
+			[]string{"network.port", "network.read_timeout", "sources", "users_database.path"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.edit != "" {
+				if err := os.WriteFile(m.path, []byte(tt.edit), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg, err := LoadConfig(m.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reloaded, err := NewManager(m.path, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			history := reloaded.History()
+			var actions []string
+			for _, v := range history {
+				actions = append(actions, v.Action)
+			}
+			if !reflect.DeepEqual(actions, tt.want) {
+				t.Errorf("history %v, want %v", actions, tt.want)
+			}
+			if last := history[len(history)-1]; !reflect.DeepEqual(paths(last.Changes), tt.changes) {
+				t.Errorf("latest version changed %v, want %v", paths(last.Changes), tt.changes)
+			}
+		})
+	}
+}
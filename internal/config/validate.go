@@ -0,0 +1,128 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalid wraps the errors of configs that don't parse or validate
+var ErrInvalid = errors.New("invalid config")
+
+// SOURCE_TYPES are the types of sources bivrost knows
+var SOURCE_TYPES = []string{"directory", "service", "module"}
+
+// compressions are the encodings of the IPC server, see ipc.ENCODING_*
+var compressions = []string{"zstd", "gzip"}
+
+// ValidationError is a setting that isn't valid
+type ValidationError struct {
+	Field   string `json:"field"` // Dotted path of the setting, ex: network.port
+	Message string `json:"message"`
+}
+
+// ValidationErrors are every invalid setting of a config
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalid, strings.Join(msgs, "; "))
+}
+
+func (v ValidationErrors) Unwrap() error {
+	return ErrInvalid
+}
+
+// Parse reads a config, as YAML or JSON. Unknown settings, and settings of the wrong type, are errors
+func Parse(data []byte) (*Cfg, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var cfg Cfg
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	return &cfg, nil
+}
+
+// Validate checks the settings of the config, and returns ValidationErrors if any are invalid
+func (c *Cfg) Validate() error {
+	var errs ValidationErrors
+	add := func(field, format string, a ...any) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, a...)})
+	}
+
+	names := make(map[string]bool)
+	for i, s := range c.Sources {
+		field := fmt.Sprintf("sources[%d]", i)
+		switch {
+		case s.Name == "":
+			add(field+".name", "is required")
+		case names[s.Name]:
+			add(field+".name", "%q is the name of another source", s.Name)
+		}
+		names[s.Name] = true
+		if !contains(SOURCE_TYPES, s.Type) {
+			add(field+".type", "%q is not one of %s", s.Type, strings.Join(SOURCE_TYPES, ", "))
+		}
+		if s.Type == "module" && strings.TrimSpace(s.Config) == "" {
+			add(field+".config", "modules need the path to their config")
+		}
+	}
+
+	if c.Network.Port < 0 || c.Network.Port > 65535 {
+		add("network.port", "%d is not a port", c.Network.Port)
+	}
+	nonNegative := map[string]int{
+		"network.read_timeout":   c.Network.ReadTimeout,
+		"network.write_timeout":  c.Network.WriteTimeout,
+		"network.live_buffer":    c.Network.LiveBuffer,
+		"ipc.heartbeat_interval": c.IPC.HeartbeatInterval,
+		"ipc.peer_timeout":       c.IPC.PeerTimeout,
+		"ipc.max_chunk_size":     c.IPC.MaxChunkSize,
+		"ipc.max_message_size":   c.IPC.MaxMessageSize,
+		"ipc.events.max_queue":   c.IPC.Events.MaxQueue,
+		"ipc.events.ack_timeout": c.IPC.Events.AckTimeout,
+		"export.ttl":             c.Export.TTL,
+		"export.concurrency":     c.Export.Concurrency,
+	}
+	for field, v := range nonNegative {
+		if v < 0 {
+			add(field, "must not be negative")
+		}
+	}
+	if c.IPC.HeartbeatInterval > 0 && c.IPC.PeerTimeout > 0 && c.IPC.PeerTimeout <= c.IPC.HeartbeatInterval {
+		add("ipc.peer_timeout", "must be longer than the heartbeat interval")
+	}
+	for _, comp := range c.IPC.Compression {
+		if !contains(compressions, comp) {
+			add("ipc.compression", "%q is not one of %s", comp, strings.Join(compressions, ", "))
+		}
+	}
+	tls := c.IPC.TLS
+	if tls.Listen != "" && (tls.Cert == "" || tls.Key == "" || tls.ClientCA == "") {
+		add("ipc.tls", "listen needs a cert, a key and a client_ca")
+	}
+
+	if len(errs) > 0 {
+		// Sorted by field, so the errors of a config are always the same
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return errs
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
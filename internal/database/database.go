@@ -128,6 +128,21 @@ func (s *DataStore[T]) AutoMigrate() error {
 // InsertLog inserts a log into the database
 func (s *DataStore[T]) InsertLog(log T) error {
 	result := s.db.Create(&log)
+	if result.Error == nil {
+		s.published([]T{log})
+	}
+	return result.Error
+}
+
+// InsertRows inserts the rows at once. Unlike InsertBulk, it returns when they are inserted
+func (s *DataStore[T]) InsertRows(rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	result := s.db.Create(&rows)
+	if result.Error == nil {
+		s.published(rows)
+	}
 	return result.Error
 }
 
@@ -135,6 +150,8 @@ func (s *DataStore[T]) insertBatch(batch []T) int {
 	result := s.db.Create(&batch)
 	if result.Error != nil {
 		ansi.PrintError("Failed to insert batch: " + result.Error.Error())
+	} else {
+		s.published(batch)
 	}
 
 	// result := s.db.FindInBatches(&batch, 10, func(tx *gorm.DB, batch int) error {
@@ -270,6 +287,14 @@ func (s *DataStore[T]) GetLogRangeFromID(from int) ([]T, error) {
 	return logs, result.Error
 }
 
+// GetLogPage returns at most limit logs with row ID greater than afterID, ordered by row ID.
+// Used to walk through a table page by page, with the ID of the last log as the cursor.
+func (s *DataStore[T]) GetLogPage(afterID int64, limit int) ([]T, error) {
+	var logs []T
+	result := s.db.Where("id > ?", afterID).Order("id").Limit(limit).Find(&logs)
+	return logs, result.Error
+}
+
 // GetEntriesByIP returns all logs with the given
 func (s *DataStore[T]) GetLogsByIP(ip string) ([]T, error) {
 	var entries []T
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EventSubscription is a module's subscription to a topic pattern
+type EventSubscription struct {
+	Identifier string `gorm:"primaryKey"`
+	Pattern    string `gorm:"primaryKey"`
+	CreatedAt  time.Time
+}
+
+func (EventSubscription) TableName() string {
+	return "event_subscriptions"
+}
+
+// QueuedEvent is an event waiting to be acknowledged by one subscription
+type QueuedEvent struct {
+	Identifier  string `gorm:"primaryKey"` // Identifier of the subscribed module
+	Pattern     string `gorm:"primaryKey"` // The subscription's pattern
+	EventID     uint64 `gorm:"primaryKey"`
+	Topic       string
+	Source      string
+	Payload     []byte
+	PublishedAt time.Time
+	Attempts    int // Deliveries so far
+}
+
+func (QueuedEvent) TableName() string {
+	return "event_queue"
+}
+
+// EventQueue stores the subscriptions of the event bus and the events waiting to be acknowledged,
+// so they survive a restart of bivrost
+type EventQueue struct {
+	db *gorm.DB
+}
+
+// NewEventQueue creates the event tables, if they don't exist
+func NewEventQueue(db *gorm.DB) (*EventQueue, error) {
+	if err := db.AutoMigrate(&EventSubscription{}, &QueuedEvent{}); err != nil {
+		return nil, err
+	}
+	return &EventQueue{db: db}, nil
+}
+
+// Load returns every subscription, and every queued event in the order they were published
+func (q *EventQueue) Load() ([]EventSubscription, []QueuedEvent, error) {
+	var subs []EventSubscription
+	if err := q.db.Order("created_at").Find(&subs).Error; err != nil {
+		return nil, nil, err
+	}
+	var events []QueuedEvent
+	if err := q.db.Order("event_id").Find(&events).Error; err != nil {
+		return nil, nil, err
+	}
+	return subs, events, nil
+}
+
+// LastEventID returns the highest event ID ever queued, so new IDs don't collide with queued ones
+func (q *EventQueue) LastEventID() (uint64, error) {
+	var id uint64
+	err := q.db.Model(&QueuedEvent{}).Select("COALESCE(MAX(event_id), 0)").Scan(&id).Error
+	return id, err
+}
+
+func (q *EventQueue) Subscribe(identifier, pattern string) error {
+	return q.db.Save(&EventSubscription{Identifier: identifier, Pattern: pattern, CreatedAt: time.Now()}).Error
+}
+
+// Unsubscribe removes the subscription, and the events queued for it
+func (q *EventQueue) Unsubscribe(identifier, pattern string) error {
+	return q.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&QueuedEvent{}, "identifier = ? AND pattern = ?", identifier, pattern).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&EventSubscription{}, "identifier = ? AND pattern = ?", identifier, pattern).Error
+	})
+}
+
+// Enqueue stores an event for each of the subscriptions it was published to, in a single transaction
+func (q *EventQueue) Enqueue(events []QueuedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return q.db.CreateInBatches(events, 100).Error
+}
+
+// Delivered records another delivery attempt of the event
+func (q *EventQueue) Delivered(identifier, pattern string, eventID uint64, attempts int) error {
+	return q.db.Model(&QueuedEvent{}).
+		Where("identifier = ? AND pattern = ? AND event_id = ?", identifier, pattern, eventID).
+		Update("attempts", attempts).Error
+}
+
+// Remove deletes an acknowledged (or dropped) event from the subscription's queue
+func (q *EventQueue) Remove(identifier, pattern string, eventID uint64) error {
+	return q.db.Delete(&QueuedEvent{}, "identifier = ? AND pattern = ? AND event_id = ?", identifier, pattern, eventID).Error
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Commit is a batch of rows committed to a table
+type Commit struct {
+	Table string
+	Rows  []map[string]any
+	Time  time.Time
+}
+
+// Feed publishes the rows committed to the stores, for live views of the data.
+// Rows are published as column name to value maps, as they're returned by QueryTable
+type Feed struct {
+	mu   sync.RWMutex
+	next uint64
+	subs map[uint64]func(Commit)
+}
+
+func NewFeed() *Feed {
+	return &Feed{subs: make(map[uint64]func(Commit))}
+}
+
+// Subscribe calls fn with every commit, until cancel is called.
+// fn is called on the goroutine that committed the rows, so it must not block
+func (f *Feed) Subscribe(fn func(Commit)) (cancel func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.next
+	f.next++
+	f.subs[id] = fn
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subs, id)
+	}
+}
+
+// active reports whether anyone is subscribed, so rows aren't converted for nobody
+func (f *Feed) active() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.subs) > 0
+}
+
+// Publish calls the subscribers with the commit
+func (f *Feed) Publish(c Commit) {
+	if len(c.Rows) == 0 {
+		return
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, fn := range f.subs {
+		fn(c)
+	}
+}
+
+// SetFeed publishes the rows inserted into the store on the feed
+func (s *DataStore[T]) SetFeed(f *Feed) {
+	s.feed = f
+}
+
+// published publishes inserted models on the store's feed
+func (s *DataStore[T]) published(inserted []T) {
+	if !s.feed.active() {
+		return
+	}
+	rows := make([]map[string]any, 0, len(inserted))
+	for i := range inserted {
+		row, err := columnMap(s.db, &inserted[i])
+		if err != nil {
+			return
+		}
+		rows = append(rows, row)
+	}
+	s.feed.Publish(Commit{Table: s.name, Rows: rows, Time: time.Now()})
+}
+
+// columnMap converts a model to a column name to value map
+func columnMap(db *gorm.DB, model any) (map[string]any, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	v := reflect.Indirect(reflect.ValueOf(model))
+	row := make(map[string]any, len(stmt.Schema.Fields))
+	for _, f := range stmt.Schema.Fields {
+		if f.DBName == "" {
+			continue
+		}
+		value, _ := f.ValueOf(context.Background(), v)
+		if d, ok := value.(gorm.DeletedAt); ok && !d.Valid {
+			value = nil
+		}
+		row[f.DBName] = value
+	}
+	return row, nil
+}
+
+// SetFeed publishes the rows inserted into the module tables on the feed
+func (t *ModuleTables) SetFeed(f *Feed) {
+	t.feed = f
+}
@@ -42,3 +42,26 @@ const (
 	// We'll add more model names here as well if neccessary. This is useful for being able to reference the model names with . notation
 	// (e.g. models.NGINX_LOGS, models.SYN_TRAFFIC, etc. providing autocomplete support)
 )
+
+// TableNames returns the names of the tables modules can use
+func TableNames() []string {
+	return []string{
+		NGINX_LOGS,
+		SYN_TRAFFIC,
+		ATTACK_TYPE,
+		INDICATORS_LOG,
+		GEO_LOCATION_DATA,
+		GEO_DATA,
+		THREAT_RECORDS,
+	}
+}
+
+// IsTable reports whether name is one of TableNames
+func IsTable(name string) bool {
+	for _, t := range TableNames() {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+// Field types of a module table
+const (
+	FIELD_STRING = wire.FIELD_STRING
+	FIELD_INT    = wire.FIELD_INT
+	FIELD_FLOAT  = wire.FIELD_FLOAT
+	FIELD_BOOL   = wire.FIELD_BOOL
+	FIELD_TIME   = wire.FIELD_TIME
+	FIELD_JSON   = wire.FIELD_JSON
+)
+
+// MODULE_TABLE_PREFIX is the prefix of every module table
+const MODULE_TABLE_PREFIX = "mod_"
+
+// Modules declare the schemas of their result tables in their manifest or IPC handshake, see pkg/wire
+type (
+	TableSchema = wire.TableSchema
+	FieldSchema = wire.FieldSchema
+	IndexSchema = wire.IndexSchema
+)
+
+func IsFieldType(t string) bool {
+	return wire.IsFieldType(t)
+}
+
+var upperIdentifier = regexp.MustCompile(`^[A-Z0-9]+$`)
+
+// ModuleTableName returns the namespaced name of a module's table, ex: mod_thri_detections.
+// SQLite table names are case insensitive, so only identifiers in upper case (the convention) are used as is.
+// Other identifiers are hex encoded, ex: mod_x74687269_detections for thri, so no two modules share a table.
+func ModuleTableName(identifier, table string) string {
+	namespace := strings.ToLower(identifier)
+	if !upperIdentifier.MatchString(identifier) {
+		namespace = "x" + hex.EncodeToString([]byte(identifier))
+	}
+	return MODULE_TABLE_PREFIX + namespace + "_" + table
+}
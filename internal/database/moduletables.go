@@ -0,0 +1,269 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/database/models"
+	"github.com/pynezz/pynezzentials/ansi"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidRow is returned by Insert when a row doesn't match the table's schema
+var ErrInvalidRow = errors.New("row does not match the schema")
+
+// moduleSchema is a row of the module_schemas table
+type moduleSchema struct {
+	Table      string `gorm:"primaryKey"`
+	Identifier string
+	Schema     string // JSON encoded models.TableSchema
+	UpdatedAt  time.Time
+}
+
+func (moduleSchema) TableName() string {
+	return "module_schemas"
+}
+
+// sqlTypes maps field types to SQLite column types
+var sqlTypes = map[string]string{
+	models.FIELD_STRING: "TEXT",
+	models.FIELD_INT:    "INTEGER",
+	models.FIELD_FLOAT:  "REAL",
+	models.FIELD_BOOL:   "BOOLEAN",
+	models.FIELD_TIME:   "DATETIME",
+	models.FIELD_JSON:   "TEXT",
+}
+
+// ModuleTables creates the tables declared by modules, and inserts rows into them.
+// Migrations only add new (nullable) columns and indexes. Removed fields are kept, and type changes are refused.
+// The latest schema of every table is kept in module_schemas
+type ModuleTables struct {
+	db *gorm.DB
+
+	mu      sync.RWMutex
+	schemas map[string]models.TableSchema // Keyed by the namespaced table name
+
+	feed *Feed // Inserted rows are published on it, if set
+}
+
+// NewModuleTables loads the schemas of the module tables that already exist in the database
+func NewModuleTables(db *gorm.DB) (*ModuleTables, error) {
+	if err := db.AutoMigrate(&moduleSchema{}); err != nil {
+		return nil, err
+	}
+
+	var rows []moduleSchema
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	t := &ModuleTables{db: db, schemas: make(map[string]models.TableSchema)}
+	for _, row := range rows {
+		var schema models.TableSchema
+		if err := json.Unmarshal([]byte(row.Schema), &schema); err != nil {
+			return nil, fmt.Errorf("stored schema of %s is corrupt: %w", row.Table, err)
+		}
+		t.schemas[row.Table] = schema
+	}
+	return t, nil
+}
+
+// Register creates the module's table, or migrates it to the schema. Returns the namespaced table name.
+func (t *ModuleTables) Register(identifier string, schema models.TableSchema) (string, error) {
+	if err := schema.Validate(); err != nil {
+		return "", err
+	}
+	table := models.ModuleTableName(identifier, schema.Name)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, exists := t.schemas[table]
+	encoded, err := json.Marshal(schema)
+	if err != nil {
+		return "", err
+	}
+	err = t.db.Transaction(func(tx *gorm.DB) error {
+		if err := migrate(tx, table, schema); err != nil {
+			return err
+		}
+		return tx.Save(&moduleSchema{Table: table, Identifier: identifier, Schema: string(encoded), UpdatedAt: time.Now()}).Error
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to migrate %s: %w", table, err)
+	}
+
+	// Fields removed from the schema are still in the table, but are no longer accepted
+	t.schemas[table] = schema
+	if !exists {
+		ansi.PrintSuccess("Created module table " + table)
+	}
+	return table, nil
+}
+
+// migrate creates the table, and adds the columns and indexes it's missing
+func migrate(tx *gorm.DB, table string, schema models.TableSchema) error {
+	create := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %q (id INTEGER PRIMARY KEY AUTOINCREMENT, created_at DATETIME NOT NULL)`, table)
+	if err := tx.Exec(create).Error; err != nil {
+		return err
+	}
+
+	columns, err := tx.Migrator().ColumnTypes(table)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]string) // Column name -> SQL type
+	for _, c := range columns {
+		existing[c.Name()] = strings.ToUpper(c.DatabaseTypeName())
+	}
+	for _, f := range schema.Fields {
+		if sqlType, ok := existing[f.Name]; ok {
+			if sqlType != sqlTypes[f.Type] {
+				return fmt.Errorf("field %s is stored as %s, changing its type to %s is not supported", f.Name, sqlType, f.Type)
+			}
+			continue
+		}
+		// Required is enforced on insert, so columns can be added to tables that already have rows
+		if err := tx.Exec(fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %q %s`, table, f.Name, sqlTypes[f.Type])).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, idx := range schema.Indexes {
+		name := "idx_" + table + "_" + strings.Join(idx.Fields, "_")
+		quoted := make([]string, len(idx.Fields))
+		for i, f := range idx.Fields {
+			quoted[i] = fmt.Sprintf("%q", f)
+		}
+		unique := ""
+		if idx.Unique {
+			unique = "UNIQUE "
+		}
+		stmt := fmt.Sprintf(`CREATE %sINDEX IF NOT EXISTS %q ON %q (%s)`, unique, name, table, strings.Join(quoted, ", "))
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schema returns the schema of the namespaced table
+func (t *ModuleTables) Schema(table string) (models.TableSchema, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s, ok := t.schemas[table]
+	return s, ok
+}
+
+// Tables returns the namespaced names of every module table, sorted
+func (t *ModuleTables) Tables() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.schemas))
+	for name := range t.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Insert checks the rows against the table's schema, and inserts them in a single transaction
+func (t *ModuleTables) Insert(table string, rows []map[string]any) error {
+	schema, ok := t.Schema(table)
+	if !ok {
+		return fmt.Errorf("unknown module table %s", table)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	values := make([]map[string]any, len(rows))
+	for i, row := range rows {
+		v, err := convertRow(schema, row)
+		if err != nil {
+			return fmt.Errorf("%w: row %d: %v", ErrInvalidRow, i, err)
+		}
+		v["created_at"] = now
+		values[i] = v
+	}
+	if !t.feed.active() {
+		return t.db.Table(table).CreateInBatches(values, 100).Error
+	}
+
+	// The ids aren't set in the maps, so the inserted rows are read back to publish them
+	var inserted []map[string]any
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		var last int64
+		if err := tx.Table(table).Select("COALESCE(MAX(id), 0)").Scan(&last).Error; err != nil {
+			return err
+		}
+		if err := tx.Table(table).CreateInBatches(values, 100).Error; err != nil {
+			return err
+		}
+		return tx.Table(table).Where("id > ?", last).Order("id").Find(&inserted).Error
+	})
+	if err == nil {
+		t.feed.Publish(Commit{Table: table, Rows: inserted, Time: now})
+	}
+	return err
+}
+
+// convertRow converts the decoded JSON values to the column types
+func convertRow(schema models.TableSchema, row map[string]any) (map[string]any, error) {
+	out := make(map[string]any, len(row)+1)
+	for name, value := range row {
+		f, ok := schema.Field(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s", name)
+		}
+		if value == nil {
+			continue
+		}
+		v, err := convertValue(f.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", name, err)
+		}
+		out[name] = v
+	}
+	for _, f := range schema.Fields {
+		if _, ok := out[f.Name]; f.Required && !ok {
+			return nil, fmt.Errorf("missing required field %s", f.Name)
+		}
+	}
+	return out, nil
+}
+
+func convertValue(fieldType string, value any) (any, error) {
+	switch fieldType {
+	case models.FIELD_STRING:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case models.FIELD_INT:
+		if n, ok := value.(float64); ok && n == math.Trunc(n) && math.Abs(n) <= 1<<53 {
+			return int64(n), nil
+		}
+	case models.FIELD_FLOAT:
+		if n, ok := value.(float64); ok {
+			return n, nil
+		}
+	case models.FIELD_BOOL:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case models.FIELD_TIME:
+		if s, ok := value.(string); ok {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+	case models.FIELD_JSON:
+		b, err := json.Marshal(value)
+		return string(b), err
+	}
+	return nil, fmt.Errorf("expected a %s, got %T", fieldType, value)
+}
@@ -0,0 +1,387 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidQuery is returned when a query refers to unknown columns, or has malformed values
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrUnknownTable is returned when querying a table that isn't in a store
+	ErrUnknownTable = errors.New("unknown table")
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 100
+	MAX_PAGE_SIZE     = 1000
+
+	TIME_COLUMN = "created_at" // Since and Until apply to it
+)
+
+// Filter operators
+const (
+	OP_EQ   = "eq"
+	OP_NE   = "ne"
+	OP_LT   = "lt"
+	OP_LTE  = "lte"
+	OP_GT   = "gt"
+	OP_GTE  = "gte"
+	OP_LIKE = "like" // Contains, case insensitive. % and _ are wildcards
+	OP_IN   = "in"   // One of the comma separated values
+)
+
+var sqlOps = map[string]string{
+	OP_EQ:  "=",
+	OP_NE:  "<>",
+	OP_LT:  "<",
+	OP_LTE: "<=",
+	OP_GT:  ">",
+	OP_GTE: ">=",
+}
+
+// Filter compares a column to a value
+type Filter struct {
+	Column string
+	Op     string
+	Value  string
+}
+
+// Query selects a page of rows from a table
+type Query struct {
+	Filters []Filter
+	Since   time.Time // Rows created at or after, if set
+	Until   time.Time // Rows created before, if set
+	Sort    string    // Column to sort by, defaults to id
+	Desc    bool
+	Cursor  string   // From the previous Page, empty for the first page
+	Limit   int      // Defaults to DEFAULT_PAGE_SIZE, at most MAX_PAGE_SIZE
+	Columns []string // Columns to select, all if empty. The id and sort columns are always selected, for the cursor
+}
+
+// Page is a page of rows. NextCursor is empty on the last page
+type Page struct {
+	Rows       []map[string]any `json:"data"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	Columns    []Column         `json:"-"` // The columns selected by the query, in order
+}
+
+// Column is a column of a table, with its database type
+type Column struct {
+	Name string
+	Type string // Upper case, ex: TEXT, INTEGER, DATETIME
+}
+
+// cursor is the position after the last row of a page, its sort value and id.
+// The next page starts after it, so rows inserted in the meantime don't shift the pages
+type cursor struct {
+	Value any    `json:"v"`
+	Time  bool   `json:"t,omitempty"` // Value is a time, which is compared as a time rather than as its JSON string
+	ID    int64  `json:"id"`
+	Sort  string `json:"s"` // The cursor is only valid with the same sort
+	Desc  bool   `json:"d,omitempty"`
+}
+
+func invalid(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidQuery, fmt.Sprintf(format, a...))
+}
+
+// Columns returns the columns of the table, in the order of the table
+func Columns(db *gorm.DB, table string) ([]Column, error) {
+	types, err := db.Migrator().ColumnTypes(table)
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]Column, 0, len(types))
+	for _, t := range types {
+		columns = append(columns, Column{Name: t.Name(), Type: strings.ToUpper(t.DatabaseTypeName())})
+	}
+	return columns, nil
+}
+
+// columnTypes returns the types of the table's columns, keyed by name
+func columnTypes(db *gorm.DB, table string) ([]Column, map[string]string, error) {
+	if !db.Migrator().HasTable(table) { // sqlite fails to read the columns of a missing table, rather than returning none
+		return nil, nil, fmt.Errorf("%w %s", ErrUnknownTable, table)
+	}
+	list, err := Columns(db, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil, fmt.Errorf("%w %s", ErrUnknownTable, table)
+	}
+	types := make(map[string]string, len(list))
+	for _, c := range list {
+		types[c.Name] = c.Type
+	}
+	return list, types, nil
+}
+
+// QueryTable returns a page of the rows of the table that match the query, as column name to value maps.
+// Every table, including the module tables, is read the same way
+func QueryTable(db *gorm.DB, table string, q Query) (*Page, error) {
+	list, columns, err := columnTypes(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := db.Table(table)
+	if _, ok := columns["deleted_at"]; ok { // Soft deleted by gorm
+		tx = tx.Where("deleted_at IS NULL")
+	}
+	for _, f := range q.Filters {
+		if tx, err = filter(tx, columns, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		if _, ok := columns[TIME_COLUMN]; !ok {
+			return nil, invalid("table %s has no %s column to filter by time", table, TIME_COLUMN)
+		}
+		if !q.Since.IsZero() {
+			tx = tx.Where(TIME_COLUMN+" >= ?", q.Since)
+		}
+		if !q.Until.IsZero() {
+			tx = tx.Where(TIME_COLUMN+" < ?", q.Until)
+		}
+	}
+
+	if q.Sort == "" {
+		q.Sort = "id"
+	}
+	if _, ok := columns[q.Sort]; !ok {
+		return nil, invalid("unknown column %s to sort by", q.Sort)
+	}
+	if q.Cursor != "" {
+		if tx, err = after(tx, q); err != nil {
+			return nil, err
+		}
+	}
+
+	selected := list
+	if len(q.Columns) > 0 {
+		selected = make([]Column, 0, len(q.Columns))
+		sel := []string{"id"}
+		for _, name := range q.Columns {
+			t, ok := columns[name]
+			if !ok {
+				return nil, invalid("unknown column %s to select", name)
+			}
+			selected = append(selected, Column{Name: name, Type: t})
+			sel = append(sel, name)
+		}
+		tx = tx.Select(append(sel, q.Sort)) // Names were checked against the table, and are quoted by gorm
+	}
+	order := " ASC"
+	if q.Desc {
+		order = " DESC"
+	}
+	tx = tx.Order(quote(q.Sort) + order)
+	if q.Sort != "id" {
+		tx = tx.Order("id" + order) // Ties are broken by id, for the cursor
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DEFAULT_PAGE_SIZE
+	}
+	if q.Limit > MAX_PAGE_SIZE {
+		q.Limit = MAX_PAGE_SIZE
+	}
+	rows := []map[string]any{}
+	if err := tx.Limit(q.Limit + 1).Find(&rows).Error; err != nil { // One more, to know if there's a next page
+		return nil, err
+	}
+
+	page := &Page{Rows: rows, Columns: selected}
+	if len(rows) > q.Limit {
+		page.Rows = rows[:q.Limit]
+		page.NextCursor, err = encodeCursor(page.Rows[q.Limit-1], q)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// FetchRow returns the row of the table with the id, or gorm.ErrRecordNotFound
+func FetchRow(db *gorm.DB, table string, id int64) (map[string]any, error) {
+	_, columns, err := columnTypes(db, table)
+	if err != nil {
+		return nil, err
+	}
+	tx := db.Table(table).Where("id = ?", id)
+	if _, ok := columns["deleted_at"]; ok {
+		tx = tx.Where("deleted_at IS NULL")
+	}
+	rows := []map[string]any{}
+	if err := tx.Limit(1).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return rows[0], nil
+}
+
+// quote quotes a column name, which has been checked against the table's columns
+func quote(column string) string {
+	return `"` + column + `"`
+}
+
+func filter(tx *gorm.DB, columns map[string]string, f Filter) (*gorm.DB, error) {
+	sqlType, ok := columns[f.Column]
+	if !ok {
+		return nil, invalid("unknown column %s", f.Column)
+	}
+	if f.Op == "" {
+		f.Op = OP_EQ
+	}
+
+	switch f.Op {
+	case OP_LIKE:
+		pattern := f.Value
+		if !strings.ContainsAny(pattern, "%_") {
+			pattern = "%" + pattern + "%"
+		}
+		return tx.Where(quote(f.Column)+" LIKE ?", pattern), nil
+	case OP_IN:
+		var values []any
+		for _, v := range strings.Split(f.Value, ",") {
+			value, err := columnValue(sqlType, strings.TrimSpace(v))
+			if err != nil {
+				return nil, invalid("%s: %v", f.Column, err)
+			}
+			values = append(values, value)
+		}
+		return tx.Where(quote(f.Column)+" IN ?", values), nil
+	}
+
+	op, ok := sqlOps[f.Op]
+	if !ok {
+		return nil, invalid("unknown operator %s, expected eq, ne, lt, lte, gt, gte, like or in", f.Op)
+	}
+	value, err := columnValue(sqlType, f.Value)
+	if err != nil {
+		return nil, invalid("%s: %v", f.Column, err)
+	}
+	return tx.Where(quote(f.Column)+" "+op+" ?", value), nil
+}
+
+// columnValue converts a value from a query string to the type of the column, so it compares as stored
+func columnValue(sqlType, value string) (any, error) {
+	switch sqlType {
+	case "DATETIME":
+		return time.Parse(time.RFC3339Nano, value)
+	case "BOOLEAN", "NUMERIC":
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+// after continues from the cursor: rows after the cursor's in the sort order, where NULLs come first
+func after(tx *gorm.DB, q Query) (*gorm.DB, error) {
+	c, err := decodeCursor(q.Cursor)
+	if err != nil || c.Sort != q.Sort || c.Desc != q.Desc {
+		return nil, invalid("the cursor is malformed, or from a query sorted differently")
+	}
+	col := quote(q.Sort)
+	if q.Sort == "id" {
+		if q.Desc {
+			return tx.Where("id < ?", c.ID), nil
+		}
+		return tx.Where("id > ?", c.ID), nil
+	}
+
+	switch {
+	case c.Value == nil && !q.Desc:
+		return tx.Where("("+col+" IS NULL AND id > ? OR "+col+" IS NOT NULL)", c.ID), nil
+	case c.Value == nil:
+		return tx.Where(col+" IS NULL AND id < ?", c.ID), nil
+	case !q.Desc:
+		return tx.Where("("+col+" > ? OR "+col+" = ? AND id > ?)", c.Value, c.Value, c.ID), nil
+	default:
+		return tx.Where("("+col+" < ? OR "+col+" = ? AND id < ? OR "+col+" IS NULL)", c.Value, c.Value, c.ID), nil
+	}
+}
+
+func encodeCursor(row map[string]any, q Query) (string, error) {
+	c := cursor{Value: row[q.Sort], Sort: q.Sort, Desc: q.Desc}
+	id, err := toInt64(row["id"])
+	if err != nil {
+		return "", err
+	}
+	c.ID = id
+	if t, ok := c.Value.(time.Time); ok {
+		c.Time = true
+		c.Value = t.Format(time.RFC3339Nano)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+	if s, ok := c.Value.(string); ok && c.Time {
+		c.Value, err = time.Parse(time.RFC3339Nano, s)
+	}
+	return c, err
+}
+
+func toInt64(v any) (int64, error) {
+	switch n := v.(type) {
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	case uint:
+		return int64(n), nil
+	case float64:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("the table has no integer id column")
+}
+
+// Query returns a page of the rows of the store's table, see QueryTable
+func (s *DataStore[T]) Query(q Query) (*Page, error) {
+	return QueryTable(s.db, s.name, q)
+}
+
+// Row returns the row of the store's table with the id, see FetchRow
+func (s *DataStore[T]) Row(id int64) (map[string]any, error) {
+	return FetchRow(s.db, s.name, id)
+}
+
+// Query returns a page of the rows of the module table, see QueryTable
+func (t *ModuleTables) Query(table string, q Query) (*Page, error) {
+	if _, ok := t.Schema(table); !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownTable, table)
+	}
+	return QueryTable(t.db, table, q)
+}
+
+// Row returns the row of the module table with the id, see FetchRow
+func (t *ModuleTables) Row(table string, id int64) (map[string]any, error) {
+	if _, ok := t.Schema(table); !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownTable, table)
+	}
+	return FetchRow(t.db, table, id)
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type testRequest struct {
+	ID         int64 `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	RemoteAddr string
+	Status     int
+	Request    string
+	Referrer   *string
+}
+
+var epoch = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+// testRequests returns a database in a temporary directory with a table of 10 requests, an hour apart
+func testRequests(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "query.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&testRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	referrer := "http://example.com/"
+	for i := 1; i <= 10; i++ {
+		r := testRequest{
+			ID:         int64(i),
+			CreatedAt:  epoch.Add(time.Duration(i) * time.Hour),
+			RemoteAddr: []string{"10.0.0.1", "10.0.0.2"}[i%2],
+			Status:     []int{200, 404, 401, 403, 500}[i%5],
+			Request:    []string{"GET /", "POST /wp-login.php"}[i%2],
+		}
+		if i%3 == 0 {
+			r.Referrer = &referrer
+		}
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// ids returns the ids of the rows, in order
+func ids(t *testing.T, rows []map[string]any) []int64 {
+	t.Helper()
+	list := []int64{}
+	for _, row := range rows {
+		id, err := toInt64(row["id"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, id)
+	}
+	return list
+}
+
+func TestQueryTable(t *testing.T) {
+	db := testRequests(t)
+	tests := []struct {
+		name    string
+		q       Query
+		want    []int64
+		wantErr error
+	}{
+		{"all, by id", Query{}, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, nil},
+		{"equals", Query{Filters: []Filter{{Column: "remote_addr", Value: "10.0.0.1"}}}, []int64{2, 4, 6, 8, 10}, nil},
+		{"compared as a number", Query{Filters: []Filter{{Column: "status", Op: OP_GTE, Value: "403"}}}, []int64{1, 3, 4, 6, 8, 9}, nil},
+		{"contains", Query{Filters: []Filter{{Column: "request", Op: OP_LIKE, Value: "WP-LOGIN"}}}, []int64{1, 3, 5, 7, 9}, nil},
+		{"one of", Query{Filters: []Filter{{Column: "status", Op: OP_IN, Value: "401, 403"}}}, []int64{2, 3, 7, 8}, nil},
+		{"filters combined", Query{Filters: []Filter{{Column: "status", Op: OP_NE, Value: "200"}, {Column: "remote_addr", Value: "10.0.0.2"}}}, []int64{1, 3, 7, 9}, nil},
+		{"time range", Query{Since: epoch.Add(3 * time.Hour), Until: epoch.Add(6 * time.Hour)}, []int64{3, 4, 5}, nil},
+		{"sorted descending, ties by id", Query{Sort: "status", Desc: true, Limit: 4}, []int64{9, 4, 6, 1}, nil},
+		{"columns", Query{Columns: []string{"status"}, Limit: 1}, []int64{1}, nil},
+		{"unknown column", Query{Filters: []Filter{{Column: "nope", Value: "1"}}}, nil, ErrInvalidQuery},
+		{"unknown operator", Query{Filters: []Filter{{Column: "status", Op: "regex", Value: "1"}}}, nil, ErrInvalidQuery},
+		{"unknown sort column", Query{Sort: "nope"}, nil, ErrInvalidQuery},
+		{"unknown selected column", Query{Columns: []string{"nope"}}, nil, ErrInvalidQuery},
+		{"malformed cursor", Query{Cursor: "not a cursor"}, nil, ErrInvalidQuery},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := QueryTable(db, "test_requests", tt.q)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(t, page.Rows); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got rows %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := QueryTable(db, "nope", Query{}); !errors.Is(err, ErrUnknownTable) {
+		t.Errorf("unknown table: got %v, want %v", err, ErrUnknownTable)
+	}
+}
+
+// Walking the pages with the cursor returns every row once, in the sort order, whatever is inserted meanwhile
+func TestQueryTablePages(t *testing.T) {
+	tests := []struct {
+		name string
+		q    Query
+		want []int64
+	}{
+		{"by id", Query{}, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"by id, descending", Query{Desc: true}, []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{"by a time", Query{Sort: "created_at", Desc: true}, []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{"with ties", Query{Sort: "status"}, []int64{5, 10, 2, 7, 3, 8, 1, 6, 4, 9}},
+		{"with NULLs first", Query{Sort: "referrer"}, []int64{1, 2, 4, 5, 7, 8, 10, 3, 6, 9}},
+		{"with NULLs last, descending", Query{Sort: "referrer", Desc: true}, []int64{9, 6, 3, 10, 8, 7, 5, 4, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testRequests(t)
+			q := tt.q
+			q.Limit = 3
+			got := []int64{}
+			for pages := 0; ; pages++ {
+				if pages > len(tt.want) {
+					t.Fatal("the pages don't end")
+				}
+				page, err := QueryTable(db, "test_requests", q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, ids(t, page.Rows)...)
+				if page.NextCursor == "" {
+					break
+				}
+				q.Cursor = page.NextCursor
+				if pages == 0 { // A row inserted while walking the pages doesn't shift them
+					if err := db.Create(&testRequest{ID: 100, CreatedAt: epoch}).Error; err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			walked := []int64{}
+			for _, id := range got {
+				if id != 100 {
+					walked = append(walked, id)
+				}
+			}
+			if !reflect.DeepEqual(walked, tt.want) || len(got)-len(walked) > 1 {
+				t.Errorf("got rows %v, want %v and at most once the row inserted meanwhile", got, tt.want)
+			}
+
+			sorted := q
+			sorted.Sort, sorted.Desc = "status", !tt.q.Desc
+			if _, err := QueryTable(db, "test_requests", sorted); !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("cursor of another sort: got %v, want %v", err, ErrInvalidQuery)
+			}
+		})
+	}
+}
+
+func TestFetchRow(t *testing.T) {
+	db := testRequests(t)
+	row, err := FetchRow(db, "test_requests", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row["remote_addr"] != "10.0.0.2" || row["referrer"] != "http://example.com/" {
+		t.Errorf("got row %v", row)
+	}
+	if _, err := FetchRow(db, "test_requests", 42); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("missing row: got %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	if _, err := FetchRow(db, "nope", 1); !errors.Is(err, ErrUnknownTable) {
+		t.Errorf("unknown table: got %v, want %v", err, ErrUnknownTable)
+	}
+}
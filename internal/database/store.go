@@ -32,6 +32,7 @@ type DataStore[StoreType any] struct {
 	name string
 	db   *gorm.DB
 	Type StoreType // ? Is this beneficial?
+	feed *Feed     // Inserted rows are published on it, if set
 }
 
 // The stores map is a map of store names to their respective DataStore
@@ -2,6 +2,7 @@ package stores
 
 import (
 	"fmt"
+	"strings"
 
 	"gorm.io/gorm"
 
@@ -20,6 +21,10 @@ type Stores struct {
 	GeoDataStore         *database.DataStore[models.GeoData]
 	ThreatRecordStore    *database.DataStore[models.ThreatRecord]
 
+	ModuleTables *database.ModuleTables // Tables declared by the modules themselves
+	EventQueue   *database.EventQueue   // Subscriptions and undelivered events of the module event bus
+	Feed         *database.Feed         // Rows inserted into any of the stores are published on it
+
 	// Add more stores here if neccessary
 	// One store per model (/ table in the/a database)
 }
@@ -141,12 +146,40 @@ func Get(storeName string) *Stores {
 	return StoreMap[storeName]
 }
 
+// New creates every store on the logs and results databases, which must have been migrated (see database.InitDB).
+// Unlike ImportAndInit, the stores aren't added to the StoreMap.
+func New(logDB, resultsDB *gorm.DB) (*Stores, error) {
+	s, err := new(logDB, resultsDB)
+	if err != nil {
+		return nil, err
+	}
+	s.ModuleTables, err = database.NewModuleTables(resultsDB)
+	if err != nil {
+		return nil, err
+	}
+	s.EventQueue, err = database.NewEventQueue(resultsDB)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Feed = database.NewFeed()
+	s.NginxLogStore.SetFeed(s.Feed)
+	s.SynTrafficStore.SetFeed(s.Feed)
+	s.AttackTypeStore.SetFeed(s.Feed)
+	s.IndicatorsLogStore.SetFeed(s.Feed)
+	s.GeoLocationDataStore.SetFeed(s.Feed)
+	s.GeoDataStore.SetFeed(s.Feed)
+	s.ThreatRecordStore.SetFeed(s.Feed)
+	s.ModuleTables.SetFeed(s.Feed)
+	return s, nil
+}
+
 func ImportAndInit(conf gorm.Config) (*Stores, error) {
 	initMap()
 	logdb, _ := database.InitDB("logs.db", conf, models.NginxLog{})
 	modulesdb, _ := database.InitDB("results.db", conf, models.GetModuleModels()...)
 
-	s, err := new(logdb, modulesdb)
+	s, err := New(logdb, modulesdb)
 	if err != nil {
 		return nil, err
 	}
@@ -178,3 +211,60 @@ func Use(store string) (*Stores, error) {
 	}
 	return StoreMap[store], nil
 }
+
+// Tables returns the tables that can be queried: the tables of the stores, then the module tables
+func (s *Stores) Tables() []string {
+	tables := []string{NGINX_LOGS, SYN_TRAFFIC, ATTACK_TYPE, INDICATORS_LOG, GEO_LOCATION_DATA, GEO_DATA, THREAT_RECORDS}
+	if s.ModuleTables != nil {
+		tables = append(tables, s.ModuleTables.Tables()...)
+	}
+	return tables
+}
+
+// Query returns a page of the rows of the table, see database.QueryTable
+func (s *Stores) Query(table string, q database.Query) (*database.Page, error) {
+	switch table {
+	case NGINX_LOGS:
+		return s.NginxLogStore.Query(q)
+	case SYN_TRAFFIC:
+		return s.SynTrafficStore.Query(q)
+	case ATTACK_TYPE:
+		return s.AttackTypeStore.Query(q)
+	case INDICATORS_LOG:
+		return s.IndicatorsLogStore.Query(q)
+	case GEO_LOCATION_DATA:
+		return s.GeoLocationDataStore.Query(q)
+	case GEO_DATA:
+		return s.GeoDataStore.Query(q)
+	case THREAT_RECORDS:
+		return s.ThreatRecordStore.Query(q)
+	}
+	if s.ModuleTables != nil && strings.HasPrefix(table, models.MODULE_TABLE_PREFIX) {
+		return s.ModuleTables.Query(table, q)
+	}
+	return nil, fmt.Errorf("%w %s", database.ErrUnknownTable, table)
+}
+
+// Row returns the row of the table with the id, see database.FetchRow
+func (s *Stores) Row(table string, id int64) (map[string]any, error) {
+	switch table {
+	case NGINX_LOGS:
+		return s.NginxLogStore.Row(id)
+	case SYN_TRAFFIC:
+		return s.SynTrafficStore.Row(id)
+	case ATTACK_TYPE:
+		return s.AttackTypeStore.Row(id)
+	case INDICATORS_LOG:
+		return s.IndicatorsLogStore.Row(id)
+	case GEO_LOCATION_DATA:
+		return s.GeoLocationDataStore.Row(id)
+	case GEO_DATA:
+		return s.GeoDataStore.Row(id)
+	case THREAT_RECORDS:
+		return s.ThreatRecordStore.Row(id)
+	}
+	if s.ModuleTables != nil && strings.HasPrefix(table, models.MODULE_TABLE_PREFIX) {
+		return s.ModuleTables.Row(table, id)
+	}
+	return nil, fmt.Errorf("%w %s", database.ErrUnknownTable, table)
+}
@@ -0,0 +1,322 @@
+// Package export writes query results as CSV, NDJSON or Parquet, for notebooks and spreadsheets
+package export
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/pynezz/bivrost/internal/database"
+)
+
+const (
+	FORMAT_CSV     = "csv"
+	FORMAT_NDJSON  = "ndjson"
+	FORMAT_PARQUET = "parquet"
+
+	ROW_GROUP_SIZE = 10000 // Rows buffered by the Parquet writer
+)
+
+// Source is what rows are exported from, ex: stores.Stores
+type Source interface {
+	Query(table string, q database.Query) (*database.Page, error)
+}
+
+// Options of an export
+type Options struct {
+	Format string
+	Gzip   bool // Compresses the whole file for CSV and NDJSON, and every column with gzip rather than snappy for Parquet
+}
+
+// Validate checks the format
+func (o Options) Validate() error {
+	switch o.Format {
+	case FORMAT_CSV, FORMAT_NDJSON, FORMAT_PARQUET:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, expected csv, ndjson or parquet", o.Format)
+}
+
+// ContentType is the MIME type of the export
+func (o Options) ContentType() string {
+	switch {
+	case o.Gzip && o.Format != FORMAT_PARQUET:
+		return "application/gzip"
+	case o.Format == FORMAT_CSV:
+		return "text/csv; charset=utf-8"
+	case o.Format == FORMAT_NDJSON:
+		return "application/x-ndjson"
+	}
+	return "application/vnd.apache.parquet"
+}
+
+// Filename is the name of the exported file for the table
+func (o Options) Filename(table string) string {
+	name := table + "." + o.Format
+	if o.Gzip && o.Format != FORMAT_PARQUET {
+		name += ".gz"
+	}
+	return name
+}
+
+// rowWriter writes rows in one of the formats
+type rowWriter interface {
+	Write(row map[string]any) error
+	Close() error // Flushes the rows, but doesn't close the underlying writer
+}
+
+// Export writes every row of the table that matches the query to w, and returns the number of rows written.
+// progress, if not nil, is called with the running count after every page. The query's cursor and limit are ignored.
+// The table is walked a page at a time, and every page is written before the next is read, so an export never holds
+// more than a page of rows in memory, or a row group for Parquet (see ROW_GROUP_SIZE).
+func Export(ctx context.Context, src Source, table string, q database.Query, opts Options, w io.Writer, progress func(rows int64)) (int64, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+	q.Cursor = ""
+	q.Limit = database.MAX_PAGE_SIZE
+
+	var count int64
+	var rw rowWriter
+	var gz *gzip.Writer
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		page, err := src.Query(table, q)
+		if err != nil {
+			return count, err
+		}
+
+		if rw == nil { // The columns are known from the first page
+			out := w
+			if opts.Gzip && opts.Format != FORMAT_PARQUET {
+				gz = gzip.NewWriter(w)
+				out = gz
+			}
+			if rw, err = newRowWriter(opts, page.Columns, out); err != nil {
+				return count, err
+			}
+		}
+
+		for _, row := range page.Rows {
+			if err := rw.Write(row); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if progress != nil {
+			progress(count)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+
+	if err := rw.Close(); err != nil {
+		return count, err
+	}
+	if gz != nil {
+		return count, gz.Close()
+	}
+	return count, nil
+}
+
+func newRowWriter(opts Options, columns []database.Column, w io.Writer) (rowWriter, error) {
+	switch opts.Format {
+	case FORMAT_CSV:
+		return newCSVWriter(columns, w)
+	case FORMAT_NDJSON:
+		return &ndjsonWriter{columns: columns, enc: json.NewEncoder(w)}, nil
+	case FORMAT_PARQUET:
+		return newParquetWriter(columns, w, opts.Gzip), nil
+	}
+	return nil, opts.Validate()
+}
+
+/* CSV */
+
+type csvWriter struct {
+	columns []database.Column
+	w       *csv.Writer
+	record  []string
+}
+
+func newCSVWriter(columns []database.Column, w io.Writer) (*csvWriter, error) {
+	c := &csvWriter{columns: columns, w: csv.NewWriter(w), record: make([]string, len(columns))}
+	for i, col := range columns {
+		c.record[i] = col.Name
+	}
+	return c, c.w.Write(c.record)
+}
+
+func (c *csvWriter) Write(row map[string]any) error {
+	for i, col := range c.columns {
+		c.record[i] = text(row[col.Name])
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// text formats a value for CSV. NULL is the empty string
+func text(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+/* NDJSON */
+
+type ndjsonWriter struct {
+	columns []database.Column
+	enc     *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(row map[string]any) error {
+	out := make(map[string]any, len(n.columns))
+	for _, col := range n.columns {
+		v := row[col.Name]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		out[col.Name] = v
+	}
+	return n.enc.Encode(out)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+/* PARQUET */
+
+type parquetWriter struct {
+	w      *parquet.Writer
+	fields []parquet.Field   // In the order of the schema, which sorts them by name
+	types  map[string]string // SQLite type of each column
+	row    parquet.Row
+}
+
+// newParquetWriter makes every column optional, with its type mapped from the SQLite type. Times are stored as
+// timestamps in milliseconds, and anything else that isn't a number or a boolean as a string
+func newParquetWriter(columns []database.Column, w io.Writer, gzipped bool) *parquetWriter {
+	group := parquet.Group{}
+	types := make(map[string]string, len(columns))
+	for _, col := range columns {
+		group[col.Name] = parquet.Optional(parquetNode(col.Type))
+		types[col.Name] = col.Type
+	}
+	schema := parquet.NewSchema("row", group)
+	codec := parquet.Compression(&parquet.Snappy)
+	if gzipped {
+		codec = parquet.Compression(&parquet.Gzip)
+	}
+	return &parquetWriter{
+		w:      parquet.NewWriter(w, schema, codec, parquet.MaxRowsPerRowGroup(ROW_GROUP_SIZE)),
+		fields: schema.Fields(),
+		types:  types,
+		row:    make(parquet.Row, len(columns)),
+	}
+}
+
+func parquetNode(sqlType string) parquet.Node {
+	switch sqlType {
+	case "INTEGER", "BIGINT", "INT":
+		return parquet.Int(64)
+	case "REAL", "FLOAT", "DOUBLE":
+		return parquet.Leaf(parquet.DoubleType)
+	case "BOOLEAN", "NUMERIC":
+		return parquet.Leaf(parquet.BooleanType)
+	case "DATETIME":
+		return parquet.Timestamp(parquet.Millisecond)
+	}
+	return parquet.String()
+}
+
+func (p *parquetWriter) Write(row map[string]any) error {
+	for i, f := range p.fields {
+		v := parquetValue(p.types[f.Name()], row[f.Name()])
+		if v.IsNull() {
+			p.row[i] = v.Level(0, 0, i)
+		} else {
+			p.row[i] = v.Level(0, 1, i)
+		}
+	}
+	_, err := p.w.WriteRows([]parquet.Row{p.row})
+	return err
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.Close()
+}
+
+// parquetValue converts a value read from SQLite to the Parquet type of the column. Values that don't convert are NULL
+func parquetValue(sqlType string, v any) parquet.Value {
+	if v == nil {
+		return parquet.NullValue()
+	}
+	switch parquetNode(sqlType).Type().Kind() {
+	case parquet.Int64:
+		switch n := v.(type) {
+		case int64:
+			return parquet.Int64Value(n)
+		case float64:
+			return parquet.Int64Value(int64(n))
+		case bool:
+			if n {
+				return parquet.Int64Value(1)
+			}
+			return parquet.Int64Value(0)
+		case time.Time: // Timestamps are int64 in Parquet
+			return parquet.Int64Value(n.UnixMilli())
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, n); err == nil {
+				return parquet.Int64Value(t.UnixMilli())
+			}
+			if i, err := strconv.ParseInt(n, 10, 64); err == nil {
+				return parquet.Int64Value(i)
+			}
+		}
+	case parquet.Double:
+		switch n := v.(type) {
+		case float64:
+			return parquet.DoubleValue(n)
+		case int64:
+			return parquet.DoubleValue(float64(n))
+		}
+	case parquet.Boolean:
+		switch n := v.(type) {
+		case bool:
+			return parquet.BooleanValue(n)
+		case int64:
+			return parquet.BooleanValue(n != 0)
+		}
+	default:
+		return parquet.ByteArrayValue([]byte(text(v)))
+	}
+	return parquet.NullValue()
+}
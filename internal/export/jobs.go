@@ -0,0 +1,332 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pynezz/pynezzentials/ansi"
+
+	"github.com/pynezz/bivrost/internal/database"
+)
+
+const (
+	DEFAULT_DIR         = "exports"
+	DEFAULT_TTL         = 24 * time.Hour // How long finished exports can be downloaded
+	DEFAULT_CONCURRENCY = 2              // Exports running at the same time, the others wait
+
+	filePrefix = "export-"
+)
+
+// States of a job
+const (
+	JOB_QUEUED   = "queued"
+	JOB_RUNNING  = "running"
+	JOB_DONE     = "done"
+	JOB_FAILED   = "failed"
+	JOB_CANCELED = "canceled"
+)
+
+var (
+	ErrNoSuchJob  = errors.New("no such export job")
+	ErrNotReady   = errors.New("the export is not done")
+	errJobsClosed = errors.New("export jobs are closed")
+)
+
+// Job is the state of a background export
+type Job struct {
+	ID       string     `json:"id"`
+	Table    string     `json:"table"`
+	Format   string     `json:"format"`
+	Gzip     bool       `json:"gzip"`
+	Filename string     `json:"filename"`
+	State    string     `json:"state"`
+	Rows     int64      `json:"rows"`
+	Bytes    int64      `json:"bytes"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"` // When the file is removed, once the job is finished
+}
+
+type job struct {
+	Job
+	path   string
+	cancel context.CancelFunc
+}
+
+func (j *job) finished() bool {
+	return j.State == JOB_DONE || j.State == JOB_FAILED || j.State == JOB_CANCELED
+}
+
+// Jobs runs the exports too large to stream before the HTTP write timeout in the background.
+// A job writes its file to the export directory, where it can be downloaded until it expires.
+// Jobs are kept in memory, so the files of jobs from before a restart are removed on startup
+type Jobs struct {
+	src   Source
+	dir   string
+	ttl   time.Duration
+	slots chan struct{} // Limits the exports running at the same time
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	closed bool
+	quit   chan struct{}
+}
+
+// NewJobs creates the export directory, and removes the files left by a previous run.
+// Zero values use DEFAULT_DIR, DEFAULT_TTL and DEFAULT_CONCURRENCY
+func NewJobs(src Source, dir string, ttl time.Duration, concurrency int) (*Jobs, error) {
+	if dir == "" {
+		dir = DEFAULT_DIR
+	}
+	if ttl <= 0 {
+		ttl = DEFAULT_TTL
+	}
+	if concurrency <= 0 {
+		concurrency = DEFAULT_CONCURRENCY
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	stale, _ := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	for _, f := range stale {
+		os.Remove(f)
+	}
+
+	j := &Jobs{
+		src:   src,
+		dir:   dir,
+		ttl:   ttl,
+		slots: make(chan struct{}, concurrency),
+		jobs:  make(map[string]*job),
+		quit:  make(chan struct{}),
+	}
+	go j.expire()
+	return j, nil
+}
+
+// Close cancels the running jobs and removes every export file
+func (j *Jobs) Close() {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return
+	}
+	j.closed = true
+	close(j.quit)
+	for id, jb := range j.jobs {
+		jb.cancel()
+		os.Remove(jb.path)
+		delete(j.jobs, id)
+	}
+	j.mu.Unlock()
+}
+
+// Start queues an export of the table
+func (j *Jobs) Start(table string, q database.Query, opts Options) (Job, error) {
+	if err := opts.Validate(); err != nil {
+		return Job{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	jb := &job{
+		Job: Job{
+			ID:       id,
+			Table:    table,
+			Format:   opts.Format,
+			Gzip:     opts.Gzip,
+			Filename: opts.Filename(table),
+			State:    JOB_QUEUED,
+			Created:  time.Now(),
+		},
+		path:   filepath.Join(j.dir, filePrefix+id+"-"+opts.Filename(table)),
+		cancel: cancel,
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		cancel()
+		return Job{}, errJobsClosed
+	}
+	j.jobs[id] = jb
+	go j.run(ctx, jb, q, opts)
+	return jb.Job, nil
+}
+
+func (j *Jobs) run(ctx context.Context, jb *job, q database.Query, opts Options) {
+	select {
+	case j.slots <- struct{}{}:
+		defer func() { <-j.slots }()
+	case <-ctx.Done():
+		j.finish(jb, ctx.Err())
+		return
+	}
+	j.update(jb, func() {
+		now := time.Now()
+		jb.State = JOB_RUNNING
+		jb.Started = &now
+	})
+
+	f, err := os.OpenFile(jb.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		j.finish(jb, err)
+		return
+	}
+	counter := &countingWriter{w: f}
+	buf := bufio.NewWriterSize(counter, 64*1024)
+	_, err = Export(ctx, j.src, jb.Table, q, opts, buf, func(rows int64) {
+		j.update(jb, func() {
+			jb.Rows = rows
+			jb.Bytes = counter.n
+		})
+	})
+	if err == nil {
+		err = buf.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	j.update(jb, func() { jb.Bytes = counter.n })
+	if err != nil {
+		os.Remove(jb.path)
+	}
+	j.finish(jb, err)
+}
+
+// update changes the job under the lock
+func (j *Jobs) update(jb *job, fn func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn()
+}
+
+func (j *Jobs) finish(jb *job, err error) {
+	j.update(jb, func() {
+		now := time.Now()
+		expires := now.Add(j.ttl)
+		jb.Finished, jb.Expires = &now, &expires
+		switch {
+		case err == nil:
+			jb.State = JOB_DONE
+		case errors.Is(err, context.Canceled):
+			jb.State = JOB_CANCELED
+		default:
+			jb.State = JOB_FAILED
+			jb.Error = err.Error()
+		}
+	})
+	switch jb.State {
+	case JOB_DONE:
+		ansi.PrintSuccess(fmt.Sprintf("[EXPORT] %s: %d rows of %s to %s", jb.ID, jb.Rows, jb.Table, jb.path))
+	case JOB_FAILED:
+		ansi.PrintError(fmt.Sprintf("[EXPORT] %s: %s failed: %s", jb.ID, jb.Table, jb.Error))
+	}
+}
+
+// Get returns the job with the id
+func (j *Jobs) Get(id string) (Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jb, ok := j.jobs[id]
+	if !ok {
+		return Job{}, ErrNoSuchJob
+	}
+	return jb.Job, nil
+}
+
+// List returns every job, the newest first
+func (j *Jobs) List() []Job {
+	j.mu.Lock()
+	list := make([]Job, 0, len(j.jobs))
+	for _, jb := range j.jobs {
+		list = append(list, jb.Job)
+	}
+	j.mu.Unlock()
+	sort.Slice(list, func(a, b int) bool { return list[a].Created.After(list[b].Created) })
+	return list
+}
+
+// File returns the path of the export file of a finished job, to download it
+func (j *Jobs) File(id string) (string, Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jb, ok := j.jobs[id]
+	if !ok {
+		return "", Job{}, ErrNoSuchJob
+	}
+	if jb.State != JOB_DONE {
+		return "", jb.Job, ErrNotReady
+	}
+	return jb.path, jb.Job, nil
+}
+
+// Remove cancels the job if it's running, and removes it and its file
+func (j *Jobs) Remove(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jb, ok := j.jobs[id]
+	if !ok {
+		return ErrNoSuchJob
+	}
+	delete(j.jobs, id)
+	jb.cancel()
+	if jb.finished() {
+		os.Remove(jb.path)
+	} // Otherwise the job removes its file when it sees it's canceled
+	return nil
+}
+
+// expire removes the jobs, and their files, that finished more than the TTL ago
+func (j *Jobs) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.quit:
+			return
+		case now := <-ticker.C:
+			j.mu.Lock()
+			for id, jb := range j.jobs {
+				if jb.finished() && now.After(*jb.Expires) {
+					os.Remove(jb.path)
+					delete(j.jobs, id)
+				}
+			}
+			j.mu.Unlock()
+		}
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
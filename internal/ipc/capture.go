@@ -0,0 +1,279 @@
+package ipc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+var errCaptureClosed = errors.New("capture closed")
+
+// Which side of a connection sent a frame
+const (
+	FROM_MODULE = "module"
+	FROM_SERVER = "server"
+)
+
+// Frame is a single message on a connection, as recorded in a capture
+type Frame struct {
+	Time          time.Time `json:"time"`
+	Conn          uint64    `json:"conn"` // Connection the frame was seen on, numbered from 1 within the capture
+	From          string    `json:"from"` // FROM_MODULE or FROM_SERVER
+	Identifier    string    `json:"identifier"`
+	MessageType   byte      `json:"message_type"`
+	Type          string    `json:"type"` // Name of the message type, see MSGTYPE
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Chunk         byte      `json:"chunk,omitempty"`
+	Datatype      DataType  `json:"datatype,omitempty"`
+	Encoding      string    `json:"encoding,omitempty"`
+	Timestamp     int64     `json:"timestamp"`
+	Checksum32    int       `json:"checksum"`
+	Signature     []byte    `json:"signature,omitempty"`
+	Metadata      *Metadata `json:"metadata,omitempty"` // Decoded from the data of JSON requests, for reading and filtering
+	Data          []byte    `json:"data,omitempty"`     // As sent, base64 encoded
+	StringData    string    `json:"string_data,omitempty"`
+}
+
+// NewFrame records the request as a frame sent by from, on the connection with the given number
+func NewFrame(req *IPCRequest, conn uint64, from string) Frame {
+	f := Frame{
+		Time:          time.Now(),
+		Conn:          conn,
+		From:          from,
+		Identifier:    strings.Trim(string(req.Header.Identifier[:]), "\x00"),
+		MessageType:   req.Header.MessageType,
+		Type:          MessageTypeName(req.Header.MessageType),
+		CorrelationID: req.CorrelationID,
+		Chunk:         req.Chunk,
+		Datatype:      req.Message.Datatype,
+		Encoding:      req.Message.Encoding,
+		Timestamp:     req.Timestamp,
+		Checksum32:    req.Checksum32,
+		Signature:     req.MessageSignature,
+		Data:          req.Message.Data,
+		StringData:    req.Message.StringData,
+	}
+	f.Metadata = decodeMetadata(req)
+	return f
+}
+
+// decodeMetadata returns the metadata of a JSON request, or nil if it has none or is a chunk of a larger message
+func decodeMetadata(req *IPCRequest) *Metadata {
+	if req.Message.Datatype != DATA_JSON || req.Chunk != CHUNK_NONE || len(req.Message.Data) == 0 {
+		return nil
+	}
+	data, err := Decompress(req.Message.Encoding, req.Message.Data, DEFAULT_MESSAGE_SIZE)
+	if err != nil {
+		return nil
+	}
+	var body struct {
+		Metadata *Metadata `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil
+	}
+	return body.Metadata
+}
+
+// Request returns the frame as it was on the wire
+func (f Frame) Request() IPCRequest {
+	req := IPCRequest{
+		MessageSignature: f.Signature,
+		CorrelationID:    f.CorrelationID,
+		Header:           IPCHeader{MessageType: f.MessageType},
+		Message: IPCMessage{
+			Datatype:   f.Datatype,
+			Data:       f.Data,
+			StringData: f.StringData,
+			Encoding:   f.Encoding,
+		},
+		Timestamp:  f.Timestamp,
+		Checksum32: f.Checksum32,
+		Chunk:      f.Chunk,
+	}
+	copy(req.Header.Identifier[:], f.Identifier)
+	return req
+}
+
+// Format pretty prints the frame, with at most maxData bytes of its data. 0 prints all of it
+func (f Frame) Format(maxData int) string {
+	req := f.Request()
+	if maxData > 0 && len(req.Message.Data) > maxData {
+		req.Message.Data = append(req.Message.Data[:maxData:maxData], fmt.Sprintf("... (%d bytes)", len(f.Data))...)
+	}
+	line := fmt.Sprintf("%s conn %d %s -> %s\n", f.Time.Format("15:04:05.000000"), f.Conn, f.From, otherSide(f.From))
+	if f.Metadata != nil {
+		line += fmt.Sprintf("METADATA: %s %s%s%s\n", f.Metadata.Method, f.Metadata.Destination.Object.Database.Table, f.Metadata.Topic, source(f.Metadata))
+	}
+	return line + req.Stringify()
+}
+
+func otherSide(from string) string {
+	if from == FROM_MODULE {
+		return FROM_SERVER
+	}
+	return FROM_MODULE
+}
+
+func source(m *Metadata) string {
+	if m.Source == "" {
+		return ""
+	}
+	return " from " + m.Source
+}
+
+// MessageTypeName returns the name of the message type, as in MSGTYPE, or its number if it's unknown
+func MessageTypeName(t byte) string {
+	return wire.MessageTypeName(t)
+}
+
+// Capture writes frames to a capture file, to reproduce problems with a module. It is safe for concurrent use by several connections.
+// The file has one JSON Frame per line, recorded as on the wire, so chunked and compressed messages show up chunk by chunk
+type Capture struct {
+	mu          sync.Mutex
+	enc         *json.Encoder
+	closer      io.Closer
+	identifiers map[string]bool // Modules to capture, all if empty
+	err         error           // First write error, after which nothing more is written
+
+	path      string
+	startedAt time.Time
+	conns     atomic.Uint64
+	frames    atomic.Uint64
+}
+
+// CaptureInfo describes a capture in progress
+type CaptureInfo struct {
+	Path      string    `json:"path,omitempty"`
+	Modules   []string  `json:"modules"` // Identifiers of the captured modules, empty for all of them
+	StartedAt time.Time `json:"started_at"`
+	Frames    uint64    `json:"frames"` // Recorded so far
+	Error     string    `json:"error,omitempty"`
+}
+
+// NewCapture captures frames of the modules with the identifiers to w. No identifiers captures every module
+func NewCapture(w io.Writer, identifiers ...string) *Capture {
+	c := &Capture{enc: json.NewEncoder(w), identifiers: make(map[string]bool), startedAt: time.Now()}
+	if closer, ok := w.(io.Closer); ok {
+		c.closer = closer
+	}
+	for _, id := range identifiers {
+		c.identifiers[id] = true
+	}
+	return c
+}
+
+// CreateCapture creates the capture file at path, see NewCapture
+func CreateCapture(path string, identifiers ...string) (*Capture, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600) // Captures hold everything modules send
+	if err != nil {
+		return nil, err
+	}
+	c := NewCapture(f, identifiers...)
+	c.path = path
+	return c, nil
+}
+
+// Info describes the capture
+func (c *Capture) Info() CaptureInfo {
+	info := CaptureInfo{Path: c.path, Modules: []string{}, StartedAt: c.startedAt, Frames: c.frames.Load()}
+	for id := range c.identifiers {
+		info.Modules = append(info.Modules, id)
+	}
+	sort.Strings(info.Modules)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil && c.err != errCaptureClosed {
+		info.Error = c.err.Error()
+	}
+	return info
+}
+
+// Record writes the frame, unless it belongs to a module that isn't captured
+func (c *Capture) Record(f Frame) error {
+	if len(c.identifiers) > 0 && !c.identifiers[f.Identifier] {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.err = c.enc.Encode(f); c.err == nil {
+		c.frames.Add(1)
+	}
+	return c.err
+}
+
+// Close closes the capture file
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = errCaptureClosed
+	}
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// ReadCapture reads every frame of a capture
+func ReadCapture(r io.Reader) ([]Frame, error) {
+	var frames []Frame
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 2*DEFAULT_MESSAGE_SIZE) // Base64 grows the data by a third
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var f Frame
+		if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		frames = append(frames, f)
+	}
+	return frames, scanner.Err()
+}
+
+// SetCapture records every frame sent and received on the connection, from the point of view of the local side
+// (FROM_SERVER or FROM_MODULE). A nil capture stops recording.
+func (c *Conn) SetCapture(capture *Capture, local string) {
+	if capture == nil {
+		c.capture.Store(nil)
+		return
+	}
+	c.capture.Store(&connCapture{capture: capture, conn: capture.conns.Add(1), local: local})
+}
+
+// connCapture is the capture of a single connection
+type connCapture struct {
+	capture *Capture
+	conn    uint64 // Number of the connection in the capture
+	local   string // The side of the connection doing the capture
+}
+
+// record captures a frame, if the connection is being captured. sent is whether the local side sent it
+func (c *Conn) record(req *IPCRequest, sent bool) {
+	cc := c.capture.Load()
+	if cc == nil {
+		return
+	}
+	from := cc.local
+	if !sent {
+		from = otherSide(cc.local)
+	}
+	cc.capture.Record(NewFrame(req, cc.conn, from))
+}
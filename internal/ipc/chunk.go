@@ -0,0 +1,261 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+// Chunk markers, see ChunkWriter
+const (
+	CHUNK_NONE     = wire.CHUNK_NONE
+	CHUNK_BEGIN    = wire.CHUNK_BEGIN
+	CHUNK_CONTINUE = wire.CHUNK_CONTINUE
+	CHUNK_END      = wire.CHUNK_END
+)
+
+const (
+	DEFAULT_CHUNK_SIZE   = 1 << 20   // 1 MiB
+	DEFAULT_MESSAGE_SIZE = 256 << 20 // 256 MiB, the largest payload we're willing to reassemble
+
+	// UNCHUNKED is used as the chunk size for peers that predate chunking (protocol version < 2)
+	UNCHUNKED = math.MaxInt
+)
+
+// CHUNKING_VERSION is the first protocol version that understands chunked and compressed messages
+const CHUNKING_VERSION = wire.CHUNKING_VERSION
+
+// ChunkWriter splits everything written to it into chunks of at most size bytes, and sends them as a stream
+// sharing the correlation ID: CHUNK_BEGIN, zero or more CHUNK_CONTINUE, then CHUNK_END. Every chunk is compressed
+// on its own, and carries the checksum of its wire data. Close must be called to send the last chunk.
+// If everything fits in one chunk, a single unchunked message (CHUNK_NONE) is sent.
+type ChunkWriter struct {
+	send       func(*IPCRequest) error
+	newMessage func(data []byte) *IPCRequest // Creates the message carrying a chunk of data
+
+	correlationID string
+	encoding      string
+	size          int
+
+	buf     []byte
+	started bool // Whether CHUNK_BEGIN has been sent
+}
+
+// NewChunkWriter returns a ChunkWriter sending messages created by newMessage through send.
+// Every message gets the given correlation ID, and is compressed with the given encoding.
+func NewChunkWriter(send func(*IPCRequest) error, newMessage func(data []byte) *IPCRequest, correlationID, encoding string, size int) *ChunkWriter {
+	if size <= 0 {
+		size = DEFAULT_CHUNK_SIZE
+	}
+	return &ChunkWriter{
+		send:          send,
+		newMessage:    newMessage,
+		correlationID: correlationID,
+		encoding:      encoding,
+		size:          size,
+	}
+}
+
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := w.size - len(w.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.buf = append(w.buf, p[:free]...)
+		p = p[free:]
+
+		// Only flush when there's more to come, so the last chunk can be marked as the end
+		if len(w.buf) == w.size && len(p) > 0 {
+			if err := w.flush(false); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close sends whatever is left in the buffer as the last chunk
+func (w *ChunkWriter) Close() error {
+	return w.flush(true)
+}
+
+func (w *ChunkWriter) flush(last bool) error {
+	marker := byte(CHUNK_CONTINUE)
+	switch {
+	case !w.started && last:
+		marker = CHUNK_NONE
+	case !w.started:
+		marker = CHUNK_BEGIN
+	case last:
+		marker = CHUNK_END
+	}
+	w.started = true
+
+	msg, err := w.chunk(w.buf, marker)
+	if err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	return w.send(msg)
+}
+
+// chunk wraps the data in a message, compressing it if it's worth it
+func (w *ChunkWriter) chunk(data []byte, marker byte) (*IPCRequest, error) {
+	encoding := w.encoding
+	if len(data) < COMPRESS_THRESHOLD {
+		encoding = ENCODING_NONE
+	}
+	payload, err := Compress(encoding, data)
+	if err != nil {
+		return nil, err
+	}
+	if encoding == ENCODING_NONE {
+		payload = append([]byte(nil), data...) // The buffer is reused for the next chunk
+	}
+
+	msg := w.newMessage(payload)
+	msg.CorrelationID = w.correlationID
+	msg.Chunk = marker
+	msg.Message.Encoding = encoding
+	msg.Checksum32 = int(crc32.ChecksumIEEE(payload))
+	if encoding != ENCODING_NONE || marker != CHUNK_NONE {
+		msg.Message.StringData = "" // Would double the size of every chunk on the wire
+	}
+	return msg, nil
+}
+
+// MAX_OPEN_STREAMS is how many chunked messages an Assembler reassembles at once
+const MAX_OPEN_STREAMS = 64
+
+// Assembler puts chunked messages back together, one stream per correlation ID.
+// All its streams together hold at most maxSize bytes. It is safe for concurrent use.
+type Assembler struct {
+	mu       sync.Mutex
+	streams  map[string]*IPCRequest
+	buffered int // Bytes held by all streams
+	maxSize  int
+}
+
+// NewAssembler returns an Assembler refusing payloads larger than maxSize bytes
+func NewAssembler(maxSize int) *Assembler {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MESSAGE_SIZE
+	}
+	return &Assembler{
+		streams: make(map[string]*IPCRequest),
+		maxSize: maxSize,
+	}
+}
+
+// Add adds a message to its stream. When the message completes a stream, or isn't chunked at all,
+// the complete and decompressed message is returned with done set to true.
+// The returned message has its checksum recalculated over the reassembled data.
+func (a *Assembler) Add(msg IPCRequest) (complete IPCRequest, done bool, err error) {
+	if msg.Checksum32 != int(crc32.ChecksumIEEE(msg.Message.Data)) {
+		a.drop(msg.CorrelationID)
+		return msg, false, fmt.Errorf("%w in chunk of %s", ErrChecksum, msg.CorrelationID)
+	}
+
+	// Every frame is decompressed up to what's left of the maximum size, so a small frame can't inflate without limit
+	limit := a.maxSize
+	if msg.Chunk != CHUNK_NONE {
+		a.mu.Lock()
+		limit -= a.buffered
+		a.mu.Unlock()
+	}
+	data, err := Decompress(msg.Message.Encoding, msg.Message.Data, limit)
+	if err != nil {
+		a.drop(msg.CorrelationID)
+		if errors.Is(err, ErrTooLarge) {
+			return msg, false, fmt.Errorf("%w: %s exceeds the maximum message size of %d bytes", ErrTooLarge, msg.CorrelationID, a.maxSize)
+		}
+		return msg, false, err
+	}
+	msg.Message.Data = data
+	msg.Message.Encoding = ENCODING_NONE
+
+	if msg.Chunk == CHUNK_NONE {
+		return finish(msg), true, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stream, ok := a.streams[msg.CorrelationID]
+	switch {
+	case msg.Chunk == CHUNK_BEGIN && ok:
+		a.remove(msg.CorrelationID)
+		return msg, false, fmt.Errorf("stream %s started twice", msg.CorrelationID)
+	case msg.Chunk == CHUNK_BEGIN && len(a.streams) >= MAX_OPEN_STREAMS:
+		return msg, false, fmt.Errorf("%w: %s would be more than %d open streams", ErrTooLarge, msg.CorrelationID, MAX_OPEN_STREAMS)
+	case msg.Chunk == CHUNK_BEGIN:
+		stream = &IPCRequest{}
+		*stream = msg
+		stream.Message.Data = nil
+		a.streams[msg.CorrelationID] = stream
+	case !ok:
+		return msg, false, fmt.Errorf("chunk for unknown stream %s", msg.CorrelationID)
+	}
+
+	if a.buffered+len(data) > a.maxSize {
+		a.remove(msg.CorrelationID)
+		return msg, false, fmt.Errorf("%w: stream %s exceeds the maximum message size of %d bytes", ErrTooLarge, msg.CorrelationID, a.maxSize)
+	}
+	stream.Message.Data = append(stream.Message.Data, data...)
+	a.buffered += len(data)
+
+	if msg.Chunk == CHUNK_END {
+		a.remove(msg.CorrelationID)
+		return finish(*stream), true, nil
+	}
+	return msg, false, nil
+}
+
+// drop forgets a stream, such as when one of its chunks was bad
+func (a *Assembler) drop(correlationID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.remove(correlationID)
+}
+
+// remove forgets a stream, with the lock held
+func (a *Assembler) remove(correlationID string) {
+	if stream, ok := a.streams[correlationID]; ok {
+		a.buffered -= len(stream.Message.Data)
+		delete(a.streams, correlationID)
+	}
+}
+
+func finish(msg IPCRequest) IPCRequest {
+	msg.Chunk = CHUNK_NONE
+	msg.Checksum32 = int(crc32.ChecksumIEEE(msg.Message.Data))
+	return msg
+}
+
+// SendChunked sends the request split into chunks of at most size bytes, each compressed with the given encoding.
+// A request that fits in one chunk is sent as a single message.
+func (c *Conn) SendChunked(req *IPCRequest, encoding string, size int) error {
+	return c.SendChunkedBefore(req, encoding, size, time.Time{})
+}
+
+// SendChunkedBefore is SendChunked with a deadline for writing each chunk, see SendBefore
+func (c *Conn) SendChunkedBefore(req *IPCRequest, encoding string, size int, deadline time.Time) error {
+	send := func(msg *IPCRequest) error { return c.SendBefore(msg, deadline) }
+	w := NewChunkWriter(send, func(data []byte) *IPCRequest {
+		chunk := *req
+		chunk.Message.Data = data
+		return &chunk
+	}, req.CorrelationID, encoding, size)
+
+	if _, err := w.Write(req.Message.Data); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,269 @@
+package ipc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// chunk returns a frame of the stream with the correlation ID
+func chunk(correlationID string, marker byte, data []byte) IPCRequest {
+	return IPCRequest{
+		CorrelationID: correlationID,
+		Chunk:         marker,
+		Message:       IPCMessage{Datatype: DATA_BIN, Data: data},
+		Checksum32:    int(crc32.ChecksumIEEE(data)),
+	}
+}
+
+// Payloads written through a ChunkWriter come out of an Assembler as they went in
+func TestChunkedRoundTrip(t *testing.T) {
+	const chunkSize = 1024
+	random := make([]byte, 5*chunkSize+7)
+	rand.New(rand.NewSource(1)).Read(random)
+	repetitive := bytes.Repeat([]byte("GET /index.html 200\n"), 1000)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantChunks int
+	}{
+		{"empty", nil, 1},
+		{"smaller than a chunk", random[:100], 1},
+		{"exactly one chunk", random[:chunkSize], 1},
+		{"several chunks", random, 6},
+		{"compressible", repetitive, 0}, // Depends on the encoding
+	}
+	for _, encoding := range append([]string{ENCODING_NONE}, SupportedEncodings...) {
+		name := encoding
+		if encoding == ENCODING_NONE {
+			name = "uncompressed"
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/%s", tt.name, name), func(t *testing.T) {
+				var frames []IPCRequest
+				send := func(msg *IPCRequest) error {
+					frames = append(frames, *msg)
+					return nil
+				}
+				newMessage := func(data []byte) *IPCRequest {
+					return &IPCRequest{Header: IPCHeader{MessageType: MSG_MSG}, Message: IPCMessage{Datatype: DATA_BIN, Data: data}}
+				}
+				w := NewChunkWriter(send, newMessage, "stream", encoding, chunkSize)
+				if _, err := w.Write(tt.data); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				if tt.wantChunks > 0 && len(frames) != tt.wantChunks {
+					t.Errorf("sent %d frames, want %d", len(frames), tt.wantChunks)
+				}
+				wantMarkers(t, frames)
+
+				a := NewAssembler(0)
+				for i, frame := range frames {
+					complete, done, err := a.Add(frame)
+					if err != nil {
+						t.Fatalf("frame %d: %v", i, err)
+					}
+					if done != (i == len(frames)-1) {
+						t.Fatalf("frame %d of %d completed the stream: %v", i, len(frames), done)
+					}
+					if !done {
+						continue
+					}
+					if !bytes.Equal(complete.Message.Data, tt.data) {
+						t.Errorf("reassembled %d bytes, want the %d bytes sent", len(complete.Message.Data), len(tt.data))
+					}
+					if complete.Chunk != CHUNK_NONE || complete.Message.Encoding != ENCODING_NONE || complete.CorrelationID != "stream" {
+						t.Errorf("reassembled message has chunk %d, encoding %q, correlation ID %q", complete.Chunk, complete.Message.Encoding, complete.CorrelationID)
+					}
+					if complete.Checksum32 != int(crc32.ChecksumIEEE(tt.data)) {
+						t.Error("checksum of the reassembled message doesn't match its data")
+					}
+				}
+			})
+		}
+	}
+}
+
+// wantMarkers checks that the frames are a single message, or a stream from CHUNK_BEGIN to CHUNK_END
+func wantMarkers(t *testing.T, frames []IPCRequest) {
+	t.Helper()
+	if len(frames) == 1 {
+		if frames[0].Chunk != CHUNK_NONE {
+			t.Errorf("single frame has chunk marker %d", frames[0].Chunk)
+		}
+		return
+	}
+	for i, frame := range frames {
+		want := byte(CHUNK_CONTINUE)
+		switch i {
+		case 0:
+			want = CHUNK_BEGIN
+		case len(frames) - 1:
+			want = CHUNK_END
+		}
+		if frame.Chunk != want {
+			t.Errorf("frame %d has chunk marker %d, want %d", i, frame.Chunk, want)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name             string
+		offered, allowed []string
+		want             string
+	}{
+		{"first offered wins", []string{ENCODING_GZIP, ENCODING_ZSTD}, []string{ENCODING_ZSTD, ENCODING_GZIP}, ENCODING_GZIP},
+		{"only what's allowed", []string{ENCODING_ZSTD, ENCODING_GZIP}, []string{ENCODING_GZIP}, ENCODING_GZIP},
+		{"nothing in common", []string{ENCODING_ZSTD}, []string{ENCODING_GZIP}, ENCODING_NONE},
+		{"unsupported", []string{"brotli"}, []string{"brotli"}, ENCODING_NONE},
+		{"nothing offered", nil, SupportedEncodings, ENCODING_NONE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NegotiateEncoding(tt.offered, tt.allowed); got != tt.want {
+				t.Errorf("NegotiateEncoding(%q, %q) = %q, want %q", tt.offered, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+// A small frame can't decompress to more than the limit
+func TestDecompressLimit(t *testing.T) {
+	bomb := make([]byte, 1<<20)
+	for _, encoding := range SupportedEncodings {
+		t.Run(encoding, func(t *testing.T) {
+			compressed, err := Compress(encoding, bomb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Decompress(encoding, compressed, len(bomb)-1); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("got %v, want %v", err, ErrTooLarge)
+			}
+			if data, err := Decompress(encoding, compressed, len(bomb)); err != nil || !bytes.Equal(data, bomb) {
+				t.Errorf("decompressed %d bytes at the limit, error %v", len(data), err)
+			}
+		})
+	}
+}
+
+func TestAssemblerLimits(t *testing.T) {
+	kb := make([]byte, 1024)
+	tests := []struct {
+		name    string
+		maxSize int
+		frames  []IPCRequest
+		wantErr error // Of the last frame, the others must be accepted
+	}{
+		{
+			name:    "too many open streams",
+			maxSize: DEFAULT_MESSAGE_SIZE,
+			frames: func() []IPCRequest {
+				var frames []IPCRequest
+				for i := 0; i <= MAX_OPEN_STREAMS; i++ {
+					frames = append(frames, chunk(fmt.Sprint("stream", i), CHUNK_BEGIN, kb))
+				}
+				return frames
+			}(),
+			wantErr: ErrTooLarge,
+		},
+		{
+			name:    "streams together larger than the maximum size",
+			maxSize: 3 * len(kb),
+			frames: []IPCRequest{
+				chunk("a", CHUNK_BEGIN, kb),
+				chunk("b", CHUNK_BEGIN, kb),
+				chunk("a", CHUNK_CONTINUE, kb),
+				chunk("b", CHUNK_CONTINUE, kb),
+			},
+			wantErr: ErrTooLarge,
+		},
+		{
+			name:    "one stream larger than the maximum size",
+			maxSize: 2 * len(kb),
+			frames: []IPCRequest{
+				chunk("a", CHUNK_BEGIN, kb),
+				chunk("a", CHUNK_CONTINUE, kb),
+				chunk("a", CHUNK_END, kb),
+			},
+			wantErr: ErrTooLarge,
+		},
+		{
+			name:    "bad checksum",
+			maxSize: DEFAULT_MESSAGE_SIZE,
+			frames: []IPCRequest{
+				chunk("a", CHUNK_BEGIN, kb),
+				{CorrelationID: "a", Chunk: CHUNK_END, Message: IPCMessage{Data: kb}, Checksum32: 1},
+			},
+			wantErr: ErrChecksum,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAssembler(tt.maxSize)
+			last := len(tt.frames) - 1
+			for _, frame := range tt.frames[:last] {
+				if _, _, err := a.Add(frame); err != nil {
+					t.Fatalf("frame of %s refused: %v", frame.CorrelationID, err)
+				}
+			}
+			if _, _, err := a.Add(tt.frames[last]); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("last frame: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Streams that were refused or completed no longer count against the limits
+func TestAssemblerReleases(t *testing.T) {
+	a := NewAssembler(2048)
+	for i := 0; i < 2*MAX_OPEN_STREAMS; i++ {
+		id := fmt.Sprint("stream", i)
+		if _, _, err := a.Add(chunk(id, CHUNK_BEGIN, make([]byte, 1024))); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if _, _, err := a.Add(chunk(id, CHUNK_CONTINUE, make([]byte, 2048))); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("%s: got %v, want %v", id, err, ErrTooLarge)
+		}
+	}
+	complete, done, err := a.Add(chunk("last", CHUNK_BEGIN, make([]byte, 1024)))
+	if err == nil {
+		complete, done, err = a.Add(chunk("last", CHUNK_END, make([]byte, 1024)))
+	}
+	if err != nil || !done || len(complete.Message.Data) != 2048 {
+		t.Fatalf("stream after the refused ones: %d bytes, done %v, error %v", len(complete.Message.Data), done, err)
+	}
+	if a.buffered != 0 || len(a.streams) != 0 {
+		t.Errorf("assembler still holds %d bytes in %d streams", a.buffered, len(a.streams))
+	}
+}
+
+// A frame larger than the maximum frame size is refused before it's decoded
+func TestConnMaxFrameSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sender, receiver := NewConn(client), NewConn(server)
+	receiver.SetMaxFrameSize(1024)
+	go func() {
+		sender.Send(&IPCRequest{Message: IPCMessage{Data: make([]byte, 512)}})
+		sender.Send(&IPCRequest{Message: IPCMessage{Data: make([]byte, FRAME_OVERHEAD+2048)}})
+	}()
+
+	if req, err := receiver.Receive(); err != nil || len(req.Message.Data) != 512 {
+		t.Fatalf("small frame: %d bytes, error %v", len(req.Message.Data), err)
+	}
+	if _, err := receiver.Receive(); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("large frame: got %v, want %v", err, ErrTooLarge)
+	}
+}
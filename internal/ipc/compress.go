@@ -0,0 +1,118 @@
+package ipc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+// Supported message encodings. ENCODING_NONE leaves the data as is.
+const (
+	ENCODING_NONE = wire.ENCODING_NONE
+	ENCODING_GZIP = wire.ENCODING_GZIP
+	ENCODING_ZSTD = wire.ENCODING_ZSTD
+)
+
+// SupportedEncodings lists the encodings this package can compress and decompress, in order of preference
+var SupportedEncodings = []string{ENCODING_ZSTD, ENCODING_GZIP}
+
+// COMPRESS_THRESHOLD is the smallest payload worth compressing. Anything smaller is sent as is.
+const COMPRESS_THRESHOLD = 512
+
+// The zstd encoder is safe for concurrent use with EncodeAll.
+// Decoders stream, so the output can be cut off at the limit, and are reused through a pool.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoders   = sync.Pool{New: func() any {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(DEFAULT_MESSAGE_SIZE))
+		return d
+	}}
+)
+
+// NegotiateEncoding picks the first encoding offered by the peer that we also allow.
+// Returns ENCODING_NONE if there is nothing in common.
+func NegotiateEncoding(offered []string, allowed []string) string {
+	for _, o := range offered {
+		for _, a := range allowed {
+			if o == a && isSupported(o) {
+				return o
+			}
+		}
+	}
+	return ENCODING_NONE
+}
+
+func isSupported(encoding string) bool {
+	for _, e := range SupportedEncodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress compresses the data with the given encoding
+func Compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case ENCODING_NONE:
+		return data, nil
+	case ENCODING_ZSTD:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case ENCODING_GZIP:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// Decompress reverses Compress. Data that decompresses to more than limit bytes is refused with ErrTooLarge,
+// without decompressing the rest of it
+func Decompress(encoding string, data []byte, limit int) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case ENCODING_NONE:
+		if len(data) > limit {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, limit)
+		}
+		return data, nil
+	case ENCODING_ZSTD:
+		zr := zstdDecoders.Get().(*zstd.Decoder)
+		defer zstdDecoders.Put(zr)
+		if err := zr.Reset(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		defer zr.Reset(nil)
+		r = zr
+	case ENCODING_GZIP:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes once decompressed", ErrTooLarge, limit)
+	}
+	return out, nil
+}
@@ -0,0 +1,109 @@
+package ipc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn wraps a net.Conn with a gob encoder and decoder that live as long as the connection.
+// gob streams carry type information only once, so a new encoder or decoder per message
+// will desync the stream as soon as more than one message is in flight.
+//
+// Send is safe for concurrent use. Receive is not, and should only be called from a single reader loop.
+type Conn struct {
+	net.Conn
+
+	enc      *gob.Encoder
+	dec      *gob.Decoder
+	frame    *frameReader
+	maxFrame int64
+	wmu      sync.Mutex // Serializes writes, as several requests may be answered at once
+
+	capture atomic.Pointer[connCapture] // Set by SetCapture, see capture.go
+}
+
+// FRAME_OVERHEAD is what a frame may take on top of its data, for the header, metadata and gob type definitions
+const FRAME_OVERHEAD = 64 << 10
+
+// NewConn wraps the given connection
+func NewConn(c net.Conn) *Conn {
+	frame := &frameReader{LimitedReader: io.LimitedReader{R: bufio.NewReader(c)}}
+	return &Conn{
+		Conn:     c,
+		enc:      gob.NewEncoder(c),
+		dec:      gob.NewDecoder(frame),
+		frame:    frame,
+		maxFrame: DEFAULT_MESSAGE_SIZE + FRAME_OVERHEAD,
+	}
+}
+
+// SetMaxFrameSize sets the largest data a received frame may carry. Peers that predate chunking send
+// whole messages in one frame, so it's the maximum message size. It must be called before Receive.
+func (c *Conn) SetMaxFrameSize(size int) {
+	c.maxFrame = int64(size) + FRAME_OVERHEAD
+}
+
+// Send encodes and writes the request to the connection
+func (c *Conn) Send(req *IPCRequest) error {
+	return c.SendBefore(req, time.Time{})
+}
+
+// SendBefore is Send with a deadline for the write, none if it's zero.
+// The deadline is set and cleared under the write lock, so concurrent sends don't overwrite each other's
+func (c *Conn) SendBefore(req *IPCRequest, deadline time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !deadline.IsZero() {
+		c.Conn.SetWriteDeadline(deadline)
+		defer c.Conn.SetWriteDeadline(time.Time{})
+	}
+	if err := c.enc.Encode(req); err != nil {
+		return err
+	}
+	c.record(req, true)
+	return nil
+}
+
+// Receive reads and decodes the next request from the connection.
+// A frame larger than the maximum frame size fails with ErrTooLarge, after which the connection is unusable.
+func (c *Conn) Receive() (IPCRequest, error) {
+	var req IPCRequest
+	c.frame.N = c.maxFrame
+	if err := c.dec.Decode(&req); err != nil {
+		if c.frame.N <= 0 {
+			return req, fmt.Errorf("%w: frame is larger than %d bytes", ErrTooLarge, c.maxFrame)
+		}
+		return req, err
+	}
+	c.record(&req, false)
+	return req, nil
+}
+
+// NewCorrelationID returns a random identifier used to match a response to its request
+func NewCorrelationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("ipc: failed to read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// frameReader limits how much a single frame may read from the connection.
+// gob reads an io.ByteReader as is, so nothing is read ahead and counted against the frame.
+type frameReader struct {
+	io.LimitedReader
+}
+
+func (f *frameReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(&f.LimitedReader, b[:])
+	return b[0], err
+}
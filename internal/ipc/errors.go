@@ -0,0 +1,44 @@
+package ipc
+
+import (
+	"errors"
+
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+// ErrorCode tells what kind of error occurred
+type ErrorCode = wire.ErrorCode
+
+const (
+	ERR_CHECKSUM      = wire.ERR_CHECKSUM
+	ERR_UNKNOWN_TABLE = wire.ERR_UNKNOWN_TABLE
+	ERR_FORBIDDEN     = wire.ERR_FORBIDDEN
+	ERR_DECODE        = wire.ERR_DECODE
+	ERR_INTERNAL      = wire.ERR_INTERNAL
+	ERR_SCHEMA        = wire.ERR_SCHEMA
+	ERR_TOO_LARGE     = wire.ERR_TOO_LARGE
+)
+
+// ErrChecksum is returned when the checksum of a message doesn't match its data
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ErrTooLarge is returned when a message is larger than the maximum message size, decompressed or reassembled
+var ErrTooLarge = errors.New("message too large")
+
+// Error is the envelope sent as the data of a MSG_ERROR message, when the server can't handle a request
+type Error = wire.Error
+
+// NewError returns an Error with the given code and formatted message
+func NewError(code ErrorCode, format string, args ...any) *Error {
+	return wire.NewError(code, format, args...)
+}
+
+// AsError returns err as an *Error, wrapping it with the given code if it isn't one already
+func AsError(err error, code ErrorCode) *Error {
+	return wire.AsError(err, code)
+}
+
+// ParseError reads the Error envelope from a MSG_ERROR message
+func ParseError(msg IPCRequest) *Error {
+	return wire.ParseError(msg)
+}
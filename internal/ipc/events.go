@@ -0,0 +1,38 @@
+package ipc
+
+import "github.com/pynezz/bivrost/pkg/wire"
+
+// Modules publish and subscribe with requests, with the topic in Metadata.Topic, see pkg/wire for the topics.
+// Events are pushed in MSG_EVENT messages, and sent again until the subscriber answers with a MSG_EVENTACK,
+// so an event may be delivered more than once.
+
+// EVENTS_VERSION is the first protocol version that receives events
+const EVENTS_VERSION = wire.EVENTS_VERSION
+
+// Request methods of the event bus, see Metadata.Method
+const (
+	METHOD_PUBLISH     = wire.METHOD_PUBLISH
+	METHOD_SUBSCRIBE   = wire.METHOD_SUBSCRIBE
+	METHOD_UNSUBSCRIBE = wire.METHOD_UNSUBSCRIBE
+)
+
+type (
+	Event     = wire.Event     // The JSON data of a MSG_EVENT message
+	EventAck  = wire.EventAck  // The JSON data of a MSG_EVENTACK message
+	Published = wire.Published // The answer to a PUBLISH request
+)
+
+// ValidateTopic checks the topic of a published event
+func ValidateTopic(topic string) error {
+	return wire.ValidateTopic(topic)
+}
+
+// ValidatePattern checks a subscription pattern
+func ValidatePattern(pattern string) error {
+	return wire.ValidatePattern(pattern)
+}
+
+// MatchTopic reports whether the topic matches the subscription pattern
+func MatchTopic(pattern, topic string) bool {
+	return wire.MatchTopic(pattern, topic)
+}
@@ -8,11 +8,8 @@ package ipc
 import (
 	"encoding/gob"
 	"os"
-	"path"
+	"path/filepath"
 	"time"
-
-	"github.com/pynezz/pynezzentials/ansi"
-	"github.com/pynezz/pynezzentials/fsutil"
 )
 
 const (
@@ -28,34 +25,12 @@ const (
 	Timeout = 1 * time.Second
 )
 
-var IPCID []byte // Identifier of the IPC communication
-
 type IPCMessageId []byte // Identifier of the message
 
-func SetIPCID(id []byte) {
-	if IPCID == nil {
-		IPCID = id
-		ansi.PrintSuccess("Set IPC ID to " + string(IPCID))
-	} else {
-		ansi.PrintWarning("IPC ID already set to " + string(IPCID))
-	}
-}
-
-func GetIPCStrID() string {
-	return string(IPCID)
-}
-
-func SetIdentifier(name string, id [4]byte) {
-	IDENTIFIERS[name] = id
-}
-
 func DefaultSock(name string) string {
-	tmpDir := os.TempDir()                     // Temporary directory (eg. /tmp)
-	subTmpDir := path.Join(tmpDir, name)       // Subdirectory in the temporary directory (eg. /tmp/<subTmpDir>)
-	sock := path.Join(subTmpDir, name+".sock") // Socket file path (eg. /tmp/<subTmpDir>/<name>)
-	// sock = path.Clean(sock)                 // Clean the path
-	sock = fsutil.PathConvert(sock) // Convert the path to the correct format
-	return sock
+	tmpDir := os.TempDir()                        // Temporary directory (eg. /tmp)
+	subTmpDir := filepath.Join(tmpDir, name)      // Subdirectory in the temporary directory (eg. /tmp/<subTmpDir>)
+	return filepath.Join(subTmpDir, name+".sock") // Socket file path (eg. /tmp/<subTmpDir>/<name>)
 }
 
 func init() {
@@ -1,21 +1,22 @@
 package ipcclient
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"net"
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
 
 	"github.com/pynezz/bivrost/internal/ipc"
-	"github.com/pynezz/bivrost/modules"
 
 	util "github.com/pynezz/pynezzentials"
 	"github.com/pynezz/pynezzentials/ansi"
@@ -30,10 +31,34 @@ type IPCClient struct {
 
 	Identifier [4]byte // Identifier of the module
 
-	Sock string   // Path to the UNIX domain socket
-	conn net.Conn // Connection to the IPC server (UNIX domain socket)
+	Sock string    // Path to the UNIX domain socket
+	conn *ipc.Conn // Connection to the IPC server (UNIX domain socket, or TCP with TLS)
+
+	// Set TLS to connect to a remote bivrost over TCP instead of the UNIX domain socket.
+	// See ipc.ClientTLSConfig. Addr defaults to ipc.Address.
+	TLS  *tls.Config
+	Addr string
+
+	// Requests waiting for a response, keyed by their CorrelationID
+	pending   map[string]chan ipc.IPCRequest
+	pendingMu sync.Mutex
+
+	unsolicited chan ipc.IPCRequest // Messages from the server that don't answer a pending request
+	done        chan struct{}       // Closed when the read loop exits
+	readErr     error               // The error that stopped the read loop
+
+	// Set by the handshake. Until then, everything is sent as single uncompressed messages.
+	// Pongs may be sent while the handshake is in flight, so they're guarded by negotiatedMu
+	encoding     string // Negotiated compression
+	chunkSize    int    // Negotiated chunk size
+	negotiatedMu sync.RWMutex
+
+	MaxMessageSize int // Largest (reassembled) message accepted from the server, defaults to ipc.DEFAULT_MESSAGE_SIZE
 }
 
+// ErrConnClosed is returned by Call when the connection is closed before a response arrives
+var ErrConnClosed = errors.New("ipc connection closed")
+
 func countDown(secLeft int) { // i--
 	ansi.PrintInfo(ansi.Overwrite + strconv.Itoa(secLeft) + " seconds left" + ansi.Backspace)
 	time.Sleep(time.Second)
@@ -53,15 +78,10 @@ func socketExists(socketPath string) bool {
 }
 
 func NewIPCClient() *IPCClient {
-	return &IPCClient{}
-}
-
-func init() {
-	gob.Register(&ipc.IPCRequest{})
-	gob.Register(&ipc.IPCMessage{})
-	gob.Register(&ipc.IPCHeader{})
-	gob.Register(&ipc.IPCMessageId{})
-	gob.Register(&ipc.IPCResponse{})
+	return &IPCClient{
+		pending:     make(map[string]chan ipc.IPCRequest),
+		unsolicited: make(chan ipc.IPCRequest, 16),
+	}
 }
 
 // Set description with format string for easier type conversion
@@ -80,7 +100,6 @@ func (c *IPCClient) Stringify() string {
 	}
 	if c.Identifier == [4]byte{} { // If the identifier is not set (ie. [0, 0, 0, 0])
 		ansi.PrintWarning("No identifier set for IPCClient")
-		c.Identifier = ipc.IDENTIFIERS["module"]
 	}
 
 	stringified := fmt.Sprintln("IPCCLIENT")
@@ -107,11 +126,9 @@ func existHandler(exist bool) (bool, error) {
 	return false, nil
 }
 
-// ClientListen listens for a message from the server and returns the data.
-// GenericData is a generic map for data (map[string]interface{}). It can be used to store any data type.
+// ClientListen waits for a message from the server that is not a response to a pending request, and returns it.
+// Responses to requests sent with Call are delivered to the caller, and will not show up here.
 func (c *IPCClient) ClientListen() ipc.IPCResponse {
-	var err error
-
 	response := ipc.IPCResponse{}
 
 	if c.conn == nil {
@@ -119,31 +136,12 @@ func (c *IPCClient) ClientListen() ipc.IPCResponse {
 		return response
 	}
 
-	res, err := parseConnection(c.conn)
-	if err != nil {
-		response.Success = false
-		if err.Error() == "EOF" {
-			ansi.PrintWarning("Client disconnected")
-			return response
-		}
-		ansi.PrintError("Error parsing the connection")
-		return response
-	}
-
-	response = ipc.IPCResponse{
-		Request:    res,
-		Success:    true,
-		Message:    res.Message.StringData,
-		Checksum32: res.Checksum32,
-	}
-
-	ansi.PrintSuccess("Received message from server: " + response.Message)
-
-	if string(res.Message.Data) == "OK" {
-		ansi.PrintColorf(ansi.LightCyan, "Message type: %v\n", res.Header.MessageType)
-		ansi.PrintSuccess("Checksums match")
-	} else {
-		ansi.PrintError("Checksums do not match")
+	select {
+	case res := <-c.unsolicited:
+		response = toResponse(res)
+		ansi.PrintSuccess("Received message from server: " + response.Message)
+	case <-c.done:
+		ansi.PrintWarning("Client disconnected")
 	}
 
 	return response
@@ -151,10 +149,7 @@ func (c *IPCClient) ClientListen() ipc.IPCResponse {
 
 // If this isn't the most ugly function I've ever seen...
 func (c *IPCClient) SetSocket(serverid string) error {
-	modules.SetModuleIdentifier(c.Identifier, c.Name)
-	return func(name, id, sid, p string) error {
-		return pclient.NewIPCClient(name, string(c.Identifier[:]), sid).SetSocket(p)
-	}(c.Name, modules.GetModuleNameFromID(c.Identifier), serverid, c.Sock)
+	return pclient.NewIPCClient(c.Name, string(c.Identifier[:]), serverid).SetSocket(c.Sock)
 }
 
 // func (c *IPCClient) SetSocket(socketPath string) error {
@@ -185,21 +180,32 @@ func (c *IPCClient) Connect(module string) error {
 	c.SetDescf("IPC testing client for %s", module)
 	c.Name = module
 
-	// Check if the socket exists
-	err := c.SetSocket(DefaultSocketPath())
-	if err != nil { // The socket did not exist and the user did not want to retry
-		return err // Return the error
-	}
-
-	conn, err := net.Dial("unix", c.Sock)
+	conn, err := c.dial()
 	if err != nil {
 		fmt.Println("Dial error:", err)
 		return err
 	}
-	c.conn = conn
-	c.Identifier = ipc.IDENTIFIERS["threat_intel"] // Should equal to 0x54, 0x48, 0x52, 0x49,
+	c.conn = ipc.NewConn(conn)
+	if c.MaxMessageSize > 0 {
+		c.conn.SetMaxFrameSize(c.MaxMessageSize)
+	}
+
+	if c.pending == nil {
+		c.pending = make(map[string]chan ipc.IPCRequest)
+	}
+	if c.unsolicited == nil {
+		c.unsolicited = make(chan ipc.IPCRequest, 16)
+	}
+	c.done = make(chan struct{})
+	go c.readLoop()
+
+	if err := c.handshake(); err != nil {
+		ansi.PrintError("Handshake failed: " + err.Error())
+		c.Close()
+		return err
+	}
 
-	ansi.PrintColorAndBg(ansi.BgGray, ansi.BgCyan, "Connected to "+c.Sock)
+	ansi.PrintColorAndBg(ansi.BgGray, ansi.BgCyan, "Connected to "+conn.RemoteAddr().String())
 
 	// Print box with client info
 	ansi.PrintColor(ansi.Cyan, c.Stringify())
@@ -207,6 +213,30 @@ func (c *IPCClient) Connect(module string) error {
 	return nil
 }
 
+// dial connects to the server over TLS if configured, and the UNIX domain socket otherwise
+func (c *IPCClient) dial() (net.Conn, error) {
+	if c.TLS != nil {
+		if c.Addr == "" {
+			c.Addr = ipc.Address
+		}
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		return tls.DialWithDialer(dialer, ipc.Network, c.Addr, c.TLS)
+	}
+
+	if c.Sock == "" {
+		c.Sock = DefaultSocketPath()
+	}
+
+	// Check if the socket exists
+	if !fsutil.FileExists(c.Sock) {
+		err := c.SetSocket(DefaultSocketPath())
+		if err != nil { // The socket did not exist and the user did not want to retry
+			return nil, err // Return the error
+		}
+	}
+	return net.Dial("unix", c.Sock)
+}
+
 // userRetry asks the user if they want to retry connecting to the IPC server.
 func userRetry() bool {
 	fmt.Println("IPCClient not connected\nDid you forget to call Connect()?")
@@ -217,44 +247,195 @@ func userRetry() bool {
 	return retry[0] != 'n' // If the user doesn't want to retry, return false
 }
 
-func (c *IPCClient) AwaitResponse() error {
-	var err error
+// readLoop reads every message from the server, and hands responses over to the pending Call they answer.
+// Anything else is queued for ClientListen.
+// Chunked messages are put back together before they're handed over.
+func (c *IPCClient) readLoop() {
+	defer close(c.done)
 
-	if c.conn == nil {
-		ansi.PrintError("Connection not established")
+	assembler := ipc.NewAssembler(c.MaxMessageSize)
+
+	for {
+		chunk, err := c.conn.Receive()
+		if err != nil {
+			if err.Error() == "EOF" {
+				ansi.PrintWarning("Server closed the connection")
+			} else {
+				ansi.PrintError("Error parsing the connection: " + err.Error())
+			}
+			c.readErr = err
+			return
+		}
+
+		res, done, err := assembler.Add(chunk)
+		if err != nil {
+			ansi.PrintError("Dropping message from server: " + err.Error())
+			continue
+		}
+		if !done {
+			continue // Wait for the rest of the chunks
+		}
+
+		if res.Header.MessageType == ipc.MSG_PING {
+			go c.pong(res)
+			continue
+		}
+
+		c.pendingMu.Lock()
+		ch, ok := c.pending[res.CorrelationID]
+		if ok {
+			delete(c.pending, res.CorrelationID)
+		}
+		c.pendingMu.Unlock()
+
+		if ok {
+			ch <- res // Buffered, never blocks
+			continue
+		}
+
+		select {
+		case c.unsolicited <- res:
+		default:
+			ansi.PrintWarning("Dropping unsolicited message from server, nobody is listening")
+		}
 	}
+}
 
-	req, err := parseConnection(c.conn)
+// pong answers a ping from the server, so it knows we're still alive
+func (c *IPCClient) pong(ping ipc.IPCRequest) {
+	pong := c.CreateReq("", ipc.MSG_PONG, ipc.DATA_TEXT)
+	pong.CorrelationID = ping.CorrelationID
+	if err := c.send(pong); err != nil {
+		ansi.PrintError("Failed to answer ping: " + err.Error())
+	}
+}
+
+// handshake tells the server who we are and which protocol version we speak,
+// and agrees on compression and chunk size for the rest of the connection
+func (c *IPCClient) handshake() error {
+	hs := ipc.Handshake{
+		Name:            c.Name,
+		Identifier:      string(c.Identifier[:]),
+		ProtocolVersion: ipc.PROTOCOL_VERSION,
+		Compression:     ipc.SupportedEncodings,
+		MaxChunkSize:    ipc.DEFAULT_CHUNK_SIZE,
+	}
+	req := c.CreateGenericReq(hs, ipc.MSG_CONN, ipc.DATA_JSON)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := c.Call(ctx, req)
 	if err != nil {
-		if err.Error() == "EOF" {
-			ansi.PrintWarning("Client disconnected")
-			return err
-		}
-		ansi.PrintError("Error parsing the connection")
 		return err
 	}
-	ansi.PrintSuccess("Received response from server: " + req.Message.StringData)
+	if res.Request.Header.MessageType != ipc.MSG_CONNACK {
+		return fmt.Errorf("expected a connection acknowledgement, got message type %v", res.Request.Header.MessageType)
+	}
 
-	if string(req.Message.Data) == "OK" {
-		ansi.PrintColorf(ansi.LightCyan, "Message type: %v\n", req.Header.MessageType)
-		ansi.PrintSuccess("Checksums match")
-	} else {
-		ansi.PrintError("Checksums do not match")
-		return fmt.Errorf("checksums do not match")
+	var server ipc.Handshake
+	if err := json.Unmarshal(res.Request.Message.Data, &server); err != nil {
+		return err
 	}
+	ansi.PrintDebug(fmt.Sprintf("Server %s speaks protocol version %d", server.Name, server.ProtocolVersion))
 
+	if server.ProtocolVersion >= ipc.CHUNKING_VERSION {
+		c.negotiatedMu.Lock()
+		c.chunkSize = server.MaxChunkSize
+		if len(server.Compression) > 0 {
+			c.encoding = server.Compression[0]
+		}
+		ansi.PrintDebug(fmt.Sprintf("Using compression %q, chunk size %d", c.encoding, c.chunkSize))
+		c.negotiatedMu.Unlock()
+	}
 	return nil
 }
 
-// SendIPCMessage sends an IPC message to the server.
-func (c *IPCClient) SendIPCMessage(msg *ipc.IPCRequest) error {
-	var bBuffer bytes.Buffer
-	encoder := gob.NewEncoder(&bBuffer)
-	err := encoder.Encode(msg)
-	if err != nil {
-		return err
+// send writes the request to the server, chunked and compressed as negotiated in the handshake
+func (c *IPCClient) send(req *ipc.IPCRequest) error {
+	return c.sendBefore(req, time.Time{})
+}
+
+// sendBefore is send with a deadline for writing every message, none if it's zero
+func (c *IPCClient) sendBefore(req *ipc.IPCRequest, deadline time.Time) error {
+	c.negotiatedMu.RLock()
+	encoding, chunkSize := c.encoding, c.chunkSize
+	c.negotiatedMu.RUnlock()
+	if chunkSize == 0 {
+		return c.conn.SendBefore(req, deadline) // Not negotiated (yet)
 	}
+	return c.conn.SendChunkedBefore(req, encoding, chunkSize, deadline)
+}
 
+// Call sends the request to the server and waits for the response that carries the same CorrelationID.
+// Several calls may be in flight at once on the same connection.
+// If the server answers with an error, it is returned as an *ipc.Error along with the response.
+// The context controls how long to wait: if it is cancelled or its deadline passes,
+// Call returns the context error and the response is discarded when it arrives.
+func (c *IPCClient) Call(ctx context.Context, req *ipc.IPCRequest) (ipc.IPCResponse, error) {
+	if c.conn == nil {
+		return ipc.IPCResponse{}, fmt.Errorf("connection not established")
+	}
+	if req.CorrelationID == "" {
+		req.CorrelationID = ipc.NewCorrelationID()
+	}
+
+	ch := make(chan ipc.IPCRequest, 1)
+	c.pendingMu.Lock()
+	c.pending[req.CorrelationID] = ch
+	c.pendingMu.Unlock()
+
+	forget := func() {
+		c.pendingMu.Lock()
+		delete(c.pending, req.CorrelationID)
+		c.pendingMu.Unlock()
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.sendBefore(req, deadline); err != nil {
+		forget()
+		return ipc.IPCResponse{}, err
+	}
+
+	select {
+	case res := <-ch:
+		if res.Header.MessageType == ipc.MSG_ERROR {
+			return toResponse(res), ipc.ParseError(res)
+		}
+		return toResponse(res), nil
+	case <-ctx.Done():
+		forget()
+		return ipc.IPCResponse{}, ctx.Err()
+	case <-c.done:
+		forget()
+		if c.readErr != nil {
+			return ipc.IPCResponse{}, fmt.Errorf("%w: %v", ErrConnClosed, c.readErr)
+		}
+		return ipc.IPCResponse{}, ErrConnClosed
+	}
+}
+
+// toResponse wraps a message from the server in an IPCResponse
+func toResponse(res ipc.IPCRequest) ipc.IPCResponse {
+	checksumOk := res.Checksum32 == int(crc32.ChecksumIEEE(res.Message.Data))
+	if !checksumOk {
+		ansi.PrintError("Checksums do not match")
+	}
+
+	message := res.Message.StringData
+	if message == "" && res.Message.Datatype != ipc.DATA_BIN {
+		message = string(res.Message.Data) // Not sent along with chunked or compressed data
+	}
+
+	return ipc.IPCResponse{
+		Request:    res,
+		Success:    checksumOk && res.Header.MessageType != ipc.MSG_ERROR,
+		Message:    message,
+		Checksum32: res.Checksum32,
+	}
+}
+
+// SendIPCMessage sends an IPC message to the server, and waits for the response.
+func (c *IPCClient) SendIPCMessage(msg *ipc.IPCRequest) error {
 	if c.conn == nil {
 		if !userRetry() {
 			return fmt.Errorf("connection not established")
@@ -264,19 +445,17 @@ func (c *IPCClient) SendIPCMessage(msg *ipc.IPCRequest) error {
 	}
 
 	ansi.PrintItalic("Sending encoded message to server...")
-	_, err = c.conn.Write(bBuffer.Bytes())
+	res, err := c.Call(context.Background(), msg)
 	if err != nil {
-		fmt.Println("Write error:", err)
+		ansi.PrintError("Error receiving response from server")
+		fmt.Println(err)
 		return err
 	}
 	ansi.PrintSuccess("Message sent: " + msg.Message.StringData)
+	ansi.PrintSuccess("Received response from server: " + res.Message)
 
-	ansi.PrintDebug("Awaiting response...")
-	err = c.AwaitResponse()
-	if err != nil {
-		ansi.PrintError("Error receiving response from server")
-		fmt.Println(err)
-		return err
+	if !res.Success {
+		return fmt.Errorf("request %s failed: %s", msg.CorrelationID, res.Message)
 	}
 
 	return nil
@@ -288,7 +467,8 @@ func (c *IPCClient) CreateReq(message string, t ipc.MsgType, dataType ipc.DataTy
 	ansi.PrintDebug("Created IPC checksum: " + strconv.Itoa(int(checksum)))
 
 	return &ipc.IPCRequest{
-		MessageSignature: ipc.IPCID, // IPC Server ID
+		MessageSignature: c.Identifier[:],        // Identifier of the IPC client
+		CorrelationID:    ipc.NewCorrelationID(), // Echoed in the response
 		Header: ipc.IPCHeader{
 			Identifier:  c.Identifier, // Identifier of the IPC client
 			MessageType: byte(t),      // Type of the message
@@ -337,7 +517,8 @@ func (c *IPCClient) CreateGenericReq(message interface{}, t ipc.MsgType, dataTyp
 	ansi.PrintDebug("[CLIENT] Created IPC checksum: " + strconv.Itoa(int(checksum)))
 
 	return &ipc.IPCRequest{
-		MessageSignature: ipc.IPCID,
+		MessageSignature: c.Identifier[:],
+		CorrelationID:    ipc.NewCorrelationID(),
 		Header: ipc.IPCHeader{
 			Identifier:  c.Identifier,
 			MessageType: byte(t),
@@ -352,46 +533,7 @@ func (c *IPCClient) CreateGenericReq(message interface{}, t ipc.MsgType, dataTyp
 	}
 }
 
-// Return the parsed IPCRequest object
-func parseConnection(c net.Conn) (ipc.IPCRequest, error) {
-	var request ipc.IPCRequest
-	// var reqBuffer bytes.Buffer
-
-	ansi.PrintDebug("[CLIENT] Trying to decode the bytes to a request struct...")
-	ansi.PrintColorf(ansi.LightCyan, "[CLIENT] Decoding the bytes to a request struct... %v", c)
-
-	decoder := gob.NewDecoder(c)
-	err := decoder.Decode(&request)
-	if err != nil {
-		if err.Error() == "EOF" {
-			ansi.PrintWarning("parseConnection: EOF error, connection closed")
-			return request, err
-		}
-		ansi.PrintWarning("parseConnection: Error decoding the request \n > " + err.Error())
-		return request, err
-	}
-
-	ansi.PrintDebug("Trying to encode the bytes to a request struct...")
-	fmt.Println(request.Stringify())
-	ansi.PrintDebug("--------------------")
-
-	ansi.PrintSuccess("[ipcclient.go] Parsed the message signature!")
-	fmt.Printf("Message ID: %v\n", request.MessageSignature)
-
-	return request, nil
-}
-
 // Close the connection
 func (c *IPCClient) Close() {
 	c.conn.Close()
 }
-
-// Get a key from a value in a map such as IDENTIFIERS
-func getKeyFromValue(value [4]byte) (string, bool) {
-	for key, val := range ipc.IDENTIFIERS {
-		if val == value {
-			return key, true
-		}
-	}
-	return "", false
-}
@@ -0,0 +1,152 @@
+package ipcclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/ipc"
+)
+
+// connected returns a client reading from one end of a pipe, and the server's end
+func connected(t *testing.T) (*IPCClient, *ipc.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	c := NewIPCClient()
+	c.conn = ipc.NewConn(client)
+	c.done = make(chan struct{})
+	go c.readLoop()
+	return c, ipc.NewConn(server)
+}
+
+// answer returns a response to the request, of the message type and with the data
+func answer(req ipc.IPCRequest, messageType byte, data string) *ipc.IPCRequest {
+	return &ipc.IPCRequest{
+		CorrelationID: req.CorrelationID,
+		Header:        ipc.IPCHeader{MessageType: messageType},
+		Message:       ipc.IPCMessage{Datatype: ipc.DATA_TEXT, Data: []byte(data)},
+		Checksum32:    int(crc32.ChecksumIEEE([]byte(data))),
+	}
+}
+
+// Concurrent calls get the response carrying their own correlation ID, whatever order the server answers in
+func TestCallsAnsweredOutOfOrder(t *testing.T) {
+	const calls = 20
+	c, server := connected(t)
+
+	go func() {
+		var received []ipc.IPCRequest
+		for len(received) < calls {
+			req, err := server.Receive()
+			if err != nil {
+				return
+			}
+			received = append(received, req)
+		}
+		for i := len(received) - 1; i >= 0; i-- {
+			server.Send(answer(received[i], ipc.MSG_ACK, string(received[i].Message.Data)))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(message string) {
+			defer wg.Done()
+			res, err := c.Call(ctx, c.CreateReq(message, ipc.MSG_MSG, ipc.DATA_TEXT))
+			if err != nil {
+				t.Errorf("call %s: %v", message, err)
+				return
+			}
+			if res.Message != message {
+				t.Errorf("call %s got the response to %s", message, res.Message)
+			}
+		}(fmt.Sprint("call ", i))
+	}
+	wg.Wait()
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if len(c.pending) != 0 {
+		t.Errorf("%d calls are still pending", len(c.pending))
+	}
+}
+
+func TestCallFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  func(server *ipc.Conn, req ipc.IPCRequest)
+		timeout time.Duration
+		check   func(t *testing.T, req *ipc.IPCRequest, err error)
+	}{
+		{
+			name: "error envelope",
+			server: func(server *ipc.Conn, req ipc.IPCRequest) {
+				server.Send(answer(req, ipc.MSG_ERROR, `{"code":"unknown_table","message":"no table nope"}`))
+			},
+			check: func(t *testing.T, req *ipc.IPCRequest, err error) {
+				var e *ipc.Error
+				if !errors.As(err, &e) || e.Code != ipc.ERR_UNKNOWN_TABLE || e.RequestID != req.CorrelationID {
+					t.Errorf("got %v, want an %s error for request %s", err, ipc.ERR_UNKNOWN_TABLE, req.CorrelationID)
+				}
+			},
+		},
+		{
+			name:    "deadline",
+			server:  func(*ipc.Conn, ipc.IPCRequest) {},
+			timeout: 50 * time.Millisecond,
+			check: func(t *testing.T, _ *ipc.IPCRequest, err error) {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+				}
+			},
+		},
+		{
+			name:   "connection closed",
+			server: func(server *ipc.Conn, _ ipc.IPCRequest) { server.Close() },
+			check: func(t *testing.T, _ *ipc.IPCRequest, err error) {
+				if !errors.Is(err, ErrConnClosed) {
+					t.Errorf("got %v, want %v", err, ErrConnClosed)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := connected(t)
+			go func() {
+				if req, err := server.Receive(); err == nil {
+					tt.server(server, req)
+				}
+			}()
+
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			req := c.CreateReq("hello", ipc.MSG_MSG, ipc.DATA_TEXT)
+			_, err := c.Call(ctx, req)
+			tt.check(t, req, err)
+
+			c.pendingMu.Lock()
+			defer c.pendingMu.Unlock()
+			if len(c.pending) != 0 {
+				t.Errorf("%d calls are still pending", len(c.pending))
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package ipcserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/database"
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/pynezzentials/ansi"
+)
+
+const (
+	defaultMaxQueue   = 10000            // Events queued per subscription before the oldest are dropped
+	defaultAckTimeout = 30 * time.Second // How long a subscriber has to acknowledge an event before it's sent again
+	maxInFlight       = 64               // Unacknowledged events sent to a subscription at a time
+)
+
+// SubscriptionInfo is a snapshot of a subscription, as exposed through the API
+type SubscriptionInfo struct {
+	Identifier string    `json:"identifier"`
+	Pattern    string    `json:"pattern"`
+	Connected  bool      `json:"connected"` // Whether the module is connected to receive events
+	Queued     int       `json:"queued"`    // Events waiting to be acknowledged, including those in flight
+	InFlight   int       `json:"in_flight"` // Events sent, but not yet acknowledged
+	Acked      uint64    `json:"acked"`     // Events acknowledged since bivrost started
+	Dropped    uint64    `json:"dropped"`   // Events dropped because the queue was full, since bivrost started
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type subKey struct {
+	identifier string
+	pattern    string
+}
+
+// queued is an event in a subscription's queue
+type queued struct {
+	event    ipc.Event
+	sentAt   time.Time // Zero until sent, and again when sending fails or the module disconnects
+	attempts int
+}
+
+type subscription struct {
+	subKey
+	createdAt time.Time
+	queue     []*queued
+	acked     uint64
+	dropped   uint64
+}
+
+// sink delivers events to the connection of a module
+type sink struct {
+	connID  uint64
+	deliver func(ipc.Event) error
+	busy    bool // A delivery is in progress
+}
+
+// Bus is the module event bus of the IPC server. Every subscription has its own queue, and an event is sent again
+// until it's acknowledged, after the ack timeout or when the module reconnects.
+// Subscriptions belong to the module rather than the connection, so events published while it's down are delivered once it's back
+type Bus struct {
+	mu     sync.Mutex
+	subs   map[subKey]*subscription
+	sinks  map[string]*sink // Keyed by module identifier
+	lastID uint64
+
+	store      *database.EventQueue // nil keeps everything in memory
+	maxQueue   int
+	ackTimeout time.Duration
+
+	wake      chan struct{}
+	done      chan struct{} // Closed by Close
+	closeOnce sync.Once
+}
+
+func newBus() *Bus {
+	b := &Bus{
+		subs:       make(map[subKey]*subscription),
+		sinks:      make(map[string]*sink),
+		maxQueue:   defaultMaxQueue,
+		ackTimeout: defaultAckTimeout,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Close stops delivering events. Queued events are kept in the store, if there is one
+func (b *Bus) Close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// load restores the subscriptions and queues from the store, and persists them from now on
+func (b *Bus) load(store *database.EventQueue) error {
+	subs, events, err := store.Load()
+	if err != nil {
+		return err
+	}
+	lastID, err := store.LastEventID()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store = store
+	if lastID > b.lastID {
+		b.lastID = lastID
+	}
+	for _, s := range subs {
+		key := subKey{s.Identifier, s.Pattern}
+		if _, ok := b.subs[key]; !ok {
+			b.subs[key] = &subscription{subKey: key, createdAt: s.CreatedAt}
+		}
+	}
+	for _, e := range events {
+		sub, ok := b.subs[subKey{e.Identifier, e.Pattern}]
+		if !ok {
+			continue
+		}
+		sub.queue = append(sub.queue, &queued{
+			event: ipc.Event{
+				ID:           e.EventID,
+				Topic:        e.Topic,
+				Source:       e.Source,
+				Payload:      e.Payload,
+				PublishedAt:  e.PublishedAt,
+				Subscription: e.Pattern,
+			},
+			attempts: e.Attempts,
+		})
+	}
+	ansi.PrintInfo(fmt.Sprintf("[EVENTS] Loaded %d subscriptions and %d queued events", len(subs), len(events)))
+	return nil
+}
+
+// Subscribe subscribes the module to the topics matching the pattern.
+// Subscribing again sends the events in flight again right away: the module is ready for them,
+// and may have dropped those that arrived before it was.
+func (b *Bus) Subscribe(identifier, pattern string) error {
+	if err := ipc.ValidatePattern(pattern); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := subKey{identifier, pattern}
+	if sub, ok := b.subs[key]; ok {
+		for _, q := range sub.queue {
+			q.sentAt = time.Time{}
+		}
+		b.poke()
+		return nil
+	}
+	if b.store != nil {
+		if err := b.store.Subscribe(identifier, pattern); err != nil {
+			return err
+		}
+	}
+	b.subs[key] = &subscription{subKey: key, createdAt: time.Now()}
+	ansi.PrintDebug("[EVENTS] " + identifier + " subscribed to " + pattern)
+	return nil
+}
+
+// Unsubscribe removes the subscription and drops its queue. Returns false if there was no such subscription
+func (b *Bus) Unsubscribe(identifier, pattern string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := subKey{identifier, pattern}
+	if _, ok := b.subs[key]; !ok {
+		return false, nil
+	}
+	if b.store != nil {
+		if err := b.store.Unsubscribe(identifier, pattern); err != nil {
+			return false, err
+		}
+	}
+	delete(b.subs, key)
+	ansi.PrintDebug("[EVENTS] " + identifier + " unsubscribed from " + pattern)
+	return true, nil
+}
+
+// Publish queues the event for every subscription matching the topic
+func (b *Bus) Publish(source, topic string, payload json.RawMessage) (ipc.Published, error) {
+	if err := ipc.ValidateTopic(topic); err != nil {
+		return ipc.Published{}, err
+	}
+	if len(payload) == 0 {
+		payload = json.RawMessage("null")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event := ipc.Event{
+		ID:          b.lastID + 1,
+		Topic:       topic,
+		Source:      source,
+		Payload:     payload,
+		PublishedAt: time.Now(),
+	}
+	var matched []*subscription
+	for _, sub := range b.subs {
+		if ipc.MatchTopic(sub.pattern, topic) {
+			matched = append(matched, sub)
+		}
+	}
+
+	if b.store != nil && len(matched) > 0 {
+		rows := make([]database.QueuedEvent, len(matched))
+		for i, sub := range matched {
+			rows[i] = database.QueuedEvent{
+				Identifier:  sub.identifier,
+				Pattern:     sub.pattern,
+				EventID:     event.ID,
+				Topic:       topic,
+				Source:      source,
+				Payload:     payload,
+				PublishedAt: event.PublishedAt,
+			}
+		}
+		if err := b.store.Enqueue(rows); err != nil {
+			return ipc.Published{}, err
+		}
+	}
+	b.lastID = event.ID
+
+	for _, sub := range matched {
+		e := event
+		e.Subscription = sub.pattern
+		sub.queue = append(sub.queue, &queued{event: e})
+		if len(sub.queue) > b.maxQueue {
+			oldest := sub.queue[0]
+			sub.queue = sub.queue[1:]
+			sub.dropped++
+			b.remove(sub, oldest.event.ID)
+			ansi.PrintWarning(fmt.Sprintf("[EVENTS] Queue of %s (%s) is full, dropped event %d", sub.identifier, sub.pattern, oldest.event.ID))
+		}
+	}
+	b.poke()
+	return ipc.Published{ID: event.ID, Subscribers: len(matched)}, nil
+}
+
+// Ack removes the event from the subscription's queue. Returns false if it wasn't queued, ex: already acknowledged
+func (b *Bus) Ack(identifier string, ack ipc.EventAck) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub, ok := b.subs[subKey{identifier, ack.Subscription}]
+	if !ok {
+		return false
+	}
+	for i, q := range sub.queue {
+		if q.event.ID == ack.ID {
+			sub.queue = append(sub.queue[:i], sub.queue[i+1:]...)
+			sub.acked++
+			b.remove(sub, ack.ID)
+			b.poke() // Room for more events in flight
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes the event from the store. Must be called with the lock held
+func (b *Bus) remove(sub *subscription, id uint64) {
+	if b.store == nil {
+		return
+	}
+	if err := b.store.Remove(sub.identifier, sub.pattern, id); err != nil {
+		ansi.PrintError("[EVENTS] Failed to remove event from the queue: " + err.Error())
+	}
+}
+
+// attach starts delivering the module's events to the connection, replacing any previous one
+func (b *Bus) attach(identifier string, connID uint64, deliver func(ipc.Event) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sinks[identifier] = &sink{connID: connID, deliver: deliver}
+	b.resend(identifier)
+	b.poke()
+}
+
+// detach stops delivering to the connection. Events it didn't acknowledge are sent again on the next attach
+func (b *Bus) detach(identifier string, connID uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.sinks[identifier]; ok && s.connID == connID {
+		delete(b.sinks, identifier)
+		b.resend(identifier)
+	}
+}
+
+// resend marks the module's events in flight as unsent. Must be called with the lock held
+func (b *Bus) resend(identifier string) {
+	for _, sub := range b.subs {
+		if sub.identifier != identifier {
+			continue
+		}
+		for _, q := range sub.queue {
+			q.sentAt = time.Time{}
+		}
+	}
+}
+
+// poke wakes up the delivery loop. Never blocks
+func (b *Bus) poke() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued events, whenever something changes and at least every second for redeliveries
+func (b *Bus) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.wake:
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+		b.deliver()
+	}
+}
+
+type delivery struct {
+	sub *subscription
+	q   *queued
+	e   ipc.Event
+}
+
+// deliver sends the events that are due to every connected module that isn't busy.
+// Each module is sent to in its own goroutine, so a slow module doesn't hold up the others.
+func (b *Bus) deliver() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	batches := make(map[string][]delivery)
+	for _, sub := range b.subs {
+		s, ok := b.sinks[sub.identifier]
+		if !ok || s.busy {
+			continue
+		}
+		inFlight := 0
+		for _, q := range sub.queue {
+			if !q.sentAt.IsZero() && now.Sub(q.sentAt) < b.ackTimeout {
+				inFlight++
+			}
+		}
+		for _, q := range sub.queue {
+			if inFlight >= maxInFlight {
+				break
+			}
+			if !q.sentAt.IsZero() && now.Sub(q.sentAt) < b.ackTimeout {
+				continue
+			}
+			q.sentAt = now
+			q.attempts++
+			inFlight++
+			e := q.event
+			e.Attempt = q.attempts
+			batches[sub.identifier] = append(batches[sub.identifier], delivery{sub, q, e})
+		}
+	}
+
+	for identifier, batch := range batches {
+		s := b.sinks[identifier]
+		s.busy = true
+		go b.send(identifier, s, batch)
+	}
+}
+
+// send delivers the batch to the module. Events that can't be sent are left for the next attempt
+func (b *Bus) send(identifier string, s *sink, batch []delivery) {
+	var failed []delivery
+	for i, d := range batch {
+		if err := s.deliver(d.e); err != nil {
+			ansi.PrintDebug("[EVENTS] Failed to deliver to " + identifier + ": " + err.Error())
+			failed = batch[i:]
+			break
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s.busy = false
+	for _, d := range failed {
+		d.q.sentAt = time.Time{}
+		d.q.attempts--
+	}
+	if b.store != nil {
+		for _, d := range batch[:len(batch)-len(failed)] {
+			if err := b.store.Delivered(identifier, d.sub.pattern, d.e.ID, d.e.Attempt); err != nil {
+				ansi.PrintError("[EVENTS] Failed to record the delivery: " + err.Error())
+			}
+		}
+	}
+	if len(failed) == 0 {
+		b.poke() // There may be more waiting behind the batch
+	}
+}
+
+// Subscriptions returns a snapshot of every subscription, ordered by module and pattern
+func (b *Bus) Subscriptions() []SubscriptionInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	list := make([]SubscriptionInfo, 0, len(b.subs))
+	for _, sub := range b.subs {
+		_, connected := b.sinks[sub.identifier]
+		info := SubscriptionInfo{
+			Identifier: sub.identifier,
+			Pattern:    sub.pattern,
+			Connected:  connected,
+			Queued:     len(sub.queue),
+			Acked:      sub.acked,
+			Dropped:    sub.dropped,
+			CreatedAt:  sub.createdAt,
+		}
+		for _, q := range sub.queue {
+			if !q.sentAt.IsZero() && now.Sub(q.sentAt) < b.ackTimeout {
+				info.InFlight++
+			}
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Identifier != list[j].Identifier {
+			return list[i].Identifier < list[j].Identifier
+		}
+		return list[i].Pattern < list[j].Pattern
+	})
+	return list
+}
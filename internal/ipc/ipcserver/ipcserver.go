@@ -1,17 +1,20 @@
 package ipcserver
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -33,15 +36,12 @@ import (
 const (
 	AF_UNIX  = "unix"     // UNIX domain sockets
 	AF_DGRAM = "unixgram" // UNIX domain datagram sockets as specified in net package
+
+	TRANSPORT_TLS = "tls" // TCP with mutual TLS, for modules on other hosts
 )
 
-/* IDENTIFIERS
- * To identify the module, the client will send a 4 byte identifier as part of the header.
- */
-var MODULEIDENTIFIERS map[string][]byte
-var MSGTYPE map[string]byte
-var SERVERIDENTIFIER [4]byte
-var IPCID []byte
+// How long a remote module gets to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
 
 /* TYPES
  * Types for the IPC communication between the connector and the other modules.
@@ -49,100 +49,224 @@ var IPCID []byte
 type IPCServer struct {
 	path         string
 	identifier   string
-	conn         net.Listener
-	moduleStates map[string]*ipc.ModuleState
+	conn         net.Listener                   // UNIX domain socket listener
+	tlsConn      net.Listener                   // TCP listener for remote modules, if enabled
+	moduleStates map[cursorKey]*ipc.ModuleState // Read cursors of the modules, by module and table
+	moduleErrors map[string]*ModuleErrors       // Requests answered with an error, by module identifier
+	statesMu     sync.Mutex                     // Guards moduleStates and moduleErrors, as requests are handled concurrently
+
+	serverID [4]byte           // Sent as the identifier in the handshake. Modules send their own in the header of every message
+	modules  *modules.Registry // The loaded modules, to look up names and manifests by identifier
+	stores   *stores.Stores    // Tables of the built in models, nil if not available
+
+	registry          *ConnectionRegistry // Connected modules
+	heartbeatInterval time.Duration       // How often to ping connected modules
+	peerTimeout       time.Duration       // How long a module may stay silent before it's dropped
+
+	maxChunkSize   int      // Largest chunk sent to a module
+	maxMessageSize int      // Largest (reassembled) message accepted from a module
+	compression    []string // Encodings the server is willing to use, in order of preference
+
+	moduleTables *database.ModuleTables // Result tables declared by modules, nil if not available
+	bus          *Bus                   // Events published by modules, see bus.go
+
+	hooks Hooks
+
+	captureMu sync.Mutex
+	capture   *ipc.Capture // Frames of the module connections are recorded to it, nil if not capturing
+}
+
+// Hooks are called while the server handles modules, to observe or interfere with the traffic.
+// They are meant for tests, such as the module conformance tests in pkg/moduletest, and must be set before listening.
+// identifier is the identifier of the module the request came from. Any of the hooks may be nil.
+type Hooks struct {
+	OnHandshake func(identifier string, hs ipc.Handshake)            // After the handshake was acknowledged
+	OnPost      func(identifier, table string, data json.RawMessage) // After the data of a POST was inserted
+	OnError     func(identifier string, e *ipc.Error)                // When a request is answered with an error
+
+	// Called before a request is handled. If it returns an error, the request is answered with it instead
+	Intercept func(identifier string, m ipc.Metadata) *ipc.Error
 }
 
+// Rows fetched from the database at a time when streaming a GET response
+const pageSize = 1000
+
+// CloseConn stops accepting modules and delivering events
 func (s *IPCServer) CloseConn() {
-	s.conn.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.tlsConn != nil {
+		s.tlsConn.Close()
+	}
+	s.bus.Close()
 }
 
-func init() {
-	MODULEIDENTIFIERS = map[string][]byte{}
+// NewIPCServer creates a new IPC server listening on the default socket for the name, see ipc.DefaultSock.
+// identifier is truncated to the 4 bytes of a message identifier. registry holds the modules allowed to connect,
+// a nil registry is the same as an empty one.
+// Nothing is shared between servers, so several can run in the same process.
+func NewIPCServer(name string, identifier string, registry *modules.Registry) *IPCServer {
+	path := ipc.DefaultSock(name)
+	if len(identifier) > 4 {
+		ansi.PrintInfo("Truncating the server identifier " + identifier + " to 4 bytes")
+	}
+	var serverID [4]byte
+	copy(serverID[:], identifier)
+	if registry == nil {
+		registry = modules.NewRegistry()
+	}
+
+	ansi.PrintColorf(ansi.LightCyan, "[SOCKETS] IPC server path: %s", path)
+
+	return &IPCServer{
+		path:              path,
+		identifier:        identifier,
+		serverID:          serverID,
+		modules:           registry,
+		conn:              nil,
+		moduleStates:      make(map[cursorKey]*ipc.ModuleState),
+		moduleErrors:      make(map[string]*ModuleErrors),
+		registry:          newConnectionRegistry(),
+		heartbeatInterval: defaultHeartbeatInterval,
+		peerTimeout:       defaultPeerTimeout,
+		maxChunkSize:      ipc.DEFAULT_CHUNK_SIZE,
+		maxMessageSize:    ipc.DEFAULT_MESSAGE_SIZE,
+		compression:       ipc.SupportedEncodings,
+		bus:               newBus(),
+	}
 }
 
-// LoadModules loads the modules from the given file
-// It will parse the config file and add the modules to the server map
-func LoadModules(path string) {
-	if !fsutil.FileExists(path) {
-		ansi.PrintError("LoadModules(): File does not exist: " + path)
+// SetHeartbeat sets how often connected modules are pinged, and how long they may stay silent before
+// the connection is dropped. Zero values keep the current setting.
+func (s *IPCServer) SetHeartbeat(interval, timeout time.Duration) {
+	if interval > 0 {
+		s.heartbeatInterval = interval
 	}
-	ansi.PrintSuccess("File exists: " + path)
-	f, err := os.Open(path)
-	if err != nil {
-		ansi.PrintError("LoadModules(): " + err.Error())
-		return
+	if timeout > 0 {
+		s.peerTimeout = timeout
 	}
-	defer f.Close()
+}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		fmt.Println(line)
-		parts := strings.Split(line, " ")
-		if len(parts[0]) < 1 {
-			// empty line
-			continue
-		}
-		firstChar := parts[0][0]
-		if firstChar == '#' || firstChar == ' ' || firstChar == '\t' || firstChar == '/' || firstChar == '*' || firstChar == '\n' || firstChar == '\r' {
-			// comment
-			continue
-		}
+// SetTransfer sets the largest chunk sent to modules, the largest message accepted from them,
+// and which compression encodings may be negotiated. Zero values and a nil list keep the current setting.
+// An empty, non-nil list disables compression.
+func (s *IPCServer) SetTransfer(maxChunkSize, maxMessageSize int, compression []string) {
+	if maxChunkSize > 0 {
+		s.maxChunkSize = maxChunkSize
+	}
+	if maxMessageSize > 0 {
+		s.maxMessageSize = maxMessageSize
+	}
+	if compression != nil {
+		s.compression = compression
+	}
+}
 
-		for i, part := range parts {
-			if part == "\t" || part == " " {
-				// skip
-				continue
-			}
-			parts[i] = strings.TrimSpace(part)
-		}
+// SetStores gives modules access to the tables of the built in models
+func (s *IPCServer) SetStores(st *stores.Stores) {
+	s.stores = st
+}
+
+// SetModuleTables enables result tables declared by modules, in their manifest or handshake
+func (s *IPCServer) SetModuleTables(t *database.ModuleTables) {
+	s.moduleTables = t
+}
 
-		AddModule(parts[0], []byte(parts[1])) // Add module to the server
-		ansi.PrintColorf(ansi.LightCyan, "Loaded module: %s", parts[0])
+// SetEvents configures the event bus. With a queue, subscriptions and undelivered events are stored in the database
+// and survive a restart, otherwise they are kept in memory. Zero values keep the current setting.
+func (s *IPCServer) SetEvents(queue *database.EventQueue, maxQueue int, ackTimeout time.Duration) error {
+	s.bus.mu.Lock()
+	if maxQueue > 0 {
+		s.bus.maxQueue = maxQueue
+	}
+	if ackTimeout > 0 {
+		s.bus.ackTimeout = ackTimeout
 	}
+	s.bus.mu.Unlock()
+
+	if queue == nil {
+		return nil
+	}
+	return s.bus.load(queue)
 }
 
-// NewIPCServer creates a new IPC server and returns it.
-func NewIPCServer(name string, identifier string) *IPCServer {
-	path := ipc.DefaultSock(name)
-	IPCID = []byte(identifier)
-	ipc.SetIPCID(IPCID)
-	SetServerIdentifier(IPCID)
+// SetHooks sets the hooks called while handling modules, see Hooks
+func (s *IPCServer) SetHooks(h Hooks) {
+	s.hooks = h
+}
 
-	moduleStates := make(map[string]*ipc.ModuleState)
+// DEFAULT_CAPTURE_DIR is where capture files go if no directory is configured
+const DEFAULT_CAPTURE_DIR = "captures"
 
-	ansi.PrintColorf(ansi.LightCyan, "[SOCKETS] IPC server path: %s", path)
+// StartCapture records every frame on the connections of the modules with the identifiers (or every module,
+// if there are none) to a new capture file in the directory. Fails if a capture is already in progress.
+func (s *IPCServer) StartCapture(dir string, identifiers []string) (ipc.CaptureInfo, error) {
+	if dir == "" {
+		dir = DEFAULT_CAPTURE_DIR
+	}
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if s.capture != nil {
+		return s.capture.Info(), fmt.Errorf("already capturing to %s", s.capture.Info().Path)
+	}
 
-	return &IPCServer{
-		path:         path,
-		identifier:   identifier,
-		conn:         nil,
-		moduleStates: moduleStates,
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return ipc.CaptureInfo{}, err
+	}
+	path := filepath.Join(dir, "capture-"+time.Now().Format("20060102-150405")+".jsonl")
+	capture, err := ipc.CreateCapture(path, identifiers...)
+	if err != nil {
+		return ipc.CaptureInfo{}, err
+	}
+	s.capture = capture
+	s.registry.setCapture(capture)
+	ansi.PrintInfo("[SOCKETS] Capturing IPC frames to " + path)
+	return capture.Info(), nil
+}
+
+// StopCapture stops the capture in progress, and returns what was captured
+func (s *IPCServer) StopCapture() (ipc.CaptureInfo, error) {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if s.capture == nil {
+		return ipc.CaptureInfo{}, fmt.Errorf("not capturing")
 	}
+	s.registry.setCapture(nil)
+	info := s.capture.Info()
+	err := s.capture.Close()
+	s.capture = nil
+	ansi.PrintInfo(fmt.Sprintf("[SOCKETS] Captured %d IPC frames to %s", info.Frames, info.Path))
+	return info, err
 }
 
-// Add a new module identifier to the map
-func AddModule(identifier string, id []byte) {
-	if len(id) > 4 {
-		ansi.PrintError("AddModule(): Identifier length must be 4 bytes")
-		ansi.PrintInfo("Truncating the identifier to 4 bytes")
-		id = id[:4]
+// Capture describes the capture in progress, if any
+func (s *IPCServer) Capture() (ipc.CaptureInfo, bool) {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if s.capture == nil {
+		return ipc.CaptureInfo{}, false
 	}
-	MODULEIDENTIFIERS[identifier] = id
+	return s.capture.Info(), true
+}
+
+// Subscriptions returns a snapshot of the event bus subscriptions
+func (s *IPCServer) Subscriptions() []SubscriptionInfo {
+	return s.bus.Subscriptions()
+}
 
-	ansi.PrintSuccess("added module:" + string(MODULEIDENTIFIERS[identifier]))
+// Connections returns a snapshot of the modules currently connected to the server
+func (s *IPCServer) Connections() []ModuleConn {
+	return s.registry.List()
 }
 
-// Set the server identifier to the SERVERIDENTIFIER variable
-func SetServerIdentifier(id []byte) {
-	if len(id) > 4 {
-		ansi.PrintError("SetServerIdentifier(): Identifier length must be 4 bytes")
-		ansi.PrintInfo("Truncating the identifier to 4 bytes")
-		id = id[:4]
+// Disconnect closes the connections of the module with the identifier, and returns how many were closed
+func (s *IPCServer) Disconnect(identifier string) int {
+	n := s.registry.disconnect(identifier)
+	if n > 0 {
+		ansi.PrintInfo(fmt.Sprintf("Disconnected %d connection(s) of module %s", n, identifier))
 	}
-	SERVERIDENTIFIER = [4]byte(id) // Convert the slice to an array
-	ansi.PrintSuccess("Set server identifier: " + string(SERVERIDENTIFIER[:]))
+	return n
 }
 
 // Write a socket file and add it to the map
@@ -152,6 +276,10 @@ func (s *IPCServer) InitServerSocket() bool {
 		ansi.PrintError("InitServerSocket(): Failed to remove old socket: " + err.Error())
 		return false
 	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		ansi.PrintError("InitServerSocket(): Failed to create the socket directory: " + err.Error())
+		return false
+	}
 	return true
 }
 
@@ -166,24 +294,72 @@ func (s *IPCServer) Listen() {
 	}
 	ansi.PrintColorf(ansi.LightCyan, "[SOCKETS] Starting listener on %s", s.path)
 
+	s.serve(s.conn)
+}
+
+// ListenTLS accepts modules on other hosts over TCP, on the given address (such as ipc.Address).
+// Clients must present a certificate trusted by the config, see ipc.ServerTLSConfig.
+func (s *IPCServer) ListenTLS(address string, config *tls.Config) {
+	var err error
+	s.tlsConn, err = tls.Listen(ipc.Network, address, config)
+	if err != nil {
+		ansi.PrintError("ListenTLS(): " + err.Error())
+		return
+	}
+	ansi.PrintColorf(ansi.LightCyan, "[SOCKETS] Starting TLS listener on %s", address)
+
+	s.serve(s.tlsConn)
+}
+
+// Serve accepts modules on a listener created by the caller, ex: a socket in a temporary directory.
+// It returns when the listener is closed.
+func (s *IPCServer) Serve(l net.Listener) {
+	s.serve(l)
+}
+
+// serve accepts connections until the listener is closed
+func (s *IPCServer) serve(l net.Listener) {
 	for {
 		ansi.PrintDebug("Waiting for connection...")
-		ansi.PrintDebug("Network: " + s.conn.Addr().Network())
-
-		conn, err := s.conn.Accept()
-		ansi.PrintColorf(ansi.LightCyan, "[SOCKETS]: New connection from %s", conn.LocalAddr().String())
+		ansi.PrintDebug("Network: " + l.Addr().Network())
 
+		conn, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			ansi.PrintError("Listen(): " + err.Error())
 			continue
 		}
+		ansi.PrintColorf(ansi.LightCyan, "[SOCKETS]: New connection from %s", conn.RemoteAddr().String())
+
 		go s.handleConnection(conn) // Handle the connection in a separate goroutine to handle multiple connections
 	}
 }
 
-// Function to create a new IPCMessage based on the identifier key
-func NewIPCMessage(identifierKey string, messageType byte, data []byte) (*ipc.IPCRequest, error) {
-	identifier := modules.Mids.GetModuleIdentifier(identifierKey)
+// certIdentifier completes the TLS handshake and returns the module identifier bound to the client certificate.
+// The certificate's Common Name is either the name or the identifier of a loaded module. Modules that only
+// connected to the socket aren't loaded, so a certificate can't be bound to them.
+func (s *IPCServer) certIdentifier(c *tls.Conn) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := c.HandshakeContext(ctx); err != nil {
+		return "", err
+	}
+
+	name := ipc.PeerName(c.ConnectionState())
+	if m, ok := s.modules.Module(name); ok && m.Config != nil {
+		return m.Config.Identifier, nil
+	}
+	if len(name) == 4 && s.modules.Config(name) != nil {
+		return name, nil
+	}
+	return "", fmt.Errorf("client certificate %q does not belong to a known module", name)
+}
+
+// newMessage creates a new IPC message to the module with the name or identifier
+func (s *IPCServer) newMessage(identifierKey string, messageType byte, data []byte) (*ipc.IPCRequest, error) {
+	identifier, _ := s.modules.Identifier(identifierKey)
 	ansi.PrintDebug("NewIPCMessage from module with key: " + identifierKey)
 
 	messageId := fmt.Sprintf("%d-%s", time.Now().UnixNano(), identifierKey)
@@ -208,14 +384,6 @@ func NewIPCMessage(identifierKey string, messageType byte, data []byte) (*ipc.IP
 	}, nil
 }
 
-// Return the parsed IPCRequest object
-func parseConnection(c net.Conn) (ipc.IPCRequest, error) {
-	var request ipc.IPCRequest
-	decoder := gob.NewDecoder(c)
-	err := decoder.Decode(&request)
-	return request, err
-}
-
 // Parse the metadata from the message
 // Returns the source, destination, and a boolean indicating if the metadata is nil
 func parseMetadata(msg ipc.Metadata) (ipc.Metadata, bool) {
@@ -231,6 +399,12 @@ func parseMetadata(msg ipc.Metadata) (ipc.Metadata, bool) {
 		v = "update data in"
 	} else if metadata.Method == "DELETE" {
 		v = "delete data from"
+	} else if metadata.Method == ipc.METHOD_PUBLISH {
+		v = "publish an event on " + metadata.Topic + " from"
+	} else if metadata.Method == ipc.METHOD_SUBSCRIBE {
+		v = "subscribe to " + metadata.Topic + " from"
+	} else if metadata.Method == ipc.METHOD_UNSUBSCRIBE {
+		v = "unsubscribe from " + metadata.Topic + " from"
 	} else {
 		v = "???"
 	}
@@ -248,7 +422,7 @@ type JsonResponse struct {
 	Model    string       `json:"model"`
 }
 
-func parseData(msg *ipc.IPCMessage) (ipc.GenericData, JsonResponse) {
+func parseData(msg *ipc.IPCMessage) (ipc.GenericData, JsonResponse, error) {
 	var data ipc.GenericData
 	var jsonData JsonResponse
 
@@ -266,8 +440,9 @@ func parseData(msg *ipc.IPCMessage) (ipc.GenericData, JsonResponse) {
 		if err != nil {
 			errMsg := fmt.Errorf("error unmarshaling JSON data: %w", err)
 			fmt.Println(errMsg)
+			return data, jsonData, errMsg
 		}
-		return data, jsonData
+		return data, jsonData, nil
 
 	case ipc.DATA_YAML:
 		// Parse the YAML data
@@ -291,11 +466,7 @@ func parseData(msg *ipc.IPCMessage) (ipc.GenericData, JsonResponse) {
 
 	}
 
-	if data == nil {
-		fmt.Println("Data is nil")
-	}
-
-	return data, jsonData
+	return data, jsonData, nil
 }
 
 func handleGenericData( /* t reflect.Type, */ dataType any) {
@@ -312,14 +483,56 @@ func handleGenericData( /* t reflect.Type, */ dataType any) {
 	fmt.Println("Data: ", dataType)
 }
 
-// handleConnection handles the incoming connection
+// handleConnection handles the incoming connection.
+// Requests are read sequentially, but each one is handled in its own goroutine,
+// so a module may have several requests in flight on the same connection.
+// Responses carry the CorrelationID of the request they answer.
 func (s *IPCServer) handleConnection(c net.Conn) {
-	// defer c.Close()
+	transport, identifier := AF_UNIX, ""
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		var err error
+		transport = TRANSPORT_TLS
+		identifier, err = s.certIdentifier(tlsConn)
+		if err != nil {
+			ansi.PrintError("handleConnection: rejected " + c.RemoteAddr().String() + ": " + err.Error())
+			c.Close()
+			return
+		}
+		ansi.PrintColorf(ansi.LightCyan, "[SOCKETS] %s authenticated as %s", c.RemoteAddr().String(), identifier)
+	}
+
+	tracked := s.registry.add(c, transport, identifier)
+	s.captureMu.Lock()
+	if s.capture != nil {
+		tracked.conn.SetCapture(s.capture, ipc.FROM_SERVER)
+	}
+	s.captureMu.Unlock()
+	conn := tracked.conn
+	conn.SetMaxFrameSize(s.maxMessageSize)
+	defer s.registry.remove(tracked)
+	defer conn.Close()
 
 	ansi.PrintColorf(ansi.LightCyan, "[SOCKETS] Handling connection...")
 
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+	go s.heartbeat(tracked, stopHeartbeat)
+
+	assembler := ipc.NewAssembler(s.maxMessageSize)
+
+	// Events are delivered to the identifier of the last handshake, until the connection closes
+	var attached string
+	defer func() {
+		if attached != "" {
+			s.bus.detach(attached, tracked.id)
+		}
+	}()
+
 	for {
-		inboundRequest, err := parseConnection(c)
+		chunk, err := conn.Receive()
 		if err != nil {
 			if err == io.EOF {
 				ansi.PrintDebug("Connection closed by client")
@@ -328,93 +541,366 @@ func (s *IPCServer) handleConnection(c net.Conn) {
 			fmt.Println(ansi.Errorf("Error parsing request: " + err.Error()))
 			break
 		}
+		tracked.touch()
 
-		_, d := parseData(&inboundRequest.Message) // Should be of type ipc.IPCMessage
-		if d == *new(JsonResponse) {
-			fmt.Println("Data is nil")
-			return
+		inboundRequest, done, err := assembler.Add(chunk)
+		if err != nil {
+			ansi.PrintError("handleConnection: dropping message: " + err.Error())
+			code := ipc.ERR_DECODE
+			switch {
+			case errors.Is(err, ipc.ErrChecksum):
+				code = ipc.ERR_CHECKSUM
+			case errors.Is(err, ipc.ErrTooLarge):
+				code = ipc.ERR_TOO_LARGE
+			}
+			s.respondError(tracked, chunk, ipc.AsError(err, code))
+			continue
+		}
+		if !done {
+			continue // Wait for the rest of the chunks
+		}
+		if !tracked.allowed(inboundRequest.Header.Identifier) {
+			s.respondError(tracked, inboundRequest, ipc.NewError(ipc.ERR_FORBIDDEN,
+				"connection belongs to %s, cannot send as %s", tracked.certIdentifier, inboundRequest.Header.Identifier[:]))
+			continue
 		}
 
-		moduleName := modules.Mids.GetModuleName(inboundRequest.Header.Identifier)
+		moduleName := s.modules.Name(inboundRequest.Header.Identifier)
 		if moduleName == "" {
 			ansi.PrintColorf(ansi.LightRed, "[+] Added module name: %s", moduleName)
-			modules.Mids.StoreModuleIdentifier(string(inboundRequest.Header.Identifier[:]), inboundRequest.Header.Identifier)
+			s.modules.StoreIdentifier(string(inboundRequest.Header.Identifier[:]), inboundRequest.Header.Identifier)
 		} else {
 			ansi.PrintColorf(ansi.LightCyan, "Module name: %s", moduleName)
 		}
+		tracked.setModule(string(inboundRequest.Header.Identifier[:]), moduleName, 0)
+
+		switch inboundRequest.Header.MessageType {
+		case ipc.MSG_CONN:
+			if err := s.handleHandshake(tracked, inboundRequest); err != nil {
+				ansi.PrintError("handleConnection: handshake failed: " + err.Error())
+				s.respondError(tracked, inboundRequest, ipc.AsError(err, ipc.ERR_DECODE))
+				return
+			}
+			if attached != "" {
+				s.bus.detach(attached, tracked.id)
+			}
+			attached = s.attachEvents(tracked)
+			continue
+		case ipc.MSG_EVENTACK:
+			var ack ipc.EventAck
+			if err := json.Unmarshal(inboundRequest.Message.Data, &ack); err != nil {
+				ansi.PrintError("handleConnection: invalid event acknowledgement: " + err.Error())
+				continue
+			}
+			s.bus.Ack(string(inboundRequest.Header.Identifier[:]), ack)
+			continue
+		case ipc.MSG_PING:
+			moduleId := string(inboundRequest.Header.Identifier[:])
+			if err := s.respondWith(tracked, ipc.MSG_PONG, nil, moduleId, inboundRequest.CorrelationID); err != nil {
+				ansi.PrintError("handleConnection: failed to answer ping: " + err.Error())
+			}
+			continue
+		case ipc.MSG_PONG:
+			continue // Already marked as alive
+		}
 
-		source := fmt.Sprint(modules.Mids.GetModuleIdentifier(moduleName)) // Sorry about this (this should print the identifier of the module that sent the request)
-		fmt.Println("Source: " + source)
+		wg.Add(1)
+		go func(req ipc.IPCRequest) {
+			defer wg.Done()
+			if err := s.handleRequest(tracked, req); err != nil {
+				ansi.PrintError("handleConnection: " + err.Error())
+			}
+		}(inboundRequest)
+	}
+}
 
-		var response []byte
+// handleHandshake records the module's handshake and answers with the server's own
+func (s *IPCServer) handleHandshake(t *trackedConn, req ipc.IPCRequest) error {
+	var hs ipc.Handshake
+	if err := json.Unmarshal(req.Message.Data, &hs); err != nil {
+		return err
+	}
+	ansi.PrintColorf(ansi.LightCyan, "[SOCKETS] Handshake from %s (%s), protocol version %d", hs.Name, hs.Identifier, hs.ProtocolVersion)
+	if t.certIdentifier != "" && strings.Trim(hs.Identifier, "\x00") != "" && strings.Trim(hs.Identifier, "\x00") != t.certIdentifier {
+		return ipc.NewError(ipc.ERR_FORBIDDEN, "module claims to be %q, but its certificate belongs to %q", hs.Identifier, t.certIdentifier)
+	}
+	t.setModule(hs.Identifier, hs.Name, hs.ProtocolVersion)
+	if err := s.registerSchemas(t, hs); err != nil {
+		return err
+	}
+	if err := s.registerSubscriptions(t); err != nil {
+		return err
+	}
 
-		// Parse metadata
-		mData, ok := parseMetadata(d.Metadata)
-		if !ok {
-			ansi.PrintWarning("Metadata is nil")
-		} else {
-			ansi.PrintSuccess("Metadata: " + fmt.Sprintf("%v", mData))
+	reply := ipc.Handshake{
+		Name:            s.identifier,
+		Identifier:      string(s.serverID[:]),
+		ProtocolVersion: ipc.PROTOCOL_VERSION,
+	}
+	if hs.ProtocolVersion >= ipc.CHUNKING_VERSION {
+		chunkSize := s.maxChunkSize
+		if hs.MaxChunkSize > 0 && hs.MaxChunkSize < chunkSize {
+			chunkSize = hs.MaxChunkSize
+		}
+		encoding := ipc.NegotiateEncoding(hs.Compression, s.compression)
+		if encoding != ipc.ENCODING_NONE {
+			reply.Compression = []string{encoding}
+		}
+		reply.MaxChunkSize = chunkSize
 
-			// If there is data to fetch, fetch it
-			if mData.Method == "GET" {
+		// The acknowledgement itself is sent before switching, so the module can read it
+		defer t.setTransfer(encoding, chunkSize)
+		ansi.PrintDebug(fmt.Sprintf("[SOCKETS] Negotiated compression %q, chunk size %d", encoding, chunkSize))
+	}
 
-				ansi.PrintBold("Got a GET request - fetching data...")
+	ack, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	if err := s.respondWith(t, ipc.MSG_CONNACK, ack, string(req.Header.Identifier[:]), req.CorrelationID); err != nil {
+		return err
+	}
+	if s.hooks.OnHandshake != nil {
+		s.hooks.OnHandshake(t.snapshot().Identifier, hs)
+	}
+	return nil
+}
 
-				// Get the data source
-				databaseName := mData.Destination.Object.Database.Name
-				tableName := mData.Destination.Object.Database.Table
+// registerSchemas creates or migrates the result tables declared in the module's manifest and handshake
+func (s *IPCServer) registerSchemas(t *trackedConn, hs ipc.Handshake) error {
+	identifier := t.snapshot().Identifier
+	var schemas []models.TableSchema
+	if config := s.modules.Config(identifier); config != nil {
+		schemas = append(schemas, config.Schemas...)
+	}
+	schemas = append(schemas, hs.Schemas...)
+	if len(schemas) == 0 {
+		return nil
+	}
 
-				// Get the data sources
-				ansi.PrintColorf(ansi.LightCyan, "Database: %s\nTable: %s", databaseName, tableName)
+	if s.moduleTables == nil {
+		return ipc.NewError(ipc.ERR_SCHEMA, "this server does not support module tables")
+	}
+	if identifier == "" {
+		return ipc.NewError(ipc.ERR_SCHEMA, "module tables require a module identifier")
+	}
+	for _, schema := range schemas {
+		table, err := s.moduleTables.Register(identifier, schema)
+		if err != nil {
+			return ipc.NewError(ipc.ERR_SCHEMA, "%v", err)
+		}
+		ansi.PrintDebug("[SOCKETS] Module " + identifier + " registered table " + table)
+	}
+	return nil
+}
 
-				// Ask database for the data
-				// TODO: Remember to make sure only the latest data is fetched
-				// ctx := context.WithValue(*s.moduleStates, "tableName", 0) // TODO: <- Add row id here
-				ctx := context.WithValue(context.Background(), tableToModel(tableName), s.moduleStates)
-				val := ctx.Value(tableToModel(tableName))
+// registerSubscriptions subscribes the module to the topics in its manifest
+func (s *IPCServer) registerSubscriptions(t *trackedConn) error {
+	identifier := t.snapshot().Identifier
+	config := s.modules.Config(identifier)
+	if config == nil {
+		return nil
+	}
+	for _, pattern := range config.Events.Subscribe {
+		if err := s.bus.Subscribe(identifier, pattern); err != nil {
+			return ipc.NewError(ipc.ERR_INTERNAL, "failed to subscribe to %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
 
-				fmt.Scanln("[⏸️] context value: ", val)
+// attachEvents starts delivering events to the connection, if the module speaks a protocol version with events.
+// Returns the module identifier the connection was attached for, or "" if it wasn't.
+func (s *IPCServer) attachEvents(t *trackedConn) string {
+	info := t.snapshot()
+	if info.ProtocolVersion < ipc.EVENTS_VERSION || info.Identifier == "" {
+		return ""
+	}
+	s.bus.attach(info.Identifier, t.id, func(e ipc.Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		msg, err := s.newMessage(info.Identifier, ipc.MSG_EVENT, data)
+		if err != nil {
+			return err
+		}
+		msg.Message.Datatype = ipc.DATA_JSON
+		msg.CorrelationID = ipc.NewCorrelationID()
+		return t.send(msg)
+	})
+	return info.Identifier
+}
 
-				latestData := fetchLatestLogData(ctx, tableName)
+// handleEvents handles the PUBLISH, SUBSCRIBE and UNSUBSCRIBE requests of the event bus
+func (s *IPCServer) handleEvents(identifier string, m ipc.Metadata, data interface{}) ([]byte, error) {
+	identifier = strings.Trim(identifier, "\x00")
+	if identifier == "" {
+		return nil, ipc.NewError(ipc.ERR_FORBIDDEN, "events require a module identifier")
+	}
 
-				if latestData.data == nil {
-					ansi.PrintError("Source not found")
-					response = []byte("Error, source not found")
-					// Respond with an error
-					ansi.PrintError("Failed to fetch the data")
+	switch m.Method {
+	case ipc.METHOD_PUBLISH:
+		if config := s.modules.Config(identifier); config != nil && len(config.Events.Publish) > 0 && !matchesAny(config.Events.Publish, m.Topic) {
+			return nil, ipc.NewError(ipc.ERR_FORBIDDEN, "module %s may not publish to %s, see events.publish in its manifest", identifier, m.Topic)
+		}
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return nil, ipc.NewError(ipc.ERR_DECODE, "%v", err)
+		}
+		if err := ipc.ValidateTopic(m.Topic); err != nil {
+			return nil, ipc.NewError(ipc.ERR_DECODE, "%v", err)
+		}
+		published, err := s.bus.Publish(identifier, m.Topic, payload)
+		if err != nil {
+			return nil, err
+		}
+		ansi.PrintDebug(fmt.Sprintf("[EVENTS] %s published event %d on %s to %d subscribers", identifier, published.ID, m.Topic, published.Subscribers))
+		return json.Marshal(published)
 
-				} else {
-					// Get the logs
-					response = latestData.data
-					// Respond with the data
-					ansi.PrintSuccess("Data fetched successfully")
-				}
-			}
-			if mData.Method == "POST" {
-				s.handlePost(mData, d.Data)
-				response = []byte("OK")
-			}
+	case ipc.METHOD_SUBSCRIBE:
+		if err := ipc.ValidatePattern(m.Topic); err != nil {
+			return nil, ipc.NewError(ipc.ERR_DECODE, "%v", err)
+		}
+		if err := s.bus.Subscribe(identifier, m.Topic); err != nil {
+			return nil, err
 		}
 
-		if err := reply(response, c, inboundRequest, s); err != nil {
-			ansi.PrintError("handleConnection: " + err.Error())
-			return
+	case ipc.METHOD_UNSUBSCRIBE:
+		if _, err := s.bus.Unsubscribe(identifier, m.Topic); err != nil {
+			return nil, err
 		}
 	}
+	return []byte("OK"), nil
 }
 
-func reply(response []byte, c net.Conn, inboundRequest ipc.IPCRequest, s *IPCServer) error {
-	// Finally, respond to the client
-	var err error
+func matchesAny(patterns []string, topic string) bool {
+	for _, p := range patterns {
+		if ipc.MatchTopic(p, topic) {
+			return true
+		}
+	}
+	return false
+}
 
-	moduleId := string(inboundRequest.Header.Identifier[:]) // TODO: req.Header.Identifier is the server identifier, not the module identifier
+// heartbeat pings the module at every interval, and closes the connection
+// when nothing has been heard from it within the peer timeout.
+func (s *IPCServer) heartbeat(t *trackedConn, stop <-chan struct{}) {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if idle := t.idle(); idle > s.peerTimeout {
+				info := t.snapshot()
+				ansi.PrintWarning(fmt.Sprintf("[SOCKETS] Dropping %s (%s): no sign of life for %s", info.Name, info.Identifier, idle.Round(time.Second)))
+				t.conn.Close() // Unblocks the read loop in handleConnection
+				return
+			}
+
+			ping, err := s.newMessage(t.snapshot().Identifier, ipc.MSG_PING, nil)
+			if err != nil {
+				continue
+			}
+			ping.CorrelationID = ipc.NewCorrelationID()
+			if err := t.conn.Send(ping); err != nil {
+				ansi.PrintDebug("[SOCKETS] Failed to send ping: " + err.Error())
+			}
+		}
+	}
+}
+
+// handleRequest handles a single request and writes the response back on the connection.
+// Requests that can't be handled are answered with an ipc.Error.
+func (s *IPCServer) handleRequest(t *trackedConn, inboundRequest ipc.IPCRequest) error {
 	if crcOk := s.CheckCRC32(inboundRequest); !crcOk {
-		response = []byte("CHKSUM ERROR")
 		ansi.PrintError("Checksum error")
-		return fmt.Errorf(string(response))
+		return s.respondError(t, inboundRequest, ipc.NewError(ipc.ERR_CHECKSUM, "checksum does not match the data"))
+	}
+
+	_, d, err := parseData(&inboundRequest.Message) // Should be of type ipc.IPCMessage
+	if err != nil {
+		return s.respondError(t, inboundRequest, ipc.AsError(err, ipc.ERR_DECODE))
+	}
+	if d.Data == nil && d.Metadata == (ipc.Metadata{}) {
+		return s.respondError(t, inboundRequest, ipc.NewError(ipc.ERR_DECODE, "expected JSON data with metadata"))
+	}
+
+	var response []byte
+
+	// Parse metadata
+	mData, ok := parseMetadata(d.Metadata)
+	if !ok {
+		ansi.PrintWarning("Metadata is nil")
+		return s.respondError(t, inboundRequest, ipc.NewError(ipc.ERR_DECODE, "missing metadata"))
+	}
+	ansi.PrintSuccess("Metadata: " + fmt.Sprintf("%v", mData))
+
+	if s.hooks.Intercept != nil {
+		if e := s.hooks.Intercept(hookIdentifier(inboundRequest), mData); e != nil {
+			return s.respondError(t, inboundRequest, e)
+		}
+	}
+
+	switch mData.Method {
+	case "GET":
+		// If there is data to fetch, stream it
+		ansi.PrintBold("Got a GET request - fetching data...")
+
+		// Get the data source
+		databaseName := mData.Destination.Object.Database.Name
+		tableName := mData.Destination.Object.Database.Table
+
+		// Get the data sources
+		ansi.PrintColorf(ansi.LightCyan, "Database: %s\nTable: %s", databaseName, tableName)
+
+		pages := pagesFor(s.stores, tableName)
+		if pages == nil {
+			ansi.PrintError("Source not found")
+			return s.respondError(t, inboundRequest, ipc.NewError(ipc.ERR_UNKNOWN_TABLE, "unknown table: %s", tableName))
+		}
+
+		// The rows are written straight to the connection, chunk by chunk
+		if err := s.streamLatestLogData(context.Background(), tableName, pages, t, inboundRequest); err != nil {
+			ansi.PrintError("Failed to stream the data: " + err.Error())
+			// Don't leave the module waiting for a response that will never come
+			return s.respondError(t, inboundRequest, ipc.AsError(err, ipc.ERR_INTERNAL))
+		}
+		ansi.PrintSuccess("Data fetched successfully")
+		responseTime(inboundRequest.Timestamp)
+		return nil
+
+	case "POST":
+		if err := s.handlePost(string(inboundRequest.Header.Identifier[:]), mData, d.Data); err != nil {
+			return s.respondError(t, inboundRequest, ipc.AsError(err, ipc.ERR_INTERNAL))
+		}
+		if s.hooks.OnPost != nil {
+			data, _ := json.Marshal(d.Data)
+			s.hooks.OnPost(hookIdentifier(inboundRequest), mData.Destination.Object.Database.Table, data)
+		}
+		response = []byte("OK")
+
+	case ipc.METHOD_PUBLISH, ipc.METHOD_SUBSCRIBE, ipc.METHOD_UNSUBSCRIBE:
+		response, err = s.handleEvents(string(inboundRequest.Header.Identifier[:]), mData, d.Data)
+		if err != nil {
+			return s.respondError(t, inboundRequest, ipc.AsError(err, ipc.ERR_INTERNAL))
+		}
+
+	default:
+		return s.respondError(t, inboundRequest, ipc.NewError(ipc.ERR_DECODE, "unsupported method: %q", mData.Method))
 	}
 
-	err = s.respond(c, response, moduleId)
+	return reply(response, t, inboundRequest, s)
+}
+
+func reply(response []byte, t *trackedConn, inboundRequest ipc.IPCRequest, s *IPCServer) error {
+	// Finally, respond to the client
+	moduleId := string(inboundRequest.Header.Identifier[:]) // TODO: req.Header.Identifier is the server identifier, not the module identifier
+
+	err := s.respond(t, response, moduleId, inboundRequest.CorrelationID)
 	if err != nil {
 		ansi.PrintError("handleConnection: " + err.Error())
 		return err
@@ -424,6 +910,65 @@ func reply(response []byte, c net.Conn, inboundRequest ipc.IPCRequest, s *IPCSer
 	return nil
 }
 
+// respondError answers the request with a MSG_ERROR message carrying the error
+func (s *IPCServer) respondError(t *trackedConn, req ipc.IPCRequest, e *ipc.Error) error {
+	e.RequestID = req.CorrelationID
+	ansi.PrintError("Request failed: " + e.Error())
+	s.countError(hookIdentifier(req), e)
+	if s.hooks.OnError != nil {
+		s.hooks.OnError(hookIdentifier(req), e)
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.respondWith(t, ipc.MSG_ERROR, data, string(req.Header.Identifier[:]), req.CorrelationID)
+}
+
+// ModuleErrors counts the requests of a module answered with an error, since bivrost started
+type ModuleErrors struct {
+	Count  uint64            `json:"count"`
+	ByCode map[string]uint64 `json:"by_code"`
+	Last   *ipc.Error        `json:"last,omitempty"`
+	LastAt time.Time         `json:"last_at"`
+}
+
+func (s *IPCServer) countError(identifier string, e *ipc.Error) {
+	s.statesMu.Lock()
+	defer s.statesMu.Unlock()
+	errs, ok := s.moduleErrors[identifier]
+	if !ok {
+		errs = &ModuleErrors{ByCode: make(map[string]uint64)}
+		s.moduleErrors[identifier] = errs
+	}
+	errs.Count++
+	errs.ByCode[string(e.Code)]++
+	last := *e
+	errs.Last, errs.LastAt = &last, time.Now()
+}
+
+// Errors returns the errors of the module with the identifier
+func (s *IPCServer) Errors(identifier string) ModuleErrors {
+	s.statesMu.Lock()
+	defer s.statesMu.Unlock()
+	errs, ok := s.moduleErrors[identifier]
+	if !ok {
+		return ModuleErrors{ByCode: map[string]uint64{}}
+	}
+	out := *errs
+	out.ByCode = make(map[string]uint64, len(errs.ByCode))
+	for code, n := range errs.ByCode {
+		out.ByCode[code] = n
+	}
+	return out
+}
+
+// hookIdentifier is the identifier of the module that sent the request, as passed to the hooks
+func hookIdentifier(req ipc.IPCRequest) string {
+	return strings.Trim(string(req.Header.Identifier[:]), "\x00")
+}
+
 // Get the model based on the table name
 func tableToModel(tableName string) any {
 	for range models.GetModels() {
@@ -447,16 +992,17 @@ func tableToModel(tableName string) any {
 	return nil
 }
 
-func (s *IPCServer) handlePost(m ipc.Metadata, data interface{}) {
+// handlePost inserts the data into the table named in the metadata.
+// Tables that aren't built in are looked up among the tables of the module with the identifier.
+func (s *IPCServer) handlePost(identifier string, m ipc.Metadata, data interface{}) error {
 	ansi.PrintBold("Got a POST request - inserting data...")
 
-	databaseName := m.Destination.Object.Database.Name
 	tableName := m.Destination.Object.Database.Table
 
 	bytes, err := json.Marshal(data)
 	if err != nil {
 		ansi.PrintError("Failed to marshal the data: " + err.Error())
-		return
+		return err
 	}
 	if len(bytes) > 100 {
 		fmt.Println("Data: ", string(bytes[:100]))
@@ -486,271 +1032,242 @@ func (s *IPCServer) handlePost(m ipc.Metadata, data interface{}) {
 	marshalled, err := json.Marshal(data)
 	if err != nil {
 		ansi.PrintError("Failed to marshal the data: " + err.Error())
+		return err
 	}
 
+	if models.IsTable(tableName) && s.stores == nil {
+		return ipc.NewError(ipc.ERR_INTERNAL, "no data stores configured for %s", tableName)
+	}
 	switch tableName {
 	case models.ATTACK_TYPE:
-		// Insert the data into the database
-		ansi.PrintDebug("Inserting data into the database...")
-		var tmpData []models.AttackType
-
-		json.Unmarshal(marshalled, &tmpData)
-		insertData[models.AttackType](databaseName, tableName, tmpData)
+		return insertData(s.stores.AttackTypeStore, tableName, marshalled)
 	case models.INDICATORS_LOG:
-		// Insert the data into the database
-		var tmpData []models.IndicatorsLog
-		json.Unmarshal(marshalled, &tmpData)
-		insertData[models.IndicatorsLog](databaseName, tableName, tmpData)
+		return insertData(s.stores.IndicatorsLogStore, tableName, marshalled)
 	case models.NGINX_LOGS:
-		// Insert the data into the database
-		var tmpData []models.NginxLog
-		json.Unmarshal(marshalled, &tmpData)
-		insertData[models.NginxLog](databaseName, tableName, tmpData)
+		// The logs are bivrost's own input, modules only read them
+		return ipc.NewError(ipc.ERR_FORBIDDEN, "%s is read-only for modules", tableName)
 	case models.SYN_TRAFFIC:
-		// Insert the data into the database
-		var tmpData []models.SynTraffic
-
-		json.Unmarshal(marshalled, &tmpData)
-		insertData[models.SynTraffic](databaseName, tableName, tmpData)
+		return insertData(s.stores.SynTrafficStore, tableName, marshalled)
 	case models.GEO_DATA:
-		// Insert the data into the database
-		var tmpData []models.GeoData
-		json.Unmarshal(marshalled, &tmpData)
-		insertData[models.GeoData](databaseName, tableName, tmpData)
+		return insertData(s.stores.GeoDataStore, tableName, marshalled)
 	case models.GEO_LOCATION_DATA:
-		// Insert the data into the database
-		var tmpData []models.GeoLocationData
-		json.Unmarshal(marshalled, &tmpData)
-		insertData[models.GeoLocationData](databaseName, tableName, tmpData)
+		return insertData(s.stores.GeoLocationDataStore, tableName, marshalled)
 	case models.THREAT_RECORDS:
-		var tmpData []models.ThreatRecord
-		json.Unmarshal(marshalled, &tmpData)
-		insertData[models.ThreatRecord](databaseName, tableName, tmpData)
+		return insertData(s.stores.ThreatRecordStore, tableName, marshalled)
 	default:
-		// Insert the data into the database
-		ansi.PrintDebug("Unknown table name")
+		return s.insertModuleRows(identifier, tableName, marshalled)
 	}
 }
 
-// WIP: ✅ Tested - working again! 03.06.2024
-func insertData[StoreType any](databaseName, tableName string, data any) {
-	// Get the data store
-	d := data.([]StoreType)
-
-	s, err := stores.Use(tableName)
-	if err != nil {
-
-		s := &database.DataStore[StoreType]{}
-
-		ansi.PrintError("Failed to get the data store: " + s.Name())
+// insertModuleRows inserts the rows into one of the module's own tables
+func (s *IPCServer) insertModuleRows(identifier, tableName string, data []byte) error {
+	if s.moduleTables == nil {
+		return ipc.NewError(ipc.ERR_UNKNOWN_TABLE, "unknown table: %s", tableName)
+	}
+	table := models.ModuleTableName(identifier, tableName)
+	if _, ok := s.moduleTables.Schema(table); !ok {
+		ansi.PrintDebug("Unknown table name")
+		return ipc.NewError(ipc.ERR_UNKNOWN_TABLE, "unknown table: %s", tableName)
 	}
 
-	ansi.PrintDebug("Getting the data store...")
-
-	// Depending on the table name, insert the data into the database
-	switch tableName {
-	case models.ATTACK_TYPE:
-		// Insert the data into the database
-		ansi.PrintDebug("Inserting data into the database...")
-		var tmpData []models.AttackType
-		tmpBytes, err := json.Marshal(d)
-		if err != nil {
-			ansi.PrintError("Failed to marshal the data: " + err.Error())
-		}
-		err = json.Unmarshal(tmpBytes, &tmpData)
-		if err != nil {
-			ansi.PrintError("Failed to unmarshal the data: " + err.Error())
-		}
-
-		// fmt.Printf("Data: %v\n", tmpData)
-		logsChannel := make(chan models.AttackType)
-		go func() {
-			for _, log := range tmpData {
-				logsChannel <- log
-			}
-			close(logsChannel)
-		}()
-
-		err = s.AttackTypeStore.InsertBulk(logsChannel, len(tmpData))
-		if err != nil {
-			ansi.PrintError("Failed to insert the data: " + err.Error())
-		} else {
-			ansi.PrintSuccess("Data inserted successfully")
-		}
-
-	case models.NGINX_LOGS:
-		return
-	case models.SYN_TRAFFIC:
-		var tmpData []models.SynTraffic
-		tmpBytes, err := json.Marshal(d)
-		if err != nil {
-			ansi.PrintError("Failed to marshal the data: " + err.Error())
-		}
-		err = json.Unmarshal(tmpBytes, &tmpData)
-		if err != nil {
-			ansi.PrintError("Failed to unmarshal the data: " + err.Error())
-		}
-		logsChannel := make(chan models.SynTraffic)
-		go func() {
-			for _, log := range tmpData {
-				logsChannel <- log
-			}
-			close(logsChannel)
-
-		}()
-
-		err = s.SynTrafficStore.InsertBulk(logsChannel, len(tmpData))
-		if err != nil {
-			ansi.PrintError("Failed to insert the data: " + err.Error())
-		} else {
-			ansi.PrintSuccess("Data inserted successfully")
-		}
-	case models.GEO_DATA:
-		var tmpData []models.GeoData
-		tmpBytes, err := json.Marshal(d)
-		if err != nil {
-			ansi.PrintError("Failed to marshal the data: " + err.Error())
-		}
-		err = json.Unmarshal(tmpBytes, &tmpData)
-		if err != nil {
-			ansi.PrintError("Failed to unmarshal the data: " + err.Error())
+	var rows []map[string]any
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return ipc.NewError(ipc.ERR_DECODE, "data for %s must be a list of objects: %v", tableName, err)
+	}
+	if err := s.moduleTables.Insert(table, rows); err != nil {
+		if errors.Is(err, database.ErrInvalidRow) {
+			return ipc.NewError(ipc.ERR_DECODE, "%v", err)
 		}
+		return err
+	}
+	ansi.PrintSuccess(fmt.Sprintf("Inserted %d rows into %s", len(rows), table))
+	return nil
+}
 
-		logsChannel := make(chan models.GeoData)
-		go func() {
-			for _, log := range tmpData {
-				logsChannel <- log
-			}
-			close(logsChannel)
-
-		}()
-
-		err = s.GeoDataStore.InsertBulk(logsChannel, len(tmpData))
-		if err != nil {
-			ansi.PrintError("Failed to insert the data: " + err.Error())
-		} else {
-			ansi.PrintSuccess("Data inserted successfully")
-		}
-	case models.GEO_LOCATION_DATA:
-		var tmpData []models.GeoLocationData
-		tmpBytes, err := json.Marshal(d)
-		if err != nil {
-			ansi.PrintError("Failed to marshal the data: " + err.Error())
-		}
-		err = json.Unmarshal(tmpBytes, &tmpData)
-		if err != nil {
-			ansi.PrintError("Failed to unmarshal the data: " + err.Error())
-		}
-		logsChannel := make(chan models.GeoLocationData)
-		go func() {
-			for _, log := range tmpData {
-				logsChannel <- log
-			}
-			close(logsChannel)
+// insertData inserts the rows, a JSON array, into the store of the built in table
+func insertData[T any](store *database.DataStore[T], tableName string, data []byte) error {
+	var rows []T
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return ipc.NewError(ipc.ERR_DECODE, "data does not match the %s table: %v", tableName, err)
+	}
+	if store == nil {
+		return ipc.NewError(ipc.ERR_UNKNOWN_TABLE, "table %s is not available", tableName)
+	}
 
-		}()
+	ansi.PrintDebug("Inserting data into the database...")
+	if err := store.InsertRows(rows); err != nil {
+		ansi.PrintError("Failed to insert the data: " + err.Error())
+		return ipc.NewError(ipc.ERR_INTERNAL, "failed to insert into %s: %v", tableName, err)
+	}
+	ansi.PrintSuccess(fmt.Sprintf("Inserted %d rows into %s", len(rows), tableName))
+	return nil
+}
 
-		err = s.GeoLocationDataStore.InsertBulk(logsChannel, len(tmpData))
-		if err != nil {
-			ansi.PrintError("Failed to insert the data: " + err.Error())
-		} else {
-			ansi.PrintSuccess("Data inserted successfully")
-		}
-	case models.THREAT_RECORDS:
-		var tmpData []models.ThreatRecord
+// cursorKey is the module and table of a read cursor
+type cursorKey struct {
+	identifier string
+	table      string
+}
 
-		// Might be unneccessary at this stage due to refactoring made in handlePost()
-		tmpBytes, err := json.Marshal(d)
-		if err != nil {
-			ansi.PrintError("failed to marshal the data " + err.Error())
-		}
-		err = json.Unmarshal(tmpBytes, &tmpData)
-		if err != nil {
-			ansi.PrintError("Failed to unmarshal the data: " + err.Error())
-		}
+// moduleState returns the read cursor state of the module for the given table, creating it if neccessary
+func (s *IPCServer) moduleState(identifier, tableName string) *ipc.ModuleState {
+	s.statesMu.Lock()
+	defer s.statesMu.Unlock()
 
-		logsChannel := make(chan models.ThreatRecord)
-		go func() {
-			for _, log := range tmpData {
-				logsChannel <- log
-			}
-			close(logsChannel)
-		}()
+	key := cursorKey{identifier: identifier, table: tableName}
+	moduleState, ok := s.moduleStates[key]
+	if !ok {
+		// Create a new ModuleState for this table
+		moduleState = &ipc.ModuleState{}
+		s.moduleStates[key] = moduleState
+	}
+	return moduleState
+}
 
-		err = s.ThreatRecordStore.InsertBulk(logsChannel, len(tmpData))
-		if err != nil {
-			ansi.PrintError("failed to insert threat records data " + err.Error())
-		} else {
-			ansi.PrintSuccess("Successfully inserted threat records")
+// Cursors returns the ID of the last row sent to the module with the identifier, by table
+func (s *IPCServer) Cursors(identifier string) map[string]int {
+	s.statesMu.Lock()
+	states := make(map[string]*ipc.ModuleState)
+	for key, state := range s.moduleStates {
+		if key.identifier == identifier {
+			states[key.table] = state
 		}
+	}
+	s.statesMu.Unlock()
 
-	default:
-		ansi.PrintError("Table not found: " + tableName)
+	cursors := make(map[string]int, len(states))
+	for table, state := range states {
+		state.RLock()
+		cursors[table] = state.LastRowID
+		state.RUnlock()
 	}
+	return cursors
 }
 
-// Parsing into this object from a "LogEntry" struct
-type LogData struct {
-	lastRowID int
-	data      []byte // LogEntry struct
+// ResetCursor makes the module read the table from the start again. It returns false if the module has no cursor on the table
+func (s *IPCServer) ResetCursor(identifier, table string) bool {
+	s.statesMu.Lock()
+	state, ok := s.moduleStates[cursorKey{identifier: identifier, table: table}]
+	s.statesMu.Unlock()
+	if !ok {
+		return false
+	}
+	state.Lock() // Waits for a read in progress
+	state.LastRowID = 0
+	state.Unlock()
+	ansi.PrintInfo(fmt.Sprintf("Reset the cursor of module %s on %s", identifier, table))
+	return true
 }
 
-// TODO: FORTSETT HER
-func fetchLatestLogData(ctx context.Context, tableName string) LogData {
-	moduleStatesMap, ok := ctx.Value(tableToModel(tableName)).(map[string]*ipc.ModuleState)
-	if !ok {
-		// Handle the case where the value is not a map[string]*ModuleState
-		ansi.PrintDebug(" [modulestate] failed to get the module states map")
-		fmt.Scanln("Press [Enter] to continue...")
+// rowPages returns at most limit rows of a table with row ID greater than afterID, and the ID of the last one
+type rowPages func(afterID int64, limit int) (rows []any, lastID int64, err error)
 
-		return LogData{}
+func pagesOf[T any](store *database.DataStore[T], id func(T) int64) rowPages {
+	if store == nil {
+		return nil
+	}
+	return func(afterID int64, limit int) ([]any, int64, error) {
+		logs, err := store.GetLogPage(afterID, limit)
+		rows := make([]any, len(logs))
+		for i := range logs {
+			rows[i] = &logs[i]
+			afterID = id(logs[i])
+		}
+		return rows, afterID, err
 	}
+}
 
-	moduleState, ok := moduleStatesMap[tableName]
-	if !ok {
-		// Create a new ModuleState for this table
-		moduleState = &ipc.ModuleState{}
-		moduleStatesMap[tableName] = moduleState
+// pagesFor returns the pages of the built in table, or nil if there's no such table to stream
+func pagesFor(all *stores.Stores, tableName string) rowPages {
+	if all == nil {
+		return nil
 	}
-	// Get the data from the database
-	ansi.PrintDebug(" [modulestate] fetching the latest log data...")
-	s, err := stores.Use(tableName)
-	if err != nil {
-		ansi.PrintError(" [modulestate] failed to get the data store: " + s.NginxLogStore.Name())
+	switch tableName {
+	case stores.NGINX_LOGS:
+		return pagesOf(all.NginxLogStore, func(r models.NginxLog) int64 { return r.ID })
+	case stores.SYN_TRAFFIC:
+		return pagesOf(all.SynTrafficStore, func(r models.SynTraffic) int64 { return r.ID })
+	case stores.ATTACK_TYPE:
+		return pagesOf(all.AttackTypeStore, func(r models.AttackType) int64 { return r.ID })
+	case stores.INDICATORS_LOG:
+		return pagesOf(all.IndicatorsLogStore, func(r models.IndicatorsLog) int64 { return r.ID })
+	case stores.GEO_LOCATION_DATA:
+		return pagesOf(all.GeoLocationDataStore, func(r models.GeoLocationData) int64 { return int64(r.ID) })
+	case stores.GEO_DATA:
+		return pagesOf(all.GeoDataStore, func(r models.GeoData) int64 { return int64(r.ID) })
+	case stores.THREAT_RECORDS:
+		return pagesOf(all.ThreatRecordStore, func(r models.ThreatRecord) int64 { return r.ID })
 	}
+	return nil
+}
 
-	// Use a read lock to safely read the LastRowID
-	moduleState.RLock()
-	lastRowID := moduleState.LastRowID
-	moduleState.RUnlock()
+// streamLatestLogData sends every row after the table's cursor to the module as one JSON array.
+// The rows are read from the database a page at a time and written to the connection in chunks,
+// so the whole result never has to fit in memory.
+func (s *IPCServer) streamLatestLogData(ctx context.Context, tableName string, pages rowPages, t *trackedConn, req ipc.IPCRequest) error {
+	moduleState := s.moduleState(hookIdentifier(req), tableName)
 
-	ansi.PrintDebug("Getting the data store...")
+	// Hold the lock for the whole read, so concurrent requests for the same table
+	// don't read the same rows twice
+	moduleState.Lock()
+	defer moduleState.Unlock()
+	lastRowID := int64(moduleState.LastRowID)
 
-	logs, err := s.NginxLogStore.GetLogRangeFromID(lastRowID) // The store is also an issue here....
-	if err != nil {
-		ansi.PrintError("[modulestate] failed to get all logs: " + err.Error())
-	}
+	ansi.PrintDebug("[modulestate] getting all logs after " + fmt.Sprintf("%d", lastRowID) + "...")
 
-	ansi.PrintDebug("[modulestate] getting all logs starting with " + fmt.Sprintf("%d", lastRowID) + "...")
-	fmt.Scanln("Press [Enter] to continue...")
+	moduleId := string(req.Header.Identifier[:])
+	encoding, chunkSize := t.transfer()
+	w := ipc.NewChunkWriter(t.conn.Send, func(data []byte) *ipc.IPCRequest {
+		msg, _ := s.newMessage(moduleId, ipc.MSG_ACK, data)
+		return msg
+	}, req.CorrelationID, encoding, chunkSize)
 
-	returnData := LogData{
-		lastRowID: lastRowID,
-		data:      nil,
+	if _, err := w.Write([]byte("[")); err != nil {
+		return err
 	}
+	rows := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	returnData.data, err = json.Marshal(&logs)
-	if err != nil {
-		ansi.PrintError("Failed to marshal the logs: " + err.Error())
+		page, lastID, err := pages(lastRowID, pageSize)
+		if err != nil {
+			ansi.PrintError("[modulestate] failed to get logs: " + err.Error())
+			return err // The cursor stays where it was
+		}
+
+		for _, row := range page {
+			entry, err := json.Marshal(row)
+			if err != nil {
+				ansi.PrintError("Failed to marshal the log: " + err.Error())
+				continue
+			}
+			if rows > 0 {
+				entry = append([]byte(","), entry...)
+			}
+			if _, err := w.Write(entry); err != nil {
+				return err
+			}
+			rows++
+		}
+		lastRowID = lastID
+
+		if len(page) < pageSize {
+			break
+		}
+	}
+	if _, err := w.Write([]byte("]")); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
 	}
 
-	moduleState.Lock()
-	moduleState.LastRowID += len(logs) // Also a bug was here (+ len(logs) instead of += len(logs))
-	moduleState.Unlock()
-	ansi.PrintDebug(" [modulestate] updated the last row ID to " + fmt.Sprintf("%d", moduleState.LastRowID))
-	ansi.PrintDebug(" [modulestate] Returning the data...")
-	fmt.Scanln("Press [Enter] to continue...")
-	return returnData
+	// Only move the cursor once the module has got everything
+	moduleState.LastRowID = int(lastRowID)
+	ansi.PrintDebug(fmt.Sprintf(" [modulestate] sent %d logs, updated the last row ID to %d", rows, moduleState.LastRowID))
+	return nil
 }
 
 func getResource(mc *modules.ModuleConfig) string {
@@ -761,26 +1278,27 @@ func (s *IPCServer) CheckCRC32(req ipc.IPCRequest) bool {
 	return req.Checksum32 == int(crc(req.Message.Data))
 }
 
-// c is the connection to the client
-func (s *IPCServer) respond(c net.Conn, data []byte, moduleId string) error {
+// t is the connection to the client
+// correlationID is the ID of the request being answered, and is echoed back in the response
+func (s *IPCServer) respond(t *trackedConn, data []byte, moduleId string, correlationID string) error {
+	return s.respondWith(t, ipc.MSG_ACK, data, moduleId, correlationID)
+}
+
+// respondWith is like respond, but with the given message type.
+// Large responses are chunked and compressed as negotiated with the module.
+func (s *IPCServer) respondWith(t *trackedConn, messageType byte, data []byte, moduleId string, correlationID string) error {
 	ansi.PrintDebug("Responding to the client...")
 
 	var response *ipc.IPCRequest
 	var err error
 
-	response, err = NewIPCMessage(moduleId, ipc.MSG_ACK, data)
+	response, err = s.newMessage(moduleId, messageType, data)
 	if err != nil {
 		return err
 	}
+	response.CorrelationID = correlationID
 
-	var responseBuffer bytes.Buffer
-	encoder := gob.NewEncoder(&responseBuffer)
-	err = encoder.Encode(response)
-	if err != nil {
-		return err
-	}
-
-	_, err = c.Write(responseBuffer.Bytes())
+	err = t.send(response)
 	if err != nil {
 		return err
 	}
@@ -818,15 +1336,6 @@ func responseTime(reqTime int64) {
 	fmt.Printf("Microseconds: %f\n", float64(diff)/1e3)
 }
 
-func NewIPCID(identifier string, id []byte) {
-	if len(id) > 4 {
-		ansi.PrintError("NewIPCID(): Identifier length must be 4 bytes")
-		ansi.PrintInfo("Truncating the identifier to 4 bytes")
-		id = id[:4]
-	}
-	ipc.SetIPCID(id)
-}
-
 func Cleanup() {
 	ansi.PrintItalic("\t... IPC server cleanup complete.")
 }
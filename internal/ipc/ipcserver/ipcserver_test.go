@@ -0,0 +1,287 @@
+package ipcserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/bivrost/pkg/module"
+)
+
+// startServer starts a server with its own registry, holding only the module, on a socket in a temporary directory.
+// The setup functions configure the server before it starts serving.
+func startServer(t *testing.T, name, identifier string, setup ...func(*IPCServer)) (*IPCServer, string) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "bivrost.sock")
+	l, err := net.Listen(AF_UNIX, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewIPCServer("bivrost-test", "test", loadedRegistry(t, name, identifier))
+	for _, f := range setup {
+		f(s)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+		s.CloseConn()
+	})
+	return s, socket
+}
+
+// connect connects the module to the server on the socket
+func connect(t *testing.T, socket, name, identifier string) *module.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := module.Connect(ctx, module.Options{Name: name, Identifier: identifier, Socket: socket, DisableReconnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// eventually fails the test if cond isn't true within a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// Servers in the same process must not see each other's modules, subscriptions, events or errors
+func TestServersShareNothing(t *testing.T) {
+	type instance struct {
+		name, identifier string
+		server           *IPCServer
+		client           *module.Client
+		events           chan module.Event
+	}
+	instances := []*instance{
+		{name: "threat", identifier: "THRI"},
+		{name: "anomaly", identifier: "ANOD"},
+		{name: "geo", identifier: "GEOL"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, in := range instances {
+		var socket string
+		in.server, socket = startServer(t, in.name, in.identifier)
+		in.client = connect(t, socket, in.name, in.identifier)
+		events := make(chan module.Event, 10)
+		in.events = events
+		go module.HandleEvents(ctx, in.client, "test.>", func(_ context.Context, e module.Event) error {
+			events <- e
+			return nil
+		})
+	}
+
+	for _, in := range instances {
+		server := in.server
+		eventually(t, in.name+" to subscribe", func() bool { return len(server.Subscriptions()) > 0 })
+	}
+	for _, in := range instances {
+		if conns := in.server.Connections(); len(conns) != 1 || conns[0].Identifier != in.identifier {
+			t.Errorf("server of %s has connections %+v", in.identifier, conns)
+		}
+		if subs := in.server.Subscriptions(); len(subs) != 1 || subs[0].Identifier != in.identifier {
+			t.Errorf("server of %s has subscriptions %+v", in.identifier, subs)
+		}
+		for _, other := range instances {
+			if _, ok := in.server.modules.Module(other.name); ok && other != in {
+				t.Errorf("server of %s knows module %s", in.identifier, other.name)
+			}
+		}
+	}
+
+	// Every bus counts its own events, and only delivers them to its own modules
+	for _, in := range instances {
+		id, err := module.Publish(ctx, in.client, "test.hello", map[string]string{"from": in.identifier})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 1 {
+			t.Errorf("first event on the server of %s has ID %d", in.identifier, id)
+		}
+	}
+	for _, in := range instances {
+		select {
+		case e := <-in.events:
+			if e.Source != in.identifier {
+				t.Errorf("%s got an event from %s", in.identifier, e.Source)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s got no event", in.identifier)
+		}
+		select {
+		case e := <-in.events:
+			t.Errorf("%s got a second event, from %s", in.identifier, e.Source)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Errors are counted by the server that answered them
+	first := instances[0]
+	if _, err := module.Publish(ctx, first.client, "not a topic", nil); err == nil {
+		t.Fatal("publishing to an invalid topic succeeded")
+	}
+	for _, in := range instances {
+		for _, other := range instances {
+			want := uint64(0)
+			if in == first && other == first {
+				want = 1
+			}
+			if got := in.server.Errors(other.identifier).Count; got != want {
+				t.Errorf("server of %s counted %d errors for %s, want %d", in.identifier, got, other.identifier, want)
+			}
+		}
+	}
+
+	// Closing a server leaves the others running
+	first.server.CloseConn()
+	for _, in := range instances[1:] {
+		if _, err := module.Publish(ctx, in.client, "test.after", nil); err != nil {
+			t.Errorf("%s can't publish after another server closed: %v", in.identifier, err)
+		}
+	}
+}
+
+// sinkIdentifiers returns the identifiers the bus delivers events to
+func (b *Bus) sinkIdentifiers() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	identifiers := []string{}
+	for identifier := range b.sinks {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	return identifiers
+}
+
+// A connection receives the events of the identifier of its last handshake, and none once it's closed
+func TestHandshakeEventSinks(t *testing.T) {
+	s, socket := startServer(t, "threat", "THRI")
+	c, err := net.Dial(AF_UNIX, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := ipc.NewConn(c)
+
+	handshake := func(identifier string) {
+		t.Helper()
+		data, _ := json.Marshal(ipc.Handshake{Name: identifier, Identifier: identifier, ProtocolVersion: ipc.PROTOCOL_VERSION})
+		req := &ipc.IPCRequest{
+			CorrelationID: ipc.NewCorrelationID(),
+			Header:        ipc.IPCHeader{MessageType: ipc.MSG_CONN},
+			Message:       ipc.IPCMessage{Datatype: ipc.DATA_JSON, Data: data},
+			Checksum32:    int(crc32.ChecksumIEEE(data)),
+		}
+		copy(req.Header.Identifier[:], identifier)
+		if err := conn.Send(req); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := conn.Receive(); err != nil || res.Header.MessageType != ipc.MSG_CONNACK {
+			t.Fatalf("handshake as %s answered %s, error %v", identifier, ipc.MessageTypeName(res.Header.MessageType), err)
+		}
+	}
+
+	for _, identifier := range []string{"THRI", "ANOD", "ANOD"} {
+		handshake(identifier)
+		if got, want := s.bus.sinkIdentifiers(), []string{identifier}; !reflect.DeepEqual(got, want) {
+			t.Errorf("after a handshake as %s, events go to %v, want %v", identifier, got, want)
+		}
+	}
+
+	c.Close()
+	eventually(t, "the connection to be detached", func() bool { return len(s.bus.sinkIdentifiers()) == 0 })
+}
+
+// Modules answering the pings stay connected, silent peers are dropped after the timeout
+func TestHeartbeat(t *testing.T) {
+	const timeout = 150 * time.Millisecond
+	tests := []struct {
+		name    string
+		connect func(t *testing.T, socket string)
+		dropped bool
+	}{
+		{
+			name: "module answering pings",
+			connect: func(t *testing.T, socket string) {
+				connect(t, socket, "threat", "THRI")
+			},
+		},
+		{
+			name: "silent peer",
+			connect: func(t *testing.T, socket string) {
+				c, err := net.Dial(AF_UNIX, socket)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { c.Close() })
+				go io.Copy(io.Discard, c) // Reads the pings, never answers
+			},
+			dropped: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, socket := startServer(t, "threat", "THRI", func(s *IPCServer) { s.SetHeartbeat(timeout/5, timeout) })
+			tt.connect(t, socket)
+			eventually(t, "the connection to be registered", func() bool { return len(s.Connections()) == 1 })
+			first := s.Connections()[0].ID
+
+			if tt.dropped {
+				eventually(t, "the peer to be dropped", func() bool { return len(s.Connections()) == 0 })
+				return
+			}
+			time.Sleep(3 * timeout)
+			if conns := s.Connections(); len(conns) != 1 || conns[0].ID != first {
+				t.Errorf("connection %d was dropped, connections are now %+v", first, conns)
+			}
+		})
+	}
+}
+
+// Requests that can't be handled are answered with an error envelope, which the module gets as an *module.Error
+func TestErrorResponses(t *testing.T) {
+	_, socket := startServer(t, "threat", "THRI")
+	c := connect(t, socket, "threat", "THRI")
+
+	tests := []struct {
+		name string
+		data string
+		want ipc.ErrorCode
+	}{
+		{"not json", `{"metadata":`, module.ERR_DECODE},
+		{"no metadata", `{}`, module.ERR_DECODE},
+		{"unknown table", `{"metadata":{"method":"GET","destination":{"destination":{"database":{"table":"nope"}}}}}`, module.ERR_UNKNOWN_TABLE},
+		{"invalid topic", `{"metadata":{"method":"PUBLISH","topic":"Not A Topic"}}`, module.ERR_DECODE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := c.Call(ctx, module.MSG_MSG, module.DATA_JSON, []byte(tt.data))
+			var e *module.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got %v, want a *module.Error", err)
+			}
+			if e.Code != tt.want || e.RequestID == "" {
+				t.Errorf("got code %s for request %q, want %s", e.Code, e.RequestID, tt.want)
+			}
+		})
+	}
+}
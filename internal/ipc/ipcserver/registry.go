@@ -0,0 +1,234 @@
+package ipcserver
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/ipc"
+)
+
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultPeerTimeout       = 45 * time.Second
+)
+
+// ModuleConn is a snapshot of a connected module, as exposed through the API
+type ModuleConn struct {
+	ID              uint64    `json:"id"`
+	Identifier      string    `json:"identifier"`
+	Name            string    `json:"name"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Transport       string    `json:"transport"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	LastSeen        time.Time `json:"last_seen"`
+	BytesIn         uint64    `json:"bytes_in"`
+	BytesOut        uint64    `json:"bytes_out"`
+	ProtocolVersion int       `json:"protocol_version"`
+	Compression     string    `json:"compression,omitempty"`
+	ChunkSize       int       `json:"chunk_size,omitempty"`
+}
+
+// trackedConn is the registry entry of a single connection
+type trackedConn struct {
+	id          uint64
+	conn        *ipc.Conn
+	counter     *countingConn
+	connectedAt time.Time
+	lastSeen    atomic.Int64 // Unix nano timestamp
+
+	transport      string // AF_UNIX or TRANSPORT_TLS
+	certIdentifier string // Identifier bound to the client certificate, empty on the UNIX domain socket
+
+	mu              sync.RWMutex
+	identifier      string
+	name            string
+	protocolVersion int
+	encoding        string // Negotiated compression
+	chunkSize       int    // Negotiated chunk size, 0 until the handshake
+}
+
+// touch marks the connection as alive
+func (t *trackedConn) touch() {
+	t.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (t *trackedConn) idle() time.Duration {
+	return time.Since(time.Unix(0, t.lastSeen.Load()))
+}
+
+func (t *trackedConn) setModule(identifier, name string, protocolVersion int) {
+	identifier = strings.Trim(identifier, "\x00") // Unset identifiers are all zero bytes
+	name = strings.Trim(name, "\x00")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if identifier != "" {
+		t.identifier = identifier
+	}
+	if name != "" {
+		t.name = name
+	}
+	if protocolVersion != 0 {
+		t.protocolVersion = protocolVersion
+	}
+}
+
+// allowed reports whether a message with the given header identifier may be sent on this connection.
+// Connections authenticated with a client certificate may only speak for the module the certificate belongs to.
+func (t *trackedConn) allowed(identifier [4]byte) bool {
+	if t.certIdentifier == "" || identifier == [4]byte{} {
+		return true
+	}
+	return string(identifier[:]) == t.certIdentifier
+}
+
+func (t *trackedConn) setTransfer(encoding string, chunkSize int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.encoding = encoding
+	t.chunkSize = chunkSize
+}
+
+// transfer returns the encoding and chunk size to send messages with.
+// Modules that haven't negotiated chunking get everything in one uncompressed message.
+func (t *trackedConn) transfer() (encoding string, chunkSize int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.protocolVersion < ipc.CHUNKING_VERSION || t.chunkSize == 0 {
+		return ipc.ENCODING_NONE, ipc.UNCHUNKED
+	}
+	return t.encoding, t.chunkSize
+}
+
+// send sends the message to the module, chunked and compressed as negotiated
+func (t *trackedConn) send(msg *ipc.IPCRequest) error {
+	encoding, chunkSize := t.transfer()
+	return t.conn.SendChunked(msg, encoding, chunkSize)
+}
+
+func (t *trackedConn) snapshot() ModuleConn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return ModuleConn{
+		ID:              t.id,
+		Identifier:      t.identifier,
+		Name:            t.name,
+		RemoteAddr:      t.counter.RemoteAddr().String(),
+		Transport:       t.transport,
+		ConnectedAt:     t.connectedAt,
+		LastSeen:        time.Unix(0, t.lastSeen.Load()),
+		BytesIn:         t.counter.in.Load(),
+		BytesOut:        t.counter.out.Load(),
+		ProtocolVersion: t.protocolVersion,
+		Compression:     t.encoding,
+		ChunkSize:       t.chunkSize,
+	}
+}
+
+// ConnectionRegistry holds the currently connected modules. A connection is added when it's accepted,
+// and removed when it closes or stops answering pings
+type ConnectionRegistry struct {
+	mu     sync.RWMutex
+	conns  map[uint64]*trackedConn
+	nextID uint64
+}
+
+func newConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{
+		conns: make(map[uint64]*trackedConn),
+	}
+}
+
+// add wraps the connection for byte counting and registers it.
+// certIdentifier is the module identifier taken from the client certificate, if any.
+func (r *ConnectionRegistry) add(c net.Conn, transport, certIdentifier string) *trackedConn {
+	counter := &countingConn{Conn: c}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	t := &trackedConn{
+		id:          r.nextID,
+		conn:        ipc.NewConn(counter),
+		counter:     counter,
+		connectedAt: time.Now(),
+
+		transport:      transport,
+		certIdentifier: certIdentifier,
+	}
+	if certIdentifier != "" {
+		t.identifier = certIdentifier
+	}
+	t.touch()
+	r.conns[t.id] = t
+	return t
+}
+
+func (r *ConnectionRegistry) remove(t *trackedConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, t.id)
+}
+
+// disconnect closes every connection of the module. The read loops notice and unregister them
+func (r *ConnectionRegistry) disconnect(identifier string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	for _, t := range r.conns {
+		t.mu.RLock()
+		match := t.identifier == identifier
+		t.mu.RUnlock()
+		if match {
+			t.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// setCapture starts or stops (if nil) capturing the frames of every connection
+func (r *ConnectionRegistry) setCapture(c *ipc.Capture) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, t := range r.conns {
+		t.conn.SetCapture(c, ipc.FROM_SERVER)
+	}
+}
+
+// List returns a snapshot of every connected module, ordered by connection time
+func (r *ConnectionRegistry) List() []ModuleConn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]ModuleConn, 0, len(r.conns))
+	for _, t := range r.conns {
+		list = append(list, t.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// countingConn counts the bytes read from and written to the connection
+type countingConn struct {
+	net.Conn
+	in  atomic.Uint64
+	out atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,201 @@
+package ipcserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/config"
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/bivrost/modules"
+)
+
+// testCA is a CA made for a test, which signs the certificates of the server and the modules
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, ca.path(name+"-ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue signs a certificate with the common name, and returns the paths of the certificate and its key
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := ca.path(commonName+".pem"), ca.path(commonName+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadedRegistry returns a registry with a module loaded from a manifest, with the name and identifier
+func loadedRegistry(t *testing.T, name, identifier string) *modules.Registry {
+	t.Helper()
+	manifest := filepath.Join(t.TempDir(), "config.yaml")
+	content := "name: " + name + "\nidentifier: " + identifier + "\nprotocol_version: 3\n"
+	if err := os.WriteFile(manifest, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := modules.NewRegistry()
+	if err := r.Load(config.Cfg{Sources: []config.Sources{{Name: name, Type: "module", Config: manifest}}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// tlsIdentifier connects to the server with the client config, and returns the identifier the server binds to it
+func tlsIdentifier(t *testing.T, s *IPCServer, serverConfig, clientConfig *tls.Config) (string, error) {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Read(make([]byte, 1)) // Until the server hangs up
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return s.certIdentifier(c.(*tls.Conn))
+}
+
+func TestCertIdentifier(t *testing.T) {
+	ca := newTestCA(t, "bivrost")
+	other := newTestCA(t, "other")
+
+	serverCert, serverKey := ca.issue(t, "bivrost", x509.ExtKeyUsageServerAuth)
+	serverConfig, err := ipc.ServerTLSConfig(serverCert, serverKey, ca.path("bivrost-ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewIPCServer("tls-test", "test", loadedRegistry(t, "threat", "THRI"))
+
+	tests := []struct {
+		name       string
+		ca         *testCA
+		commonName string
+		want       string // Empty if the certificate must be refused
+	}{
+		{"module name", ca, "threat", "THRI"},
+		{"module identifier", ca, "THRI", "THRI"},
+		{"unknown name", ca, "nobody", ""},
+		{"unknown identifier", ca, "ABCD", ""},
+		{"other CA", other, "THRI", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, key := tt.ca.issue(t, tt.commonName, x509.ExtKeyUsageClientAuth)
+			clientConfig, err := ipc.ClientTLSConfig(cert, key, ca.path("bivrost-ca.pem"), "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tlsIdentifier(t, s, serverConfig, clientConfig)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("certificate %q was accepted as %q", tt.commonName, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("certificate %q was refused: %v", tt.commonName, err)
+			}
+			if got != tt.want {
+				t.Fatalf("certificate %q bound to %q, want %q", tt.commonName, got, tt.want)
+			}
+		})
+	}
+
+	// A module that connected to the socket without being loaded isn't known well enough for a certificate
+	s.modules.StoreIdentifier("ABCD", [4]byte{'A', 'B', 'C', 'D'})
+	cert, key := ca.issue(t, "ABCD", x509.ExtKeyUsageClientAuth)
+	clientConfig, err := ipc.ClientTLSConfig(cert, key, ca.path("bivrost-ca.pem"), "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tlsIdentifier(t, s, serverConfig, clientConfig); err == nil {
+		t.Fatalf("certificate of an unloaded module was accepted as %q", got)
+	}
+}
@@ -0,0 +1,268 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const defaultReplayTimeout = 10 * time.Second
+
+// ErrNoFrames is returned when the capture has nothing to replay on the connection
+var ErrNoFrames = errors.New("no frames to replay")
+
+// ReplayOptions configure a replay
+type ReplayOptions struct {
+	Conn    uint64        // Connection of the capture to replay, defaults to the first one
+	Timing  bool          // Keep the delays between the frames, instead of sending them as fast as possible
+	Timeout time.Duration // How long to wait for each expected frame, defaults to 10s
+	OnFrame func(f Frame) // Called with every frame sent and received during the replay
+}
+
+// Mismatch is a difference between the capture and the replay
+type Mismatch struct {
+	Expected *Frame // The captured frame, nil if the frame received wasn't expected at all
+	Got      *Frame // The frame received, nil if nothing was
+}
+
+func (m Mismatch) String() string {
+	switch {
+	case m.Got == nil:
+		return fmt.Sprintf("expected %s %s from the %s, got nothing", m.Expected.Type, m.Expected.CorrelationID, m.Expected.From)
+	case m.Expected == nil:
+		return fmt.Sprintf("unexpected %s %s from the %s", m.Got.Type, m.Got.CorrelationID, m.Got.From)
+	default:
+		return fmt.Sprintf("expected %s %s from the %s, got %s", m.Expected.Type, m.Expected.CorrelationID, m.Expected.From, m.Got.Type)
+	}
+}
+
+// ConnFrames returns the frames of the connection, without pings and pongs, which depend on timing rather than on the peers.
+// Connection 0 is the first in the capture
+func ConnFrames(frames []Frame, conn uint64) []Frame {
+	var out []Frame
+	for _, f := range frames {
+		if conn == 0 {
+			conn = f.Conn
+		}
+		if f.Conn != conn || f.MessageType == MSG_PING || f.MessageType == MSG_PONG {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// ReplayToServer plays the module's part of the capture on the connection to a server, and reports every answer that differs
+func ReplayToServer(ctx context.Context, c net.Conn, frames []Frame, opts ReplayOptions) ([]Mismatch, error) {
+	r := newReplayer(c, FROM_MODULE, opts)
+	defer r.close()
+	return r.run(ctx, ConnFrames(frames, opts.Conn), func(expected, got Frame) bool {
+		if expected.MessageType == MSG_EVENT { // Events are pushed with new correlation IDs
+			return got.MessageType == MSG_EVENT
+		}
+		return got.CorrelationID == expected.CorrelationID && got.Chunk == expected.Chunk
+	})
+}
+
+// ReplayToModule accepts a module on the listener, and plays the server's part of the capture.
+// The module picks new correlation IDs, so the captured IDs in the server's answers are replaced with the ones it used
+func ReplayToModule(ctx context.Context, l net.Listener, frames []Frame, opts ReplayOptions) ([]Mismatch, error) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	var c net.Conn
+	select {
+	case c = <-accepted:
+	case <-ctx.Done():
+		l.Close() // Unblocks Accept
+		return nil, ctx.Err()
+	}
+
+	r := newReplayer(c, FROM_SERVER, opts)
+	defer r.close()
+	return r.run(ctx, ConnFrames(frames, opts.Conn), func(expected, got Frame) bool {
+		if got.MessageType != expected.MessageType || got.Chunk != expected.Chunk {
+			return false
+		}
+		if id, ok := r.ids[expected.CorrelationID]; ok { // Already seen, ex: the next chunk of a stream
+			return got.CorrelationID == id
+		}
+		r.ids[expected.CorrelationID] = got.CorrelationID
+		return true
+	})
+}
+
+// replayer plays one side of a captured connection
+type replayer struct {
+	conn    *Conn
+	local   string // The side being played, FROM_MODULE or FROM_SERVER
+	opts    ReplayOptions
+	frames  chan Frame        // Received from the peer
+	pending []Frame           // Received, but not matched yet
+	ids     map[string]string // Captured correlation IDs of the peer's requests, and the ones it used in the replay
+	done    chan struct{}
+}
+
+func newReplayer(c net.Conn, local string, opts ReplayOptions) *replayer {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultReplayTimeout
+	}
+	r := &replayer{
+		conn:   NewConn(c),
+		local:  local,
+		opts:   opts,
+		frames: make(chan Frame, 64),
+		ids:    make(map[string]string),
+		done:   make(chan struct{}),
+	}
+	go r.read()
+	return r
+}
+
+// read receives frames from the peer until the connection is closed. Pings are answered right away
+func (r *replayer) read() {
+	defer close(r.frames)
+	for {
+		req, err := r.conn.Receive()
+		if err != nil {
+			return
+		}
+		switch req.Header.MessageType {
+		case MSG_PING:
+			pong := req
+			pong.Header.MessageType = MSG_PONG
+			pong.Message = IPCMessage{}
+			pong.Checksum32 = 0
+			r.conn.Send(&pong)
+			continue
+		case MSG_PONG:
+			continue
+		}
+		f := NewFrame(&req, 0, otherSide(r.local))
+		select {
+		case r.frames <- f:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *replayer) close() {
+	close(r.done)
+	r.conn.Close()
+}
+
+// run sends the frames of the local side, and waits for the frames of the peer in between.
+// match reports whether a received frame is the expected one.
+func (r *replayer) run(ctx context.Context, frames []Frame, match func(expected, got Frame) bool) ([]Mismatch, error) {
+	if len(frames) == 0 {
+		return nil, ErrNoFrames
+	}
+	var mismatches []Mismatch
+	var last time.Time
+	for i := range frames {
+		f := frames[i]
+		if f.From != r.local {
+			if got, ok := r.expect(ctx, f, match); !ok {
+				mismatches = append(mismatches, Mismatch{Expected: &frames[i], Got: got})
+			}
+			continue
+		}
+
+		if r.opts.Timing && !last.IsZero() {
+			select {
+			case <-time.After(f.Time.Sub(last)):
+			case <-ctx.Done():
+				return mismatches, ctx.Err()
+			}
+		}
+		last = f.Time
+
+		req := f.Request()
+		if id, ok := r.ids[req.CorrelationID]; ok {
+			req.CorrelationID = id
+		}
+		if err := r.conn.Send(&req); err != nil {
+			return mismatches, fmt.Errorf("failed to send frame %d: %w", i+1, err)
+		}
+		if r.opts.OnFrame != nil {
+			sent := NewFrame(&req, f.Conn, r.local)
+			r.opts.OnFrame(sent)
+		}
+	}
+
+	// Anything else the peer sends shortly after is unexpected
+	r.drain(ctx, 200*time.Millisecond)
+	for i := range r.pending {
+		mismatches = append(mismatches, Mismatch{Got: &r.pending[i]})
+	}
+	if err := ctx.Err(); err != nil {
+		return mismatches, err
+	}
+	return mismatches, nil
+}
+
+// expect waits for the expected frame from the peer. Frames received in the meantime are kept for later.
+// Returns false, with the first frame received instead (if any), when the expected one doesn't arrive in time.
+func (r *replayer) expect(ctx context.Context, expected Frame, match func(expected, got Frame) bool) (*Frame, bool) {
+	timeout := time.NewTimer(r.opts.Timeout)
+	defer timeout.Stop()
+	for {
+		for i, got := range r.pending {
+			if match(expected, got) {
+				r.pending = append(r.pending[:i], r.pending[i+1:]...)
+				return &got, true
+			}
+		}
+		select {
+		case f, ok := <-r.frames:
+			if !ok {
+				return r.first(), false
+			}
+			if r.opts.OnFrame != nil {
+				r.opts.OnFrame(f)
+			}
+			r.pending = append(r.pending, f)
+		case <-timeout.C:
+			return r.first(), false
+		case <-ctx.Done():
+			return r.first(), false
+		}
+	}
+}
+
+// first removes and returns the oldest unmatched frame, or nil if there are none
+func (r *replayer) first() *Frame {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	f := r.pending[0]
+	r.pending = r.pending[1:]
+	return &f
+}
+
+// drain collects the frames received within d
+func (r *replayer) drain(ctx context.Context, d time.Duration) {
+	deadline := time.After(d)
+	for {
+		select {
+		case f, ok := <-r.frames:
+			if !ok {
+				return
+			}
+			if r.opts.OnFrame != nil {
+				r.opts.OnFrame(f)
+			}
+			r.pending = append(r.pending, f)
+		case <-deadline:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
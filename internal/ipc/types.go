@@ -1,28 +1,18 @@
 package ipc
 
 import (
-	"fmt"
 	"sync"
-)
-
-type IPCRequest struct {
-	MessageSignature []byte     // The message signature, used to declare an ipcRequest
-	Header           IPCHeader  // The header - containing type and identifier
-	Message          IPCMessage // The message
-	Timestamp        int64      // Timestamp of the message
-	Checksum32       int        // Checksum of the message byte data
-}
 
-type IPCHeader struct {
-	Identifier  [4]byte // Identifier of the module - available from the IPCClient for qol purposes
-	MessageType byte    // Type of the message
-}
+	"github.com/pynezz/bivrost/pkg/wire"
+)
 
-type IPCMessage struct {
-	Datatype   DataType // Type of the data ("json", "string", "int", etc.)
-	Data       []byte   // The actual data
-	StringData string   // String representation of the data if applicable
-}
+// The messages exchanged with the modules, see pkg/wire
+type (
+	IPCRequest = wire.IPCRequest
+	IPCHeader  = wire.IPCHeader
+	IPCMessage = wire.IPCMessage
+	DataType   = wire.DataType
+)
 
 type IPCResponse struct {
 	Request    IPCRequest // The request that was sent
@@ -41,28 +31,12 @@ type IPCResponse struct {
 // GenericData is a generic map for data. It can be used to store any data type.
 type GenericData map[string]interface{}
 
-type Metadata struct {
-	Source      string      `json:"source"`      // Source. Ex: sigma
-	Destination Destination `json:"destination"` // Destination. Ex: { name: database, info: "table=threat_intel" }
-	Method      string      `json:"method"`      // Using HTTP verbs to differentiate between requests (ps: this got nothing to do with actual HTTP)
-	Type        any         `json:"type"`        // Type of the data. A struct or a map
-}
-
-type Destination struct {
-	Object Object `json:"destination" yaml:"destination"` // Object (descriptor of the destination) should unmarsal as Destination
-}
-
-type Object struct {
-	Id       string   `json:"id"`
-	Name     string   `json:"name"`
-	Database Database `json:"database"`
-}
-
-type Database struct {
-	Name  string `json:"name"`
-	Table string `json:"table"`
-	RowID string `json:"row_id,omitempty"` // Row ID - fetch anything after this ID
-}
+type (
+	Metadata    = wire.Metadata
+	Destination = wire.Destination
+	Object      = wire.Object
+	Database    = wire.Database
+)
 
 type GetJSON struct {
 	Metadata    Metadata `json:"metadata"`
@@ -74,6 +48,13 @@ type MessageJSON struct {
 	Description string   `json:"description"`
 }
 
+// Handshake is sent as JSON data in a MSG_CONN message when a module connects,
+// and answered by the server with its own Handshake in a MSG_CONNACK message.
+type Handshake = wire.Handshake
+
+// PROTOCOL_VERSION is the version of the IPC protocol implemented by this package, see pkg/wire
+const PROTOCOL_VERSION = wire.PROTOCOL_VERSION
+
 type ModuleState struct {
 	LastRowID int
 	// Add any other module-specific state here
@@ -83,57 +64,28 @@ type ModuleState struct {
 // ----------------------------
 
 type MsgType int
-type DataType int
 
 const (
-	MSG_CONN    = 0x01 // Connection message
-	MSG_ACK     = 0x02 // Acknowledgement message
-	MSG_CONNACK = 0x03 // Connection acknowledgement message
-	MSG_MSG     = 0x04 // Message
-	MSG_MSGACK  = 0x05 // Message acknowledgement
-
-	MSG_PING = 0x08 // Ping message
-	MSG_PONG = 0x09 // Pong message
-
-	MSG_DISCONNECT = 0xD1 // Disconnect message
-
-	// Error message
-	// The sender is obviously still connected, but something went wrong and the message was not handled
-	MSG_ERROR = 0xEE
-
-	MSG_UNKNOWN = 0xFF // Unknown message - for signifying unknown type, maybe an error, but the receiver will try to wing it
+	MSG_CONN       = wire.MSG_CONN
+	MSG_ACK        = wire.MSG_ACK
+	MSG_CONNACK    = wire.MSG_CONNACK
+	MSG_MSG        = wire.MSG_MSG
+	MSG_MSGACK     = wire.MSG_MSGACK
+	MSG_EVENT      = wire.MSG_EVENT
+	MSG_EVENTACK   = wire.MSG_EVENTACK
+	MSG_PING       = wire.MSG_PING
+	MSG_PONG       = wire.MSG_PONG
+	MSG_DISCONNECT = wire.MSG_DISCONNECT
+	MSG_ERROR      = wire.MSG_ERROR
+	MSG_UNKNOWN    = wire.MSG_UNKNOWN
 )
 
 const (
-	DATA_TEXT = 0x01 // Text data
-	DATA_INT  = 0x02 // Integer data
-	DATA_JSON = 0x03 // JSON data	(used for structured data)
-	DATA_YAML = 0x04 // YAML data	(used for configuration files)
-	DATA_BIN  = 0x05 // Binary data	(such as images, files, etc.)
+	DATA_TEXT = wire.DATA_TEXT
+	DATA_INT  = wire.DATA_INT
+	DATA_JSON = wire.DATA_JSON
+	DATA_YAML = wire.DATA_YAML
+	DATA_BIN  = wire.DATA_BIN
 )
 
-var MSGTYPE = map[string]byte{
-	"conn":       byte(MSG_CONN),
-	"ack":        byte(MSG_ACK),
-	"connack":    byte(MSG_CONNACK),
-	"msg":        byte(MSG_MSG),
-	"msgack":     byte(MSG_MSGACK),
-	"ping":       byte(MSG_PING),
-	"pong":       byte(MSG_PONG),
-	"disconnect": byte(MSG_DISCONNECT),
-	"error":      byte(MSG_ERROR),
-	"unknown":    byte(MSG_UNKNOWN),
-}
-
-var IDENTIFIERS = map[string][4]byte{}
-
-func (r *IPCRequest) Stringify() string {
-	h := fmt.Sprintf("HEADER:\n\tIdentifier: %v\nMessageType: %v\n", r.Header.Identifier, r.Header.MessageType)
-	// m := "MESSAGE:\n"
-	// for i, data := range r.Message.Data {
-	// 	m += fmt.Sprintf("\tData[%d]: %v\n", i, data)
-	// }
-	m := fmt.Sprintf("MESSAGE:\n\tData: %v\n\tStringData: %v\n", r.Message.Data, r.Message.StringData)
-	c := fmt.Sprintf("CHECKSUM: %v\n", r.Checksum32)
-	return h + m + c
-}
+var MSGTYPE = wire.MSGTYPE
@@ -0,0 +1,478 @@
+package live
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MAX_FILTER_LENGTH keeps the filters cheap to evaluate on every row
+const MAX_FILTER_LENGTH = 1024
+
+// Filter is a parsed filter expression. The nil filter matches every row
+type Filter interface {
+	Match(row map[string]any) bool
+}
+
+type and []Filter
+type or []Filter
+type not struct{ f Filter }
+
+type comparison struct {
+	column string
+	op     string
+	values []literal // One, except for in
+}
+
+// literal is a value in a filter expression
+type literal struct {
+	str    string
+	num    float64
+	isNum  bool
+	isBool bool
+	b      bool
+	null   bool
+}
+
+func (a and) Match(row map[string]any) bool {
+	for _, f := range a {
+		if !f.Match(row) {
+			return false
+		}
+	}
+	return true
+}
+
+func (o or) Match(row map[string]any) bool {
+	for _, f := range o {
+		if f.Match(row) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n not) Match(row map[string]any) bool {
+	return !n.f.Match(row)
+}
+
+func (c comparison) Match(row map[string]any) bool {
+	v := row[c.column]
+	if c.op == "in" {
+		for _, lit := range c.values {
+			if compare(v, "=", lit) {
+				return true
+			}
+		}
+		return false
+	}
+	return compare(v, c.op, c.values[0])
+}
+
+func compare(v any, op string, lit literal) bool {
+	if lit.null {
+		switch op {
+		case "=":
+			return v == nil
+		case "!=":
+			return v != nil
+		}
+		return false
+	}
+	if v == nil {
+		return op == "!="
+	}
+	if op == "~" {
+		return strings.Contains(strings.ToLower(text(v)), strings.ToLower(lit.text()))
+	}
+
+	switch {
+	case lit.isNum:
+		n, ok := number(v)
+		if !ok {
+			return op == "!="
+		}
+		return ordered(op, cmp(n, lit.num))
+	case lit.isBool:
+		b, ok := boolean(v)
+		if !ok {
+			return op == "!="
+		}
+		switch op {
+		case "=":
+			return b == lit.b
+		case "!=":
+			return b != lit.b
+		}
+		return false
+	}
+	if t, ok := v.(time.Time); ok {
+		lt, err := time.Parse(time.RFC3339Nano, lit.str)
+		if err != nil {
+			return op == "!="
+		}
+		return ordered(op, t.Compare(lt))
+	}
+	return ordered(op, strings.Compare(text(v), lit.str))
+}
+
+// ordered reports whether the result of comparing two values, -1, 0 or 1, satisfies the operator
+func ordered(op string, c int) bool {
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func cmp(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (l literal) text() string {
+	switch {
+	case l.isNum:
+		return strconv.FormatFloat(l.num, 'f', -1, 64)
+	case l.isBool:
+		return strconv.FormatBool(l.b)
+	}
+	return l.str
+}
+
+func text(v any) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case time.Time:
+		return s.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(n)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// boolean reads booleans, which SQLite stores as 0 and 1
+func boolean(v any) (bool, bool) {
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+	if n, ok := number(v); ok {
+		return n != 0, true
+	}
+	return false, false
+}
+
+// ParseFilter parses a filter expression over the columns of the rows. The empty expression matches every row. Ex:
+//
+//	status >= 400 and remote_addr = '10.0.0.1'
+//	request ~ 'wp-login' or (severity in ('high', 'critical') and not status = 'resolved')
+//	score != null
+//
+// Comparisons are =, !=, <, <=, >, >=, ~ (contains, case insensitive) and in. Values are quoted strings,
+// numbers, true, false or null. Numbers compare numerically with text columns holding numbers, like the
+// status of the nginx logs, and strings compare with time columns as RFC 3339 times.
+// Rows without the column, or with NULL in it, only match != and = null
+func ParseFilter(expr string) (Filter, error) {
+	if len(expr) > MAX_FILTER_LENGTH {
+		return nil, fmt.Errorf("the filter is longer than %d characters", MAX_FILTER_LENGTH)
+	}
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &parser{tokens: tokens, end: len(expr)}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEnd {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return f, nil
+}
+
+const (
+	tokEnd = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokPunct // ( ) ,
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, token{tokPunct, string(c), i})
+			i++
+		case c == '\'' || c == '"':
+			// Quotes are escaped by doubling them, as in SQL
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s); j++ {
+				if rune(s[j]) == c {
+					if j+1 < len(s) && rune(s[j+1]) == c {
+						b.WriteByte(s[j])
+						j++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{tokString, b.String(), i})
+			i = j + 1
+		case strings.ContainsRune("=!<>~", c):
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			op := s[i:j]
+			if op == "==" {
+				op = "="
+			}
+			if op == "!" || op == "~=" {
+				return nil, fmt.Errorf("unknown operator %q at %d", op, i)
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i = j
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.' || s[j] == 'e' || s[j] == 'E') {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, s[i:j], i})
+			i = j
+		case c == '_' || unicode.IsLetter(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, s[i:j], i})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	i      int
+	end    int // Position of the end of the filter, for errors
+}
+
+func (p *parser) peek() token {
+	if p.i >= len(p.tokens) {
+		return token{kind: tokEnd, text: "end of the filter", pos: p.end}
+	}
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.i++
+	return t
+}
+
+// keyword reports whether the next token is the keyword, and consumes it if so
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokIdent && strings.EqualFold(t.text, kw) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) punct(c string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.text == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (Filter, error) {
+	var fs or
+	for {
+		f, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+		if !p.keyword("or") {
+			break
+		}
+	}
+	if len(fs) == 1 {
+		return fs[0], nil
+	}
+	return fs, nil
+}
+
+func (p *parser) and() (Filter, error) {
+	var fs and
+	for {
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+		if !p.keyword("and") {
+			break
+		}
+	}
+	if len(fs) == 1 {
+		return fs[0], nil
+	}
+	return fs, nil
+}
+
+func (p *parser) unary() (Filter, error) {
+	if p.keyword("not") {
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{f}, nil
+	}
+	if p.punct("(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.punct(")") {
+			t := p.peek()
+			return nil, fmt.Errorf("expected ) at %d, got %q", t.pos, t.text)
+		}
+		return f, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (Filter, error) {
+	col := p.next()
+	if col.kind != tokIdent {
+		return nil, fmt.Errorf("expected a column at %d, got %q", col.pos, col.text)
+	}
+	c := comparison{column: col.text}
+
+	if p.keyword("in") {
+		c.op = "in"
+		if !p.punct("(") {
+			return nil, fmt.Errorf("expected ( after in at %d", p.peek().pos)
+		}
+		for {
+			lit, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, lit)
+			if p.punct(")") {
+				return c, nil
+			}
+			if !p.punct(",") {
+				t := p.peek()
+				return nil, fmt.Errorf("expected , or ) at %d, got %q", t.pos, t.text)
+			}
+		}
+	}
+
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, fmt.Errorf("expected a comparison after %s at %d, got %q", col.text, op.pos, op.text)
+	}
+	c.op = op.text
+	lit, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	c.values = []literal{lit}
+	return c, nil
+}
+
+func (p *parser) literal() (literal, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return literal{str: t.text}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return literal{}, fmt.Errorf("malformed number %q at %d", t.text, t.pos)
+		}
+		return literal{num: n, isNum: true}, nil
+	case tokIdent:
+		switch strings.ToLower(t.text) {
+		case "true", "false":
+			return literal{b: strings.EqualFold(t.text, "true"), isBool: true}, nil
+		case "null":
+			return literal{null: true}, nil
+		}
+	}
+	return literal{}, fmt.Errorf("expected a value at %d, got %q", t.pos, t.text)
+}
@@ -0,0 +1,82 @@
+package live
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	row := map[string]any{
+		"status":      "404", // Text holding a number, as in the nginx logs
+		"remote_addr": "10.0.0.1",
+		"request":     "POST /wp-login.php HTTP/1.1",
+		"severity":    "high",
+		"score":       nil,
+		"blocked":     int64(1), // SQLite stores booleans as 0 and 1
+		"created_at":  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"status >= 400", true},
+		{"status < 400", false},
+		{"status = 404 and remote_addr = '10.0.0.1'", true},
+		{"status == 404 and remote_addr != '10.0.0.1'", false},
+		{"request ~ 'WP-LOGIN'", true},
+		{"severity in ('high', 'critical')", true},
+		{"severity in ('low')", false},
+		{"not severity = 'high' or status > 500", false},
+		{"(status > 500 or request ~ 'login') and not blocked = false", true},
+		{"blocked = true", true},
+		{"score = null", true},
+		{"score != null", false},
+		{"score > 1", false},
+		{"score != 1", true},
+		{"missing = 'x'", false},
+		{"missing != 'x'", true},
+		{"created_at >= '2024-05-01T00:00:00Z'", true},
+		{"created_at > '2024-05-02T00:00:00Z'", false},
+		{"remote_addr = 'it''s'", false},
+		{"AND_column = 1 OR status = 404", true}, // Keywords are case insensitive, columns aren't
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := ParseFilter(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f == nil || f.Match(row); got != tt.want {
+				t.Errorf("%q matched %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	long := make([]byte, MAX_FILTER_LENGTH+1)
+	for i := range long {
+		long[i] = ' '
+	}
+	for _, expr := range []string{
+		"status",
+		"status >=",
+		"status ! 400",
+		"status ~= 'x'",
+		"request ~ 'unterminated",
+		"(status = 1",
+		"status = 1)",
+		"severity in 'high'",
+		"severity in ('high' 'low')",
+		"status = 1 and",
+		"= 1",
+		"status = 1 # comment",
+		"status = 1.2.3",
+		string(long),
+	} {
+		if f, err := ParseFilter(expr); err == nil {
+			t.Errorf("parsed %q as %v, want an error", expr, f)
+		}
+	}
+}
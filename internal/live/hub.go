@@ -0,0 +1,248 @@
+// Package live streams the rows committed to the stores to live tail clients, such as the SOC wall display
+package live
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/database"
+)
+
+const (
+	DEFAULT_BUFFER    = 256 // Rows queued per client before they're dropped
+	MAX_SUBSCRIPTIONS = 16  // Per client
+	ALL_TABLES        = "*"
+)
+
+// Types of the messages sent to clients
+const (
+	MSG_EVENT        = "event"        // A new row
+	MSG_DROPPED      = "dropped"      // Rows were dropped because the client was too slow
+	MSG_SUBSCRIBED   = "subscribed"   // Answers a subscription
+	MSG_UNSUBSCRIBED = "unsubscribed" // Answers an unsubscription
+	MSG_ERROR        = "error"        // Answers a request that failed
+)
+
+// Message is sent to clients as JSON
+type Message struct {
+	Type          string         `json:"type"`
+	ID            string         `json:"id,omitempty"`            // Of the subscription a control message answers
+	Subscriptions []string       `json:"subscriptions,omitempty"` // Every subscription of the client the row matches
+	Table         string         `json:"table,omitempty"`
+	Row           map[string]any `json:"row,omitempty"`
+	Dropped       uint64         `json:"dropped,omitempty"` // Rows dropped since the last notice
+	Error         string         `json:"error,omitempty"`
+	Time          time.Time      `json:"time"` // When the row was committed, or the message sent
+}
+
+// Subscription selects the rows a client gets
+type Subscription struct {
+	ID     string   `json:"id"`
+	Tables []string `json:"tables"` // ALL_TABLES for every table
+	Filter string   `json:"filter,omitempty"`
+}
+
+type subscription struct {
+	Subscription
+	tables map[string]bool
+	filter Filter
+}
+
+func (s *subscription) match(table string, row map[string]any) bool {
+	if !s.tables[table] && !s.tables[ALL_TABLES] {
+		return false
+	}
+	return s.filter == nil || s.filter.Match(row)
+}
+
+// Hub fans the commits of the feed out to the clients. Every client has a bounded queue, and the rows that don't fit
+// when it reads slower than rows are committed are dropped, telling the client how many it missed.
+// Committing rows never waits for a client
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+	buffer  int
+	cancel  func()
+}
+
+// NewHub subscribes to the feed. buffer is the size of the queue of each client, DEFAULT_BUFFER if 0
+func NewHub(feed *database.Feed, buffer int) *Hub {
+	if buffer <= 0 {
+		buffer = DEFAULT_BUFFER
+	}
+	h := &Hub{clients: make(map[*Client]struct{}), buffer: buffer}
+	h.cancel = feed.Subscribe(h.publish)
+	return h
+}
+
+// Close stops following the feed
+func (h *Hub) Close() {
+	h.cancel()
+}
+
+// Clients returns the number of connected clients
+func (h *Hub) Clients() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// SetBuffer sets the size of the queue of the clients that join from now on, DEFAULT_BUFFER if 0
+func (h *Hub) SetBuffer(buffer int) {
+	if buffer <= 0 {
+		buffer = DEFAULT_BUFFER
+	}
+	h.mu.Lock()
+	h.buffer = buffer
+	h.mu.Unlock()
+}
+
+// Join adds a client, without any subscriptions. The client must be closed when it disconnects
+func (h *Hub) Join() *Client {
+	c := &Client{
+		hub:     h,
+		control: make(chan Message, MAX_SUBSCRIPTIONS),
+		subs:    make(map[string]*subscription),
+	}
+	h.mu.Lock()
+	c.events = make(chan Message, h.buffer)
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+	return c
+}
+
+func (h *Hub) publish(commit database.Commit) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		c.publish(commit)
+	}
+}
+
+// Client is a live tail client
+type Client struct {
+	hub     *Hub
+	events  chan Message // Bounded, rows are dropped when it's full
+	control chan Message // Answers to the client's requests
+	dropped atomic.Uint64
+
+	mu   sync.RWMutex
+	subs map[string]*subscription
+}
+
+// Events are the rows matching the client's subscriptions
+func (c *Client) Events() <-chan Message {
+	return c.events
+}
+
+// Control are the answers to the client's subscriptions and unsubscriptions
+func (c *Client) Control() <-chan Message {
+	return c.control
+}
+
+// TakeDropped returns the number of rows dropped since it was last called
+func (c *Client) TakeDropped() uint64 {
+	return c.dropped.Swap(0)
+}
+
+// Close removes the client from the hub. No more events are queued after it returns
+func (c *Client) Close() {
+	c.hub.mu.Lock()
+	delete(c.hub.clients, c)
+	c.hub.mu.Unlock()
+}
+
+// Subscribe adds or replaces the subscription with the same ID, and answers on the control channel
+func (c *Client) Subscribe(s Subscription) error {
+	sub, err := c.subscribe(s)
+	if err != nil {
+		c.reply(Message{Type: MSG_ERROR, ID: s.ID, Error: err.Error()})
+		return err
+	}
+	c.mu.Lock()
+	c.subs[s.ID] = sub
+	c.mu.Unlock()
+	c.reply(Message{Type: MSG_SUBSCRIBED, ID: s.ID})
+	return nil
+}
+
+func (c *Client) subscribe(s Subscription) (*subscription, error) {
+	if s.ID == "" {
+		return nil, fmt.Errorf("the subscription has no id")
+	}
+	if len(s.Tables) == 0 {
+		return nil, fmt.Errorf("the subscription has no tables, use %q for every table", ALL_TABLES)
+	}
+	c.mu.RLock()
+	_, replaces := c.subs[s.ID]
+	count := len(c.subs)
+	c.mu.RUnlock()
+	if !replaces && count >= MAX_SUBSCRIPTIONS {
+		return nil, fmt.Errorf("at most %d subscriptions per connection", MAX_SUBSCRIPTIONS)
+	}
+
+	filter, err := ParseFilter(s.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	sub := &subscription{Subscription: s, tables: make(map[string]bool), filter: filter}
+	for _, t := range s.Tables {
+		sub.tables[t] = true
+	}
+	return sub, nil
+}
+
+// Unsubscribe removes the subscription, and answers on the control channel
+func (c *Client) Unsubscribe(id string) bool {
+	c.mu.Lock()
+	_, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+	if !ok {
+		c.reply(Message{Type: MSG_ERROR, ID: id, Error: "no such subscription"})
+		return false
+	}
+	c.reply(Message{Type: MSG_UNSUBSCRIBED, ID: id})
+	return true
+}
+
+// Error answers a request of the client that failed
+func (c *Client) Error(id string, err error) {
+	c.reply(Message{Type: MSG_ERROR, ID: id, Error: err.Error()})
+}
+
+// reply queues a control message. They're dropped if the client doesn't read its answers
+func (c *Client) reply(m Message) {
+	m.Time = time.Now()
+	select {
+	case c.control <- m:
+	default:
+	}
+}
+
+// publish queues the rows of the commit that match a subscription, and counts those that don't fit
+func (c *Client) publish(commit database.Commit) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.subs) == 0 {
+		return
+	}
+	for _, row := range commit.Rows {
+		var matched []string
+		for id, sub := range c.subs {
+			if sub.match(commit.Table, row) {
+				matched = append(matched, id)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		select {
+		case c.events <- Message{Type: MSG_EVENT, Subscriptions: matched, Table: commit.Table, Row: row, Time: commit.Time}:
+		default:
+			c.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package live
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/database"
+)
+
+// received drains the events queued for the client, and returns the subscriptions each matched
+func received(c *Client) []string {
+	var got []string
+	for {
+		select {
+		case m := <-c.Events():
+			sort.Strings(m.Subscriptions)
+			got = append(got, fmt.Sprintf("%s:%v:%v", m.Table, m.Row["id"], m.Subscriptions))
+		default:
+			return got
+		}
+	}
+}
+
+func TestHubSubscriptions(t *testing.T) {
+	logs := database.Commit{Table: "nginx_logs", Time: time.Now(), Rows: []map[string]any{
+		{"id": 1, "status": "200"},
+		{"id": 2, "status": "404"},
+	}}
+	threats := database.Commit{Table: "threat_records", Time: time.Now(), Rows: []map[string]any{
+		{"id": 1, "severity": "high"},
+	}}
+
+	tests := []struct {
+		name          string
+		subscriptions []Subscription
+		unsubscribe   string
+		want          []string
+	}{
+		{"none", nil, "", nil},
+		{
+			name:          "by table",
+			subscriptions: []Subscription{{ID: "logs", Tables: []string{"nginx_logs"}}},
+			want:          []string{"nginx_logs:1:[logs]", "nginx_logs:2:[logs]"},
+		},
+		{
+			name:          "every table, filtered",
+			subscriptions: []Subscription{{ID: "errors", Tables: []string{ALL_TABLES}, Filter: "status >= 400 or severity = 'high'"}},
+			want:          []string{"nginx_logs:2:[errors]", "threat_records:1:[errors]"},
+		},
+		{
+			name: "a row matching several subscriptions is sent once",
+			subscriptions: []Subscription{
+				{ID: "logs", Tables: []string{"nginx_logs"}},
+				{ID: "errors", Tables: []string{"nginx_logs"}, Filter: "status >= 400"},
+			},
+			want: []string{"nginx_logs:1:[logs]", "nginx_logs:2:[errors logs]"},
+		},
+		{
+			name: "replaced",
+			subscriptions: []Subscription{
+				{ID: "logs", Tables: []string{"nginx_logs"}},
+				{ID: "logs", Tables: []string{"threat_records"}},
+			},
+			want: []string{"threat_records:1:[logs]"},
+		},
+		{
+			name:          "unsubscribed",
+			subscriptions: []Subscription{{ID: "logs", Tables: []string{"nginx_logs"}}, {ID: "threats", Tables: []string{"threat_records"}}},
+			unsubscribe:   "logs",
+			want:          []string{"threat_records:1:[threats]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed := database.NewFeed()
+			hub := NewHub(feed, 0)
+			defer hub.Close()
+			c := hub.Join()
+			defer c.Close()
+
+			for _, s := range tt.subscriptions {
+				if err := c.Subscribe(s); err != nil {
+					t.Fatal(err)
+				}
+				if m := <-c.Control(); m.Type != MSG_SUBSCRIBED || m.ID != s.ID {
+					t.Errorf("subscribing answered %+v", m)
+				}
+			}
+			if tt.unsubscribe != "" {
+				if !c.Unsubscribe(tt.unsubscribe) {
+					t.Fatalf("unsubscribing %s failed", tt.unsubscribe)
+				}
+				if m := <-c.Control(); m.Type != MSG_UNSUBSCRIBED || m.ID != tt.unsubscribe {
+					t.Errorf("unsubscribing answered %+v", m)
+				}
+			}
+			feed.Publish(logs)
+			feed.Publish(threats)
+
+			if got := received(c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("received %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscribeErrors(t *testing.T) {
+	hub := NewHub(database.NewFeed(), 0)
+	defer hub.Close()
+	full := hub.Join()
+	defer full.Close()
+	for i := 0; i < MAX_SUBSCRIPTIONS; i++ {
+		if err := full.Subscribe(Subscription{ID: fmt.Sprint(i), Tables: []string{ALL_TABLES}}); err != nil {
+			t.Fatal(err)
+		}
+		<-full.Control()
+	}
+
+	tests := []struct {
+		name   string
+		client *Client
+		s      Subscription
+	}{
+		{"no id", hub.Join(), Subscription{Tables: []string{ALL_TABLES}}},
+		{"no tables", hub.Join(), Subscription{ID: "logs"}},
+		{"bad filter", hub.Join(), Subscription{ID: "logs", Tables: []string{ALL_TABLES}, Filter: "status >="}},
+		{"too many subscriptions", full, Subscription{ID: "one more", Tables: []string{ALL_TABLES}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.client.Subscribe(tt.s); err == nil {
+				t.Fatal("the subscription was accepted")
+			}
+			if m := <-tt.client.Control(); m.Type != MSG_ERROR || m.ID != tt.s.ID || m.Error == "" {
+				t.Errorf("the failed subscription answered %+v", m)
+			}
+		})
+	}
+
+	if err := full.Subscribe(Subscription{ID: "0", Tables: []string{"nginx_logs"}}); err != nil {
+		t.Errorf("replacing a subscription of a full client: %v", err)
+	}
+	c := hub.Join()
+	if c.Unsubscribe("nope") {
+		t.Error("unsubscribing an unknown subscription succeeded")
+	}
+	if m := <-c.Control(); m.Type != MSG_ERROR || m.ID != "nope" {
+		t.Errorf("unsubscribing an unknown subscription answered %+v", m)
+	}
+}
+
+// A slow client gets the rows that fit in its queue, and is told how many it missed. Other clients aren't affected
+func TestSlowClient(t *testing.T) {
+	const buffer = 4
+	feed := database.NewFeed()
+	hub := NewHub(feed, buffer)
+	defer hub.Close()
+	slow, fast := hub.Join(), hub.Join()
+	for _, c := range []*Client{slow, fast} {
+		c.Subscribe(Subscription{ID: "all", Tables: []string{ALL_TABLES}})
+	}
+
+	for i := 0; i < 10; i++ {
+		feed.Publish(database.Commit{Table: "nginx_logs", Rows: []map[string]any{{"id": i}}})
+		if got := received(fast); len(got) != 1 { // Keeps up
+			t.Fatalf("the fast client got %v for row %d", got, i)
+		}
+	}
+	if dropped := fast.TakeDropped(); dropped != 0 {
+		t.Errorf("the fast client dropped %d rows", dropped)
+	}
+	if got := len(received(slow)); got != buffer {
+		t.Errorf("the slow client got %d rows, want the %d that fit", got, buffer)
+	}
+	if dropped := slow.TakeDropped(); dropped != 10-buffer {
+		t.Errorf("the slow client dropped %d rows, want %d", dropped, 10-buffer)
+	}
+	if dropped := slow.TakeDropped(); dropped != 0 {
+		t.Errorf("%d dropped rows were reported twice", dropped)
+	}
+
+	slow.Close()
+	feed.Publish(database.Commit{Table: "nginx_logs", Rows: []map[string]any{{"id": 10}}})
+	if got := received(slow); len(got) != 0 || hub.Clients() != 1 {
+		t.Errorf("a closed client got %v, the hub has %d clients", got, hub.Clients())
+	}
+}
@@ -0,0 +1,439 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pynezz/pynezzentials/ansi"
+	"github.com/pynezz/pynezzentials/cryptoutils"
+)
+
+var (
+	ErrNoUsersDatabase   = errors.New("the users database is not connected")
+	ErrNoSuchUser        = errors.New("no such user")
+	ErrNoSuchInvitation  = errors.New("no such invitation")
+	ErrInvalidInvitation = errors.New("the invitation is invalid, expired or already used")
+	ErrLastAdmin         = errors.New("there must be at least one enabled admin")
+)
+
+const (
+	sqliteTime         = "2006-01-02 15:04:05" // Format of datetime('now'), in UTC
+	DEFAULT_INVITE_TTL = 72 * time.Hour
+)
+
+// userColumns are the columns scanned by scanUser
+const userColumns = `UserID, DisplayName, CreatedAt, UpdatedAt, LastLogin, Role,
+		FirstName, ProfileImageURL, SessionId, AuthMethodID, Disabled`
+
+// UserUpdate changes a user. Fields that are nil aren't changed
+type UserUpdate struct {
+	Role      *string `json:"role,omitempty"`
+	FirstName *string `json:"firstname,omitempty"`
+	Disabled  *bool   `json:"disabled,omitempty"`
+	Password  *string `json:"password,omitempty"`
+}
+
+// Invitation lets someone register with a role, decided by the admin who made it.
+// Its token is stored as a SHA-256 hash
+type Invitation struct {
+	ID        int64   `json:"id"`
+	Role      string  `json:"role"`
+	CreatedBy uint64  `json:"created_by"`
+	CreatedAt string  `json:"created_at"`
+	ExpiresAt string  `json:"expires_at"`
+	UsedBy    *uint64 `json:"used_by,omitempty"`
+	UsedAt    *string `json:"used_at,omitempty"`
+	Token     string  `json:"token,omitempty"` // Only when it's created
+}
+
+func usersDB() (*Database, error) {
+	if DBInstance == nil || DBInstance.Driver == nil {
+		return nil, ErrNoUsersDatabase
+	}
+	return DBInstance, nil
+}
+
+// scanUser scans the userColumns of a row. Columns added after the users were created may be NULL
+func scanUser(row RowScanner) (User, error) {
+	var u User
+	var createdAt, updatedAt, lastLogin, firstName, image, session sql.NullString
+	var authMethod sql.NullInt64
+	err := row.Scan(&u.UserID, &u.DisplayName, &createdAt, &updatedAt, &lastLogin, &u.Role,
+		&firstName, &image, &session, &authMethod, &u.Disabled)
+	u.CreatedAt, u.UpdatedAt, u.LastLogin = createdAt.String, updatedAt.String, lastLogin.String
+	u.FirstName, u.ProfileImageUrl, u.SessionId = firstName.String, image.String, session.String
+	u.AuthMethodID = int(authMethod.Int64)
+	return u, err
+}
+
+// ListUsers returns every user, ordered by display name
+func ListUsers() ([]User, error) {
+	db, err := usersDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Driver.Query(`SELECT ` + userColumns + ` FROM users ORDER BY DisplayName`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// LookupUser returns the user with the ID, or ErrNoSuchUser
+func LookupUser(id uint64) (User, error) {
+	db, err := usersDB()
+	if err != nil {
+		return User{}, err
+	}
+	u, err := scanUser(db.Driver.QueryRow(`SELECT `+userColumns+` FROM users WHERE UserID = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, ErrNoSuchUser
+	}
+	return u, err
+}
+
+// ensureAdmin fails with ErrLastAdmin if no enabled admin but the user with the ID is left
+func ensureAdmin(tx *sql.Tx, id uint64) error {
+	var admins int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE Role = ? AND Disabled = 0 AND UserID != ?`, ROLE_ADMIN, id).Scan(&admins)
+	if err != nil {
+		return err
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// UpdateUser changes the user, and returns it
+func UpdateUser(id uint64, update UserUpdate) (User, error) {
+	db, err := usersDB()
+	if err != nil {
+		return User{}, err
+	}
+	if update.Role != nil && !ValidRole(*update.Role) {
+		return User{}, NewUserValidationError("Invalid role: " + *update.Role)
+	}
+	if update.Password != nil && len(*update.Password) < 12 {
+		return User{}, NewUserValidationError("Password must be at least 12 characters long")
+	}
+
+	tx, err := db.Driver.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+	u, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE UserID = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, ErrNoSuchUser
+	}
+	if err != nil {
+		return u, err
+	}
+
+	if update.Role != nil {
+		u.Role = *update.Role
+	}
+	if update.FirstName != nil {
+		u.FirstName = *update.FirstName
+	}
+	if update.Disabled != nil {
+		u.Disabled = *update.Disabled
+	}
+	if u.Role != ROLE_ADMIN || u.Disabled {
+		if err := ensureAdmin(tx, id); err != nil {
+			return u, err
+		}
+	}
+	u.UpdatedAt = time.Now().UTC().Format(sqliteTime)
+	if _, err := tx.Exec(`UPDATE users SET Role = ?, FirstName = ?, Disabled = ?, UpdatedAt = ? WHERE UserID = ?`,
+		u.Role, u.FirstName, u.Disabled, u.UpdatedAt, id); err != nil {
+		return u, err
+	}
+	if update.Password != nil {
+		hash, err := hashPassword(*update.Password)
+		if err != nil {
+			return u, err
+		}
+		if _, err := tx.Exec(`INSERT INTO password_auth (UserID, Enabled, PasswordHash) VALUES (?, 1, ?)
+			ON CONFLICT(UserID) DO UPDATE SET PasswordHash = excluded.PasswordHash`, id, hash); err != nil {
+			return u, err
+		}
+		// Whoever knew the old password may hold a session, see Session
+		if _, err := tx.Exec(`UPDATE user_sessions SET RevokedAt = ? WHERE UserID = ? AND RevokedAt IS NULL`, u.UpdatedAt, id); err != nil {
+			return u, err
+		}
+	}
+	return u, tx.Commit()
+}
+
+// DeleteUser deletes the user, its credentials and API keys
+func DeleteUser(id uint64) error {
+	db, err := usersDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Driver.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := ensureAdmin(tx, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM users WHERE UserID = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchUser
+	}
+	// Foreign keys aren't enforced by SQLite by default, so the credentials aren't deleted along with the user
+	for _, table := range []string{DefaultTables.PasswordAuth, DefaultTables.WebAuthnAuth, DefaultTables.UserSessions, "api_keys"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE UserID = ?`, id); err != nil {
+			return err
+		}
+	}
+	ansi.PrintInfo("Deleted user " + strconv.FormatUint(id, 10))
+	return tx.Commit()
+}
+
+// CreateUser creates a user with a password, for the admins
+func CreateUser(req CreateUserRequest) (User, error) {
+	if _, errs := ValidateNewUser(req); len(errs) > 0 {
+		return User{}, errs[0]
+	}
+	db, err := usersDB()
+	if err != nil {
+		return User{}, err
+	}
+	tx, err := db.Driver.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+	u, err := insertUser(tx, req.DisplayName, req.Password, req.Role, req.FirstName)
+	if err != nil {
+		return u, err
+	}
+	return u, tx.Commit()
+}
+
+// RegisterUser registers a user with the invitation in the request, which decides the role.
+// The first user doesn't need an invitation, and is an admin
+func RegisterUser(req PasswordRegisterRequest) (User, error) {
+	if len(req.Password) < 12 {
+		return User{}, NewUserValidationError("Password must be at least 12 characters long")
+	}
+	db, err := usersDB()
+	if err != nil {
+		return User{}, err
+	}
+	tx, err := db.Driver.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var users int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&users); err != nil {
+		return User{}, err
+	}
+	role := ROLE_ADMIN
+	var invitationID int64
+	if users > 0 {
+		if req.Invitation == "" {
+			return User{}, ErrInvalidInvitation
+		}
+		now := time.Now().UTC().Format(sqliteTime)
+		err := tx.QueryRow(`SELECT InvitationID, Role FROM invitations WHERE TokenHash = ? AND UsedAt IS NULL AND ExpiresAt > ?`,
+			hashToken(req.Invitation), now).Scan(&invitationID, &role)
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, ErrInvalidInvitation
+		}
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	firstName := req.DisplayName
+	if firstName == "" {
+		firstName = req.Username
+	}
+	u, err := insertUser(tx, req.Username, req.Password, role, firstName)
+	if err != nil {
+		return u, err
+	}
+	if invitationID != 0 {
+		if _, err := tx.Exec(`UPDATE invitations SET UsedBy = ?, UsedAt = ? WHERE InvitationID = ?`,
+			u.UserID, time.Now().UTC().Format(sqliteTime), invitationID); err != nil {
+			return u, err
+		}
+	}
+	return u, tx.Commit()
+}
+
+// insertUser inserts a user with a password. The display name is the username with the first 3 digits of the ID, see BeginLogin
+func insertUser(tx *sql.Tx, username, password, role, firstName string) (User, error) {
+	if username == "" {
+		return User{}, NewUserValidationError("Username is required")
+	}
+	if strings.ContainsAny(username, "#%") {
+		return User{}, NewUserValidationError("Username must not contain # or %")
+	}
+	if !ValidRole(role) {
+		return User{}, NewUserValidationError("Invalid role: " + role)
+	}
+	// Users log in with the username, without the digits of the display name
+	var taken int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE substr(DisplayName, 1, ?) = ?`,
+		len(username)+1, username+"#").Scan(&taken); err != nil {
+		return User{}, err
+	}
+	if taken > 0 {
+		return User{}, NewUserValidationError("Username is taken: " + username)
+	}
+	id, err := cryptoutils.GenerateRandomInt(1000000, 10000000)
+	if err != nil {
+		return User{}, err
+	}
+	now := time.Now().UTC().Format(sqliteTime)
+	if firstName == "" {
+		firstName = username
+	}
+	u := User{
+		UserID:          id,
+		DisplayName:     username + "#" + strconv.FormatUint(id, 10)[:3],
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		Role:            role,
+		FirstName:       firstName,
+		ProfileImageUrl: GetPlaceholderImage(PlaceholderImage{Width: 200, Height: 200, Text: username}),
+		AuthMethodID:    1, // Password
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return u, err
+	}
+	if _, err := tx.Exec(`INSERT INTO users (UserID, DisplayName, CreatedAt, UpdatedAt, Role, FirstName, ProfileImageURL, AuthMethodID)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.UserID, u.DisplayName, u.CreatedAt, u.UpdatedAt, u.Role, u.FirstName, u.ProfileImageUrl, u.AuthMethodID); err != nil {
+		return u, err
+	}
+	if _, err := tx.Exec(`INSERT INTO password_auth (UserID, Enabled, PasswordHash) VALUES (?, 1, ?)`, u.UserID, hash); err != nil {
+		return u, err
+	}
+	ansi.PrintInfo(fmt.Sprintf("Created user %s with the role %s", u.DisplayName, u.Role))
+	return u, nil
+}
+
+// hashPassword hashes the password with argon2, see ComparePasswordAndHash
+func hashPassword(password string) (string, error) {
+	_, encodedHash, err := generateFromPassword(password, DefaultParams())
+	return encodedHash, err
+}
+
+// newToken returns a random token for invitations and other secrets, URL safe
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken hashes a random token. Tokens are long and random enough not to need a slow hash
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateInvitation makes an invitation to register with the role, valid for the ttl (DEFAULT_INVITE_TTL if 0)
+func CreateInvitation(role string, createdBy uint64, ttl time.Duration) (Invitation, error) {
+	if !ValidRole(role) {
+		return Invitation{}, NewUserValidationError("Invalid role: " + role)
+	}
+	if ttl <= 0 {
+		ttl = DEFAULT_INVITE_TTL
+	}
+	db, err := usersDB()
+	if err != nil {
+		return Invitation{}, err
+	}
+	token, err := newToken()
+	if err != nil {
+		return Invitation{}, err
+	}
+	now := time.Now().UTC()
+	inv := Invitation{Role: role, CreatedBy: createdBy, CreatedAt: now.Format(sqliteTime),
+		ExpiresAt: now.Add(ttl).Format(sqliteTime), Token: token}
+	res, err := db.Driver.Exec(`INSERT INTO invitations (TokenHash, Role, CreatedBy, CreatedAt, ExpiresAt) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(token), inv.Role, inv.CreatedBy, inv.CreatedAt, inv.ExpiresAt)
+	if err != nil {
+		return Invitation{}, err
+	}
+	inv.ID, err = res.LastInsertId()
+	return inv, err
+}
+
+// ListInvitations returns every invitation, the latest first, without their tokens
+func ListInvitations() ([]Invitation, error) {
+	db, err := usersDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Driver.Query(`SELECT InvitationID, Role, CreatedBy, CreatedAt, ExpiresAt, UsedBy, UsedAt
+		FROM invitations ORDER BY InvitationID DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		var usedBy sql.NullInt64
+		var usedAt sql.NullString
+		if err := rows.Scan(&inv.ID, &inv.Role, &inv.CreatedBy, &inv.CreatedAt, &inv.ExpiresAt, &usedBy, &usedAt); err != nil {
+			return nil, err
+		}
+		if usedBy.Valid {
+			id := uint64(usedBy.Int64)
+			inv.UsedBy, inv.UsedAt = &id, &usedAt.String
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// DeleteInvitation revokes the invitation
+func DeleteInvitation(id int64) error {
+	db, err := usersDB()
+	if err != nil {
+		return err
+	}
+	res, err := db.Driver.Exec(`DELETE FROM invitations WHERE InvitationID = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchInvitation
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testUsersDB connects a users database in a temporary directory, with the schema of the migration scripts upgraded
+func testUsersDB(t *testing.T) *Database {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tables of db/migrations the upgrades start from
+	if _, err := conn.Exec(`CREATE TABLE users (
+UserID INTEGER PRIMARY KEY,
+DisplayName TEXT UNIQUE NOT NULL,
+CreatedAt TEXT DEFAULT (datetime('now')),
+UpdatedAt TEXT DEFAULT (datetime('now')),
+LastLogin TEXT,
+Role TEXT CHECK(Role IN ('admin', 'user')) DEFAULT 'user',
+FirstName TEXT,
+ProfileImageURL TEXT,
+SessionId TEXT,
+AuthMethodID INTEGER
+);
+CREATE TABLE password_auth (
+    UserID INTEGER PRIMARY KEY,
+    Enabled BOOLEAN DEFAULT 1,
+    PasswordHash TEXT NOT NULL,
+    FOREIGN KEY (UserID) REFERENCES users(UserID) ON DELETE CASCADE
+);`); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := DBInstance
+	db := InitDatabaseDriver(conn)
+	t.Cleanup(func() {
+		DBInstance = previous
+		conn.Close()
+	})
+	if err := db.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testUser creates a user with the role
+func testUser(t *testing.T, name, role string) User {
+	t.Helper()
+	u, err := CreateUser(CreateUserRequest{DisplayName: name, Password: "correct horse battery", Role: role})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// testSession logs the user in, as the login handlers do
+func testSession(t *testing.T, u User) UserSession {
+	t.Helper()
+	var session UserSession
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) (err error) {
+		session, err = newSession(u, c)
+		return err
+	})
+	res, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("starting a session answered %d", res.StatusCode)
+	}
+	return session
+}
+
+func TestUpdateUserSessions(t *testing.T) {
+	testUsersDB(t)
+	testUser(t, "admin", ROLE_ADMIN)
+	password, name := "a new password 123", "Ada"
+
+	tests := []struct {
+		name    string
+		update  UserUpdate
+		revoked bool
+	}{
+		{"password", UserUpdate{Password: &password}, true},
+		{"first name", UserUpdate{FirstName: &name}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := testUser(t, "user"+tt.name[:1], ROLE_VIEWER)
+			session := testSession(t, u)
+			if _, err := UpdateUser(u.UserID, tt.update); err != nil {
+				t.Fatal(err)
+			}
+
+			active, err := SessionActive(session.SessionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if active == tt.revoked {
+				t.Errorf("session active = %v after changing the %s", active, tt.name)
+			}
+			_, err = RefreshSession(session.RefreshToken)
+			if tt.revoked && err != ErrInvalidRefreshToken {
+				t.Errorf("refreshing after changing the %s: got %v, want %v", tt.name, err, ErrInvalidRefreshToken)
+			}
+			if !tt.revoked && err != nil {
+				t.Errorf("refreshing after changing the %s: %v", tt.name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pynezz/pynezzentials/ansi"
+)
+
+var (
+	ErrNoSuchKey  = errors.New("no such API key")
+	ErrInvalidKey = errors.New("the API key is invalid, expired or revoked")
+)
+
+const (
+	API_KEY_PREFIX = "bvk_"
+	KEY_CACHE_TTL  = 5 * time.Minute
+)
+
+// APIKey is a long-lived key for machine clients, without its secret. It's sent as a bearer token like the JWTs:
+//
+//	Authorization: Bearer bvk_<prefix>_<secret>
+//
+// The prefix identifies the key, and the secret is stored hashed with argon2
+type APIKey struct {
+	ID        int64        `json:"id"`
+	Prefix    string       `json:"prefix"`
+	Name      string       `json:"name"`
+	UserID    uint64       `json:"user_id"`
+	Scopes    []Permission `json:"scopes"`
+	CreatedAt string       `json:"created_at"`
+	ExpiresAt *string      `json:"expires_at,omitempty"` // Never expires if nil
+	LastUsed  *string      `json:"last_used,omitempty"`
+	RevokedAt *string      `json:"revoked_at,omitempty"`
+	Key       string       `json:"key,omitempty"` // Only when it's created
+}
+
+type cachedKey struct {
+	key     APIKey
+	expires time.Time
+}
+
+var (
+	keyCache   = map[[32]byte]cachedKey{}
+	keyCacheMu sync.Mutex
+)
+
+// forgetKey removes the key with the ID from the cache
+func forgetKey(id int64) {
+	keyCacheMu.Lock()
+	defer keyCacheMu.Unlock()
+	for sum, cached := range keyCache {
+		if cached.key.ID == id {
+			delete(keyCache, sum)
+		}
+	}
+}
+
+// IsAPIKey reports whether the bearer token is an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, API_KEY_PREFIX)
+}
+
+// CreateAPIKey makes a key for the user with the scopes, valid for the ttl, or forever if 0.
+// The scopes must be granted by the role of the user
+func CreateAPIKey(userID uint64, name string, scopes []Permission, ttl time.Duration) (APIKey, error) {
+	if name == "" {
+		return APIKey{}, NewUserValidationError("Name is required")
+	}
+	if len(scopes) == 0 {
+		return APIKey{}, NewUserValidationError("At least one scope is required")
+	}
+	owner, err := LookupUser(userID)
+	if err != nil {
+		return APIKey{}, err
+	}
+	for _, scope := range scopes {
+		if !RoleHas(owner.Role, scope) {
+			return APIKey{}, NewUserValidationError("The role " + owner.Role + " doesn't grant the scope " + string(scope))
+		}
+	}
+	db, err := usersDB()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	prefix, err := newToken()
+	if err != nil {
+		return APIKey{}, err
+	}
+	prefix = strings.NewReplacer("-", "", "_", "").Replace(prefix)[:8] // The prefix ends at the next _
+	secret, err := newToken()
+	if err != nil {
+		return APIKey{}, err
+	}
+	hash, err := hashPassword(secret)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	now := time.Now().UTC()
+	key := APIKey{Prefix: prefix, Name: name, UserID: userID, Scopes: scopes, CreatedAt: now.Format(sqliteTime),
+		Key: API_KEY_PREFIX + prefix + "_" + secret}
+	if ttl > 0 {
+		expires := now.Add(ttl).Format(sqliteTime)
+		key.ExpiresAt = &expires
+	}
+	res, err := db.Driver.Exec(`INSERT INTO api_keys (Prefix, KeyHash, Name, UserID, Scopes, CreatedAt, ExpiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key.Prefix, hash, key.Name, key.UserID, joinScopes(scopes), key.CreatedAt, key.ExpiresAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.ID, err = res.LastInsertId()
+	ansi.PrintInfo("Created the API key " + key.Prefix + " for " + owner.DisplayName)
+	return key, err
+}
+
+func joinScopes(scopes []Permission) string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return strings.Join(s, ",")
+}
+
+func splitScopes(s string) []Permission {
+	scopes := []Permission{}
+	for _, scope := range strings.Split(s, ",") {
+		if scope != "" {
+			scopes = append(scopes, Permission(scope))
+		}
+	}
+	return scopes
+}
+
+const apiKeyColumns = `KeyID, Prefix, Name, UserID, Scopes, CreatedAt, ExpiresAt, LastUsed, RevokedAt`
+
+func scanAPIKey(row RowScanner) (APIKey, string, error) {
+	var key APIKey
+	var scopes, hash string
+	var expires, lastUsed, revoked sql.NullString
+	err := row.Scan(&key.ID, &key.Prefix, &key.Name, &key.UserID, &scopes, &key.CreatedAt, &expires, &lastUsed, &revoked, &hash)
+	key.Scopes = splitScopes(scopes)
+	for _, col := range []struct {
+		v   sql.NullString
+		dst **string
+	}{{expires, &key.ExpiresAt}, {lastUsed, &key.LastUsed}, {revoked, &key.RevokedAt}} {
+		if col.v.Valid {
+			v := col.v.String
+			*col.dst = &v
+		}
+	}
+	return key, hash, err
+}
+
+// ListAPIKeys returns the keys of the user, or of every user if userID is 0, the latest first
+func ListAPIKeys(userID uint64) ([]APIKey, error) {
+	db, err := usersDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Driver.Query(`SELECT `+apiKeyColumns+`, KeyHash FROM api_keys WHERE ? = 0 OR UserID = ? ORDER BY KeyID DESC`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		key, _, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes the key. If userID isn't 0, only a key of that user is revoked
+func RevokeAPIKey(id int64, userID uint64) error {
+	db, err := usersDB()
+	if err != nil {
+		return err
+	}
+	res, err := db.Driver.Exec(`UPDATE api_keys SET RevokedAt = COALESCE(RevokedAt, ?) WHERE KeyID = ? AND (? = 0 OR UserID = ?)`,
+		time.Now().UTC().Format(sqliteTime), id, userID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchKey
+	}
+	forgetKey(id)
+	return nil
+}
+
+// VerifyAPIKey returns the key if it's valid, and records that it was used. A key has the scopes it was created with,
+// as long as the role of its owner grants them, and stops working when the owner is disabled or deleted.
+// Argon2 is slow on purpose, so verified keys are remembered for KEY_CACHE_TTL, by a SHA-256 of the key
+func VerifyAPIKey(token string) (APIKey, error) {
+	db, err := usersDB()
+	if err != nil {
+		return APIKey{}, err
+	}
+	sum := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	keyCacheMu.Lock()
+	cached, ok := keyCache[sum]
+	keyCacheMu.Unlock()
+	key := cached.key
+	if !ok || now.After(cached.expires) {
+		prefix, secret, found := strings.Cut(strings.TrimPrefix(token, API_KEY_PREFIX), "_")
+		if !found {
+			return APIKey{}, ErrInvalidKey
+		}
+		var hash string
+		key, hash, err = scanAPIKey(db.Driver.QueryRow(`SELECT `+apiKeyColumns+`, KeyHash FROM api_keys WHERE Prefix = ?`, prefix))
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, ErrInvalidKey
+		}
+		if err != nil {
+			return APIKey{}, err
+		}
+		if match, err := ComparePasswordAndHash(secret, hash); err != nil || !match {
+			return APIKey{}, ErrInvalidKey
+		}
+		keyCacheMu.Lock()
+		keyCache[sum] = cachedKey{key: key, expires: now.Add(KEY_CACHE_TTL)}
+		keyCacheMu.Unlock()
+	}
+
+	nowUTC := now.UTC().Format(sqliteTime)
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && *key.ExpiresAt <= nowUTC) {
+		return APIKey{}, ErrInvalidKey
+	}
+	if _, err := db.Driver.Exec(`UPDATE api_keys SET LastUsed = ? WHERE KeyID = ?`, nowUTC, key.ID); err != nil {
+		return APIKey{}, err
+	}
+	key.LastUsed = &nowUTC
+	return key, nil
+}
+
+// scopesKey is the key of the scopes of the API key of the request in its locals, set by the Bouncer
+const scopesKey = "scopes"
+
+// Scopes returns the scopes of the API key the request was authenticated with, or nil if it wasn't an API key
+func Scopes(c *fiber.Ctx) []Permission {
+	scopes, _ := c.Locals(scopesKey).([]Permission)
+	return scopes
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+	testUsersDB(t)
+	viewer := testUser(t, "viewer", ROLE_VIEWER)
+
+	tests := []struct {
+		name   string
+		userID uint64
+		key    string
+		scopes []Permission
+	}{
+		{"no name", viewer.UserID, "", []Permission{PERM_READ}},
+		{"no scopes", viewer.UserID, "ci", nil},
+		{"scope the role doesn't grant", viewer.UserID, "ci", []Permission{PERM_READ, PERM_CONFIG}},
+		{"unknown user", 1234567, "ci", []Permission{PERM_READ}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key, err := CreateAPIKey(tt.userID, tt.key, tt.scopes, 0); err == nil {
+				t.Errorf("created %+v", key)
+			}
+		})
+	}
+
+	key, err := CreateAPIKey(viewer.UserID, "ci", []Permission{PERM_READ}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAPIKey(key.Key) || !strings.HasPrefix(key.Key, API_KEY_PREFIX+key.Prefix+"_") {
+		t.Errorf("the key %q doesn't start with %s and its prefix %s", key.Key, API_KEY_PREFIX, key.Prefix)
+	}
+	_, secret, _ := strings.Cut(strings.TrimPrefix(key.Key, API_KEY_PREFIX), "_")
+	var hash string
+	if err := DBInstance.Driver.QueryRow(`SELECT KeyHash FROM api_keys WHERE KeyID = ?`, key.ID).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(hash, secret) || !strings.HasPrefix(hash, "$argon2id$") {
+		t.Errorf("the secret is stored as %q, want an argon2 hash", hash)
+	}
+	if match, err := ComparePasswordAndHash(secret, hash); err != nil || !match {
+		t.Errorf("the secret doesn't match its hash: %v", err)
+	}
+
+	keys, err := ListAPIKeys(viewer.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Key != "" || keys[0].Prefix != key.Prefix {
+		t.Errorf("listed %+v, want the key without its secret", keys)
+	}
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+	testUsersDB(t)
+	u := testUser(t, "analyst", ROLE_ANALYST)
+	other := testUser(t, "other", ROLE_ANALYST)
+	create := func(ttl time.Duration) APIKey {
+		key, err := CreateAPIKey(u.UserID, "ci", []Permission{PERM_READ}, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		want  error
+	}{
+		{"valid", func() string { return create(0).Key }, nil},
+		{"valid until it expires", func() string { return create(time.Hour).Key }, nil},
+		{"expired", func() string {
+			key := create(time.Hour)
+			if _, err := DBInstance.Driver.Exec(`UPDATE api_keys SET ExpiresAt = ? WHERE KeyID = ?`,
+				time.Now().UTC().Add(-time.Minute).Format(sqliteTime), key.ID); err != nil {
+				t.Fatal(err)
+			}
+			return key.Key
+		}, ErrInvalidKey},
+		{"revoked after it was used", func() string {
+			key := create(0)
+			if _, err := VerifyAPIKey(key.Key); err != nil { // Remembered by the cache
+				t.Fatal(err)
+			}
+			if err := RevokeAPIKey(key.ID, u.UserID); err != nil {
+				t.Fatal(err)
+			}
+			return key.Key
+		}, ErrInvalidKey},
+		{"wrong secret", func() string {
+			key := create(0)
+			return API_KEY_PREFIX + key.Prefix + "_" + strings.Repeat("x", 43)
+		}, ErrInvalidKey},
+		{"unknown prefix", func() string { return API_KEY_PREFIX + "nope1234_secret" }, ErrInvalidKey},
+		{"malformed", func() string { return API_KEY_PREFIX + "nosecret" }, ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token()
+			key, err := VerifyAPIKey(token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && (key.UserID != u.UserID || key.LastUsed == nil) {
+				t.Errorf("verified %+v, want a key of user %d that was just used", key, u.UserID)
+			}
+		})
+	}
+
+	key := create(0)
+	if err := RevokeAPIKey(key.ID, other.UserID); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("revoking the key of another user: got %v, want %v", err, ErrNoSuchKey)
+	}
+	if err := RevokeAPIKey(key.ID, 0); err != nil {
+		t.Errorf("revoking as an admin: %v", err)
+	}
+}
+
+// API keys only get the permissions in their scopes, as long as the role of their owner grants them
+func TestAPIKeyPermissions(t *testing.T) {
+	testUsersDB(t)
+	testUser(t, "admin", ROLE_ADMIN)
+
+	tests := []struct {
+		name   string
+		scopes []Permission
+		setup  func(u User)
+		perm   Permission
+		want   int
+	}{
+		{"in its scopes", []Permission{PERM_READ, PERM_ANALYZE}, nil, PERM_ANALYZE, fiber.StatusOK},
+		{"granted by the role, not in its scopes", []Permission{PERM_READ}, nil, PERM_ANALYZE, fiber.StatusForbidden},
+		{"owner demoted", []Permission{PERM_READ, PERM_ANALYZE}, func(u User) {
+			viewer := ROLE_VIEWER
+			UpdateUser(u.UserID, UserUpdate{Role: &viewer})
+		}, PERM_ANALYZE, fiber.StatusForbidden},
+		{"owner disabled", []Permission{PERM_READ}, func(u User) {
+			disabled := true
+			UpdateUser(u.UserID, UserUpdate{Disabled: &disabled})
+		}, PERM_READ, fiber.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := testUser(t, "analyst"+string(rune('a'+i)), ROLE_ANALYST)
+			key, err := CreateAPIKey(u.UserID, "ci", tt.scopes, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(u)
+			}
+			if got := requireStatus(t, key.Key, tt.perm); got != tt.want {
+				t.Errorf("%s permission answered %d, want %d", tt.perm, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package middleware // Could maybe rename to handlers
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -9,9 +10,7 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
-	util "github.com/pynezz/pynezzentials"
 	"github.com/pynezz/pynezzentials/ansi"
-	"github.com/pynezz/pynezzentials/cryptoutils"
 )
 
 // Claims defines the structure of the JWT claims.
@@ -26,9 +25,11 @@ type AuthMethod struct {
 }
 
 type UserSession struct {
-	UserID    uint64 `json:"userId"`
-	Token     string `json:"token"`
-	SessionID string `json:"sessionId"`
+	UserID       uint64 `json:"userId"`
+	Token        string `json:"token"` // The access token
+	SessionID    string `json:"sessionId"`
+	RefreshToken string `json:"refreshToken"` // For /refresh, see RefreshSession
+	ExpiresIn    int    `json:"expiresIn"`    // Seconds until the access token expires
 }
 
 type WebAuthnAuth struct {
@@ -57,7 +58,7 @@ type PasswordRegisterRequest struct {
 	Username    string `json:"username"`
 	Password    string `json:"password"`
 	DisplayName string `json:"displayName"`
-	Role        string `json:"role"`
+	Invitation  string `json:"invitation"` // Token of the invitation, which decides the role. Not needed by the first user
 }
 
 type WebAuthnRegisterRequest struct {
@@ -82,12 +83,15 @@ func Bouncer() fiber.Handler {
 
 	ansi.PrintDebug("Bouncer middleware is running")
 	return func(c *fiber.Ctx) error {
-		if c.Route().Path == "/" {
+		if c.Path() == "/" {
 			return c.SendStatus(200)
 		}
 		fmt.Println("Authenticating user...")
 		// Extract the token from the Authorization header.
 		authHeader := c.Get("Authorization")
+		if authHeader == "" && strings.EqualFold(c.Get("Upgrade"), "websocket") && c.Query("access_token") != "" {
+			authHeader = "Bearer " + c.Query("access_token") // Browsers can't set headers on WebSocket connections
+		}
 		splits := strings.Split(authHeader, " ")
 		if len(splits) != 2 || splits[0] != "Bearer" {
 			fmt.Printf("Splits: %d\n Splits[0]:%s \n", len(splits), splits[0])
@@ -97,24 +101,91 @@ func Bouncer() fiber.Handler {
 
 		// ---
 
-		// tokenString := c.Get("Authorization")
-		fmt.Println("Token: ", tokenString)
+		if IsAPIKey(tokenString) { // See APIKey
+			key, err := VerifyAPIKey(tokenString)
+			if err != nil {
+				ansi.PrintError("[BOUNCER] error verifying API key: " + err.Error())
+				return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+			}
+			c.Locals(subjectKey, strconv.FormatUint(key.UserID, 10))
+			c.Locals(scopesKey, key.Scopes)
+		} else {
+			// Validate token
+			token, err := VerifyJWTToken(tokenString)
+			if err != nil || !token.Valid {
+				ansi.PrintError(fmt.Sprintf("[BOUNCER] error verifying token: %v", err))
+				return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+			}
+			c.Locals(claimsKey, token.Claims)
 
-		// Validate token
-		token, err := VerifyJWTToken(tokenString)
-		if err != nil || !token.Valid {
-			ansi.PrintError("[BOUNCER] error verifying token: " + err.Error())
-			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+			// Revoked sessions can't be told apart without the users database, so nothing is let through
+			if _, err := usersDB(); err != nil {
+				ansi.PrintError("[BOUNCER] " + err.Error())
+				return c.Status(fiber.StatusServiceUnavailable).SendString("Service Unavailable")
+			}
+			// Access tokens of revoked sessions are refused, see SessionActive
+			if active, err := SessionActive(SessionID(c)); err != nil || !active {
+				return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+			}
 		}
 
 		ansi.PrintColorAndBgBold(ansi.Green, ansi.Cyan, "[+] User is authenticated 🎉")
 
+		// The role and account may have changed since the token was issued
+		id, err := strconv.ParseUint(Subject(c), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+		}
+		user, err := LookupUser(id)
+		if errors.Is(err, ErrNoUsersDatabase) {
+			ansi.PrintError("[BOUNCER] " + err.Error())
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Service Unavailable")
+		}
+		if err != nil || user.Disabled {
+			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+		}
+		c.Locals(roleKey, user.Role)
+
 		// Token is valid, proceed with the request
 		ansi.PrintDebug("Token is valid, proceeding with the request. Bouncer done.")
 		return c.Next()
 	}
 }
 
+// claimsKey is the key of the claims of the token in the locals of the request, set by the Bouncer
+const claimsKey = "claims"
+
+// subjectKey is the key of the user ID of a request authenticated without a JWT in its locals, set by the Bouncer
+const subjectKey = "subject"
+
+// SessionID returns the session of the access token of the request, or "" if it wasn't authenticated with one
+func SessionID(c *fiber.Ctx) string {
+	claims, ok := c.Locals(claimsKey).(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	jti, _ := claims["jti"].(string)
+	return jti
+}
+
+// Subject returns the user ID of the authenticated user of the request, or "" if it isn't authenticated
+func Subject(c *fiber.Ctx) string {
+	if sub, ok := c.Locals(subjectKey).(string); ok {
+		return sub
+	}
+	claims, ok := c.Locals(claimsKey).(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	switch sub := claims["sub"].(type) {
+	case float64:
+		return strconv.FormatFloat(sub, 'f', -1, 64)
+	case string:
+		return sub
+	}
+	return ""
+}
+
 func Base64Decode(b string) string {
 	// Decode the base64 string
 	base64Decoded, err := base64.StdEncoding.DecodeString(b)
@@ -161,6 +232,9 @@ func BeginLogin(c *fiber.Ctx) error {
 	if user.UserID == 0 {
 		return c.Status(fiber.StatusUnauthorized).SendString("Invalid credentials")
 	}
+	if user.Disabled {
+		return c.Status(fiber.StatusForbidden).SendString("Account disabled")
+	}
 
 	pwAuth, err := GetPasswordHash(user.UserID)
 	if err != nil {
@@ -192,9 +266,12 @@ func BeginLogin(c *fiber.Ctx) error {
 
 	// Now I want to set the JWT token in the Authorization header for the client
 	// Generate a JWT token
-	ansi.PrintDebug("Generating JWT token for user: " + username)
-	token := GenerateJWTToken(user, time.Now())
-	c.WriteString(token)
+	ansi.PrintDebug("Starting a session for user: " + username)
+	session, err := newSession(user, c)
+	if err != nil {
+		ansi.PrintError("Error starting a session: " + err.Error())
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal server error")
+	}
 
 	if FinishLogin(user) != nil {
 		ansi.PrintError("Error finishing login")
@@ -211,7 +288,8 @@ func BeginLogin(c *fiber.Ctx) error {
 	// resultstring := LoginSuccessHTML(user, token)
 
 	// return c.Status(fiber.StatusOK).SendString(resultstring)
-	return c.Status(fiber.StatusOK).JSON(LoginSucessJSON(user, token))
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON) // Already encoded
+	return c.Status(fiber.StatusOK).SendString(LoginSucessJSON(user, session))
 
 	// c.App().Post("/login", func(lctx *fiber.Ctx) error {
 	// 	ansi.PrintDebug("Got a POST request to /login")
@@ -257,7 +335,7 @@ func FinishLogin(u User) error {
 	return nil
 }
 
-// TODO: Finish the registration process
+// BeginRegistration registers a user with a password and an invitation, see RegisterUser
 func BeginRegistration(c *fiber.Ctx) error {
 	var regReq PasswordRegisterRequest
 	if err := c.BodyParser(&regReq); err != nil {
@@ -273,106 +351,15 @@ func BeginRegistration(c *fiber.Ctx) error {
 
 	ansi.PrintSuccess("Username: " + username)
 
-	// os.cms
-
-	// Insert the user into the database
-	db := GetDBInstance()
-	// displayName := getRandomName()
-
-	// Generate a cryptographically secure random 32-bit integer
-	var randomID uint64
-	randomID, err := cryptoutils.GenerateRandomInt(1000000, 10000000) // I know I shouldn't have hardcoded these...
-	ansi.PrintDebug("Generated random ID: " + strconv.Itoa(int(randomID)) + " for user " + username)
-	if err != nil {
-		ansi.PrintError(err.Error())
-	}
-
-	today := time.Now()
-	timestamp := today.Format("01-02-2006 15:04:05")
-
-	profileImageUrl := PlaceholderImage{
-		Width:  200,
-		Height: 200,
-		Text:   username,
-	}
-
-	userId := randomID
-
-	// Session id is a combination of the last 10 digits in the current time in nanoseconds + the user ID
-	// We could then hash this in some magical way to make it tamper proof by checking the last login time
-	// and the session id
-	// sessionId := time.Now() * time.Nanosecond + strconv.FormatUint(userId, 10)
-	sessionId := util.UserSessionIdValue(randomID, today)
-	ansi.PrintDebug("Generated session ID: " + sessionId)
-
-	// Creating the user to insert into the database
-	u := User{
-		UserID:      userId,
-		DisplayName: username + fmt.Sprintf("%s%s", "#", strconv.FormatUint(userId, 10)[:3]),
-		CreatedAt:   timestamp,
-		UpdatedAt:   timestamp,
-		LastLogin:   timestamp,
-		Role:        "user",
-		FirstName: func(s string) string { // This is a closure
-			if len(s) > 0 {
-				return regReq.DisplayName // If the display name is not empty, use it
-			}
-			return username // If the display name is empty, use the username
-		}(regReq.DisplayName), // Run the closure
-		ProfileImageUrl: GetPlaceholderImage(profileImageUrl),
-		SessionId:       sessionId,
-		AuthMethodID:    1, // 1 = Password | 2 = WebAuthn | 3 = Password + WebAuthn
-	}
-
-	result, err := db.Write(`INSERT INTO users (
-		UserID, DisplayName, CreatedAt,
-		UpdatedAt, LastLogin, Role,
-		FirstName, ProfileImageURL,
-		SessionId, AuthMethodID) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		u.UserID, u.DisplayName, u.CreatedAt,
-		u.UpdatedAt, u.LastLogin, u.Role,
-		u.FirstName, u.ProfileImageUrl,
-		u.SessionId, u.AuthMethodID)
-	if err != nil {
-		ansi.PrintError(err.Error())
-	}
-	rowsAffected, _ := result.RowsAffected()
-	ansi.PrintDebug("Affected rows: " + strconv.FormatInt(rowsAffected, 10)) // Get the affected amount of rows
-
-	// Insert password hash into the password_auth table
-
-	p := &params{
-		memory:      64 * 1024,
-		iterations:  3,
-		parallelism: 2,
-		saltLength:  16,
-		keyLength:   32, // AES256 compatible key length
-	}
-
-	_, encodedHash, err := generateFromPassword(regReq.Password, p)
-	if err != nil {
-		ansi.PrintError("Error generating password hash: " + err.Error())
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal server error")
-	}
-
-	ansi.PrintSuccess("Generated encoded hash: " + encodedHash)
-
-	// Insert the password hash into the password_auth table
-	result, err = db.Write(`INSERT INTO password_auth (UserID, Enabled, PasswordHash) VALUES (?, ?, ?)`,
-		u.UserID, true, encodedHash)
-	if err != nil {
-		ansi.PrintError("Error inserting password hash into the database: " + err.Error())
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal server error")
-	}
-
-	rowsAffected, _ = result.RowsAffected()
-	ansi.PrintDebug("Affected rows: " + strconv.FormatInt(rowsAffected, 10))
-
-	// Generate a JWT token
-	token := GenerateJWTToken(u, today)
-
-	if _, err := VerifyJWTToken(token); err != nil {
-		ansi.PrintError("Error verifying token: " + err.Error())
+	u, err := RegisterUser(regReq)
+	var invalid *UserValidationError
+	switch {
+	case errors.As(err, &invalid):
+		return c.Status(fiber.StatusBadRequest).SendString(invalid.Error())
+	case errors.Is(err, ErrInvalidInvitation):
+		return c.Status(fiber.StatusForbidden).SendString(err.Error())
+	case err != nil:
+		ansi.PrintError("Error registering user: " + err.Error())
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal server error")
 	}
 
@@ -381,12 +368,8 @@ func BeginRegistration(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal server error")
 	}
 
-	c.Context().SetBody([]byte(token))
 	// Return register success
 	return c.Status(fiber.StatusOK).SendString("Registration successful")
-
-	// ValidateUserPasswordAuth()
-
 }
 
 // TODO: Implement the finish registration process
@@ -396,10 +379,20 @@ func FinishRegistration(user User) error {
 	return nil
 }
 
-// TODO: Implement the logoff process
-func Logoff() {
-	// General overview:
-	// Find the user in the database and clear the session (token, increment the webauthn counter(?), etc.)
+// Logoff revokes the session of the access token of the request, with its refresh token
+func Logoff(c *fiber.Ctx) error {
+	id := SessionID(c)
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Not authenticated with a session")
+	}
+	if err := RevokeSession(id); err != nil {
+		if errors.Is(err, ErrNoSuchSession) {
+			return c.Status(fiber.StatusNotFound).SendString(err.Error())
+		}
+		ansi.PrintError("Error revoking the session: " + err.Error())
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal server error")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
 func EnableWebAuthn() {
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// bouncerStatus answers a request with the token through the Bouncer
+func bouncerStatus(t *testing.T, token string) int {
+	t.Helper()
+	app := fiber.New()
+	app.Use(Bouncer())
+	app.Get("/api/test", func(c *fiber.Ctx) error { return c.SendString(Role(c)) })
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestBouncerSessions(t *testing.T) {
+	testUsersDB(t)
+	testUser(t, "admin", ROLE_ADMIN)
+	disabled := true
+
+	tests := []struct {
+		name  string
+		setup func(u User, s UserSession)
+		want  int
+	}{
+		{"active", func(User, UserSession) {}, fiber.StatusOK},
+		{"revoked session", func(_ User, s UserSession) { RevokeSession(s.SessionID) }, fiber.StatusUnauthorized},
+		{"disabled user", func(u User, _ UserSession) { UpdateUser(u.UserID, UserUpdate{Disabled: &disabled}) }, fiber.StatusUnauthorized},
+		{"no users database", func(User, UserSession) { DBInstance = nil }, fiber.StatusServiceUnavailable},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := testUser(t, "user"+string(rune('a'+i)), ROLE_VIEWER)
+			s := testSession(t, u)
+			tt.setup(u, s)
+			if got := bouncerStatus(t, s.Token); got != tt.want {
+				t.Errorf("token answered %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Without the users database, not even a token made for a user that was never revoked gets through
+	if got := bouncerStatus(t, GenerateJWTToken(User{UserID: 1234567, Role: ROLE_ADMIN}, "session", time.Now())); got != fiber.StatusServiceUnavailable {
+		t.Errorf("token answered %d without the users database, want %d", got, fiber.StatusServiceUnavailable)
+	}
+}
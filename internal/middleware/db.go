@@ -199,6 +199,9 @@ func (db *Database) Connect(dbPath string) (*Database, error) {
 			return nil, err
 		}
 	}
+	if err := db.Upgrade(); err != nil {
+		return nil, err
+	}
 
 	util.PrintSuccess("Connected to the database.")
 	// testPrintRows(DBInstance)
@@ -611,13 +614,13 @@ const (
 //
 // SELECT UserID, DisplayName, CreatedAt, UpdatedAt, LastLogin, Role,
 // FirstName, ProfileImageURL,
-// SessionId, AuthMethodID
+// SessionId, AuthMethodID, Disabled
 //
 // FROM users WHERE %s = ?
 func (d *Database) SelectColEq(col string) string {
 	return fmt.Sprintf(`SELECT UserID, DisplayName, CreatedAt, UpdatedAt, LastLogin, Role,
 		FirstName, ProfileImageURL,
-		SessionId, AuthMethodID
+		SessionId, AuthMethodID, Disabled
 		FROM users WHERE %s = ?`, col)
 }
 
@@ -627,7 +630,7 @@ func (d *Database) SelectColEq(col string) string {
 func (d *Database) SelectCol(col string, operator string) string {
 	return fmt.Sprintf(`SELECT UserID, DisplayName, CreatedAt, UpdatedAt, LastLogin, Role,
 		FirstName, ProfileImageURL,
-		SessionId, AuthMethodID
+		SessionId, AuthMethodID, Disabled
 		FROM users WHERE %s %s ?`, col, operator)
 }
 
@@ -648,23 +651,23 @@ func (d *Database) SelectFromWebAuthnAuth(col string, value string) string {
 }
 
 func (d *Database) SetAndEnablePasswordAuth(userId int, passwordHash string) string {
-	return fmt.Sprintf(`INSERT INTO password_auth (UserID, Enabled, PasswordHash)
-		VALUES (?, 1, ?)`, userId, passwordHash)
+	return `INSERT INTO password_auth (UserID, Enabled, PasswordHash)
+		VALUES (?, 1, ?)`
 }
 
 func (d *Database) SetWebAuthnAuth(credentialId string, userId int, publicKey string, userHandle string, signatureCounter int) string {
-	return fmt.Sprintf(`INSERT INTO webauthn_auth (CredentialID, UserID, PublicKey, UserHandle, SignatureCounter)
-		VALUES (?, ?, ?, ?, ?)`, credentialId, userId, publicKey, userHandle, signatureCounter)
+	return `INSERT INTO webauthn_auth (CredentialID, UserID, PublicKey, UserHandle, SignatureCounter)
+		VALUES (?, ?, ?, ?, ?)`
 }
 
 func (d *Database) UpdateWebAuthnAuth(credentialId string, userId int, publicKey string, userHandle string, signatureCounter int) string {
-	return fmt.Sprintf(`UPDATE webauthn_auth SET PublicKey = ?, UserHandle = ?, SignatureCounter = ?
-		WHERE CredentialID = ? AND UserID = ?`, publicKey, userHandle, signatureCounter, credentialId, userId)
+	return `UPDATE webauthn_auth SET PublicKey = ?, UserHandle = ?, SignatureCounter = ?
+		WHERE CredentialID = ? AND UserID = ?`
 }
 
 func (d *Database) UpdatePasswordAuth(userId int, passwordHash string) string {
-	return fmt.Sprintf(`UPDATE password_auth SET PasswordHash = ?
-		WHERE UserID = ?`, passwordHash, userId)
+	return `UPDATE password_auth SET PasswordHash = ?
+		WHERE UserID = ?`
 }
 
 func (d *Database) GetPasswordHashQuery() string {
@@ -7,45 +7,36 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/pynezz/bivrost/internal/util"
-	"github.com/pynezz/bivrost/internal/util/cryptoutils"
 )
 
 const (
-	exp = 9         // Expires in 9 hours
 	iss = "bivrost" // Issuer
 )
 
-func GetSecretKey() string {
-	return cryptoutils.GetBivrostJWTSecret()
-}
-
+// VerifyJWTToken verifies the token with the key of the key set named by its kid, see KeySet
 func VerifyJWTToken(tokenString string) (*jwt.Token, error) {
+	keys := currentKeys()
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 
-		signing := token.Header["alg"]
-		fmt.Printf("%v\n", token)
-		fmt.Println("Signing method: ", signing)
-
-		exp := token.Claims.(jwt.MapClaims)["exp"].(float64)
+		exp, _ := token.Claims.(jwt.MapClaims)["exp"].(float64)
 		debugExp := fmt.Sprintf("%f", exp)
 		util.PrintDebug(fmt.Sprintf("Token expires at: %s", debugExp))
 
-		timeNow := time.Now().Unix()
-		fmt.Println("Time now: ", timeNow)
-
-		if exp < float64(timeNow) {
+		if exp < float64(time.Now().Unix()) {
 			fmt.Println("Token has expired")
 			return nil, fiber.ErrUnauthorized
 		}
 
-		// Ensure token's signing method matches
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		// Ensure token's signing method matches the key, so a public key is never taken for an HMAC secret
+		kid, _ := token.Header["kid"].(string)
+		key := keys.key(kid)
+		if key == nil || token.Method.Alg() != key.Alg {
 			return nil, fiber.ErrUnauthorized
 		}
 
-		// Return the secret key to the jwt.Parse function
-		return []byte(GetSecretKey()), nil
-	})
+		// Return the key to the jwt.Parse function
+		return key.verifyKey(), nil
+	}, jwt.WithExpirationRequired())
 
 	if err != nil {
 		fmt.Println(err)
@@ -54,40 +45,42 @@ func VerifyJWTToken(tokenString string) (*jwt.Token, error) {
 
 	if !token.Valid {
 		fmt.Println("Token is not valid")
-		return nil, err
+		return nil, fiber.ErrUnauthorized
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
 		fmt.Println("Error getting claims")
-		return nil, err
+		return nil, fiber.ErrUnauthorized
 	}
 
-	sub := fmt.Sprintf("%f", claims["sub"].(float64))
+	sub := fmt.Sprintf("%v", claims["sub"])
 	util.PrintDebug("Subject(user): " + sub)
 	aud := fmt.Sprintf("%s", claims["aud"])
 	util.PrintDebug("Audience(role): " + aud)
 
-	return token, err
+	return token, nil
 }
 
-func GenerateJWTToken(user User, loginTime time.Time) string {
+// GenerateJWTToken issues an access token of the session, which expires after ACCESS_TOKEN_TTL, see Session
+func GenerateJWTToken(user User, sessionID string, loginTime time.Time) string {
 	// Create a new token object, specifying signing method and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		//  // NB! This might not work. It's a time.Time object
-		"exp": loginTime.Add(time.Duration(exp) * time.Hour).Unix(),
-
+	keys := currentKeys()
+	key := keys.key(keys.Active)
+	token := jwt.NewWithClaims(key.method(), jwt.MapClaims{
+		"exp": loginTime.Add(ACCESS_TOKEN_TTL).Unix(),
+		"jti": sessionID,
 		"iss": iss,
 		"aud": user.Role,
 		"sub": user.UserID,
 	})
+	token.Header["kid"] = key.ID
 
 	// Sign and get the complete encoded token as a string
-	tokenString, err := token.SignedString([]byte(GetSecretKey()))
+	tokenString, err := token.SignedString(key.private)
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	fmt.Println(tokenString)
 	return tokenString
 }
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// Roles, from the least to the most access
+const (
+	ROLE_VIEWER          = "viewer"
+	ROLE_ANALYST         = "analyst"
+	ROLE_MODULE_OPERATOR = "module-operator"
+	ROLE_ADMIN           = "admin"
+)
+
+// ROLES are every role, from the least to the most access
+var ROLES = []string{ROLE_VIEWER, ROLE_ANALYST, ROLE_MODULE_OPERATOR, ROLE_ADMIN}
+
+// Permission is what a route requires
+type Permission string
+
+const (
+	PERM_READ    Permission = "read"    // Logs, module results, the live tail, and the state of the modules
+	PERM_ANALYZE Permission = "analyze" // Exports and threat intel lookups
+	PERM_MODULES Permission = "modules" // Operating the modules and IPC captures
+	PERM_CONFIG  Permission = "config"  // Reading and changing the config
+	PERM_USERS   Permission = "users"   // Managing the users and invitations
+)
+
+// PERMISSIONS are every permission
+var PERMISSIONS = []Permission{PERM_READ, PERM_ANALYZE, PERM_MODULES, PERM_CONFIG, PERM_USERS}
+
+// rolePermissions are the permissions every role grants. API keys only get the ones in their scopes
+var rolePermissions = map[string][]Permission{
+	ROLE_VIEWER:          {PERM_READ},
+	ROLE_ANALYST:         {PERM_READ, PERM_ANALYZE},
+	ROLE_MODULE_OPERATOR: {PERM_READ, PERM_MODULES},
+	ROLE_ADMIN:           PERMISSIONS,
+}
+
+// ValidRole reports whether the role exists
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleHas reports whether the role grants the permission
+func RoleHas(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// roleKey is the key of the role of the authenticated user in the locals of the request, set by the Bouncer
+const roleKey = "role"
+
+// Role returns the role of the authenticated user of the request, or "" if it isn't authenticated.
+// The role is looked up by the Bouncer, the one the token was issued with may be out of date.
+func Role(c *fiber.Ctx) string {
+	role, _ := c.Locals(roleKey).(string)
+	return role
+}
+
+// hasScope reports whether the API key of the request has the permission in its scopes. Requests with a JWT have every scope
+func hasScope(c *fiber.Ctx, perm Permission) bool {
+	scopes := Scopes(c)
+	if scopes == nil {
+		return true
+	}
+	for _, scope := range scopes {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Require answers 403 unless the role of the authenticated user, and the scopes of its API key, grant the permission.
+// It runs after the Bouncer, which authenticates the request
+func Require(perm Permission) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !RoleHas(Role(c), perm) || !hasScope(c, perm) {
+			return c.Status(fiber.StatusForbidden).SendString("Forbidden: requires the " + string(perm) + " permission")
+		}
+		return c.Next()
+	}
+}
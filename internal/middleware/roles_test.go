@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requireStatus answers a request with the token through the Bouncer, to a route requiring the permission
+func requireStatus(t *testing.T, token string, perm Permission) int {
+	t.Helper()
+	app := fiber.New()
+	app.Use(Bouncer())
+	app.Get("/api/test", Require(perm), func(c *fiber.Ctx) error { return c.SendString(Role(c)) })
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestRequire(t *testing.T) {
+	testUsersDB(t)
+	grants := map[string][]Permission{
+		ROLE_VIEWER:          {PERM_READ},
+		ROLE_ANALYST:         {PERM_READ, PERM_ANALYZE},
+		ROLE_MODULE_OPERATOR: {PERM_READ, PERM_MODULES},
+		ROLE_ADMIN:           PERMISSIONS,
+	}
+	for _, role := range ROLES {
+		role := role
+		t.Run(role, func(t *testing.T) {
+			s := testSession(t, testUser(t, role, role))
+			for _, perm := range PERMISSIONS {
+				want := fiber.StatusForbidden
+				for _, p := range grants[role] {
+					if p == perm {
+						want = fiber.StatusOK
+					}
+				}
+				if RoleHas(role, perm) != (want == fiber.StatusOK) {
+					t.Errorf("RoleHas(%s, %s) = %v", role, perm, RoleHas(role, perm))
+				}
+				if got := requireStatus(t, s.Token, perm); got != want {
+					t.Errorf("%s permission answered %d, want %d", perm, got, want)
+				}
+			}
+		})
+	}
+	if ValidRole("user") || ValidRole("") || RoleHas("", PERM_READ) {
+		t.Error("a role that doesn't exist is valid, or grants permissions")
+	}
+}
+
+// The role is looked up on every request, so a change of role applies to the tokens already issued
+func TestRequireRoleChanged(t *testing.T) {
+	testUsersDB(t)
+	testUser(t, "admin", ROLE_ADMIN)
+
+	tests := []struct {
+		name      string
+		from, to  string
+		perm      Permission
+		before    int
+		afterward int
+	}{
+		{"demoted", ROLE_ADMIN, ROLE_VIEWER, PERM_CONFIG, fiber.StatusOK, fiber.StatusForbidden},
+		{"promoted", ROLE_VIEWER, ROLE_MODULE_OPERATOR, PERM_MODULES, fiber.StatusForbidden, fiber.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := testUser(t, tt.name, tt.from)
+			s := testSession(t, u)
+			if got := requireStatus(t, s.Token, tt.perm); got != tt.before {
+				t.Errorf("as %s: answered %d, want %d", tt.from, got, tt.before)
+			}
+			to := tt.to
+			if _, err := UpdateUser(u.UserID, UserUpdate{Role: &to}); err != nil {
+				t.Fatal(err)
+			}
+			if got := requireStatus(t, s.Token, tt.perm); got != tt.afterward {
+				t.Errorf("as %s: answered %d, want %d", tt.to, got, tt.afterward)
+			}
+		})
+	}
+}
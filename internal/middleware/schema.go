@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/pynezz/bivrost/internal/util"
+)
+
+// upgrades are the changes of the schema after the migration scripts in db/migrations, which only run when the users
+// database is created. They're applied in order, and only ever appended to, never changed
+var upgrades = []string{
+	// 1: Roles beyond admin/user, disabled accounts and invitations. Users become viewers, the role with the least access
+	`CREATE TABLE users_upgrade (
+    UserID INTEGER PRIMARY KEY,
+    DisplayName TEXT UNIQUE NOT NULL,
+    CreatedAt TEXT DEFAULT (datetime('now')),
+    UpdatedAt TEXT DEFAULT (datetime('now')),
+    LastLogin TEXT,
+    Role TEXT CHECK(Role IN ('viewer', 'analyst', 'module-operator', 'admin')) DEFAULT 'viewer',
+    FirstName TEXT,
+    ProfileImageURL TEXT,
+    SessionId TEXT,
+    AuthMethodID INTEGER,
+    Disabled BOOLEAN NOT NULL DEFAULT 0
+);
+INSERT INTO users_upgrade (UserID, DisplayName, CreatedAt, UpdatedAt, LastLogin, Role, FirstName, ProfileImageURL, SessionId, AuthMethodID)
+    SELECT UserID, DisplayName, CreatedAt, UpdatedAt, LastLogin, CASE Role WHEN 'admin' THEN 'admin' ELSE 'viewer' END,
+        FirstName, ProfileImageURL, SessionId, AuthMethodID FROM users;
+DROP TABLE users;
+ALTER TABLE users_upgrade RENAME TO users;
+
+CREATE TABLE invitations (
+    InvitationID INTEGER PRIMARY KEY AUTOINCREMENT,
+    TokenHash TEXT UNIQUE NOT NULL, /* SHA-256 of the token, the token is only shown when it's created */
+    Role TEXT NOT NULL CHECK(Role IN ('viewer', 'analyst', 'module-operator', 'admin')),
+    CreatedBy INTEGER NOT NULL,
+    CreatedAt TEXT DEFAULT (datetime('now')),
+    ExpiresAt TEXT NOT NULL,
+    UsedBy INTEGER,
+    UsedAt TEXT
+);`,
+
+	// 2: API keys, see APIKey
+	`CREATE TABLE api_keys (
+    KeyID INTEGER PRIMARY KEY AUTOINCREMENT,
+    Prefix TEXT UNIQUE NOT NULL, /* Identifies the key, the part of it before the secret */
+    KeyHash TEXT NOT NULL, /* Argon2 of the secret */
+    Name TEXT NOT NULL,
+    UserID INTEGER NOT NULL,
+    Scopes TEXT NOT NULL, /* Comma separated permissions */
+    CreatedAt TEXT DEFAULT (datetime('now')),
+    ExpiresAt TEXT, /* NULL if it never expires */
+    LastUsed TEXT,
+    RevokedAt TEXT
+);`,
+
+	// 3: Sessions with rotating refresh tokens, see Session. The sessions were never used, so the table is replaced
+	`DROP TABLE IF EXISTS user_sessions;
+CREATE TABLE user_sessions (
+    SessionID TEXT PRIMARY KEY, /* The jti of the access tokens */
+    UserID INTEGER NOT NULL,
+    TokenHash TEXT NOT NULL, /* SHA-256 of the secret of the current refresh token */
+    PreviousTokenHash TEXT, /* Of the refresh token before the last rotation, using it again revokes the session */
+    CreatedAt TEXT DEFAULT (datetime('now')),
+    ExpiresAt TEXT NOT NULL,
+    LastUsed TEXT,
+    RevokedAt TEXT,
+    UserAgent TEXT NOT NULL DEFAULT '',
+    IP TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY (UserID) REFERENCES users(UserID) ON DELETE CASCADE
+);
+CREATE INDEX user_sessions_user ON user_sessions (UserID);`,
+}
+
+// Upgrade applies the upgrades of the schema the database doesn't have yet, when bivrost connects to it.
+// The version of the schema is the user_version of the database, the number of upgrades applied
+func (db *Database) Upgrade() error {
+	var version int
+	if err := db.Driver.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(upgrades); i++ {
+		util.PrintInfo(fmt.Sprintf("Upgrading the users database to version %d...", i+1))
+		tx, err := db.Driver.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(upgrades[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("upgrade %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
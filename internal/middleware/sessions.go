@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pynezz/pynezzentials/ansi"
+)
+
+var (
+	ErrNoSuchSession       = errors.New("no such session")
+	ErrInvalidRefreshToken = errors.New("the refresh token is invalid, expired or revoked")
+)
+
+const (
+	ACCESS_TOKEN_TTL  = 15 * time.Minute
+	REFRESH_TOKEN_TTL = 7 * 24 * time.Hour // From the last refresh
+)
+
+// Session is a login of a user, in the user_sessions table. It gives out short-lived access tokens, JWTs with the ID
+// of the session as jti, and a refresh token, <session ID>.<secret>, that is exchanged at /refresh for new ones
+type Session struct {
+	ID        string  `json:"id"`
+	UserID    uint64  `json:"user_id"`
+	CreatedAt string  `json:"created_at"`
+	ExpiresAt string  `json:"expires_at"` // When the refresh token expires
+	LastUsed  *string `json:"last_used,omitempty"`
+	RevokedAt *string `json:"revoked_at,omitempty"`
+	UserAgent string  `json:"user_agent"`
+	IP        string  `json:"ip"`
+}
+
+// newSession starts a session for the user, and answers with its tokens
+func newSession(u User, c *fiber.Ctx) (UserSession, error) {
+	db, err := usersDB()
+	if err != nil {
+		return UserSession{}, err
+	}
+	id, err := newToken()
+	if err != nil {
+		return UserSession{}, err
+	}
+	secret, err := newToken()
+	if err != nil {
+		return UserSession{}, err
+	}
+	now := time.Now().UTC()
+	if _, err := db.Driver.Exec(`INSERT INTO user_sessions (SessionID, UserID, TokenHash, CreatedAt, ExpiresAt, UserAgent, IP)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, id, u.UserID, hashToken(secret), now.Format(sqliteTime),
+		now.Add(REFRESH_TOKEN_TTL).Format(sqliteTime), c.Get(fiber.HeaderUserAgent), c.IP()); err != nil {
+		return UserSession{}, err
+	}
+	return sessionTokens(u, id, secret, now), nil
+}
+
+func sessionTokens(u User, id, secret string, now time.Time) UserSession {
+	return UserSession{
+		UserID:       u.UserID,
+		SessionID:    id,
+		Token:        GenerateJWTToken(u, id, now),
+		RefreshToken: id + "." + secret,
+		ExpiresIn:    int(ACCESS_TOKEN_TTL.Seconds()),
+	}
+}
+
+// RefreshSession exchanges the refresh token for new tokens of its session, rotating the refresh token.
+// Using a refresh token that was already rotated means it was copied, so it revokes the session
+func RefreshSession(refreshToken string) (UserSession, error) {
+	db, err := usersDB()
+	if err != nil {
+		return UserSession{}, err
+	}
+	id, secret, found := strings.Cut(refreshToken, ".")
+	if !found {
+		return UserSession{}, ErrInvalidRefreshToken
+	}
+	tx, err := db.Driver.Begin()
+	if err != nil {
+		return UserSession{}, err
+	}
+	defer tx.Rollback()
+
+	var userID uint64
+	var current, expires string
+	var previous, revoked sql.NullString
+	err = tx.QueryRow(`SELECT UserID, TokenHash, PreviousTokenHash, ExpiresAt, RevokedAt FROM user_sessions WHERE SessionID = ?`, id).
+		Scan(&userID, &current, &previous, &expires, &revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserSession{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return UserSession{}, err
+	}
+	now := time.Now().UTC()
+	hash := hashToken(secret)
+	switch {
+	case revoked.Valid || expires <= now.Format(sqliteTime):
+		return UserSession{}, ErrInvalidRefreshToken
+	case previous.Valid && hash == previous.String:
+		ansi.PrintWarning("A rotated refresh token of the session " + id + " was used, revoking it")
+		if _, err := tx.Exec(`UPDATE user_sessions SET RevokedAt = ? WHERE SessionID = ?`, now.Format(sqliteTime), id); err != nil {
+			return UserSession{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return UserSession{}, err
+		}
+		return UserSession{}, ErrInvalidRefreshToken
+	case hash != current:
+		return UserSession{}, ErrInvalidRefreshToken
+	}
+
+	u, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE UserID = ?`, userID))
+	if err != nil || u.Disabled {
+		return UserSession{}, ErrInvalidRefreshToken
+	}
+	next, err := newToken()
+	if err != nil {
+		return UserSession{}, err
+	}
+	if _, err := tx.Exec(`UPDATE user_sessions SET TokenHash = ?, PreviousTokenHash = ?, ExpiresAt = ?, LastUsed = ? WHERE SessionID = ?`,
+		hashToken(next), current, now.Add(REFRESH_TOKEN_TTL).Format(sqliteTime), now.Format(sqliteTime), id); err != nil {
+		return UserSession{}, err
+	}
+	return sessionTokens(u, id, next, now), tx.Commit()
+}
+
+// SessionActive reports whether the session exists, and isn't revoked or expired. The Bouncer refuses access tokens
+// of inactive sessions, so a logout takes effect at once rather than when the tokens expire
+func SessionActive(id string) (bool, error) {
+	db, err := usersDB()
+	if err != nil {
+		return false, err
+	}
+	var active bool
+	err = db.Driver.QueryRow(`SELECT RevokedAt IS NULL AND ExpiresAt > ? FROM user_sessions WHERE SessionID = ?`,
+		time.Now().UTC().Format(sqliteTime), id).Scan(&active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return active, err
+}
+
+// RevokeSession ends the session
+func RevokeSession(id string) error {
+	db, err := usersDB()
+	if err != nil {
+		return err
+	}
+	res, err := db.Driver.Exec(`UPDATE user_sessions SET RevokedAt = COALESCE(RevokedAt, ?) WHERE SessionID = ?`,
+		time.Now().UTC().Format(sqliteTime), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchSession
+	}
+	return nil
+}
+
+// RevokeUserSessions ends every active session of the user, and returns how many there were
+func RevokeUserSessions(userID uint64) (int64, error) {
+	if _, err := LookupUser(userID); err != nil {
+		return 0, err
+	}
+	db, err := usersDB()
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Driver.Exec(`UPDATE user_sessions SET RevokedAt = ? WHERE UserID = ? AND RevokedAt IS NULL`,
+		time.Now().UTC().Format(sqliteTime), userID)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	ansi.PrintInfo("Revoked " + strconv.FormatInt(n, 10) + " sessions of the user " + strconv.FormatUint(userID, 10))
+	return n, nil
+}
+
+// ListSessions returns the sessions of the user that haven't expired, the latest first
+func ListSessions(userID uint64) ([]Session, error) {
+	if _, err := LookupUser(userID); err != nil {
+		return nil, err
+	}
+	db, err := usersDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Driver.Query(`SELECT SessionID, UserID, CreatedAt, ExpiresAt, LastUsed, RevokedAt, UserAgent, IP
+		FROM user_sessions WHERE UserID = ? AND ExpiresAt > ? ORDER BY CreatedAt DESC`, userID, time.Now().UTC().Format(sqliteTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		var lastUsed, revoked sql.NullString
+		if err := rows.Scan(&s.ID, &s.UserID, &s.CreatedAt, &s.ExpiresAt, &lastUsed, &revoked, &s.UserAgent, &s.IP); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			s.LastUsed = &lastUsed.String
+		}
+		if revoked.Valid {
+			s.RevokedAt = &revoked.String
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RefreshRequest exchanges a refresh token for new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Refresh answers with new tokens for a refresh token
+func Refresh(c *fiber.Ctx) error {
+	var req RefreshRequest
+	if err := c.BodyParser(&req); err != nil || req.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid request")
+	}
+	session, err := RefreshSession(req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+	}
+	if err != nil {
+		ansi.PrintError("Error refreshing the session: " + err.Error())
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal server error")
+	}
+	return c.JSON(session)
+}
@@ -0,0 +1,325 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pynezz/pynezzentials/ansi"
+)
+
+// Signing algorithms
+const (
+	ALG_EDDSA = "EdDSA" // Ed25519, the default
+	ALG_ES256 = "ES256" // ECDSA with P-256
+	ALG_HS256 = "HS256" // HMAC with a shared secret, the keys aren't in the JWKS
+)
+
+const (
+	ENV_JWT_KEYS     = "BIVROST_JWT_KEYS"
+	ENV_JWT_KEY_FILE = "BIVROST_JWT_KEY_FILE"
+	DEFAULT_KEEP     = 2 // Keys kept in a key set when it's rotated, the active one included
+)
+
+var (
+	ErrNoActiveKey = errors.New("the key set has no active key")
+	ErrUnknownAlg  = errors.New("unknown signing algorithm, must be one of EdDSA, ES256 or HS256")
+)
+
+// SigningKey is a key of a key set
+type SigningKey struct {
+	ID        string `json:"kid"`
+	Alg       string `json:"alg"`
+	Key       string `json:"key"` // Base64 of the PKCS #8 private key, or of the secret for HS256
+	CreatedAt string `json:"created_at"`
+
+	private any // ed25519.PrivateKey, *ecdsa.PrivateKey or []byte
+}
+
+// KeySet are the keys tokens are signed and verified with, a JSON file made with `bivrost keys`.
+// Tokens are signed with the active key, and verified with the key named by their kid, so keys are rotated
+// without logging anyone out: the new key signs, the previous ones verify until their tokens expire
+type KeySet struct {
+	Active string        `json:"active"` // kid of the key that signs
+	Keys   []*SigningKey `json:"keys"`
+}
+
+// JWK is the public key of a signing key, see RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS is a set of public keys
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// GenerateSigningKey makes a key with the algorithm
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var private any
+	var err error
+	switch alg {
+	case ALG_EDDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case ALG_ES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ALG_HS256:
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		private = secret
+	default:
+		return nil, ErrUnknownAlg
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{Alg: alg, CreatedAt: time.Now().UTC().Format(time.RFC3339), private: private}
+	if secret, ok := private.([]byte); ok {
+		key.Key = base64.StdEncoding.EncodeToString(secret)
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		key.Key = base64.StdEncoding.EncodeToString(der)
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	key.ID = time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(id)
+	return key, nil
+}
+
+// parse decodes the private key of the signing key
+func (k *SigningKey) parse() error {
+	raw, err := base64.StdEncoding.DecodeString(k.Key)
+	if err != nil {
+		return fmt.Errorf("key %s: %w", k.ID, err)
+	}
+	if k.Alg == ALG_HS256 {
+		if len(raw) < 32 {
+			return fmt.Errorf("key %s: HS256 secrets must be at least 32 bytes", k.ID)
+		}
+		k.private = raw
+		return nil
+	}
+	private, err := x509.ParsePKCS8PrivateKey(raw)
+	if err != nil {
+		return fmt.Errorf("key %s: %w", k.ID, err)
+	}
+	switch private := private.(type) {
+	case ed25519.PrivateKey:
+		if k.Alg != ALG_EDDSA {
+			return fmt.Errorf("key %s: an Ed25519 key for %s", k.ID, k.Alg)
+		}
+	case *ecdsa.PrivateKey:
+		if k.Alg != ALG_ES256 || private.Curve != elliptic.P256() {
+			return fmt.Errorf("key %s: an ECDSA key for %s, or not on P-256", k.ID, k.Alg)
+		}
+	default:
+		return fmt.Errorf("key %s: %w", k.ID, ErrUnknownAlg)
+	}
+	k.private = private
+	return nil
+}
+
+// method is the signing method of the key
+func (k *SigningKey) method() jwt.SigningMethod {
+	switch k.Alg {
+	case ALG_EDDSA:
+		return jwt.SigningMethodEdDSA
+	case ALG_ES256:
+		return jwt.SigningMethodES256
+	}
+	return jwt.SigningMethodHS256
+}
+
+// verifyKey is the key tokens signed with the key are verified with
+func (k *SigningKey) verifyKey() any {
+	if signer, ok := k.private.(crypto.Signer); ok {
+		return signer.Public()
+	}
+	return k.private
+}
+
+// ParseKeySet decodes a key set, and checks that it has its active key
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var ks KeySet
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return nil, err
+	}
+	for _, key := range ks.Keys {
+		if err := key.parse(); err != nil {
+			return nil, err
+		}
+	}
+	if ks.key(ks.Active) == nil {
+		return nil, ErrNoActiveKey
+	}
+	return &ks, nil
+}
+
+// ReadKeySet reads the key set file
+func ReadKeySet(path string) (*KeySet, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o077 != 0 {
+		ansi.PrintWarning("The key set " + path + " can be read by other users, it should only be readable by bivrost (chmod 600)")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+// Write writes the key set to the file, readable only by its owner
+func (ks *KeySet) Write(path string) error {
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path) // CreateTemp makes the file with 0600
+}
+
+// NewKeySet makes a key set with a key of the algorithm
+func NewKeySet(alg string) (*KeySet, error) {
+	key, err := GenerateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySet{Active: key.ID, Keys: []*SigningKey{key}}, nil
+}
+
+// Rotate adds a key of the algorithm and makes it the active one. Only the latest keep keys are kept
+func (ks *KeySet) Rotate(alg string, keep int) (*SigningKey, error) {
+	key, err := GenerateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	if keep < 1 {
+		keep = DEFAULT_KEEP
+	}
+	ks.Keys = append(ks.Keys, key)
+	if len(ks.Keys) > keep {
+		ks.Keys = ks.Keys[len(ks.Keys)-keep:]
+	}
+	ks.Active = key.ID
+	return key, nil
+}
+
+func (ks *KeySet) key(id string) *SigningKey {
+	for _, key := range ks.Keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// JWKS returns the public keys of the key set. HS256 keys are secret, and aren't in it
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	b64 := base64.RawURLEncoding.EncodeToString
+	for _, key := range ks.Keys {
+		jwk := JWK{Kid: key.ID, Alg: key.Alg, Use: "sig"}
+		switch public := key.verifyKey().(type) {
+		case ed25519.PublicKey:
+			jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", b64(public)
+		case *ecdsa.PublicKey:
+			x, y := make([]byte, 32), make([]byte, 32)
+			jwk.Kty, jwk.Crv, jwk.X, jwk.Y = "EC", "P-256", b64(public.X.FillBytes(x)), b64(public.Y.FillBytes(y))
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+var signingKeys atomic.Pointer[KeySet]
+
+// SetSigningKeys makes the tokens be signed and verified with the key set
+func SetSigningKeys(ks *KeySet) {
+	signingKeys.Store(ks)
+	ansi.PrintInfo(fmt.Sprintf("Signing tokens with the key %s, verifying with %d keys", ks.Active, len(ks.Keys)))
+}
+
+// LoadSigningKeys loads the key set, from the first of:
+//
+//	BIVROST_JWT_KEYS          the key set itself, for containers
+//	BIVROST_JWT_KEY_FILE      the path of the key set
+//	path                      auth.key_file of the config
+//
+// Without either, tokens are signed with a key made now, and don't survive a restart
+func LoadSigningKeys(path string) error {
+	var ks *KeySet
+	var err error
+	switch {
+	case os.Getenv(ENV_JWT_KEYS) != "":
+		ks, err = ParseKeySet([]byte(os.Getenv(ENV_JWT_KEYS)))
+	case os.Getenv(ENV_JWT_KEY_FILE) != "":
+		ks, err = ReadKeySet(os.Getenv(ENV_JWT_KEY_FILE))
+	case path != "":
+		ks, err = ReadKeySet(path)
+	default:
+		ansi.PrintWarning("No signing keys are configured, see `bivrost keys`. Tokens won't survive a restart")
+		ks, err = NewKeySet(ALG_EDDSA)
+	}
+	if err != nil {
+		return fmt.Errorf("loading the signing keys: %w", err)
+	}
+	SetSigningKeys(ks)
+	return nil
+}
+
+// currentKeys returns the key set, made at first use if none was loaded
+func currentKeys() *KeySet {
+	if ks := signingKeys.Load(); ks != nil {
+		return ks
+	}
+	ks, err := NewKeySet(ALG_EDDSA)
+	if err != nil {
+		panic(err) // Only if there's no randomness
+	}
+	if signingKeys.CompareAndSwap(nil, ks) {
+		ansi.PrintWarning("No signing keys were loaded, signing tokens with a key made now")
+	}
+	return signingKeys.Load()
+}
+
+// CurrentJWKS returns the public keys tokens are verified with, for other services to verify the tokens
+func CurrentJWKS() JWKS {
+	return currentKeys().JWKS()
+}
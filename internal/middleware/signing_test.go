@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useKeys signs and verifies the tokens with the key set, until the test ends
+func useKeys(t *testing.T, ks *KeySet) {
+	t.Helper()
+	previous := signingKeys.Load()
+	t.Cleanup(func() { signingKeys.Store(previous) })
+	SetSigningKeys(ks)
+}
+
+// newKeySet makes a key set with a key of the algorithm
+func newKeySet(t *testing.T, alg string) *KeySet {
+	t.Helper()
+	ks, err := NewKeySet(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+var tokenUser = User{UserID: 42, Role: ROLE_VIEWER}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, alg := range []string{ALG_EDDSA, ALG_ES256, ALG_HS256} {
+		alg := alg
+		t.Run(alg, func(t *testing.T) {
+			ks := newKeySet(t, alg)
+			useKeys(t, ks)
+			signed := GenerateJWTToken(tokenUser, "session", time.Now())
+
+			token, err := VerifyJWTToken(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Method.Alg() != alg || token.Header["kid"] != ks.Active {
+				t.Errorf("signed with %s and kid %v, want %s and %s", token.Method.Alg(), token.Header["kid"], alg, ks.Active)
+			}
+
+			// Tokens signed before a rotation verify until their key is no longer kept
+			if _, err := ks.Rotate(alg, 2); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := VerifyJWTToken(signed); err != nil {
+				t.Errorf("token of the previous key: %v", err)
+			}
+			if _, err := VerifyJWTToken(GenerateJWTToken(tokenUser, "session", time.Now())); err != nil {
+				t.Errorf("token of the new key: %v", err)
+			}
+			if _, err := ks.Rotate(alg, 2); err != nil {
+				t.Fatal(err)
+			}
+			if len(ks.Keys) != 2 {
+				t.Errorf("the key set kept %d keys, want 2", len(ks.Keys))
+			}
+			if _, err := VerifyJWTToken(signed); err == nil {
+				t.Error("a token of a key that was rotated out verified")
+			}
+		})
+	}
+}
+
+func TestVerifyRefuses(t *testing.T) {
+	ks := newKeySet(t, ALG_EDDSA)
+	useKeys(t, ks)
+	active := ks.key(ks.Active)
+	other := newKeySet(t, ALG_EDDSA).Keys[0]
+	claims := func(exp time.Time) jwt.MapClaims {
+		return jwt.MapClaims{"exp": exp.Unix(), "jti": "session", "iss": iss, "aud": ROLE_ADMIN, "sub": 42}
+	}
+	sign := func(method jwt.SigningMethod, kid string, claims jwt.MapClaims, key any) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	public := []byte(active.verifyKey().(ed25519.PublicKey))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", sign(jwt.SigningMethodEdDSA, active.ID, claims(time.Now().Add(-time.Minute)), active.private)},
+		{"no expiry", sign(jwt.SigningMethodEdDSA, active.ID, jwt.MapClaims{"sub": 42}, active.private)},
+		{"no kid", sign(jwt.SigningMethodEdDSA, "", claims(time.Now().Add(time.Hour)), active.private)},
+		{"unknown kid", sign(jwt.SigningMethodEdDSA, other.ID, claims(time.Now().Add(time.Hour)), other.private)},
+		{"signed by another key with the kid", sign(jwt.SigningMethodEdDSA, active.ID, claims(time.Now().Add(time.Hour)), other.private)},
+		{"public key as an HMAC secret", sign(jwt.SigningMethodHS256, active.ID, claims(time.Now().Add(time.Hour)), public)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := VerifyJWTToken(tt.token); err == nil {
+				t.Error("the token verified")
+			}
+		})
+	}
+}
+
+func TestKeySetFile(t *testing.T) {
+	ks := newKeySet(t, ALG_ES256)
+	if _, err := ks.Rotate(ALG_EDDSA, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Rotate(ALG_HS256, 3); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := ks.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("the key set file has mode %v, error %v, want 0600", info.Mode().Perm(), err)
+	}
+	read, err := ReadKeySet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, ks) {
+		t.Error("the key set read back differs from the one written")
+	}
+
+	ed := newKeySet(t, ALG_EDDSA).Keys[0]
+	tests := []struct {
+		name string
+		ks   KeySet
+	}{
+		{"no active key", KeySet{Active: "nope", Keys: []*SigningKey{ed}}},
+		{"short HMAC secret", KeySet{Active: "k", Keys: []*SigningKey{{ID: "k", Alg: ALG_HS256, Key: base64.StdEncoding.EncodeToString([]byte("short"))}}}},
+		{"key of another algorithm", KeySet{Active: "k", Keys: []*SigningKey{{ID: "k", Alg: ALG_ES256, Key: ed.Key}}}},
+		{"unknown algorithm", KeySet{Active: "k", Keys: []*SigningKey{{ID: "k", Alg: "RS256", Key: ed.Key}}}},
+		{"not base64", KeySet{Active: "k", Keys: []*SigningKey{{ID: "k", Alg: ALG_EDDSA, Key: "!"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.ks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseKeySet(data); err == nil {
+				t.Error("the key set parsed")
+			}
+		})
+	}
+}
+
+// The JWKS has the public keys, which verify the tokens, and not the HMAC secrets
+func TestJWKS(t *testing.T) {
+	ks := newKeySet(t, ALG_HS256)
+	for _, alg := range []string{ALG_EDDSA, ALG_ES256} {
+		if _, err := ks.Rotate(alg, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jwks := ks.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("the JWKS has %d keys, want the 2 public ones", len(jwks.Keys))
+	}
+
+	b64 := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	for _, jwk := range jwks.Keys {
+		t.Run(jwk.Alg, func(t *testing.T) {
+			var public any
+			switch jwk.Alg {
+			case ALG_EDDSA:
+				if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || jwk.Y != "" {
+					t.Errorf("got kty %s, crv %s", jwk.Kty, jwk.Crv)
+				}
+				public = ed25519.PublicKey(b64(jwk.X))
+			case ALG_ES256:
+				if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+					t.Errorf("got kty %s, crv %s", jwk.Kty, jwk.Crv)
+				}
+				public = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(b64(jwk.X)), Y: new(big.Int).SetBytes(b64(jwk.Y))}
+			default:
+				t.Fatalf("the JWKS has a %s key", jwk.Alg)
+			}
+			if jwk.Use != "sig" || ks.key(jwk.Kid) == nil {
+				t.Errorf("got use %s, kid %s", jwk.Use, jwk.Kid)
+			}
+
+			signed := ks.key(jwk.Kid)
+			useKeys(t, &KeySet{Active: signed.ID, Keys: ks.Keys})
+			token, err := jwt.Parse(GenerateJWTToken(tokenUser, "session", time.Now()), func(*jwt.Token) (any, error) { return public, nil })
+			if err != nil || !token.Valid {
+				t.Errorf("the public key of the JWKS doesn't verify the token: %v", err)
+			}
+		})
+	}
+
+	useKeys(t, ks)
+	if served := CurrentJWKS(); !reflect.DeepEqual(served, jwks) {
+		t.Errorf("served %+v, want the JWKS of the loaded key set", served)
+	}
+}
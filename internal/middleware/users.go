@@ -28,11 +28,12 @@ The user model is not meant to be used for authentication, or marshalling, but r
 //     CreatedAt TEXT DEFAULT (datetime('now')),
 //     UpdatedAt TEXT DEFAULT (datetime('now')),
 //     LastLogin TEXT,
-//     Role TEXT CHECK(Role IN ('admin', 'user')) DEFAULT 'user',
+//     Role TEXT CHECK(Role IN ('viewer', 'analyst', 'module-operator', 'admin')) DEFAULT 'viewer',
 //     FirstName TEXT,
 //     ProfileImageURL TEXT,
 //     SessionId TEXT,
-//     AuthMethodID INTEGER
+//     AuthMethodID INTEGER,
+//     Disabled BOOLEAN NOT NULL DEFAULT 0 -- See schema.go for the upgrades since the migration scripts
 // );
 
 /* SQLite initialization script for the webauthn_auth and password_auth tables */
@@ -100,6 +101,7 @@ type User struct {
 	ProfileImageUrl string `json:"profileimageurl"`
 	SessionId       string `json:"sessionid"`
 	AuthMethodID    int    `json:"authmethodid"`
+	Disabled        bool   `json:"disabled"` // Disabled accounts can't log in, and their tokens are refused
 }
 
 type Users struct {
@@ -170,8 +172,8 @@ func ValidateNewUser(user CreateUserRequest) (bool, []error) {
 	if len(user.Password) < 12 {
 		err = append(err, NewUserValidationError("Password must be at least 12 characters long"))
 	}
-	if user.Role != "admin" && user.Role != "user" {
-		err = append(err, NewUserValidationError("Invalid role. Should be 'admin' or 'user'"))
+	if !ValidRole(user.Role) {
+		err = append(err, NewUserValidationError("Invalid role. Should be one of viewer, analyst, module-operator or admin"))
 	}
 	if user.ProfileImageUrl == "" {
 		p := PlaceholderImage{
@@ -228,13 +230,7 @@ func GetUserByID(id string) User {
 		return user
 	}
 
-	err := instance.Driver.QueryRow(instance.SelectColEq(UCId), id).
-		Scan(
-			&user.UserID, &user.DisplayName, &user.CreatedAt,
-			&user.UpdatedAt, &user.LastLogin, &user.Role,
-			&user.FirstName, &user.ProfileImageUrl,
-			&user.SessionId, &user.AuthMethodID,
-		)
+	user, err := scanUser(instance.Driver.QueryRow(instance.SelectColEq(UCId), id))
 
 	if err != nil {
 		ansi.PrintError("GetUserByID: " + err.Error())
@@ -259,13 +255,7 @@ func GetUserByDisplayName(displayname string) User { // Displayname is used to l
 
 	ansi.PrintDebug("SelectCol: " + instance.SelectCol(UCDisplayName, UClike) + displayname + "#" + "%")
 
-	err := instance.Driver.QueryRow(instance.SelectCol(UCDisplayName, UClike), displayname+"#"+"%").
-		Scan(
-			&user.UserID, &user.DisplayName, &user.CreatedAt,
-			&user.UpdatedAt, &user.LastLogin, &user.Role,
-			&user.FirstName, &user.ProfileImageUrl,
-			&user.SessionId, &user.AuthMethodID,
-		)
+	user, err := scanUser(instance.Driver.QueryRow(instance.SelectCol(UCDisplayName, UClike), displayname+"#"+"%"))
 
 	if err != nil {
 		ansi.PrintError("GetUserByDisplayName: " + err.Error())
@@ -439,17 +429,13 @@ func LoginSuccessHTML(u User, jwt string) string {
 		u.AuthMethodID, u.LastLogin, u.CreatedAt, u.UpdatedAt, jwt)
 }
 
-func LoginSucessJSON(u User, jwt string) string {
+func LoginSucessJSON(u User, session UserSession) string {
 
 	response := CreateUserResponse{
 		Success:     true,
 		Message:     "Login success",
 		DisplayName: u.DisplayName,
-		UserSession: UserSession{
-			SessionID: u.SessionId,
-			UserID:    u.UserID,
-			Token:     jwt,
-		},
+		UserSession: session,
 	}
 	json, err := json.Marshal(response)
 	if err != nil {
@@ -45,14 +45,6 @@ func GenerateRandomInt(min, max int) (uint64, error) {
 	return randomID.Uint64(), nil
 }
 
-// Get Bivrost JWT secret Argon2 encoded hash from TheValve
-func GetBivrostJWTSecret() string {
-	// extract "$argon2id$v=19$m=16,t=2,p=1$aGVORDFaUmJrVTgzdm1wQw$Sin4nQSD3lnO7G8XD6lb7Q"
-	// decodeArgon2Hash
-	// return string(vault.GetVault().GetSection("bivrost").GetEntry("jwt").GetContent("secret")
-	return "password"
-}
-
 // func DecodeArgon2Hash(encodedHash string) (p *Argon2Params, salt, hash []byte, err error) {
 // 	fmt.Println("Decoding hash " + "\033[0;35m" + encodedHash + "\033[0m")
 // 	vals := strings.Split(encodedHash, "$")
@@ -33,6 +33,10 @@ var (
 )
 
 const usage = `Usage: bivrost [options]
+       bivrost module test [options] CONFIG	Run the conformance checks against a module, see bivrost module -h
+       bivrost capture print|replay [options] FILE	Read or replay a capture of IPC frames, see bivrost capture -h
+       bivrost export [options] TABLE [FILTER ...]	Export logs or module results as CSV, NDJSON or Parquet, see bivrost export -h
+       bivrost openapi [-check] [-o FILE]		Write the OpenAPI document of the API, see bivrost openapi -h
 
 Options:
   -v, --version    		Print version information
@@ -1,7 +1,10 @@
 // package main
 package main
 
-import "github.com/pynezz/bivrost/cmd"
+import (
+	"github.com/pynezz/bivrost/cmd"
+	"github.com/pynezz/bivrost/modules"
+)
 
 var buildVersion string
 
@@ -10,5 +13,9 @@ func Execute() {
 }
 
 func main() {
+	// bivrost starts itself to sandbox modules, see modules/sandbox.go
+	if modules.IsSandboxShim() {
+		modules.RunSandboxShim()
+	}
 	cmd.Execute(buildVersion)
 }
@@ -0,0 +1,254 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pynezz/bivrost/internal/database/models"
+	"github.com/pynezz/bivrost/internal/ipc"
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestError is a problem with a module manifest, the module's config.yaml, at the line it was found on:
+//
+//	modules/threat_intel/config.yaml:9: identifier must be exactly 4 characters, got "THR"
+type ManifestError struct {
+	Path    string
+	Line    int // 0 if the problem isn't tied to a line, ex: a missing field
+	Message string
+}
+
+func (e *ManifestError) Error() string {
+	if e.Line == 0 {
+		return e.Path + ": " + e.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Message)
+}
+
+// manifest is a decoded module manifest, with the YAML nodes kept for error reporting
+type manifest struct {
+	path   string
+	root   *yaml.Node // The top level mapping
+	config ModuleConfig
+	errs   []error
+}
+
+// ParseManifest decodes and validates a module manifest.
+// version is the running bivrost version, and is checked against the bivrost section of the manifest.
+// All problems are returned, joined.
+func ParseManifest(path string, r io.Reader, version string) (*ModuleConfig, error) {
+	m, err := decodeManifest(path, r)
+	if err != nil {
+		return nil, err
+	}
+	m.validate(version)
+	if len(m.errs) > 0 {
+		return nil, errors.Join(m.errs...)
+	}
+	return &m.config, nil
+}
+
+func decodeManifest(path string, r io.Reader) (*manifest, error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil, &ManifestError{Path: path, Message: "manifest is empty"}
+		}
+		return nil, yamlError(path, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, &ManifestError{Path: path, Line: doc.Line, Message: "manifest must be a mapping"}
+	}
+
+	m := &manifest{path: path, root: doc.Content[0]}
+	if err := m.root.Decode(&m.config); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			for _, e := range typeErr.Errors {
+				m.errs = append(m.errs, yamlError(path, e))
+			}
+			return nil, errors.Join(m.errs...)
+		}
+		return nil, &ManifestError{Path: path, Message: err.Error()}
+	}
+	if n := m.node("identifier"); n != nil {
+		m.config.identifierLine = n.Line
+	}
+	return m, nil
+}
+
+// yamlError turns a message from the YAML decoder, ex: "line 3: cannot unmarshal ...", into a ManifestError
+func yamlError(path, msg string) *ManifestError {
+	var line int
+	if _, err := fmt.Sscanf(msg, "line %d:", &line); err == nil {
+		msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+	}
+	return &ManifestError{Path: path, Line: line, Message: msg}
+}
+
+// node returns the value node at the path of keys, or nil if it's missing
+func (m *manifest) node(keys ...string) *yaml.Node {
+	n := m.root
+	for _, key := range keys {
+		if n.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == key {
+				next = n.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+// errorf records a problem with the node. n may be nil when the problem is a missing field.
+func (m *manifest) errorf(n *yaml.Node, format string, a ...any) {
+	line := 0
+	if n != nil {
+		line = n.Line
+	}
+	m.errs = append(m.errs, &ManifestError{Path: m.path, Line: line, Message: fmt.Sprintf(format, a...)})
+}
+
+func (m *manifest) validate(version string) {
+	c := &m.config
+
+	for _, key := range []string{"name", "identifier", "protocol_version"} {
+		if n := m.node(key); n == nil || n.Value == "" {
+			m.errorf(nil, "missing required field %s", key)
+		}
+	}
+
+	if c.Identifier != "" {
+		if len(c.Identifier) != 4 {
+			m.errorf(m.node("identifier"), "identifier must be exactly 4 characters, got %q", c.Identifier)
+		} else if !isPrintableASCII(c.Identifier) {
+			m.errorf(m.node("identifier"), "identifier must be printable ASCII, got %q", c.Identifier)
+		}
+	}
+
+	if m.node("protocol_version") != nil {
+		if c.ProtocolVersion < 0 || c.ProtocolVersion > ipc.PROTOCOL_VERSION {
+			m.errorf(m.node("protocol_version"), "protocol_version %d is not supported, this version of bivrost supports 0 to %d",
+				c.ProtocolVersion, ipc.PROTOCOL_VERSION)
+		}
+	}
+
+	for i, table := range c.Tables {
+		if !models.IsTable(table) {
+			var n *yaml.Node
+			if tables := m.node("tables"); i < len(tables.Content) {
+				n = tables.Content[i]
+			}
+			m.errorf(n, "unknown table %q, expected one of %s", table, strings.Join(models.TableNames(), ", "))
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, schema := range c.Schemas {
+		n := m.node("schemas").Content[i]
+		if err := schema.Validate(); err != nil {
+			m.errorf(n, "%v", err)
+		} else if names[schema.Name] {
+			m.errorf(n, "table %s is declared twice", schema.Name)
+		}
+		names[schema.Name] = true
+	}
+
+	for _, key := range []string{"publish", "subscribe"} {
+		patterns := c.Events.Publish
+		if key == "subscribe" {
+			patterns = c.Events.Subscribe
+		}
+		for i, pattern := range patterns {
+			if err := ipc.ValidatePattern(pattern); err != nil {
+				m.errorf(m.node("events", key).Content[i], "invalid %s pattern: %v", key, err)
+			}
+		}
+	}
+
+	m.validateVersions(version)
+}
+
+// validateVersions checks that the running bivrost is within the version range the module supports
+func (m *manifest) validateVersions(version string) {
+	c := &m.config
+	min, minOk := parseVersion(c.Bivrost.MinVersion)
+	max, maxOk := parseVersion(c.Bivrost.MaxVersion)
+	if c.Bivrost.MinVersion != "" && !minOk {
+		m.errorf(m.node("bivrost", "min_version"), "min_version %q is not a valid version, expected ex: 1.2.0", c.Bivrost.MinVersion)
+	}
+	if c.Bivrost.MaxVersion != "" && !maxOk {
+		m.errorf(m.node("bivrost", "max_version"), "max_version %q is not a valid version, expected ex: 1.2.0", c.Bivrost.MaxVersion)
+	}
+	if minOk && maxOk && compareVersions(min, max) > 0 {
+		m.errorf(m.node("bivrost", "min_version"), "min_version %s is newer than max_version %s", c.Bivrost.MinVersion, c.Bivrost.MaxVersion)
+	}
+
+	running, ok := parseVersion(version)
+	if !ok {
+		return // Development build, nothing to compare against
+	}
+	if minOk && compareVersions(running, min) < 0 {
+		m.errorf(m.node("bivrost", "min_version"), "module requires bivrost %s or newer, this is %s", c.Bivrost.MinVersion, version)
+	}
+	if maxOk && compareVersions(running, max) > 0 {
+		m.errorf(m.node("bivrost", "max_version"), "module supports bivrost up to %s, this is %s", c.Bivrost.MaxVersion, version)
+	}
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// parseVersion parses major.minor.patch, with an optional v prefix and anything after a - ignored,
+// so versions from git describe (ex: v1.2.0-3-gabc1234) work. A missing patch is 0.
+func parseVersion(s string) ([3]int, bool) {
+	var v [3]int
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	if s == "" {
+		return v, false
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
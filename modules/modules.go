@@ -6,102 +6,159 @@
 package modules
 
 import (
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/pynezz/bivrost/internal/config"
 	"github.com/pynezz/bivrost/internal/fsutil"
 	"github.com/pynezz/bivrost/internal/util"
-	"gopkg.in/yaml.v3"
 )
 
-func (m *Module) Stop() {
-	// Load the modules from the modules directory
-	// For each module, load the configuration and the binary
-	// Start the module with the configuration
+// Registry holds the loaded modules and their identifiers.
+// It's shared by the IPC server and the API, and changes when the modules are reloaded.
+type Registry struct {
+	mu      sync.RWMutex
+	modules map[string]Module // Keyed by name, nil until Load
+	ids     map[string][4]byte
 }
 
-func StartModule() {
-	// Start the module with the provided configuration
+// NewRegistry returns an empty registry. Use Load to read the modules from the config
+func NewRegistry() *Registry {
+	return &Registry{
+		ids: make(map[string][4]byte),
+	}
 }
 
-var Modules map[string]Module
-
-var Mids ModuleIdentifiers
-
-// LoadModules loads all the modules and their configuration files
-func LoadModules(config config.Cfg) error {
+// Load loads all the modules and their configuration files.
+// version is the running bivrost version, which the modules may require a range of.
+func (r *Registry) Load(config config.Cfg, version string) error {
 	util.PrintDebug("Loading modules")
-	if Modules != nil {
-		return fmt.Errorf("modules already loaded")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.modules != nil {
+		return fmt.Errorf("modules already loaded, use Reload")
 	}
-	Modules = make(map[string]Module)
-
-	var m ModuleIdentifiers = make(map[string][4]byte)
-	Mids = m
-
-	modules := func() []Module {
-		var m []Module
-		for _, module := range config.Sources {
-			if module.Type == "module" {
-				found := Module{
-					Name:        module.Name,
-					Description: module.Description,
-					ConfigPath:  module.Config,
-				}
-				m = append(m, found)
-			} else {
-				util.PrintDebug("Skipping non-module source " + module.Name + " of type " + module.Type + "...")
-			}
-		}
-		return m
+
+	loaded, err := readModules(config, version)
+	if err != nil {
+		return err
 	}
+	r.modules = loaded
+	for _, module := range loaded {
+		r.ids[module.Name] = module.identifier()
+		util.PrintSuccess("Loaded identifier for " + module.Name + " as " + fmt.Sprintf("%v", module.identifier()))
+	}
+	return nil
+}
+
+// Validate reads the manifest of every module source in the config, without loading the modules
+func Validate(config config.Cfg, version string) error {
+	_, err := readModules(config, version)
+	return err
+}
+
+// readModules reads and validates the manifest of every module source in the config.
+// Every manifest is checked, so all problems are reported at once.
+func readModules(config config.Cfg, version string) (map[string]Module, error) {
+	loaded := make(map[string]Module)
+	owners := make(map[string]string) // Identifier -> manifest path
 
+	var errs []error
 	util.PrintDebug("Loading module configurations...")
-	for _, module := range modules() {
-		conf, err := fsutil.GetFile(fsutil.PathConvert(module.ConfigPath))
-		if err != nil {
-			return err
+	for _, source := range config.Sources {
+		if source.Type != "module" {
+			util.PrintDebug("Skipping non-module source " + source.Name + " of type " + source.Type + "...")
+			continue
+		}
+		if source.Disabled {
+			util.PrintDebug("Skipping disabled module " + source.Name + "...")
+			continue
+		}
+		module := Module{
+			Name:        source.Name,
+			Description: source.Description,
+			ConfigPath:  source.Config,
 		}
-		defer conf.Close()
 
-		util.PrintDebug("Decoding module configuration for " + module.Name + "...")
-		yamlDecoder := yaml.NewDecoder(conf)
-		var mc ModuleConfig
-		err = yamlDecoder.Decode(&mc)
+		mc, err := loadManifest(module.ConfigPath, version)
 		if err != nil {
-			util.PrintError("Failed to decode module configuration for " + module.Name)
-			return err
+			util.PrintError("Invalid module configuration for " + module.Name)
+			errs = append(errs, err)
+			continue
 		}
+		if owner, taken := owners[mc.Identifier]; taken {
+			errs = append(errs, &ManifestError{Path: module.ConfigPath, Line: mc.identifierLine,
+				Message: fmt.Sprintf("identifier %q is already used by %s", mc.Identifier, owner)})
+			continue
+		}
+		owners[mc.Identifier] = module.ConfigPath
 
-		module.Config = &mc
-		Modules[module.Name] = module
+		module.Config = mc
+		loaded[module.Name] = module
 		util.PrintSuccess("Loaded module " + module.Name)
+	}
+	return loaded, errors.Join(errs...)
+}
 
-		id := [4]byte{}
-		for i := range id {
-			id[i] = mc.Identifier[i]
-		}
-		Mids[module.Name] = id
-		util.PrintSuccess("Loaded identifier for " + module.Name + " as " + fmt.Sprintf("%v", id))
-		Mids.StoreModuleIdentifier(module.Name, id)
+// loadManifest reads and validates the module configuration file
+func loadManifest(path, version string) (*ModuleConfig, error) {
+	conf, err := fsutil.GetFile(fsutil.PathConvert(path))
+	if err != nil {
+		return nil, err
+	}
+	defer conf.Close()
+
+	util.PrintDebug("Decoding module configuration " + path + "...")
+	return ParseManifest(path, conf, version)
+}
+
+// identifier returns the 4 byte identifier from the manifest
+func (m Module) identifier() [4]byte {
+	var id [4]byte
+	copy(id[:], m.Config.Identifier)
+	return id
+}
 
+// Modules returns a copy of the loaded modules, keyed by name
+func (r *Registry) Modules() map[string]Module {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	modules := make(map[string]Module, len(r.modules))
+	for name, m := range r.modules {
+		modules[name] = m
 	}
-	return nil
+	return modules
+}
+
+// Module returns the loaded module with the name
+func (r *Registry) Module(name string) (Module, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.modules[name]
+	return m, ok
 }
 
-// GetModuleIdentifiers returns the module identifiers
-func (i *ModuleIdentifiers) GetModuleIdentifier(name string) [4]byte {
-	return (*i)[name]
+// Identifier returns the identifier of the module, and whether the module is known
+func (r *Registry) Identifier(name string) ([4]byte, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.ids[name]
+	return id, ok
 }
 
-// StoreModuleIdentifier stores the module identifier in the MODULEIDENTIFIERS map
-func (i *ModuleIdentifiers) StoreModuleIdentifier(name string, identifier [4]byte) {
-	(*i)[name] = identifier
+// StoreIdentifier remembers the identifier of a module that connected without being loaded
+func (r *Registry) StoreIdentifier(name string, identifier [4]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids[name] = identifier
 }
 
-// GetModuleName returns the name of the module from the identifier
-func (i *ModuleIdentifiers) GetModuleName(identifier [4]byte) string {
-	for name, id := range *i {
+// Name returns the name of the module with the identifier, or "" if it's unknown
+func (r *Registry) Name(identifier [4]byte) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for name, id := range r.ids {
 		if id == identifier {
 			return name
 		}
@@ -109,30 +166,25 @@ func (i *ModuleIdentifiers) GetModuleName(identifier [4]byte) string {
 	return ""
 }
 
-func GetModule(name string) Module {
-	return Modules[name]
+// Config returns the manifest of the loaded module with the identifier, or nil if there is none
+func (r *Registry) Config(identifier string) *ModuleConfig {
+	var id [4]byte
+	copy(id[:], identifier)
+	name := r.Name(id)
+	if name == "" {
+		return nil
+	}
+	m, _ := r.Module(name)
+	return m.Config
 }
 
-// GetModuleNames returns the names of the modules
-func (i *ModuleIdentifiers) GetModuleNames() []string {
+// Names returns the names of the known modules
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	var names []string
-	for name := range *i {
+	for name := range r.ids {
 		names = append(names, name)
 	}
 	return names
 }
-
-// AddModuleIdentifier adds a module identifier to the MODULEIDENTIFIERS map
-func SetModuleIdentifier(identifier [4]byte, name string) {
-	MODULEIDENTIFIERS[name] = identifier
-}
-
-// GetModuleNameFromID returns the name of the module from the identifier
-func GetModuleNameFromID(identifier [4]byte) string {
-	for name, id := range MODULEIDENTIFIERS {
-		if id == identifier {
-			return name
-		}
-	}
-	return ""
-}
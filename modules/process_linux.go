@@ -0,0 +1,24 @@
+//go:build linux
+
+package modules
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detach starts the module in its own process group, so stopping it also stops whatever it started.
+// The kernel kills the module if bivrost dies without stopping it. This is only a backstop:
+// the signal is tied to the thread that started the module, not to bivrost as a whole.
+func detach(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+}
+
+// signalGroup sends the signal to the process group of the module
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package modules
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func detach(cmd *exec.Cmd) {}
+
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Signal(sig)
+}
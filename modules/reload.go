@@ -0,0 +1,102 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/pynezz/bivrost/internal/config"
+	"github.com/pynezz/bivrost/internal/util"
+)
+
+// ReloadResult lists what a reload did, by module name
+type ReloadResult struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// Reload applies the module sources in the config, after a SIGHUP or POST /modules/reload: new modules are started,
+// removed ones stopped, and those with a changed source or manifest restarted. Unchanged modules keep their
+// connections and cursors. Modules with a binary are started and stopped with the supervisor.
+// disconnect is called with the identifier of every removed or changed module, and should close its IPC connections,
+// so changed modules handshake again. If any manifest is invalid, nothing is changed.
+// Modules that fail to start are reported in the error, but don't undo the reload.
+func (r *Registry) Reload(config config.Cfg, version string, s *Supervisor, disconnect func(identifier string)) (*ReloadResult, error) {
+	loaded, err := readModules(config, version)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	if r.modules == nil {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("modules are not loaded")
+	}
+	result := &ReloadResult{Added: []string{}, Removed: []string{}, Changed: []string{}, Unchanged: []string{}}
+	var retired []Module // Removed, or the old version of a changed module
+	var start []Module
+	for name, old := range r.modules {
+		m, ok := loaded[name]
+		switch {
+		case !ok:
+			result.Removed = append(result.Removed, name)
+			retired = append(retired, old)
+			delete(r.modules, name)
+			delete(r.ids, name)
+		case changed(old, m):
+			result.Changed = append(result.Changed, name)
+			retired = append(retired, old)
+			start = append(start, m)
+		default:
+			result.Unchanged = append(result.Unchanged, name)
+		}
+	}
+	for name, m := range loaded {
+		if _, ok := r.modules[name]; !ok {
+			result.Added = append(result.Added, name)
+			start = append(start, m)
+		}
+	}
+	for _, m := range start {
+		r.modules[m.Name] = m
+		r.ids[m.Name] = m.identifier()
+	}
+	r.mu.Unlock()
+
+	for _, m := range retired {
+		s.Remove(m.Name)
+		if disconnect != nil {
+			disconnect(m.Config.Identifier)
+		}
+	}
+
+	var errs []error
+	for _, m := range start {
+		if m.Config.Exec.Binary == "" {
+			continue // Started by hand
+		}
+		if err := s.Start(m); err != nil {
+			errs = append(errs, fmt.Errorf("failed to start module %s: %w", m.Name, err))
+		}
+	}
+
+	for _, list := range [][]string{result.Added, result.Removed, result.Changed, result.Unchanged} {
+		sort.Strings(list)
+	}
+	util.PrintInfo(fmt.Sprintf("Reloaded modules: %d added, %d removed, %d changed, %d unchanged",
+		len(result.Added), len(result.Removed), len(result.Changed), len(result.Unchanged)))
+	return result, errors.Join(errs...)
+}
+
+// changed reports whether the module needs to be restarted
+func changed(old, new Module) bool {
+	if old.ConfigPath != new.ConfigPath || old.Description != new.Description {
+		return true
+	}
+	a, b := *old.Config, *new.Config
+	a.identifierLine, b.identifierLine = 0, 0
+	return !reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,137 @@
+package modules
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pynezz/bivrost/internal/config"
+)
+
+// manifests writes a manifest for every module, by name, and returns a config with the modules as sources
+func manifests(t *testing.T, dir string, modules map[string]string) config.Cfg {
+	t.Helper()
+	var cfg config.Cfg
+	for name, manifest := range modules {
+		path := filepath.Join(dir, name+".yaml")
+		if err := os.WriteFile(path, []byte(manifest), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Sources = append(cfg.Sources, config.Sources{Name: name, Type: "module", Config: path})
+	}
+	return cfg
+}
+
+func TestReload(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run modules with")
+	}
+	supervised := "name: supervised\nidentifier: SUPV\nprotocol_version: 3\nexec:\n  binary: " + sh + "\n  args: [-c, 'exec sleep 60']\n"
+	initial := map[string]string{
+		"threat":     "name: threat\nidentifier: THRI\nprotocol_version: 3\n",
+		"anomaly":    "name: anomaly\nidentifier: ANOD\nprotocol_version: 3\n",
+		"geo":        "name: geo\nidentifier: GEOL\nprotocol_version: 3\n",
+		"supervised": supervised,
+	}
+
+	tests := []struct {
+		name         string
+		modules      map[string]string
+		want         ReloadResult
+		disconnected []string
+		wantErr      bool
+	}{
+		{
+			name:    "nothing changed",
+			modules: initial,
+			want:    ReloadResult{Added: []string{}, Removed: []string{}, Changed: []string{}, Unchanged: []string{"anomaly", "geo", "supervised", "threat"}},
+		},
+		{
+			name: "added, removed and changed",
+			modules: map[string]string{
+				"threat":     initial["threat"],
+				"anomaly":    "name: anomaly\nidentifier: ANOD\nprotocol_version: 3\ntables: [nginx_logs]\n",
+				"supervised": supervised + "  stop_grace: 1\n",
+				"intel":      "name: intel\nidentifier: INTL\nprotocol_version: 3\n",
+			},
+			want:         ReloadResult{Added: []string{"intel"}, Removed: []string{"geo"}, Changed: []string{"anomaly", "supervised"}, Unchanged: []string{"threat"}},
+			disconnected: []string{"ANOD", "GEOL", "SUPV"},
+		},
+		{
+			name: "invalid manifest",
+			modules: map[string]string{
+				"threat": initial["threat"],
+				"intel":  "name: intel\nidentifier: TOOLONG\n",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r, s := NewRegistry(), NewSupervisor()
+			t.Cleanup(s.StopAll)
+			if err := r.Load(manifests(t, dir, initial), ""); err != nil {
+				t.Fatal(err)
+			}
+			s.StartAll(r.Modules())
+			eventually(t, "the supervised module to start", func() bool { return status(s, "supervised").PID != 0 })
+			pid := status(s, "supervised").PID
+
+			var disconnected []string
+			result, err := r.Reload(manifests(t, dir, tt.modules), "", s, func(identifier string) {
+				disconnected = append(disconnected, identifier)
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("reload with an invalid manifest succeeded")
+				}
+				if names := r.Names(); len(names) != len(initial) {
+					t.Errorf("the registry has %v after a failed reload, want it unchanged", names)
+				}
+				if status(s, "supervised").PID != pid {
+					t.Error("the supervised module was restarted by a failed reload")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(*result, tt.want) {
+				t.Errorf("reload returned %+v, want %+v", *result, tt.want)
+			}
+			sort.Strings(disconnected)
+			if !reflect.DeepEqual(disconnected, tt.disconnected) {
+				t.Errorf("disconnected %v, want %v", disconnected, tt.disconnected)
+			}
+			for _, name := range tt.want.Removed {
+				if _, ok := r.Module(name); ok {
+					t.Errorf("removed module %s is still registered", name)
+				}
+			}
+			for _, name := range tt.want.Added {
+				if _, ok := r.Module(name); !ok {
+					t.Errorf("added module %s isn't registered", name)
+				}
+			}
+
+			restarted := false
+			for _, name := range tt.want.Changed {
+				restarted = restarted || name == "supervised"
+			}
+			if restarted {
+				eventually(t, "the supervised module to restart", func() bool {
+					st := status(s, "supervised")
+					return st.PID != 0 && st.PID != pid
+				})
+			} else if status(s, "supervised").PID != pid {
+				t.Error("the unchanged supervised module was restarted")
+			}
+		})
+	}
+}
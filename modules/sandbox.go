@@ -0,0 +1,109 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Seccomp presets
+const (
+	SECCOMP_NONE    = "none"
+	SECCOMP_DEFAULT = "default" // Kills the module if it tries to mount, trace, load kernel modules, etc.
+	SECCOMP_STRICT  = "strict"  // default, and no sockets other than UNIX domain sockets
+)
+
+// SandboxConfig is the sandbox section of a module's config.yaml. Modules parse untrusted data, so a sandboxed
+// module is started through a copy of bivrost (the shim), which restricts itself and then execs the module.
+// The restrictions are inherited through exec. Only supported on Linux, see sandbox_linux.go
+type SandboxConfig struct {
+	UID int `yaml:"uid,omitempty" json:"uid,omitempty"` // User to run as, 0 keeps bivrost's. Requires bivrost to run as root
+	GID int `yaml:"gid,omitempty" json:"gid,omitempty"` // Group to run as, 0 keeps bivrost's. Requires bivrost to run as root
+
+	Rlimits struct {
+		MemoryMB   uint64 `yaml:"memory_mb,omitempty" json:"memory_mb,omitempty"`     // Address space
+		CPUSeconds uint64 `yaml:"cpu_seconds,omitempty" json:"cpu_seconds,omitempty"` // CPU time
+		OpenFiles  uint64 `yaml:"open_files,omitempty" json:"open_files,omitempty"`   // File descriptors
+	} `yaml:"rlimits,omitempty" json:"rlimits"`
+
+	NoNewPrivs bool   `yaml:"no_new_privs,omitempty" json:"no_new_privs,omitempty"` // Always set when a seccomp preset is used
+	Seccomp    string `yaml:"seccomp,omitempty" json:"seccomp,omitempty"`           // none, default or strict. Defaults to default
+
+	// Filesystem view, through a mount namespace. Without root, it needs unprivileged user namespaces
+	ReadOnly bool     `yaml:"read_only,omitempty" json:"read_only,omitempty"` // Mount everything read-only
+	Writable []string `yaml:"writable,omitempty" json:"writable,omitempty"`   // Exceptions to read_only
+	Hidden   []string `yaml:"hidden,omitempty" json:"hidden,omitempty"`       // Paths the module can't see at all
+}
+
+// usesMounts reports whether the sandbox needs a mount namespace
+func (c *SandboxConfig) usesMounts() bool {
+	return c.ReadOnly || len(c.Hidden) > 0
+}
+
+// validate checks the configuration after the paths have been resolved
+func (c *SandboxConfig) validate() error {
+	switch c.Seccomp {
+	case SECCOMP_NONE, SECCOMP_DEFAULT, SECCOMP_STRICT:
+	default:
+		return fmt.Errorf("unknown seccomp preset %q, expected none, default or strict", c.Seccomp)
+	}
+	if c.UID < 0 || c.GID < 0 {
+		return fmt.Errorf("uid and gid must be positive")
+	}
+	for _, path := range append(append([]string(nil), c.Writable...), c.Hidden...) {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("sandbox path %s is not absolute", path)
+		}
+	}
+	return nil
+}
+
+// Event is something noteworthy that happened to a supervised module, such as a sandbox violation
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+// Event types
+const (
+	EVENT_VIOLATION = "sandbox_violation" // The module was killed for breaking the sandbox rules
+	EVENT_SANDBOX   = "sandbox"           // The sandbox couldn't be (fully) set up
+	EVENT_EXIT      = "exit"
+)
+
+// SANDBOX_ENV carries the sandbox configuration from bivrost to the shim
+const SANDBOX_ENV = "BIVROST_SANDBOX"
+
+// sandboxEventPrefix marks lines the shim writes to stderr to report an event to the supervisor
+const sandboxEventPrefix = "bivrost-sandbox: "
+
+// IsSandboxShim reports whether this process was started as a sandbox shim.
+// main should call RunSandboxShim first thing when it is.
+func IsSandboxShim() bool {
+	return os.Getenv(SANDBOX_ENV) != ""
+}
+
+// sandboxEnv encodes the configuration for the shim
+func sandboxEnv(c SandboxConfig) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return SANDBOX_ENV + "=" + string(b), nil
+}
+
+// shimEnv returns the environment for the module, without the sandbox configuration
+func shimEnv() []string {
+	env := os.Environ()
+	out := env[:0]
+	for _, e := range env {
+		if !strings.HasPrefix(e, SANDBOX_ENV+"=") {
+			out = append(out, e)
+		}
+	}
+	return out
+}
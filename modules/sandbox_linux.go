@@ -0,0 +1,339 @@
+//go:build linux
+
+package modules
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxExitCode is the exit code of a shim that failed to set up the sandbox
+const sandboxExitCode = 125
+
+// sandbox wraps the command in the sandbox shim.
+// Returns notes about restrictions that can't be applied, which should be reported as events.
+func sandbox(cmd *exec.Cmd, c SandboxConfig) ([]string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	root := os.Geteuid() == 0
+	if (c.UID != 0 || c.GID != 0) && !root {
+		return nil, fmt.Errorf("running as uid %d/gid %d requires bivrost to run as root", c.UID, c.GID)
+	}
+
+	attr := &syscall.SysProcAttr{}
+	if c.usesMounts() {
+		attr.Cloneflags = syscall.CLONE_NEWNS
+		if !root {
+			// The shim is root of a user namespace holding only bivrost's user, long enough to set up the mounts.
+			// The module can't be started if the kernel doesn't allow unprivileged user namespaces
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		}
+	}
+
+	env, err := sandboxEnv(c)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Args = append([]string{self, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	cmd.Env = append(cmd.Env, env)
+	cmd.SysProcAttr = attr
+	return nil, nil
+}
+
+// RunSandboxShim applies the sandbox configuration to the current process, and replaces it with the module binary.
+// It never returns.
+func RunSandboxShim() {
+	// Seccomp filters and no_new_privs apply to the calling thread, which must be the one calling exec
+	runtime.LockOSThread()
+
+	var c SandboxConfig
+	if err := json.Unmarshal([]byte(os.Getenv(SANDBOX_ENV)), &c); err != nil {
+		shimFail("invalid sandbox configuration: %v", err)
+	}
+	if len(os.Args) < 2 {
+		shimFail("no module binary given")
+	}
+
+	if err := setRlimits(c); err != nil {
+		shimFail("failed to set resource limits: %v", err)
+	}
+	if c.usesMounts() {
+		if err := mountView(c); err != nil {
+			shimFail("failed to set up the filesystem view: %v", err)
+		}
+	}
+	if err := dropPrivileges(c); err != nil {
+		shimFail("failed to drop privileges: %v", err)
+	}
+	if inUserNamespace() {
+		// Otherwise the module could unmount what hides the protected files
+		if err := dropCapabilities(); err != nil {
+			shimFail("failed to drop capabilities: %v", err)
+		}
+	}
+	if c.NoNewPrivs || c.Seccomp != SECCOMP_NONE {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			shimFail("failed to set no_new_privs: %v", err)
+		}
+	}
+	if c.Seccomp != SECCOMP_NONE {
+		if err := installSeccomp(c.Seccomp); err != nil {
+			shimFail("failed to install the %s seccomp profile: %v", c.Seccomp, err)
+		}
+	}
+
+	err := syscall.Exec(os.Args[1], os.Args[1:], shimEnv())
+	shimFail("failed to start %s: %v", os.Args[1], err)
+}
+
+// shimNote reports something to the supervisor, which records it as an event
+func shimNote(format string, a ...any) {
+	fmt.Fprintf(os.Stderr, sandboxEventPrefix+format+"\n", a...)
+}
+
+func shimFail(format string, a ...any) {
+	shimNote(format, a...)
+	os.Exit(sandboxExitCode)
+}
+
+func setRlimits(c SandboxConfig) error {
+	set := func(resource int, soft, hard uint64) error {
+		return unix.Setrlimit(resource, &unix.Rlimit{Cur: soft, Max: hard})
+	}
+	if mb := c.Rlimits.MemoryMB; mb > 0 {
+		if err := set(unix.RLIMIT_AS, mb<<20, mb<<20); err != nil {
+			return fmt.Errorf("memory: %w", err)
+		}
+	}
+	if s := c.Rlimits.CPUSeconds; s > 0 {
+		// SIGXCPU at the soft limit, SIGKILL one second later if it's ignored
+		if err := set(unix.RLIMIT_CPU, s, s+1); err != nil {
+			return fmt.Errorf("cpu time: %w", err)
+		}
+	}
+	if n := c.Rlimits.OpenFiles; n > 0 {
+		if err := set(unix.RLIMIT_NOFILE, n, n); err != nil {
+			return fmt.Errorf("open files: %w", err)
+		}
+	}
+	return nil
+}
+
+// mountView makes the filesystem read-only and hides the hidden paths.
+// The shim runs in its own mount namespace, so nothing here is visible to bivrost.
+func mountView(c SandboxConfig) error {
+	// Keep the changes from propagating back to bivrost's namespace
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+
+	if c.ReadOnly {
+		points, err := mountPoints()
+		if err != nil {
+			return err
+		}
+		for _, p := range points {
+			if isVirtual(p) {
+				continue
+			}
+			if err := remount(p, unix.MS_RDONLY); err != nil {
+				if p == "/" {
+					return err
+				}
+				shimNote("could not make %s read-only: %v", p, err)
+			}
+		}
+
+		for _, w := range c.Writable {
+			if _, err := os.Stat(w); err != nil {
+				shimNote("writable path %s does not exist, skipping", w)
+				continue
+			}
+			if err := unix.Mount(w, w, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+				return err
+			}
+			if err := remount(w, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, h := range c.Hidden {
+		info, err := os.Stat(h)
+		if err != nil {
+			continue // Nothing to hide
+		}
+		if info.IsDir() {
+			err = unix.Mount("tmpfs", h, "tmpfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "size=0,mode=000")
+		} else if err = unix.Mount("/dev/null", h, "", unix.MS_BIND, ""); err == nil {
+			err = remount(h, unix.MS_RDONLY)
+		}
+		if err != nil {
+			return fmt.Errorf("hiding %s: %w", h, err)
+		}
+	}
+
+	// The working directory may have been mounted over
+	if wd, err := os.Getwd(); err == nil {
+		os.Chdir(wd)
+	}
+	return nil
+}
+
+// remount changes the flags of a bind mount, keeping nosuid, nodev and noexec
+func remount(path string, flags uintptr) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	// Flags of mounts inherited by a user namespace are locked, and the remount fails if it changes them
+	keep := uintptr(st.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME)
+	if st.Flags&unix.ST_RELATIME != 0 {
+		keep |= unix.MS_RELATIME
+	}
+	return unix.Mount("", path, "", unix.MS_BIND|unix.MS_REMOUNT|keep|flags, "")
+}
+
+// inUserNamespace reports whether the process runs in a user namespace other than the initial one
+func inUserNamespace() bool {
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	return strings.Join(strings.Fields(string(data)), " ") != "0 0 4294967295"
+}
+
+// dropCapabilities empties the bounding set, so the module gets no capabilities when the shim execs it
+func dropCapabilities() error {
+	for c := 0; c <= unix.CAP_LAST_CAP; c++ {
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return err
+		}
+	}
+	return nil
+}
+
+// isVirtual reports whether the mount point holds a kernel filesystem that doesn't need to be made read-only
+func isVirtual(path string) bool {
+	for _, v := range []string{"/proc", "/dev"} {
+		if path == v || strings.HasPrefix(path, v+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mountPoints lists the mount points of the current namespace
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var points []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		points = append(points, unescapeMountPath(fields[4]))
+	}
+	return points, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (ex: \040 for space) used in /proc/self/mountinfo
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func dropPrivileges(c SandboxConfig) error {
+	if c.UID == 0 && c.GID == 0 {
+		return nil
+	}
+
+	groups := []int{}
+	if c.GID != 0 {
+		groups = append(groups, c.GID)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if c.GID != 0 {
+		if err := syscall.Setgid(c.GID); err != nil {
+			return err
+		}
+	}
+	if c.UID != 0 {
+		if err := syscall.Setuid(c.UID); err != nil {
+			return err
+		}
+	}
+	// Changing the credentials clears the signal the module gets when bivrost dies, see detach
+	return unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(unix.SIGKILL), 0, 0, 0)
+}
+
+// violation explains why the sandbox killed the module, if it did
+func violation(c *SandboxConfig, err error) string {
+	var exitErr *exec.ExitError
+	if c == nil || !errors.As(err, &exitErr) {
+		return ""
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return ""
+	}
+	if status.Exited() && status.ExitStatus() == 128+int(syscall.SIGSYS) {
+		// How shells report a child that was killed by SIGSYS
+		return fmt.Sprintf("a child process was killed by the %s seccomp profile for making a forbidden system call", c.Seccomp)
+	}
+	if !status.Signaled() {
+		return ""
+	}
+
+	switch status.Signal() {
+	case syscall.SIGSYS:
+		return fmt.Sprintf("killed by the %s seccomp profile for making a forbidden system call", c.Seccomp)
+	case syscall.SIGXCPU:
+		return fmt.Sprintf("killed for exceeding the cpu time limit of %ds", c.Rlimits.CPUSeconds)
+	case syscall.SIGKILL:
+		if c.Rlimits.CPUSeconds > 0 && exitErr.SysUsage() != nil {
+			if usage, ok := exitErr.SysUsage().(*syscall.Rusage); ok &&
+				uint64(usage.Utime.Sec+usage.Stime.Sec) >= c.Rlimits.CPUSeconds {
+				return fmt.Sprintf("killed for exceeding the cpu time limit of %ds", c.Rlimits.CPUSeconds)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package modules
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+var errSandboxUnsupported = errors.New("sandboxing is only supported on Linux")
+
+func sandbox(cmd *exec.Cmd, c SandboxConfig) ([]string, error) {
+	return nil, errSandboxUnsupported
+}
+
+// RunSandboxShim is only supported on Linux
+func RunSandboxShim() {
+	os.Stderr.WriteString(sandboxEventPrefix + errSandboxUnsupported.Error() + "\n")
+	os.Exit(125)
+}
+
+func violation(c *SandboxConfig, err error) string {
+	return ""
+}
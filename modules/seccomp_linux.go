@@ -0,0 +1,89 @@
+//go:build linux && (amd64 || arm64)
+
+package modules
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// deniedSyscalls are killed by the default seccomp profile. None of them are needed to parse data,
+// and all of them can be used to escape the sandbox or affect the host.
+var deniedSyscalls = []uint32{
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_KEXEC_LOAD, unix.SYS_KEXEC_FILE_LOAD, unix.SYS_REBOOT,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_SWAPON, unix.SYS_SWAPOFF, unix.SYS_ACCT,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME,
+}
+
+// Offsets into struct seccomp_data
+const (
+	seccompNr   = 0
+	seccompArch = 4
+	seccompArg0 = 16 // Lower half of the first argument, little endian
+)
+
+// installSeccomp installs the seccomp filter for the preset. Requires no_new_privs (or CAP_SYS_ADMIN).
+func installSeccomp(preset string) error {
+	var filter []unix.SockFilter
+	switch preset {
+	case SECCOMP_DEFAULT:
+		filter = seccompFilter(false)
+	case SECCOMP_STRICT:
+		filter = seccompFilter(true)
+	default:
+		return fmt.Errorf("unknown seccomp preset %q", preset)
+	}
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0)
+}
+
+// seccompFilter builds the BPF program: kill the process on a denied system call, allow everything else
+func seccompFilter(strict bool) []unix.SockFilter {
+	load := func(offset uint32) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset}
+	}
+	jumpIf := func(op uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, K: k, Jt: jt, Jf: jf}
+	}
+	ret := func(action uint32) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: action}
+	}
+	kill := ret(unix.SECCOMP_RET_KILL_PROCESS)
+
+	filter := []unix.SockFilter{
+		// System call numbers differ between architectures, so refuse anything but the one the filter was built for
+		load(seccompArch),
+		jumpIf(unix.BPF_JEQ, auditArch, 1, 0),
+		kill,
+		load(seccompNr),
+		// The x32 ABI on amd64 sets this bit in the system call number
+		jumpIf(unix.BPF_JGE, 0x40000000, 0, 1),
+		kill,
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter, jumpIf(unix.BPF_JEQ, nr, 0, 1), kill)
+	}
+	if strict {
+		// Only UNIX domain sockets, so the module can reach bivrost but not the network
+		filter = append(filter,
+			jumpIf(unix.BPF_JEQ, unix.SYS_SOCKET, 0, 3),
+			load(seccompArg0),
+			jumpIf(unix.BPF_JEQ, unix.AF_UNIX, 1, 0),
+			kill,
+		)
+	}
+	return append(filter, ret(unix.SECCOMP_RET_ALLOW))
+}
@@ -0,0 +1,12 @@
+//go:build linux && !amd64 && !arm64
+
+package modules
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func installSeccomp(preset string) error {
+	return fmt.Errorf("seccomp profiles are not available on %s", runtime.GOARCH)
+}
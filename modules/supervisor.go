@@ -0,0 +1,573 @@
+package modules
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/util"
+)
+
+// Process states
+const (
+	STATE_STARTING = "starting"
+	STATE_RUNNING  = "running"
+	STATE_BACKOFF  = "backoff"  // Crashed, waiting before the next restart
+	STATE_STOPPING = "stopping" // SIGTERM sent, waiting for the module to exit
+	STATE_STOPPED  = "stopped"
+	STATE_FAILED   = "failed" // Could not be started at all
+)
+
+const (
+	minBackoff       = time.Second
+	maxBackoff       = time.Minute
+	stableAfter      = 30 * time.Second // A module that ran this long is considered healthy, and the backoff is reset
+	defaultStopGrace = 10 * time.Second
+	logLines         = 500 // Lines of output kept per module
+	eventCount       = 100 // Events kept per module
+)
+
+var (
+	ErrNotSupervised  = errors.New("not supervised")
+	ErrAlreadyRunning = errors.New("already running")
+	ErrNoBinary       = errors.New("has no binary configured")
+)
+
+// Status is the state of a supervised module, as exposed through the API
+type Status struct {
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	PID        int       `json:"pid,omitempty"`
+	Restarts   int       `json:"restarts"`
+	Sandboxed  bool      `json:"sandboxed"`
+	StartedAt  time.Time `json:"started_at"`
+	LastExit   string    `json:"last_exit,omitempty"` // Exit status or error of the last run
+	LastExitAt time.Time `json:"last_exit_at"`
+}
+
+// LogLine is a line written by a module to stdout or stderr
+type LogLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"` // stdout or stderr
+	Text   string    `json:"text"`
+}
+
+// Supervisor runs the modules that have a binary configured as child processes of bivrost, and restarts
+// those that exit on their own with exponential backoff. Their output is logged, and kept for the API.
+// Modules with a sandbox section are started through the sandbox shim, see sandbox.go
+type Supervisor struct {
+	mu        sync.Mutex
+	procs     map[string]*process
+	protected []string // Hidden from every sandboxed module
+	env       []string // Added to the environment of every module, after the manifest's
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		procs: make(map[string]*process),
+	}
+}
+
+// Start launches the module and keeps it running until Stop is called
+func (s *Supervisor) Start(m Module) error {
+	if m.Config == nil || m.Config.Exec.Binary == "" {
+		return fmt.Errorf("module %s %w", m.Name, ErrNoBinary)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.procs[m.Name]; ok && !p.finished() {
+		return fmt.Errorf("module %s is %w", m.Name, ErrAlreadyRunning)
+	}
+
+	p := newProcess(m, s.protected, s.env)
+	s.procs[m.Name] = p
+	go p.supervise()
+	return nil
+}
+
+// Protect hides the files from every sandboxed module started after the call, ex: the users database.
+// SQLite's journal files next to the file are hidden as well.
+func (s *Supervisor) Protect(paths ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			util.PrintError("Failed to protect " + path + ": " + err.Error())
+			continue
+		}
+		s.protected = append(s.protected, abs, abs+"-journal", abs+"-wal", abs+"-shm")
+	}
+}
+
+// SetEnv adds the variables, as KEY=value, to the environment of every module started after the call.
+// They take precedence over the manifest, ex: BIVROST_SOCKET when bivrost listens somewhere else.
+func (s *Supervisor) SetEnv(env ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.env = append(s.env, env...)
+}
+
+// StartAll starts every module with a binary configured. Modules without one are expected to be started by hand.
+func (s *Supervisor) StartAll(modules map[string]Module) {
+	for _, m := range modules {
+		if m.Config == nil || m.Config.Exec.Binary == "" {
+			util.PrintDebug("Module " + m.Name + " has no binary, not supervising it")
+			continue
+		}
+		if err := s.Start(m); err != nil {
+			util.PrintError("Failed to start module " + m.Name + ": " + err.Error())
+		}
+	}
+}
+
+// Stop stops the module gracefully: SIGTERM, and SIGKILL if it's still running after the grace period
+func (s *Supervisor) Stop(name string) error {
+	s.mu.Lock()
+	p, ok := s.procs[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("module %s is %w", name, ErrNotSupervised)
+	}
+	p.shutdown()
+	return nil
+}
+
+// Remove stops the module, if it's supervised, and forgets about it
+func (s *Supervisor) Remove(name string) {
+	s.mu.Lock()
+	p, ok := s.procs[name]
+	delete(s.procs, name)
+	s.mu.Unlock()
+	if ok {
+		p.shutdown()
+	}
+}
+
+// StopAll stops every module, in parallel
+func (s *Supervisor) StopAll() {
+	s.mu.Lock()
+	procs := make([]*process, 0, len(s.procs))
+	for _, p := range s.procs {
+		procs = append(procs, p)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range procs {
+		wg.Add(1)
+		go func(p *process) {
+			defer wg.Done()
+			p.shutdown()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// Restart stops the module and starts it again
+func (s *Supervisor) Restart(name string) error {
+	s.mu.Lock()
+	p, ok := s.procs[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("module %s is %w", name, ErrNotSupervised)
+	}
+	p.shutdown()
+	return s.Start(p.module)
+}
+
+// Status returns the status of every supervised module, ordered by name
+func (s *Supervisor) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Status, 0, len(s.procs))
+	for _, p := range s.procs {
+		list = append(list, p.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Logs returns the latest output of the module
+func (s *Supervisor) Logs(name string) ([]LogLine, error) {
+	s.mu.Lock()
+	p, ok := s.procs[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("module %s is %w", name, ErrNotSupervised)
+	}
+	return p.logs.items(), nil
+}
+
+// Events returns the latest events of the module, such as sandbox violations
+func (s *Supervisor) Events(name string) ([]Event, error) {
+	s.mu.Lock()
+	p, ok := s.procs[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("module %s is %w", name, ErrNotSupervised)
+	}
+	return p.events.items(), nil
+}
+
+// process is a single supervised module
+type process struct {
+	module    Module
+	protected []string
+	env       []string
+	logs      *ring[LogLine]
+	events    *ring[Event]
+	sandbox   *SandboxConfig // Resolved sandbox configuration, nil if the module isn't sandboxed
+
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	state      string
+	restarts   int
+	startedAt  time.Time
+	lastExit   string
+	lastExitAt time.Time
+
+	stop     chan struct{} // Closed to stop supervising
+	stopOnce sync.Once
+	done     chan struct{} // Closed when supervise returns
+}
+
+func newProcess(m Module, protected, env []string) *process {
+	return &process{
+		module:    m,
+		protected: protected,
+		env:       env,
+		logs:      newRing[LogLine](logLines),
+		events:    newRing[Event](eventCount),
+		state:     STATE_STARTING,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// supervise runs the module, and restarts it with exponential backoff whenever it exits
+func (p *process) supervise() {
+	defer close(p.done)
+
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := p.run()
+
+		select {
+		case <-p.stop:
+			p.setState(STATE_STOPPED)
+			util.PrintInfo("Module " + p.module.Name + " stopped")
+			return
+		default:
+		}
+
+		if time.Since(started) > stableAfter {
+			backoff = minBackoff
+		}
+
+		p.mu.Lock()
+		p.lastExit = exitReason(err)
+		p.lastExitAt = time.Now()
+		p.state = STATE_BACKOFF
+		p.mu.Unlock()
+		util.PrintWarning(fmt.Sprintf("Module %s exited (%s), restarting in %s", p.module.Name, exitReason(err), backoff))
+
+		select {
+		case <-p.stop:
+			p.setState(STATE_STOPPED)
+			return
+		case <-time.After(backoff):
+		}
+
+		p.mu.Lock()
+		p.restarts++
+		p.mu.Unlock()
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// run starts the module and waits for it to exit
+func (p *process) run() error {
+	cmd, err := p.command()
+	if err != nil {
+		p.setState(STATE_FAILED)
+		return err
+	}
+	detach(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	select {
+	case <-p.stop: // Stopped while in backoff
+		p.mu.Unlock()
+		return nil
+	default:
+	}
+	if err := cmd.Start(); err != nil {
+		p.state = STATE_FAILED
+		p.mu.Unlock()
+		return err
+	}
+	p.cmd = cmd
+	p.state = STATE_RUNNING
+	p.startedAt = time.Now()
+	p.mu.Unlock()
+	util.PrintSuccess(fmt.Sprintf("Started module %s (pid %d)", p.module.Name, cmd.Process.Pid))
+
+	// The pipes must be drained before calling Wait
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go p.capture(stdout, "stdout", &wg)
+	go p.capture(stderr, "stderr", &wg)
+	wg.Wait()
+
+	err = cmd.Wait()
+	if v := violation(p.sandbox, err); v != "" {
+		p.event(EVENT_VIOLATION, v)
+	}
+
+	p.mu.Lock()
+	p.cmd = nil
+	p.mu.Unlock()
+	return err
+}
+
+// command builds the command for the module. Relative paths are relative to the module's config file.
+func (p *process) command() (*exec.Cmd, error) {
+	conf := p.module.Config.Exec
+	base, err := filepath.Abs(filepath.Dir(p.module.ConfigPath))
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(base, path)
+	}
+
+	cmd := exec.Command(resolve(conf.Binary), conf.Args...)
+	cmd.Dir = resolve(conf.Dir)
+	if cmd.Dir == "" {
+		cmd.Dir = base
+	}
+
+	// The module SDK finds its configuration through BIVROST_MODULE_CONFIG
+	configPath, err := filepath.Abs(p.module.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = append(inheritedEnv(os.Environ()), "BIVROST_MODULE_CONFIG="+configPath)
+	for k, v := range conf.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Env = append(cmd.Env, p.env...)
+
+	if p.module.Config.Sandbox == nil {
+		return cmd, nil
+	}
+	sb := *p.module.Config.Sandbox
+	if sb.Seccomp == "" {
+		sb.Seccomp = SECCOMP_DEFAULT
+	}
+	sb.Writable = nil
+	for _, path := range p.module.Config.Sandbox.Writable {
+		sb.Writable = append(sb.Writable, resolve(path))
+	}
+	sb.Hidden = append([]string(nil), p.protected...)
+	for _, path := range p.module.Config.Sandbox.Hidden {
+		sb.Hidden = append(sb.Hidden, resolve(path))
+	}
+	if err := sb.validate(); err != nil {
+		return nil, err
+	}
+
+	notes, err := sandbox(cmd, sb)
+	if err != nil {
+		return nil, err
+	}
+	for _, note := range notes {
+		p.event(EVENT_SANDBOX, note)
+	}
+	p.sandbox = &sb
+	return cmd, nil
+}
+
+// inheritedVars are the variables of bivrost's environment passed on to modules, with the LC_* ones.
+// The rest stay with bivrost, such as the signing keys in BIVROST_JWT_KEYS.
+// Modules needing more get them from the env of their manifest.
+var inheritedVars = map[string]bool{
+	"PATH": true, "HOME": true, "USER": true, "LOGNAME": true, "SHELL": true, "TERM": true,
+	"LANG": true, "LANGUAGE": true, "TZ": true, "TMPDIR": true,
+	"SSL_CERT_FILE": true, "SSL_CERT_DIR": true,
+	"BIVROST_SOCKET": true, "BIVROST_ADDRESS": true,
+}
+
+// inheritedEnv keeps the variables of environ, as KEY=value, that modules may see
+func inheritedEnv(environ []string) []string {
+	var env []string
+	for _, kv := range environ {
+		key, _, _ := strings.Cut(kv, "=")
+		if inheritedVars[key] || strings.HasPrefix(key, "LC_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// capture writes every line of output to bivrost's log, and keeps it for the API
+func (p *process) capture(r io.Reader, stream string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		p.logs.add(LogLine{Time: time.Now(), Stream: stream, Text: line})
+		fmt.Printf("[%s|%s] %s\n", p.module.Name, stream, line)
+
+		if stream != "stderr" || p.sandbox == nil {
+			continue
+		}
+		if note, ok := strings.CutPrefix(line, sandboxEventPrefix); ok {
+			p.event(EVENT_SANDBOX, note)
+		} else if mb := p.sandbox.Rlimits.MemoryMB; mb > 0 && strings.Contains(strings.ToLower(line), "out of memory") {
+			p.event(EVENT_VIOLATION, fmt.Sprintf("ran out of memory, the limit is %d MB", mb))
+		}
+	}
+}
+
+// event records an event for the module
+func (p *process) event(eventType, message string) {
+	p.events.add(Event{Time: time.Now(), Type: eventType, Message: message})
+	util.PrintWarning(fmt.Sprintf("Module %s: %s: %s", p.module.Name, eventType, message))
+}
+
+// shutdown stops supervising, and stops the module if it's running
+func (p *process) shutdown() {
+	p.stopOnce.Do(func() { close(p.stop) })
+
+	p.mu.Lock()
+	cmd := p.cmd
+	if cmd != nil {
+		p.state = STATE_STOPPING
+	}
+	p.mu.Unlock()
+
+	if cmd != nil {
+		util.PrintInfo("Stopping module " + p.module.Name + "...")
+		signalGroup(cmd, syscall.SIGTERM)
+	}
+
+	grace := defaultStopGrace
+	if g := p.module.Config.Exec.StopGrace; g > 0 {
+		grace = time.Duration(g) * time.Second
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(grace):
+		util.PrintWarning("Module " + p.module.Name + " did not stop within " + grace.String() + ", killing it")
+		if cmd != nil {
+			signalGroup(cmd, syscall.SIGKILL)
+		}
+		<-p.done
+	}
+}
+
+func (p *process) finished() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *process) setState(state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = state
+}
+
+func (p *process) status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := Status{
+		Name:       p.module.Name,
+		State:      p.state,
+		Restarts:   p.restarts,
+		Sandboxed:  p.module.Config.Sandbox != nil,
+		LastExit:   p.lastExit,
+		LastExitAt: p.lastExitAt,
+	}
+	if p.cmd != nil && p.cmd.Process != nil {
+		s.PID = p.cmd.Process.Pid
+		s.StartedAt = p.startedAt
+	}
+	return s
+}
+
+func exitReason(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// ring keeps the last n items, ex: lines of output
+type ring[T any] struct {
+	mu   sync.Mutex
+	buf  []T
+	next int
+	full bool
+}
+
+func newRing[T any](n int) *ring[T] {
+	return &ring[T]{buf: make([]T, n)}
+}
+
+func (r *ring[T]) add(item T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = item
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// items returns the kept items, oldest first
+func (r *ring[T]) items() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]T(nil), r.buf[:r.next]...)
+	}
+	return append(append([]T(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
@@ -0,0 +1,192 @@
+package modules
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInheritedEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		want    []string
+	}{
+		{"system", []string{"PATH=/usr/bin", "HOME=/root", "LC_ALL=C"}, []string{"PATH=/usr/bin", "HOME=/root", "LC_ALL=C"}},
+		{"signing keys", []string{"BIVROST_JWT_KEYS={}", "BIVROST_JWT_KEY_FILE=/etc/bivrost/keys.json"}, nil},
+		{"api token", []string{"BIVROST_TOKEN=secret"}, nil},
+		{"anything else", []string{"AWS_SECRET_ACCESS_KEY=secret", "PATHS=/x"}, nil},
+		{"socket", []string{"BIVROST_SOCKET=/run/bivrost.sock"}, []string{"BIVROST_SOCKET=/run/bivrost.sock"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inheritedEnv(tt.environ); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("inheritedEnv(%q) = %q, want %q", tt.environ, got, tt.want)
+			}
+		})
+	}
+}
+
+// Modules started by the supervisor must not see the signing keys
+func TestCommandEnv(t *testing.T) {
+	t.Setenv("BIVROST_JWT_KEYS", `{"active":"x"}`)
+	p := newProcess(Module{Name: "test", ConfigPath: "/tmp/config.yaml", Config: &ModuleConfig{}}, nil, []string{"EXTRA=1"})
+	p.module.Config.Exec.Binary = "/bin/true"
+	p.module.Config.Exec.Env = map[string]string{"FROM_MANIFEST": "1"}
+	cmd, err := p.command()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]bool{}
+	for _, kv := range cmd.Env {
+		env[kv] = true
+	}
+	for _, kv := range []string{"BIVROST_MODULE_CONFIG=/tmp/config.yaml", "FROM_MANIFEST=1", "EXTRA=1"} {
+		if !env[kv] {
+			t.Errorf("%s is missing from %q", kv, cmd.Env)
+		}
+	}
+	if env[`BIVROST_JWT_KEYS={"active":"x"}`] {
+		t.Errorf("the signing keys were passed to the module: %q", cmd.Env)
+	}
+}
+
+// shModule returns a module running the shell script, stopped when the test ends
+func shModule(t *testing.T, s *Supervisor, name, script string, stopGrace int) Module {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run modules with")
+	}
+	m := Module{Name: name, ConfigPath: filepath.Join(t.TempDir(), "config.yaml"), Config: &ModuleConfig{}}
+	m.Config.Exec.Binary = sh
+	m.Config.Exec.Args = []string{"-c", script}
+	m.Config.Exec.StopGrace = stopGrace
+	t.Cleanup(func() { s.Remove(name) })
+	return m
+}
+
+// eventually fails the test if cond isn't true within a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// status returns the status of the supervised module
+func status(s *Supervisor, name string) Status {
+	for _, st := range s.Status() {
+		if st.Name == name {
+			return st
+		}
+	}
+	return Status{}
+}
+
+func TestSupervisor(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		stopGrace int
+		check     func(t *testing.T, s *Supervisor, name string)
+	}{
+		{
+			name:   "output is captured",
+			script: "echo hello; echo oops >&2; exec sleep 60",
+			check: func(t *testing.T, s *Supervisor, name string) {
+				want := map[string]bool{"stdout hello": true, "stderr oops": true}
+				eventually(t, "the output", func() bool {
+					logs, _ := s.Logs(name)
+					found := 0
+					for _, line := range logs {
+						if want[line.Stream+" "+line.Text] {
+							found++
+						}
+					}
+					return found == len(want)
+				})
+				if st := status(s, name); st.State != STATE_RUNNING || st.PID == 0 {
+					t.Errorf("module is %s with pid %d, want it running", st.State, st.PID)
+				}
+			},
+		},
+		{
+			name:   "crashed module is restarted",
+			script: "exit 3",
+			check: func(t *testing.T, s *Supervisor, name string) {
+				eventually(t, "a restart", func() bool { return status(s, name).Restarts > 0 })
+				if st := status(s, name); st.LastExit != "exit status 3" {
+					t.Errorf("last exit is %q, want %q", st.LastExit, "exit status 3")
+				}
+			},
+		},
+		{
+			name:      "module ignoring SIGTERM is killed after the grace period",
+			script:    "trap '' TERM; echo ready; while :; do sleep 1; done",
+			stopGrace: 1,
+			check: func(t *testing.T, s *Supervisor, name string) {
+				eventually(t, "the module to start", func() bool {
+					logs, _ := s.Logs(name)
+					return len(logs) > 0
+				})
+				started := time.Now()
+				if err := s.Stop(name); err != nil {
+					t.Fatal(err)
+				}
+				if waited := time.Since(started); waited < time.Second {
+					t.Errorf("stopped after %s, before the grace period", waited)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSupervisor()
+			name := strings.ReplaceAll(tt.name, " ", "-")
+			if err := s.Start(shModule(t, s, name, tt.script, tt.stopGrace)); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, s, name)
+
+			if err := s.Stop(name); err != nil {
+				t.Fatal(err)
+			}
+			if st := status(s, name); st.State != STATE_STOPPED || st.PID != 0 {
+				t.Errorf("module is %s with pid %d after Stop, want it stopped", st.State, st.PID)
+			}
+		})
+	}
+}
+
+func TestSupervisorErrors(t *testing.T) {
+	s := NewSupervisor()
+	running := shModule(t, s, "running", "exec sleep 60", 0)
+	if err := s.Start(running); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"started twice", func() error { return s.Start(running) }, ErrAlreadyRunning},
+		{"no binary", func() error { return s.Start(Module{Name: "manual", Config: &ModuleConfig{}}) }, ErrNoBinary},
+		{"stopping an unknown module", func() error { return s.Stop("unknown") }, ErrNotSupervised},
+		{"restarting an unknown module", func() error { return s.Restart("unknown") }, ErrNotSupervised},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
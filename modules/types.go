@@ -1,5 +1,7 @@
 package modules
 
+import "github.com/pynezz/bivrost/internal/database/models"
+
 // Module represents a module
 type Module struct {
 	Name        string `json:"name"`
@@ -8,10 +10,31 @@ type Module struct {
 	Config      *ModuleConfig
 }
 
+// ModuleConfig is a module's manifest (config.yaml). See ParseManifest for how it's validated
 type ModuleConfig struct {
-	Name       string `yaml:"name"`
-	Identifier string `yaml:"identifier"`
-	Database   struct {
+	Name            string   `yaml:"name"`             // Required
+	Identifier      string   `yaml:"identifier"`       // Required, 4 characters, unique
+	ProtocolVersion int      `yaml:"protocol_version"` // Required, the IPC protocol version the module speaks (ipc.PROTOCOL_VERSION)
+	Tables          []string `yaml:"tables,omitempty"` // Tables the module reads from or writes to
+
+	// Result tables owned by the module, created and migrated by bivrost when the module connects
+	Schemas []models.TableSchema `yaml:"schemas,omitempty"`
+
+	// Topics of the event bus. Subscriptions are made when the module connects, and events published
+	// while it's down are delivered once it's back. Publish restricts the topics the module may publish on,
+	// anything goes if it's empty. Both take patterns, see ipc/events.go
+	Events struct {
+		Publish   []string `yaml:"publish,omitempty"`
+		Subscribe []string `yaml:"subscribe,omitempty"`
+	} `yaml:"events,omitempty"`
+
+	// The bivrost versions the module works with. Either can be left out
+	Bivrost struct {
+		MinVersion string `yaml:"min_version,omitempty"`
+		MaxVersion string `yaml:"max_version,omitempty"`
+	} `yaml:"bivrost,omitempty"`
+
+	Database struct {
 		Path string `yaml:"path"`
 	} `yaml:"database,omitempty"`
 	DataSources []struct {
@@ -20,21 +43,18 @@ type ModuleConfig struct {
 		Location string `yaml:"location"`
 		Format   string `yaml:"format,omitempty"`
 	} `yaml:"data_sources,omitempty"`
-}
 
-// This have become grossly overcomplicated. Just use a simple struct instead in the future.
-// Ex:
-// type MID struct {
-// 	StrID      string
-// 	Identifier []byte
-// }
-// var MODULEIDENTIFIERS map[string]MID
-//
-// MODULEIDENTIFIERS is a map of module names to their identifiers
-var MODULEIDENTIFIERS map[string][4]byte
-
-func init() {
-	MODULEIDENTIFIERS = make(map[string][4]byte)
-}
+	// How bivrost runs the module. Modules without a binary are not supervised, and must be started by hand.
+	Exec struct {
+		Binary    string            `yaml:"binary"`                // Path to the module binary, relative to this file
+		Args      []string          `yaml:"args,omitempty"`        // Command line arguments
+		Env       map[string]string `yaml:"env,omitempty"`         // Added to bivrost's environment
+		Dir       string            `yaml:"working_dir,omitempty"` // Defaults to the directory of this file
+		StopGrace int               `yaml:"stop_grace,omitempty"`  // Seconds between SIGTERM and SIGKILL, defaults to 10
+	} `yaml:"exec,omitempty"`
 
-type ModuleIdentifiers map[string][4]byte
+	// Restrictions for the module process. See SandboxConfig
+	Sandbox *SandboxConfig `yaml:"sandbox,omitempty"`
+
+	identifierLine int // For reporting duplicate identifiers
+}
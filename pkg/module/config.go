@@ -0,0 +1,78 @@
+package module
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables overriding the module's config.yaml
+const (
+	ENV_CONFIG     = "BIVROST_MODULE_CONFIG" // Path to the module's config.yaml
+	ENV_NAME       = "BIVROST_MODULE_NAME"
+	ENV_IDENTIFIER = "BIVROST_MODULE_IDENTIFIER"
+	ENV_SOCKET     = "BIVROST_SOCKET"  // Path to bivrost's UNIX domain socket
+	ENV_ADDRESS    = "BIVROST_ADDRESS" // host:port of bivrost's TLS listener
+	ENV_TLS_CERT   = "BIVROST_TLS_CERT"
+	ENV_TLS_KEY    = "BIVROST_TLS_KEY"
+	ENV_TLS_CA     = "BIVROST_TLS_CA"
+)
+
+// Config is the part of a module's config.yaml the SDK cares about.
+// Everything else in the file is left to the module.
+//
+// Ex:
+//
+//	name: Threat Intel
+//	identifier: THRI
+//	ipc:
+//	  socket: /tmp/bivrost/bivrost.sock
+type Config struct {
+	Name       string `yaml:"name"`
+	Identifier string `yaml:"identifier"` // 4 characters
+	IPC        struct {
+		Socket  string `yaml:"socket,omitempty"`  // Defaults to /tmp/bivrost/bivrost.sock
+		Address string `yaml:"address,omitempty"` // Connect over TCP with mutual TLS instead of the socket
+		TLS     struct {
+			Cert       string `yaml:"cert,omitempty"`
+			Key        string `yaml:"key,omitempty"`
+			CA         string `yaml:"ca,omitempty"`
+			ServerName string `yaml:"server_name,omitempty"`
+		} `yaml:"tls,omitempty"`
+	} `yaml:"ipc,omitempty"`
+}
+
+// LoadConfig reads the module configuration from path, and applies the environment overrides.
+// If path is empty, it is taken from BIVROST_MODULE_CONFIG. If that is empty too, only the environment is used.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+
+	if path == "" {
+		path = os.Getenv(ENV_CONFIG)
+	}
+	if path != "" {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read the module config: %w", err)
+		}
+		if err := yaml.Unmarshal(buf, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse the module config %s: %w", path, err)
+		}
+	}
+
+	override := func(field *string, env string) {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+	override(&cfg.Name, ENV_NAME)
+	override(&cfg.Identifier, ENV_IDENTIFIER)
+	override(&cfg.IPC.Socket, ENV_SOCKET)
+	override(&cfg.IPC.Address, ENV_ADDRESS)
+	override(&cfg.IPC.TLS.Cert, ENV_TLS_CERT)
+	override(&cfg.IPC.TLS.Key, ENV_TLS_KEY)
+	override(&cfg.IPC.TLS.CA, ENV_TLS_CA)
+
+	return cfg, nil
+}
@@ -0,0 +1,253 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+// The rows of the built in tables, as bivrost sends and expects them as JSON. They mirror the models
+// bivrost stores them with, without depending on its database
+
+// Record are the columns bivrost keeps for the rows of most tables. They are set when a row is inserted
+type Record struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time
+}
+
+// NginxLog is a line of the nginx access log, the input of most modules
+type NginxLog struct {
+	Record
+	TimeLocal     string `json:"time_local"`
+	RemoteAddr    string `json:"remote_addr"`
+	RemoteUser    string `json:"remote_user"`
+	Request       string `json:"request"`
+	Status        string `json:"status"`
+	BodyBytesSent string `json:"body_bytes_sent"`
+	RequestTime   string `json:"request_time"`
+	HttpReferer   string `json:"http_referrer"`
+	HttpUserAgent string `json:"http_user_agent"`
+	RequestBody   string `json:"request_body"`
+}
+
+// SynTraffic is a SYN flood seen by a module
+type SynTraffic struct {
+	Record
+	Description    string `json:"description"`
+	Source         string `json:"source"`
+	FirstTimestamp string `json:"first_timestamp"`
+	LastTimestamp  string `json:"last_timestamp"`
+	Count          int    `json:"count"`
+	Status         string `json:"status"`
+	Recommendation string `json:"recommendation"`
+}
+
+// AttackType is an attack found by a module, such as in the logs
+type AttackType struct {
+	Record
+	Description    string `json:"description"`
+	Source         string `json:"source"`
+	Count          int    `json:"count"`
+	Severity       string `json:"severity"`
+	Threshold      string `json:"threshold"`
+	FirstTimestamp string `json:"first_timestamp"`
+	LastTimestamp  string `json:"last_timestamp"`
+	Status         string `json:"status"`
+	Recommendation string `json:"recommendation"`
+	RequestPath    string `json:"request_path"`
+	UserAgent      string `json:"user_agent"`
+	Payload        string `json:"payload"`
+}
+
+// IndicatorsLog is what threat intelligence feeds say about an IP
+type IndicatorsLog struct {
+	Source              string `json:"ip"`
+	AbuseIPDBMalicious  bool   `json:"abuseipdb_blacklisted"`
+	AlienVaultMalicious bool   `json:"alien_vault_blacklisted"`
+	ThreatFoxMalicious  bool   `json:"threat_fox_blacklisted"`
+	Timestamp           string `json:"timestamp"`
+}
+
+// GeoLocationData is where an IP is located
+type GeoLocationData struct {
+	Record
+	Query       string
+	Country     string
+	CountryCode string
+	RegionName  string
+	Lat         float64
+	Lon         float64
+	Message     string
+}
+
+// GeoData ties a source to its location
+type GeoData struct {
+	Record
+	Source            string
+	GeoLocationDataID uint
+	GeoLocationData   GeoLocationData
+}
+
+// ThreatRecord is a threat found by a module
+type ThreatRecord struct {
+	Record
+	Description string
+	Source      string
+	Timestamp   string
+	Status      string
+	Severity    string
+	File        string
+}
+
+// Model is any of the tables above
+type Model interface {
+	NginxLog | SynTraffic | AttackType | IndicatorsLog | GeoLocationData | GeoData | ThreatRecord
+}
+
+// TableName returns the name of the table holding T
+func TableName[T Model]() string {
+	var t T
+	switch any(t).(type) {
+	case NginxLog:
+		return "nginx_logs"
+	case SynTraffic:
+		return "syn_traffics"
+	case AttackType:
+		return "attack_types"
+	case IndicatorsLog:
+		return "indicators_logs"
+	case GeoLocationData:
+		return "geo_location_data"
+	case GeoData:
+		return "geo_data"
+	default:
+		return "threat_records"
+	}
+}
+
+// request is the JSON body of a GET or POST message
+type request struct {
+	Metadata wire.Metadata `json:"metadata"`
+	Data     any           `json:"data,omitempty"`
+}
+
+func (c *Client) request(method, table string, data any) ([]byte, error) {
+	return json.Marshal(request{
+		Metadata: wire.Metadata{
+			Source: c.opts.Name,
+			Method: method,
+			Destination: wire.Destination{
+				Object: wire.Object{
+					Id:       c.opts.Identifier,
+					Name:     c.opts.Name,
+					Database: wire.Database{Table: table},
+				},
+			},
+		},
+		Data: data,
+	})
+}
+
+// Get returns the rows of T's table that were added since the last Get
+func Get[T Model](ctx context.Context, c *Client) ([]T, error) {
+	body, err := c.request("GET", TableName[T](), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Call(ctx, MSG_MSG, DATA_JSON, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []T
+	if err := json.Unmarshal(res.Message.Data, &rows); err != nil {
+		return nil, fmt.Errorf("unexpected response from bivrost: %w", err)
+	}
+	return rows, nil
+}
+
+// Post inserts the rows into T's table
+func Post[T Model](ctx context.Context, c *Client, rows []T) error {
+	body, err := c.request("POST", TableName[T](), rows)
+	if err != nil {
+		return err
+	}
+	_, err = c.Call(ctx, MSG_MSG, DATA_JSON, body)
+	return err
+}
+
+// TableSchema is a result table owned by the module, see Options.Schemas.
+// Bivrost stores table "detections" of module THRI as mod_thri_detections
+type TableSchema struct {
+	Name    string        `yaml:"name" json:"name"`
+	Fields  []FieldSchema `yaml:"fields" json:"fields"`
+	Indexes []IndexSchema `yaml:"indexes,omitempty" json:"indexes,omitempty"`
+}
+
+// FieldSchema is a column of a module table. Every table also gets an id and a created_at column.
+type FieldSchema struct {
+	Name     string `yaml:"name" json:"name"`
+	Type     string `yaml:"type" json:"type"` // One of the FIELD_ types
+	Required bool   `yaml:"required,omitempty" json:"required,omitempty"`
+}
+
+// IndexSchema is an index over one or more fields
+type IndexSchema struct {
+	Fields []string `yaml:"fields" json:"fields"`
+	Unique bool     `yaml:"unique,omitempty" json:"unique,omitempty"`
+}
+
+// Field types of a TableSchema
+const (
+	FIELD_STRING = "string"
+	FIELD_INT    = "int"
+	FIELD_FLOAT  = "float"
+	FIELD_BOOL   = "bool"
+	FIELD_TIME   = "time" // RFC 3339
+	FIELD_JSON   = "json" // Any JSON value, stored as text
+)
+
+// PostRows inserts the rows into one of the module's own tables, declared with a TableSchema.
+// Rows are encoded as JSON objects, with keys matching the schema's field names.
+func PostRows[T any](ctx context.Context, c *Client, table string, rows []T) error {
+	body, err := c.request("POST", table, rows)
+	if err != nil {
+		return err
+	}
+	_, err = c.Call(ctx, MSG_MSG, DATA_JSON, body)
+	return err
+}
+
+// Subscribe calls handler with the new rows of T's table every interval, until the context is done
+// or the handler returns an error. Failed polls are logged and retried at the next interval.
+func Subscribe[T Model](ctx context.Context, c *Client, interval time.Duration, handler func([]T) error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		rows, err := Get[T](ctx, c)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err == ErrClosed:
+			return err
+		case err != nil:
+			c.log.Error("subscription poll failed", "table", TableName[T](), "error", err)
+		case len(rows) > 0:
+			if err := handler(rows); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package module
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/pynezz/bivrost/internal/database/models"
+)
+
+// jsonKeys returns the keys of v encoded as a JSON object, with nested objects under their key
+func jsonKeys(t *testing.T, v any) map[string]any {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]any, len(decoded))
+	for key, value := range decoded {
+		if nested, ok := value.(map[string]any); ok {
+			keys[key] = jsonKeys(t, nested)
+			continue
+		}
+		keys[key] = nil
+	}
+	return keys
+}
+
+// The tables of the SDK must encode like the models bivrost stores them with
+func TestTablesMatchModels(t *testing.T) {
+	tests := []struct {
+		table string
+		sdk   any
+		model any
+	}{
+		{TableName[NginxLog](), NginxLog{}, models.NginxLog{}},
+		{TableName[SynTraffic](), SynTraffic{}, models.SynTraffic{}},
+		{TableName[AttackType](), AttackType{}, models.AttackType{}},
+		{TableName[IndicatorsLog](), IndicatorsLog{}, models.IndicatorsLog{}},
+		{TableName[GeoLocationData](), GeoLocationData{}, models.GeoLocationData{}},
+		{TableName[GeoData](), GeoData{}, models.GeoData{}},
+		{TableName[ThreatRecord](), ThreatRecord{}, models.ThreatRecord{}},
+	}
+	tables := map[string]bool{}
+	for _, tt := range tests {
+		if !models.IsTable(tt.table) {
+			t.Errorf("%T: unknown table %q", tt.sdk, tt.table)
+		}
+		tables[tt.table] = true
+		if got, want := jsonKeys(t, tt.sdk), jsonKeys(t, tt.model); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T encodes as %v, bivrost expects %v", tt.sdk, got, want)
+		}
+	}
+	if len(tables) != len(models.TableNames()) {
+		t.Errorf("the SDK has %d tables, bivrost has %d", len(tables), len(models.TableNames()))
+	}
+
+	if got, want := jsonKeys(t, TableSchema{Fields: []FieldSchema{{}}, Indexes: []IndexSchema{{}}}.model()),
+		jsonKeys(t, models.TableSchema{Fields: []models.FieldSchema{{}}, Indexes: []models.IndexSchema{{}}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("TableSchema encodes as %v, bivrost expects %v", got, want)
+	}
+}
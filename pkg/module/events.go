@@ -0,0 +1,170 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+// Event is an event published by a module, see HandleEvents
+type Event = wire.Event
+
+// Events waiting for a busy handler. Events that don't fit are delivered again by bivrost later
+const eventBuffer = 64
+
+// eventRequest is the JSON body of a PUBLISH, SUBSCRIBE or UNSUBSCRIBE message
+func (c *Client) eventRequest(method, topic string, payload any) ([]byte, error) {
+	return json.Marshal(request{
+		Metadata: wire.Metadata{
+			Source: c.opts.Name,
+			Method: method,
+			Topic:  topic,
+		},
+		Data: payload,
+	})
+}
+
+// Publish sends the payload, encoded as JSON, to every module subscribed to the topic, ex: finding.attack.
+// Returns the ID of the event.
+func Publish(ctx context.Context, c *Client, topic string, payload any) (uint64, error) {
+	body, err := c.eventRequest(wire.METHOD_PUBLISH, topic, payload)
+	if err != nil {
+		return 0, err
+	}
+	res, err := c.Call(ctx, MSG_MSG, DATA_JSON, body)
+	if err != nil {
+		return 0, err
+	}
+	var published wire.Published
+	if err := json.Unmarshal(res.Message.Data, &published); err != nil {
+		return 0, fmt.Errorf("unexpected response from bivrost: %w", err)
+	}
+	return published.ID, nil
+}
+
+// HandleEvents subscribes to the topics matching the pattern (ex: ioc.* or finding.>), and calls handler
+// with every event until the context is done. An event is acknowledged when the handler returns nil.
+// Otherwise, or when the handler takes longer than bivrost's ack timeout, it's delivered again,
+// so handlers must cope with seeing the same event twice.
+//
+// The subscription outlives the call: events published while the module isn't handling them are
+// kept by bivrost until it does, or until Unsubscribe.
+func HandleEvents(ctx context.Context, c *Client, pattern string, handler func(context.Context, Event) error) error {
+	if err := wire.ValidatePattern(pattern); err != nil {
+		return err
+	}
+	events := make(chan Event, eventBuffer)
+	c.mu.Lock()
+	if _, ok := c.handlers[pattern]; ok {
+		c.mu.Unlock()
+		return fmt.Errorf("events on %s are already being handled", pattern)
+	}
+	c.handlers[pattern] = events
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.handlers, pattern)
+		c.mu.Unlock()
+	}()
+
+	if err := c.subscribe(ctx, pattern); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closed:
+			return ErrClosed
+		case e := <-events:
+			if err := handler(ctx, e); err != nil {
+				c.log.Error("event handler failed, the event will be delivered again", "topic", e.Topic, "id", e.ID, "error", err)
+				continue
+			}
+			c.ack(e)
+		}
+	}
+}
+
+// Unsubscribe removes the module's subscription to the pattern, and drops the events queued for it
+func Unsubscribe(ctx context.Context, c *Client, pattern string) error {
+	body, err := c.eventRequest(wire.METHOD_UNSUBSCRIBE, pattern, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.Call(ctx, MSG_MSG, DATA_JSON, body)
+	return err
+}
+
+func (c *Client) subscribe(ctx context.Context, pattern string) error {
+	body, err := c.eventRequest(wire.METHOD_SUBSCRIBE, pattern, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.Call(ctx, MSG_MSG, DATA_JSON, body)
+	return err
+}
+
+// resubscribe renews the subscriptions being handled on a new connection, in case bivrost lost them in a restart
+func (c *Client) resubscribe(ctx context.Context, s *session) error {
+	c.mu.Lock()
+	patterns := make([]string, 0, len(c.handlers))
+	for pattern := range c.handlers {
+		patterns = append(patterns, pattern)
+	}
+	c.mu.Unlock()
+
+	for _, pattern := range patterns {
+		body, err := c.eventRequest(wire.METHOD_SUBSCRIBE, pattern, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := s.call(ctx, s.newRequest(wire.MSG_MSG, wire.DATA_JSON, body)); err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// dispatch hands an event from bivrost over to the handler of its subscription
+func (c *Client) dispatch(msg Message) {
+	var e Event
+	if err := json.Unmarshal(msg.Message.Data, &e); err != nil {
+		c.log.Error("invalid event from bivrost", "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	events, ok := c.handlers[e.Subscription]
+	c.mu.Unlock()
+	if !ok {
+		c.log.Debug("no handler for event, it will be delivered again", "subscription", e.Subscription, "id", e.ID)
+		return
+	}
+	select {
+	case events <- e:
+	default:
+		c.log.Debug("event handler is busy, the event will be delivered again", "subscription", e.Subscription, "id", e.ID)
+	}
+}
+
+// ack tells bivrost the event was handled. Lost acknowledgements only cause a redelivery
+func (c *Client) ack(e Event) {
+	c.mu.Lock()
+	s := c.session
+	c.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	data, err := json.Marshal(wire.EventAck{Subscription: e.Subscription, ID: e.ID})
+	if err != nil {
+		return
+	}
+	if err := s.send(s.newRequest(wire.MSG_EVENTACK, wire.DATA_JSON, data)); err != nil {
+		c.log.Debug("failed to acknowledge event", "id", e.ID, "error", err)
+	}
+}
@@ -0,0 +1,350 @@
+/*
+Package module is the SDK for writing bivrost modules in Go.
+
+A module connects to bivrost over its UNIX domain socket (or over TCP with mutual TLS when running on
+another host), reads data from bivrost's tables, and posts its results back:
+
+	client, err := module.Connect(ctx, module.Options{ConfigPath: "config.yaml"})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	logs, err := module.Get[module.NginxLog](ctx, client)
+	...
+	err = module.Post(ctx, client, []module.ThreatRecord{...})
+
+Modules can also talk to each other through bivrost's event bus, see Publish and HandleEvents:
+
+	_, err = module.Publish(ctx, client, "finding.attack", finding)
+	...
+	err = module.HandleEvents(ctx, client, "ioc.*", func(ctx context.Context, e module.Event) error { ... })
+
+The connection is re-established with exponential backoff if bivrost restarts.
+*/
+package module
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+// Message is a raw IPC message
+type Message = wire.IPCRequest
+
+// Error is returned when bivrost fails to handle a request. Check the code with errors.As:
+//
+//	var e *module.Error
+//	if errors.As(err, &e) && e.Code == module.ERR_UNKNOWN_TABLE { ... }
+type Error = wire.Error
+
+// Error codes, see Error
+const (
+	ERR_CHECKSUM      = wire.ERR_CHECKSUM
+	ERR_UNKNOWN_TABLE = wire.ERR_UNKNOWN_TABLE
+	ERR_FORBIDDEN     = wire.ERR_FORBIDDEN
+	ERR_DECODE        = wire.ERR_DECODE
+	ERR_INTERNAL      = wire.ERR_INTERNAL
+	ERR_SCHEMA        = wire.ERR_SCHEMA
+	ERR_TOO_LARGE     = wire.ERR_TOO_LARGE
+)
+
+// DataType tells how the data of a Message is encoded, see Call
+type DataType = wire.DataType
+
+// Data types of a Message
+const (
+	DATA_TEXT DataType = wire.DATA_TEXT
+	DATA_INT  DataType = wire.DATA_INT
+	DATA_JSON DataType = wire.DATA_JSON
+	DATA_YAML DataType = wire.DATA_YAML
+	DATA_BIN  DataType = wire.DATA_BIN
+)
+
+// Message types that may be sent with Call. The rest are handled by the Client
+const (
+	MSG_MSG   byte = wire.MSG_MSG // A request, answered by MSG_ACK or MSG_ERROR
+	MSG_ACK   byte = wire.MSG_ACK
+	MSG_ERROR byte = wire.MSG_ERROR
+)
+
+var (
+	// ErrDisconnected is returned by requests in flight when the connection to bivrost is lost
+	ErrDisconnected = errors.New("disconnected from bivrost")
+	// ErrClosed is returned when the client has been closed
+	ErrClosed = errors.New("module client closed")
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+	dialTimeout       = 10 * time.Second
+)
+
+// Options configure Connect. Anything left empty is read from the module's config.yaml (see LoadConfig).
+type Options struct {
+	ConfigPath string // Path to the module's config.yaml. Defaults to $BIVROST_MODULE_CONFIG
+
+	Name       string // Name of the module
+	Identifier string // 4 character identifier of the module
+	Socket     string // Path to bivrost's UNIX domain socket
+	Address    string // host:port of bivrost's TLS listener. Requires TLS
+	TLS        *tls.Config
+
+	Logger *slog.Logger // Defaults to discarding everything
+
+	// Result tables owned by the module, in addition to the schemas in its config.yaml.
+	// Bivrost creates or migrates them on every connect. Insert rows with PostRows
+	Schemas []TableSchema
+
+	DisableReconnect bool          // Give up when the connection is lost, instead of reconnecting
+	MinBackoff       time.Duration // First delay between reconnect attempts, defaults to 500ms
+	MaxBackoff       time.Duration // Longest delay between reconnect attempts, defaults to 30s
+
+	OnConnect    func()          // Called every time the connection is (re-)established
+	OnDisconnect func(err error) // Called every time the connection is lost
+	OnMessage    func(m Message) // Called for messages from bivrost that don't answer a request
+}
+
+// Client is a module's connection to bivrost. It is safe for concurrent use.
+type Client struct {
+	opts       Options
+	log        *slog.Logger
+	identifier [4]byte
+
+	mu       sync.Mutex
+	session  *session              // Current connection, nil while reconnecting
+	ready    chan struct{}         // Closed when session is set
+	closed   chan struct{}         // Closed by Close
+	handlers map[string]chan Event // Events waiting for HandleEvents, keyed by subscription pattern
+}
+
+// Connect loads the module configuration, connects to bivrost and completes the handshake.
+// The context bounds the first connection attempt only.
+func Connect(ctx context.Context, opts Options) (*Client, error) {
+	if err := resolveOptions(&opts); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		opts:   opts,
+		log:    opts.Logger,
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+
+		handlers: make(map[string]chan Event),
+	}
+	copy(c.identifier[:], opts.Identifier)
+
+	s, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.setSession(s)
+	return c, nil
+}
+
+// resolveOptions fills in the options from the module's config.yaml and the environment
+func resolveOptions(opts *Options) error {
+	cfg, err := LoadConfig(opts.ConfigPath)
+	if err != nil {
+		return err
+	}
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&opts.Name, cfg.Name)
+	fill(&opts.Identifier, cfg.Identifier)
+	fill(&opts.Socket, cfg.IPC.Socket)
+	fill(&opts.Address, cfg.IPC.Address)
+	fill(&opts.Socket, ipc.DefaultSock("bivrost"))
+
+	if len(opts.Identifier) != 4 {
+		return fmt.Errorf("module identifier must be 4 characters, got %q", opts.Identifier)
+	}
+	if opts.Address != "" && opts.TLS == nil {
+		if cfg.IPC.TLS.Cert == "" {
+			return fmt.Errorf("connecting to %s requires a TLS configuration", opts.Address)
+		}
+		opts.TLS, err = ipc.ClientTLSConfig(cfg.IPC.TLS.Cert, cfg.IPC.TLS.Key, cfg.IPC.TLS.CA, cfg.IPC.TLS.ServerName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	opts.Logger = opts.Logger.With("module", opts.Name, "identifier", opts.Identifier)
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	return nil
+}
+
+// dial opens a new connection and completes the handshake
+func (c *Client) dial(ctx context.Context) (*session, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	var conn net.Conn
+	var err error
+	if c.opts.Address != "" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.opts.TLS}).DialContext(ctx, ipc.Network, c.opts.Address)
+	} else {
+		conn, err = dialer.DialContext(ctx, ipc.AF_UNIX, c.opts.Socket)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSession(conn, c.identifier, c.log, c.opts.OnMessage, c.dispatch)
+	if err := s.handshake(ctx, c.opts.Name, c.opts.Schemas); err != nil {
+		s.close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	if err := c.resubscribe(ctx, s); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// setSession makes s the current connection, and watches it for disconnects
+func (c *Client) setSession(s *session) {
+	c.mu.Lock()
+	select {
+	case <-c.closed: // Closed while reconnecting
+		c.mu.Unlock()
+		s.close()
+		return
+	default:
+	}
+	c.session = s
+	close(c.ready)
+	c.mu.Unlock()
+
+	c.log.Info("connected to bivrost")
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect()
+	}
+	go c.watch(s)
+}
+
+// watch waits for the connection to drop, and reconnects unless the client is closed
+func (c *Client) watch(s *session) {
+	<-s.done
+
+	c.mu.Lock()
+	c.session = nil
+	c.ready = make(chan struct{})
+	c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	err := s.readErr
+	if err == nil || err == io.EOF {
+		err = ErrDisconnected
+	}
+	c.log.Warn("lost the connection to bivrost", "error", err)
+	if c.opts.OnDisconnect != nil {
+		c.opts.OnDisconnect(err)
+	}
+	if c.opts.DisableReconnect {
+		c.Close()
+		return
+	}
+	c.reconnect()
+}
+
+// reconnect retries with exponential backoff and jitter until it succeeds or the client is closed
+func (c *Client) reconnect() {
+	backoff := c.opts.MinBackoff
+	for attempt := 1; ; attempt++ {
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(wait):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		s, err := c.dial(ctx)
+		cancel()
+		if err == nil {
+			c.setSession(s)
+			return
+		}
+
+		c.log.Debug("reconnect failed", "attempt", attempt, "error", err)
+		if backoff *= 2; backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// current returns the current connection, waiting for a reconnect if necessary
+func (c *Client) current(ctx context.Context) (*session, error) {
+	for {
+		c.mu.Lock()
+		s, ready := c.session, c.ready
+		c.mu.Unlock()
+		if s != nil {
+			return s, nil
+		}
+
+		select {
+		case <-ready:
+		case <-c.closed:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Call sends a raw message to bivrost and waits for the answer.
+// Most modules should use Get and Post instead.
+func (c *Client) Call(ctx context.Context, messageType byte, dataType DataType, data []byte) (Message, error) {
+	s, err := c.current(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	return s.call(ctx, s.newRequest(messageType, dataType, data))
+}
+
+// Close disconnects from bivrost and stops reconnecting
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	if c.session != nil {
+		c.session.close()
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package module
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// Modules import the SDK, so it must not pull in the database or the other dependencies of bivrost itself
+func TestDependencies(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go tool isn't available")
+	}
+	out, err := exec.Command(goTool, "list", "-deps", ".").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := []string{
+		"github.com/pynezz/bivrost/pkg/",
+		"github.com/pynezz/bivrost/internal/ipc",
+		"github.com/klauspost/compress",
+		"gopkg.in/yaml.v3",
+		"golang.org/x/",
+	}
+	for _, dep := range strings.Fields(string(out)) {
+		first, _, _ := strings.Cut(dep, "/")
+		if !strings.Contains(first, ".") {
+			continue // Standard library
+		}
+		ok := false
+		for _, prefix := range allowed {
+			ok = ok || strings.HasPrefix(dep, prefix)
+		}
+		if !ok {
+			t.Errorf("the SDK depends on %s", dep)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/bivrost/pkg/wire"
+)
+
+// session is a single connection to bivrost. The Client replaces it when reconnecting.
+type session struct {
+	conn       *ipc.Conn
+	identifier [4]byte
+	log        *slog.Logger
+	onMessage  func(Message)
+	onEvent    func(Message) // Called with every MSG_EVENT message
+
+	pending   map[string]chan wire.IPCRequest // Requests waiting for a response, keyed by their CorrelationID
+	pendingMu sync.Mutex
+
+	// Negotiated in the handshake. Until then, everything is sent as single uncompressed messages.
+	// Pongs may be sent while the handshake is in flight, so they're guarded by negotiatedMu
+	encoding     string
+	chunkSize    int
+	negotiatedMu sync.RWMutex
+
+	done    chan struct{} // Closed when the read loop exits
+	readErr error         // The error that stopped the read loop
+}
+
+func newSession(conn net.Conn, identifier [4]byte, log *slog.Logger, onMessage, onEvent func(Message)) *session {
+	s := &session{
+		conn:       ipc.NewConn(conn),
+		identifier: identifier,
+		log:        log,
+		onMessage:  onMessage,
+		onEvent:    onEvent,
+		pending:    make(map[string]chan wire.IPCRequest),
+		done:       make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *session) close() {
+	s.conn.Close()
+}
+
+// readLoop reads every message from bivrost, and hands responses over to the pending call they answer
+func (s *session) readLoop() {
+	defer close(s.done)
+
+	assembler := ipc.NewAssembler(0)
+	for {
+		chunk, err := s.conn.Receive()
+		if err != nil {
+			s.readErr = err
+			if err != io.EOF {
+				s.log.Debug("read failed", "error", err)
+			}
+			return
+		}
+
+		msg, done, err := assembler.Add(chunk)
+		if err != nil {
+			s.log.Error("dropping message from bivrost", "error", err)
+			continue
+		}
+		if !done {
+			continue
+		}
+
+		if msg.Header.MessageType == wire.MSG_PING {
+			go s.pong(msg)
+			continue
+		}
+		if msg.Header.MessageType == wire.MSG_EVENT && s.onEvent != nil {
+			s.onEvent(msg)
+			continue
+		}
+
+		s.pendingMu.Lock()
+		ch, ok := s.pending[msg.CorrelationID]
+		delete(s.pending, msg.CorrelationID)
+		s.pendingMu.Unlock()
+
+		if ok {
+			ch <- msg // Buffered, never blocks
+		} else if s.onMessage != nil {
+			s.onMessage(msg)
+		} else {
+			s.log.Debug("ignoring unsolicited message", "type", msg.Header.MessageType)
+		}
+	}
+}
+
+func (s *session) pong(ping wire.IPCRequest) {
+	pong := s.newRequest(wire.MSG_PONG, wire.DATA_TEXT, nil)
+	pong.CorrelationID = ping.CorrelationID
+	if err := s.send(pong); err != nil {
+		s.log.Error("failed to answer ping", "error", err)
+	}
+}
+
+// handshake introduces the module, declares its tables, and agrees on compression and chunk size
+func (s *session) handshake(ctx context.Context, name string, schemas []TableSchema) error {
+	declared := make([]wire.TableSchema, len(schemas))
+	for i, schema := range schemas {
+		declared[i] = schema.model()
+	}
+	data, err := json.Marshal(wire.Handshake{
+		Name:            name,
+		Identifier:      string(s.identifier[:]),
+		ProtocolVersion: wire.PROTOCOL_VERSION,
+		Compression:     ipc.SupportedEncodings,
+		MaxChunkSize:    ipc.DEFAULT_CHUNK_SIZE,
+		Schemas:         declared,
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := s.call(ctx, s.newRequest(wire.MSG_CONN, wire.DATA_JSON, data))
+	if err != nil {
+		return err
+	}
+	if res.Header.MessageType != wire.MSG_CONNACK {
+		return fmt.Errorf("expected a connection acknowledgement, got message type %v", res.Header.MessageType)
+	}
+
+	var server wire.Handshake
+	if err := json.Unmarshal(res.Message.Data, &server); err != nil {
+		return err
+	}
+	var encoding string
+	var chunkSize int
+	if server.ProtocolVersion >= wire.CHUNKING_VERSION {
+		chunkSize = server.MaxChunkSize
+		if len(server.Compression) > 0 {
+			encoding = server.Compression[0]
+		}
+	}
+	s.negotiatedMu.Lock()
+	s.encoding, s.chunkSize = encoding, chunkSize
+	s.negotiatedMu.Unlock()
+	s.log.Debug("handshake complete", "server", server.Name, "protocol_version", server.ProtocolVersion,
+		"compression", encoding, "chunk_size", chunkSize)
+	return nil
+}
+
+func (s *session) send(req *wire.IPCRequest) error {
+	return s.sendBefore(req, time.Time{})
+}
+
+// sendBefore is send with a deadline for writing every message, none if it's zero
+func (s *session) sendBefore(req *wire.IPCRequest, deadline time.Time) error {
+	s.negotiatedMu.RLock()
+	encoding, chunkSize := s.encoding, s.chunkSize
+	s.negotiatedMu.RUnlock()
+	if chunkSize == 0 {
+		return s.conn.SendBefore(req, deadline)
+	}
+	return s.conn.SendChunkedBefore(req, encoding, chunkSize, deadline)
+}
+
+// call sends the request and waits for the response with the same CorrelationID.
+// Error responses from bivrost are returned as an *Error.
+func (s *session) call(ctx context.Context, req *wire.IPCRequest) (wire.IPCRequest, error) {
+	ch := make(chan wire.IPCRequest, 1)
+	s.pendingMu.Lock()
+	s.pending[req.CorrelationID] = ch
+	s.pendingMu.Unlock()
+
+	forget := func() {
+		s.pendingMu.Lock()
+		delete(s.pending, req.CorrelationID)
+		s.pendingMu.Unlock()
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := s.sendBefore(req, deadline); err != nil {
+		forget()
+		return wire.IPCRequest{}, err
+	}
+
+	select {
+	case res := <-ch:
+		if res.Header.MessageType == wire.MSG_ERROR {
+			return res, wire.ParseError(res)
+		}
+		return res, nil
+	case <-ctx.Done():
+		forget()
+		return wire.IPCRequest{}, ctx.Err()
+	case <-s.done:
+		forget()
+		return wire.IPCRequest{}, ErrDisconnected
+	}
+}
+
+func (s *session) newRequest(messageType byte, dataType wire.DataType, data []byte) *wire.IPCRequest {
+	return &wire.IPCRequest{
+		MessageSignature: s.identifier[:],
+		CorrelationID:    ipc.NewCorrelationID(),
+		Header: wire.IPCHeader{
+			Identifier:  s.identifier,
+			MessageType: messageType,
+		},
+		Message: wire.IPCMessage{
+			Datatype: dataType,
+			Data:     data,
+		},
+		Timestamp:  time.Now().UnixNano(),
+		Checksum32: int(crc32.ChecksumIEEE(data)),
+	}
+}
+
+// model converts the schema to the one bivrost validates and stores
+func (t TableSchema) model() wire.TableSchema {
+	schema := wire.TableSchema{Name: t.Name}
+	for _, f := range t.Fields {
+		schema.Fields = append(schema.Fields, wire.FieldSchema(f))
+	}
+	for _, idx := range t.Indexes {
+		schema.Indexes = append(schema.Indexes, wire.IndexSchema(idx))
+	}
+	return schema
+}
@@ -0,0 +1,291 @@
+package moduletest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/bivrost/modules"
+)
+
+// ErrSkipped is returned by checks that could not be carried out, see Result
+var ErrSkipped = errors.New("skipped")
+
+// Check is a single conformance check
+type Check struct {
+	Name string
+	Run  func(ctx context.Context, h *Harness) error
+}
+
+// Result is the outcome of a Check. Err is nil if it passed, and wraps ErrSkipped if it was skipped
+type Result struct {
+	Check string
+	Err   error
+}
+
+func (r Result) Passed() bool  { return r.Err == nil }
+func (r Result) Skipped() bool { return errors.Is(r.Err, ErrSkipped) }
+
+func skip(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrSkipped, fmt.Sprintf(format, a...))
+}
+
+// Expectation is what the module is expected to post to a table. Every row must match one of the posted rows,
+// which may have more fields than the expected row. Values are compared as JSON.
+type Expectation struct {
+	Table string
+	Rows  []json.RawMessage
+}
+
+// Names of the conformance checks
+const (
+	CHECK_HANDSHAKE = "handshake" // The module connects and identifies itself as in its manifest
+	CHECK_POSTS     = "posts"     // The module posts what's expected, and nothing it posts is rejected
+	CHECK_CHECKSUM  = "checksum"  // The module's messages carry valid checksums, and it survives a request failing the checksum
+	CHECK_ERROR     = "error"     // The module survives a request failing on bivrost's side
+	CHECK_RECONNECT = "reconnect" // The module reconnects when bivrost drops the connection, without exiting
+)
+
+// Conformance returns the checks a module must pass to be run by bivrost, in the order they must run.
+// The checksum and error checks need the module to make another request after it has settled, as modules
+// polling bivrost do, and are skipped for modules that don't
+func Conformance(expect ...Expectation) []Check {
+	return []Check{
+		{CHECK_HANDSHAKE, checkHandshake},
+		{CHECK_POSTS, func(ctx context.Context, h *Harness) error { return checkPosts(ctx, h, expect) }},
+		{CHECK_CHECKSUM, checkChecksum},
+		{CHECK_ERROR, checkError},
+		{CHECK_RECONNECT, checkReconnect},
+	}
+}
+
+// Run starts the module, and runs the checks in order. Once a check fails, the rest are skipped
+func (h *Harness) Run(ctx context.Context, checks ...Check) []Result {
+	results := make([]Result, 0, len(checks))
+	failed := ""
+	if err := h.Start(); err != nil {
+		failed = "start"
+		results = append(results, Result{Check: "start", Err: err})
+	}
+	for _, c := range checks {
+		if failed != "" {
+			results = append(results, Result{Check: c.Name, Err: skip("%s failed", failed)})
+			continue
+		}
+		err := c.Run(ctx, h)
+		if err != nil && !errors.Is(err, ErrSkipped) {
+			failed = c.Name
+		}
+		results = append(results, Result{Check: c.Name, Err: err})
+	}
+	return results
+}
+
+// alive returns an error if the module has exited since it was started
+func (h *Harness) alive() error {
+	status := h.Status()
+	switch {
+	case status.LastExit != "":
+		return fmt.Errorf("the module exited (%s)", status.LastExit)
+	case status.State == modules.STATE_FAILED, status.State == modules.STATE_STOPPED:
+		return fmt.Errorf("the module is %s", status.State)
+	}
+	return nil
+}
+
+// errorsSince describes the errors the module was answered with, after the first n
+func (h *Harness) errorsSince(n int) string {
+	var msgs []string
+	for _, e := range h.Errors()[n:] {
+		msgs = append(msgs, string(e.Code)+": "+e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func checkHandshake(ctx context.Context, h *Harness) error {
+	err := h.Wait(ctx, func() bool { return len(h.Handshakes()) > 0 || h.alive() != nil })
+	if err := h.alive(); err != nil {
+		return err
+	}
+	if err != nil {
+		if msgs := h.errorsSince(0); msgs != "" {
+			return fmt.Errorf("the handshake was rejected: %s", msgs)
+		}
+		return fmt.Errorf("the module did not connect: %w", err)
+	}
+
+	hs := h.Handshakes()[0]
+	manifest := h.Manifest()
+	if id := strings.Trim(hs.Identifier, "\x00"); id != manifest.Identifier {
+		return fmt.Errorf("the module identified itself as %q, but its manifest says %q", id, manifest.Identifier)
+	}
+	if hs.ProtocolVersion != manifest.ProtocolVersion {
+		return fmt.Errorf("the module speaks protocol version %d, but its manifest says %d", hs.ProtocolVersion, manifest.ProtocolVersion)
+	}
+	if hs.ProtocolVersion < 1 || hs.ProtocolVersion > ipc.PROTOCOL_VERSION {
+		return fmt.Errorf("protocol version %d is not supported, bivrost speaks 1 to %d", hs.ProtocolVersion, ipc.PROTOCOL_VERSION)
+	}
+	return nil
+}
+
+func checkPosts(ctx context.Context, h *Harness, expect []Expectation) error {
+	missing := func() []string {
+		var missing []string
+		for _, e := range expect {
+			rows := h.Rows(e.Table)
+			for _, row := range e.Rows {
+				if !matchesAnyRow(row, rows) {
+					missing = append(missing, e.Table+": "+string(row))
+				}
+			}
+		}
+		return missing
+	}
+
+	if len(expect) > 0 {
+		h.Wait(ctx, func() bool { return len(missing()) == 0 || h.alive() != nil })
+	}
+	if err := h.Settle(ctx); err != nil {
+		return err
+	}
+	if msgs := h.errorsSince(0); msgs != "" {
+		return fmt.Errorf("bivrost rejected requests of the module: %s", msgs)
+	}
+	if m := missing(); len(m) > 0 {
+		return fmt.Errorf("%d expected rows were not posted, the first is %s", len(m), m[0])
+	}
+	// Modules that post once and exit are fine here, the checks after this one are skipped for them
+	if exit := h.Status().LastExit; exit != "" && exit != "exit status 0" {
+		return fmt.Errorf("the module exited (%s)", exit)
+	}
+	return nil
+}
+
+// matchesAnyRow reports whether one of the rows has every field of the expected row, with the same value
+func matchesAnyRow(expected json.RawMessage, rows []map[string]any) bool {
+	var want map[string]any
+	if err := json.Unmarshal(expected, &want); err != nil {
+		return false
+	}
+	for _, row := range rows {
+		match := true
+		for k, v := range want {
+			if !reflect.DeepEqual(row[k], v) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func checkChecksum(ctx context.Context, h *Harness) error {
+	for _, e := range h.Errors() {
+		if e.Code == ipc.ERR_CHECKSUM {
+			return fmt.Errorf("a message from the module failed the checksum: %s", e.Message)
+		}
+	}
+	return survives(ctx, h, ipc.NewError(ipc.ERR_CHECKSUM, "injected by the conformance test"))
+}
+
+func checkError(ctx context.Context, h *Harness) error {
+	return survives(ctx, h, ipc.NewError(ipc.ERR_INTERNAL, "injected by the conformance test"))
+}
+
+// survives answers the next request of the module with the error, and checks that it's still running
+// and connected after settling
+func survives(ctx context.Context, h *Harness, e *ipc.Error) error {
+	if err := h.alive(); err != nil {
+		return skip("%v", err)
+	}
+	requests := h.Requests()
+	h.Inject(e)
+	if err := h.Wait(ctx, func() bool { return h.Requests() > requests || h.alive() != nil }); err != nil {
+		h.record(func() { h.faults = nil }) // Not for the checks after this one
+		return skip("the module made no further requests")
+	}
+	if err := h.Settle(ctx); err != nil {
+		return err
+	}
+	if err := h.alive(); err != nil {
+		return fmt.Errorf("after a request failed with %s: %w", e.Code, err)
+	}
+	if !h.Connected() {
+		return fmt.Errorf("the module disconnected after a request failed with %s", e.Code)
+	}
+	return nil
+}
+
+func checkReconnect(ctx context.Context, h *Harness) error {
+	if err := h.alive(); err != nil {
+		return skip("%v", err)
+	}
+	handshakes := len(h.Handshakes())
+	if h.Disconnect() == 0 {
+		return fmt.Errorf("the module was not connected")
+	}
+	err := h.Wait(ctx, func() bool { return len(h.Handshakes()) > handshakes || h.alive() != nil })
+	if err := h.alive(); err != nil {
+		return fmt.Errorf("the module exited instead of reconnecting: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("the module did not reconnect: %w", err)
+	}
+	return nil
+}
+
+// TB is the part of testing.TB used by Test
+type TB interface {
+	Helper()
+	Logf(format string, args ...any)
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// Test runs the conformance checks against the module, seeded with the fixtures, keyed by table.
+// Failed checks fail the test, and the module's output is logged:
+//
+//	func TestConformance(t *testing.T) {
+//		moduletest.Test(t, moduletest.Options{Manifest: "config.yaml"}, map[string][]json.RawMessage{
+//			"nginx_logs": {json.RawMessage(`{"remote_addr": "10.0.0.1", "request": "GET /.env HTTP/1.1"}`)},
+//		}, moduletest.Expectation{Table: "threat_records", Rows: ...})
+//	}
+func Test(t TB, opts Options, fixtures map[string][]json.RawMessage, expect ...Expectation) {
+	t.Helper()
+	h, err := New(opts)
+	if err != nil {
+		t.Fatalf("moduletest: %v", err)
+	}
+	defer h.Close()
+
+	for table, rows := range fixtures {
+		if err := h.Seed(table, rows); err != nil {
+			t.Fatalf("moduletest: seeding %s: %v", table, err)
+		}
+	}
+
+	failed := false
+	for _, r := range h.Run(context.Background(), Conformance(expect...)...) {
+		switch {
+		case r.Passed():
+			t.Logf("%s: ok", r.Check)
+		case r.Skipped():
+			t.Logf("%s: %v", r.Check, r.Err)
+		default:
+			failed = true
+			t.Errorf("%s: %v", r.Check, r.Err)
+		}
+	}
+	if failed {
+		for _, line := range h.Output() {
+			t.Logf("[%s] %s", line.Stream, line.Text)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+/*
+Package moduletest runs a module binary against a bivrost of its own, to check that it speaks the protocol.
+
+The harness starts an IPC server in the calling process, with stores in temporary SQLite databases, and runs
+the module through the supervisor, the way bivrost would. Fixture rows are seeded into the tables before
+the module starts, and everything the module posts back is recorded:
+
+	h, err := moduletest.New(moduletest.Options{Manifest: "config.yaml"})
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	err = h.SeedJSONL(models.NGINX_LOGS, fixtures)
+	...
+	for _, r := range h.Run(ctx, moduletest.Conformance(expectations...)...) { ... }
+
+From a Go test, Test does all of the above, see its example. `bivrost module test` does it from the command line.
+*/
+package moduletest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/pynezz/bivrost/internal/config"
+	"github.com/pynezz/bivrost/internal/database"
+	"github.com/pynezz/bivrost/internal/database/models"
+	"github.com/pynezz/bivrost/internal/database/stores"
+	"github.com/pynezz/bivrost/internal/ipc"
+	"github.com/pynezz/bivrost/internal/ipc/ipcserver"
+	"github.com/pynezz/bivrost/modules"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultSettle  = 2 * time.Second
+)
+
+// Sandboxed modules are started through the running binary, see modules/sandbox.go.
+// This makes test binaries importing the package work as the sandbox shim.
+func init() {
+	if modules.IsSandboxShim() {
+		modules.RunSandboxShim()
+	}
+}
+
+// Options configure New
+type Options struct {
+	Manifest string // Path to the module's config.yaml. exec.binary must be set
+	Version  string // The bivrost version the manifest is checked against. Empty skips the version range check
+
+	Timeout time.Duration // How long to wait for the module at each step, defaults to 10s
+	Settle  time.Duration // How long the module must be quiet before it's considered done, defaults to 2s
+}
+
+// Post is the data of a POST request, as it was inserted
+type Post struct {
+	Time  time.Time
+	Table string // As named by the module, without the mod_<identifier>_ prefix of module tables
+	Data  json.RawMessage
+}
+
+// Harness is a bivrost for a single module under test
+type Harness struct {
+	opts       Options
+	dir        string // Temporary directory with the socket and the databases
+	listener   net.Listener
+	server     *ipcserver.IPCServer
+	stores     *stores.Stores
+	supervisor *modules.Supervisor
+	module     modules.Module
+
+	mu         sync.Mutex
+	handshakes []ipc.Handshake
+	posts      []Post
+	errors     []*ipc.Error  // Errors answered to the module, including injected ones
+	requests   int           // Requests received after the handshake, including GETs
+	faults     []*ipc.Error  // Answered to the next requests instead of handling them
+	changed    chan struct{} // Closed and replaced whenever something is recorded
+}
+
+// New loads the manifest, and starts an IPC server for the module on a socket in a temporary directory.
+// The module isn't started until Start, so tables can be seeded first.
+func New(opts Options) (*Harness, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Settle <= 0 {
+		opts.Settle = defaultSettle
+	}
+
+	name, err := manifestName(opts.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	registry := modules.NewRegistry()
+	cfg := config.Cfg{Sources: []config.Sources{{Name: name, Type: "module", Config: opts.Manifest}}}
+	if err := registry.Load(cfg, opts.Version); err != nil {
+		return nil, err
+	}
+	module, _ := registry.Module(name)
+	if module.Config.Exec.Binary == "" {
+		return nil, fmt.Errorf("%s: exec.binary is not set, there is nothing to test", opts.Manifest)
+	}
+
+	// Kept short, as UNIX socket paths are limited to about 100 characters
+	dir, err := os.MkdirTemp("", "bivrost-test-")
+	if err != nil {
+		return nil, err
+	}
+	h := &Harness{
+		opts:       opts,
+		dir:        dir,
+		supervisor: modules.NewSupervisor(),
+		module:     module,
+		changed:    make(chan struct{}),
+	}
+
+	if h.stores, err = openStores(dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	socket := filepath.Join(dir, "bivrost.sock")
+	h.listener, err = net.Listen(ipcserver.AF_UNIX, socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	h.server = ipcserver.NewIPCServer("bivrost-test", "test", registry)
+	h.server.SetStores(h.stores)
+	h.server.SetModuleTables(h.stores.ModuleTables)
+	h.server.SetHooks(ipcserver.Hooks{
+		OnHandshake: h.onHandshake,
+		OnPost:      h.onPost,
+		OnError:     h.onError,
+		Intercept:   h.intercept,
+	})
+	go h.server.Serve(h.listener)
+
+	h.supervisor.SetEnv("BIVROST_SOCKET=" + socket)
+	return h, nil
+}
+
+// manifestName returns the name in the manifest, which the module is registered under like in bivrost's config
+func manifestName(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var m struct {
+		Name string `yaml:"name"`
+	}
+	if err := yaml.NewDecoder(f).Decode(&m); err != nil || m.Name == "" {
+		return "module", nil // Reported with the line number when the registry loads it
+	}
+	return m.Name, nil
+}
+
+// openStores creates the logs and results databases in the directory
+func openStores(dir string) (*stores.Stores, error) {
+	conf := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+	logDB, err := gorm.Open(sqlite.Open(filepath.Join(dir, "logs.db")), conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := logDB.AutoMigrate(&models.NginxLog{}); err != nil {
+		return nil, err
+	}
+	resultsDB, err := gorm.Open(sqlite.Open(filepath.Join(dir, "results.db")), conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := resultsDB.AutoMigrate(models.GetModuleModels()...); err != nil {
+		return nil, err
+	}
+	return stores.New(logDB, resultsDB)
+}
+
+// Seed inserts the rows, JSON objects shaped like the table's model, into one of the built in tables
+func (h *Harness) Seed(table string, rows []json.RawMessage) error {
+	s := h.stores
+	switch table {
+	case models.NGINX_LOGS:
+		return seed(s.NginxLogStore, rows)
+	case models.SYN_TRAFFIC:
+		return seed(s.SynTrafficStore, rows)
+	case models.ATTACK_TYPE:
+		return seed(s.AttackTypeStore, rows)
+	case models.INDICATORS_LOG:
+		return seed(s.IndicatorsLogStore, rows)
+	case models.GEO_LOCATION_DATA:
+		return seed(s.GeoLocationDataStore, rows)
+	case models.GEO_DATA:
+		return seed(s.GeoDataStore, rows)
+	case models.THREAT_RECORDS:
+		return seed(s.ThreatRecordStore, rows)
+	default:
+		return fmt.Errorf("fixtures can only be seeded into the built in tables, not %s", table)
+	}
+}
+
+func seed[T any](store *database.DataStore[T], rows []json.RawMessage) error {
+	for i, row := range rows {
+		var v T
+		if err := json.Unmarshal(row, &v); err != nil {
+			return fmt.Errorf("row %d does not match the %s table: %w", i+1, store.Name(), err)
+		}
+		if err := store.InsertLog(v); err != nil {
+			return fmt.Errorf("row %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// SeedJSONL seeds the table with the rows read from r, one JSON object per line. Blank lines are skipped
+func (h *Harness) SeedJSONL(table string, r io.Reader) error {
+	rows, err := ReadJSONL(r)
+	if err != nil {
+		return err
+	}
+	return h.Seed(table, rows)
+}
+
+// ReadJSONL reads one JSON value per line. Blank lines are skipped
+func ReadJSONL(r io.Reader) ([]json.RawMessage, error) {
+	var rows []json.RawMessage
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), ipc.DEFAULT_MESSAGE_SIZE)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if !json.Valid([]byte(text)) {
+			return nil, fmt.Errorf("line %d is not valid JSON", line)
+		}
+		rows = append(rows, json.RawMessage(text))
+	}
+	return rows, scanner.Err()
+}
+
+// Start starts the module. It's restarted if it exits, like bivrost would, which shows in Restarts
+func (h *Harness) Start() error {
+	return h.supervisor.Start(h.module)
+}
+
+// Close stops the module and the server, and removes the temporary directory
+func (h *Harness) Close() error {
+	h.supervisor.StopAll()
+	h.listener.Close()
+	h.server.CloseConn()
+	h.server.Disconnect(h.module.Config.Identifier)
+	return os.RemoveAll(h.dir)
+}
+
+// Identifier returns the identifier of the module under test
+func (h *Harness) Identifier() string {
+	return h.module.Config.Identifier
+}
+
+// Manifest returns the module's parsed config.yaml
+func (h *Harness) Manifest() *modules.ModuleConfig {
+	return h.module.Config
+}
+
+/* RECORDING */
+
+func (h *Harness) record(f func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f()
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *Harness) onHandshake(identifier string, hs ipc.Handshake) {
+	h.record(func() { h.handshakes = append(h.handshakes, hs) })
+}
+
+func (h *Harness) onPost(identifier, table string, data json.RawMessage) {
+	h.record(func() { h.posts = append(h.posts, Post{Time: time.Now(), Table: table, Data: data}) })
+}
+
+func (h *Harness) onError(identifier string, e *ipc.Error) {
+	copied := *e
+	h.record(func() { h.errors = append(h.errors, &copied) })
+}
+
+func (h *Harness) intercept(identifier string, m ipc.Metadata) *ipc.Error {
+	var fault *ipc.Error
+	h.record(func() {
+		h.requests++
+		if len(h.faults) > 0 {
+			fault, h.faults = h.faults[0], h.faults[1:]
+		}
+	})
+	if fault == nil {
+		return nil
+	}
+	copied := *fault
+	return &copied
+}
+
+// Inject answers the next request of the module with the error, instead of handling it
+func (h *Harness) Inject(e *ipc.Error) {
+	h.record(func() { h.faults = append(h.faults, e) })
+}
+
+// Handshakes returns every handshake the module completed, one per connection
+func (h *Harness) Handshakes() []ipc.Handshake {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]ipc.Handshake(nil), h.handshakes...)
+}
+
+// Posts returns the POSTs to the table, or to every table if it's empty, in the order they were inserted
+func (h *Harness) Posts(table string) []Post {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var posts []Post
+	for _, p := range h.posts {
+		if table == "" || p.Table == table {
+			posts = append(posts, p)
+		}
+	}
+	return posts
+}
+
+// Rows returns every row posted to the table, decoded as JSON objects
+func (h *Harness) Rows(table string) []map[string]any {
+	var rows []map[string]any
+	for _, p := range h.Posts(table) {
+		var list []map[string]any
+		if err := json.Unmarshal(p.Data, &list); err == nil {
+			rows = append(rows, list...)
+			continue
+		}
+		var row map[string]any
+		if err := json.Unmarshal(p.Data, &row); err == nil {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// Errors returns the errors the module was answered with, including injected ones
+func (h *Harness) Errors() []*ipc.Error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*ipc.Error(nil), h.errors...)
+}
+
+// Requests returns how many requests the module has made, not counting handshakes, pings and acknowledgements
+func (h *Harness) Requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+// Connected reports whether the module is connected to the server
+func (h *Harness) Connected() bool {
+	for _, c := range h.server.Connections() {
+		if c.Identifier == h.module.Config.Identifier {
+			return true
+		}
+	}
+	return false
+}
+
+// Disconnect closes the module's connections from the server side, and returns how many were closed
+func (h *Harness) Disconnect() int {
+	return h.server.Disconnect(h.module.Config.Identifier)
+}
+
+// Status returns the state of the module process
+func (h *Harness) Status() modules.Status {
+	for _, s := range h.supervisor.Status() {
+		if s.Name == h.module.Name {
+			return s
+		}
+	}
+	return modules.Status{Name: h.module.Name, State: modules.STATE_STOPPED}
+}
+
+// Output returns the last lines the module wrote to stdout and stderr
+func (h *Harness) Output() []modules.LogLine {
+	lines, _ := h.supervisor.Logs(h.module.Name)
+	return lines
+}
+
+// Wait blocks until cond returns true, checking it whenever something is recorded.
+// Gives up with an error when the context is done or the module's timeout has passed.
+func (h *Harness) Wait(ctx context.Context, cond func() bool) error {
+	ctx, cancel := context.WithTimeout(ctx, h.opts.Timeout)
+	defer cancel()
+	for {
+		h.mu.Lock()
+		changed := h.changed
+		h.mu.Unlock()
+		if cond() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %s", h.opts.Timeout)
+		case <-changed:
+		case <-time.After(100 * time.Millisecond): // For conditions on state that isn't recorded, ex: the process
+		}
+	}
+}
+
+// Settle blocks until the module hasn't posted anything for the settle time of the options.
+// A module that keeps posting is given up on after the timeout, without an error.
+func (h *Harness) Settle(ctx context.Context) error {
+	deadline := time.Now().Add(h.opts.Timeout)
+	quietSince, posts := time.Now(), len(h.Posts(""))
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for time.Since(quietSince) < h.opts.Settle && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if n := len(h.Posts("")); n != posts {
+			quietSince, posts = time.Now(), n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package wire
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// When a request can't be handled, the server answers with a MSG_ERROR message carrying an Error as JSON data.
+
+// ErrorCode tells what kind of error occurred
+type ErrorCode string
+
+const (
+	ERR_CHECKSUM      ErrorCode = "bad_checksum"   // The checksum didn't match the data
+	ERR_UNKNOWN_TABLE ErrorCode = "unknown_table"  // The requested table doesn't exist
+	ERR_FORBIDDEN     ErrorCode = "forbidden"      // The module isn't allowed to do this
+	ERR_DECODE        ErrorCode = "decode_failure" // The request couldn't be decoded or understood
+	ERR_INTERNAL      ErrorCode = "internal"       // Something went wrong on the server
+	ERR_SCHEMA        ErrorCode = "invalid_schema" // A table schema was invalid, or couldn't be migrated
+	ERR_TOO_LARGE     ErrorCode = "too_large"      // The message was larger than the maximum message size
+)
+
+// Error is the envelope sent as the data of a MSG_ERROR message.
+// It is also returned as an error by the client, so callers can check the code with errors.As.
+type Error struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id"` // CorrelationID of the failed request
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s (request %s)", e.Code, e.Message, e.RequestID)
+}
+
+// NewError returns an Error with the given code and formatted message
+func NewError(code ErrorCode, format string, args ...any) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// AsError returns err as an *Error, wrapping it with the given code if it isn't one already
+func AsError(err error, code ErrorCode) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
+
+// ParseError reads the Error envelope from a MSG_ERROR message.
+// Messages from older servers carry a plain string, which is returned as an internal error.
+func ParseError(msg IPCRequest) *Error {
+	var e Error
+	if err := json.Unmarshal(msg.Message.Data, &e); err != nil || e.Code == "" {
+		e = Error{Code: ERR_INTERNAL, Message: string(msg.Message.Data)}
+	}
+	if e.RequestID == "" {
+		e.RequestID = msg.CorrelationID
+	}
+	return &e
+}
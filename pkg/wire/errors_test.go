@@ -0,0 +1,53 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Error
+	}{
+		{"envelope", `{"code":"unknown_table","message":"no table nope","request_id":"abc"}`,
+			Error{Code: ERR_UNKNOWN_TABLE, Message: "no table nope", RequestID: "abc"}},
+		{"envelope without request ID", `{"code":"forbidden","message":"no"}`,
+			Error{Code: ERR_FORBIDDEN, Message: "no", RequestID: "correlation"}},
+		{"plain string from an older server", `CHKSUM ERROR`,
+			Error{Code: ERR_INTERNAL, Message: "CHKSUM ERROR", RequestID: "correlation"}},
+		{"JSON without a code", `{"message":"what"}`,
+			Error{Code: ERR_INTERNAL, Message: `{"message":"what"}`, RequestID: "correlation"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := IPCRequest{CorrelationID: "correlation", Message: IPCMessage{Data: []byte(tt.data)}}
+			if got := ParseError(msg); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ParseError(%s) = %+v, want %+v", tt.data, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAsError(t *testing.T) {
+	envelope := NewError(ERR_SCHEMA, "table %s", "x")
+	tests := []struct {
+		name string
+		err  error
+		want *Error
+	}{
+		{"already an Error", envelope, envelope},
+		{"wrapped Error", fmt.Errorf("registering: %w", envelope), envelope},
+		{"other error", errors.New("disk full"), &Error{Code: ERR_INTERNAL, Message: "disk full"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AsError(tt.err, ERR_INTERNAL); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AsError(%v) = %+v, want %+v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Modules publish events on dot separated topics, ex: finding.attack or ioc.ip, and bivrost delivers them to every
+// module subscribed to a matching pattern. In a pattern, * matches a single segment and a trailing > one or more.
+
+// Request methods of the event bus, see Metadata.Method
+const (
+	METHOD_PUBLISH     = "PUBLISH"     // Data is the payload of the event
+	METHOD_SUBSCRIBE   = "SUBSCRIBE"   // Metadata.Topic is the pattern
+	METHOD_UNSUBSCRIBE = "UNSUBSCRIBE" // Metadata.Topic is the pattern
+)
+
+const maxTopicLength = 255
+
+// Event is the JSON data of a MSG_EVENT message
+type Event struct {
+	ID           uint64          `json:"id"`
+	Topic        string          `json:"topic"`
+	Source       string          `json:"source"` // Identifier of the publishing module
+	Payload      json.RawMessage `json:"payload"`
+	PublishedAt  time.Time       `json:"published_at"`
+	Subscription string          `json:"subscription"` // The pattern the event was delivered for
+	Attempt      int             `json:"attempt"`      // 1 on the first delivery, higher when redelivered
+}
+
+// EventAck is the JSON data of a MSG_EVENTACK message. It's not answered
+type EventAck struct {
+	Subscription string `json:"subscription"`
+	ID           uint64 `json:"id"`
+}
+
+// Published is the answer to a PUBLISH request
+type Published struct {
+	ID          uint64 `json:"id"`
+	Subscribers int    `json:"subscribers"` // How many subscriptions the event was queued for
+}
+
+// ValidateTopic checks the topic of a published event
+func ValidateTopic(topic string) error {
+	return validateTopic(topic, false)
+}
+
+// ValidatePattern checks a subscription pattern
+func ValidatePattern(pattern string) error {
+	return validateTopic(pattern, true)
+}
+
+func validateTopic(topic string, pattern bool) error {
+	if topic == "" {
+		return fmt.Errorf("topic is empty")
+	}
+	if len(topic) > maxTopicLength {
+		return fmt.Errorf("topic is longer than %d characters", maxTopicLength)
+	}
+	segments := strings.Split(topic, ".")
+	for i, s := range segments {
+		switch {
+		case pattern && s == "*":
+			continue
+		case pattern && s == ">":
+			if i != len(segments)-1 {
+				return fmt.Errorf("%q: > is only allowed as the last segment", topic)
+			}
+			continue
+		case s == "":
+			return fmt.Errorf("%q has an empty segment", topic)
+		}
+		for _, c := range s {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+				if c == '*' || c == '>' {
+					return fmt.Errorf("%q: wildcards are only allowed in subscriptions, as whole segments", topic)
+				}
+				return fmt.Errorf("%q: segments may only contain lowercase letters, digits, _ and -", topic)
+			}
+		}
+	}
+	return nil
+}
+
+// MatchTopic reports whether the topic matches the subscription pattern
+func MatchTopic(pattern, topic string) bool {
+	ps := strings.Split(pattern, ".")
+	ts := strings.Split(topic, ".")
+	for i, p := range ps {
+		if p == ">" {
+			return len(ts) > i
+		}
+		if i >= len(ts) || (p != "*" && p != ts[i]) {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
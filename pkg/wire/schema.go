@@ -0,0 +1,102 @@
+package wire
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Modules can declare their own result tables, in their manifest or in the IPC handshake.
+// bivrost namespaces each table by the module identifier.
+
+// Field types of a module table
+const (
+	FIELD_STRING = "string"
+	FIELD_INT    = "int"
+	FIELD_FLOAT  = "float"
+	FIELD_BOOL   = "bool"
+	FIELD_TIME   = "time" // RFC 3339
+	FIELD_JSON   = "json" // Any JSON value, stored as text
+)
+
+// TableSchema is a result table declared by a module
+type TableSchema struct {
+	Name    string        `yaml:"name" json:"name"`
+	Fields  []FieldSchema `yaml:"fields" json:"fields"`
+	Indexes []IndexSchema `yaml:"indexes,omitempty" json:"indexes,omitempty"`
+}
+
+// FieldSchema is a column of a module table. Every table also gets an id and a created_at column.
+type FieldSchema struct {
+	Name     string `yaml:"name" json:"name"`
+	Type     string `yaml:"type" json:"type"`
+	Required bool   `yaml:"required,omitempty" json:"required,omitempty"`
+}
+
+// IndexSchema is an index over one or more fields
+type IndexSchema struct {
+	Fields []string `yaml:"fields" json:"fields"`
+	Unique bool     `yaml:"unique,omitempty" json:"unique,omitempty"`
+}
+
+// Names end up in SQL, so they are kept to a safe subset
+var schemaName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,47}$`)
+
+// reservedFields are added to every module table by bivrost
+var reservedFields = map[string]bool{"id": true, "created_at": true}
+
+// Validate checks the names and types of the schema
+func (s TableSchema) Validate() error {
+	if !schemaName.MatchString(s.Name) {
+		return fmt.Errorf("table name %q must be lowercase letters, digits and underscores, starting with a letter", s.Name)
+	}
+	if len(s.Fields) == 0 {
+		return fmt.Errorf("table %s has no fields", s.Name)
+	}
+
+	fields := make(map[string]bool)
+	for _, f := range s.Fields {
+		if !schemaName.MatchString(f.Name) {
+			return fmt.Errorf("field name %q in table %s must be lowercase letters, digits and underscores, starting with a letter", f.Name, s.Name)
+		}
+		if reservedFields[f.Name] {
+			return fmt.Errorf("field name %q in table %s is reserved", f.Name, s.Name)
+		}
+		if fields[f.Name] {
+			return fmt.Errorf("field %s is declared twice in table %s", f.Name, s.Name)
+		}
+		if !IsFieldType(f.Type) {
+			return fmt.Errorf("field %s in table %s has unknown type %q, expected string, int, float, bool, time or json", f.Name, s.Name, f.Type)
+		}
+		fields[f.Name] = true
+	}
+
+	for _, idx := range s.Indexes {
+		if len(idx.Fields) == 0 {
+			return fmt.Errorf("index in table %s has no fields", s.Name)
+		}
+		for _, f := range idx.Fields {
+			if !fields[f] && !reservedFields[f] {
+				return fmt.Errorf("index in table %s refers to unknown field %s", s.Name, f)
+			}
+		}
+	}
+	return nil
+}
+
+// Field returns the field with the name, if it's declared
+func (s TableSchema) Field(name string) (FieldSchema, bool) {
+	for _, f := range s.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return FieldSchema{}, false
+}
+
+func IsFieldType(t string) bool {
+	switch t {
+	case FIELD_STRING, FIELD_INT, FIELD_FLOAT, FIELD_BOOL, FIELD_TIME, FIELD_JSON:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+// Package wire holds the messages exchanged by bivrost and its modules over IPC.
+// It only depends on the standard library, so modules importing the SDK don't pull in bivrost's own dependencies.
+package wire
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// PROTOCOL_VERSION is the version of the IPC protocol described by this package.
+// Modules that never send a handshake are assumed to speak version 0.
+//
+//	1: handshake, heartbeats
+//	2: chunked messages and compression
+//	3: event bus
+const PROTOCOL_VERSION = 3
+
+// CHUNKING_VERSION is the first protocol version that understands chunked and compressed messages
+const CHUNKING_VERSION = 2
+
+// EVENTS_VERSION is the first protocol version that receives events
+const EVENTS_VERSION = 3
+
+type IPCRequest struct {
+	MessageSignature []byte     // The message signature, used to declare an ipcRequest
+	CorrelationID    string     // Set by the sender of a request, and echoed by the server in the response
+	Header           IPCHeader  // The header - containing type and identifier
+	Message          IPCMessage // The message
+	Timestamp        int64      // Timestamp of the message
+	Checksum32       int        // Checksum of the message byte data
+	Chunk            byte       // Chunk marker (CHUNK_NONE, CHUNK_BEGIN, CHUNK_CONTINUE, CHUNK_END)
+}
+
+type IPCHeader struct {
+	Identifier  [4]byte // Identifier of the module - available from the IPCClient for qol purposes
+	MessageType byte    // Type of the message
+}
+
+type IPCMessage struct {
+	Datatype   DataType // Type of the data ("json", "string", "int", etc.)
+	Data       []byte   // The actual data
+	StringData string   // String representation of the data if applicable
+	Encoding   string   // Compression of Data (ENCODING_NONE, ENCODING_GZIP, ENCODING_ZSTD)
+}
+
+type DataType int
+
+const (
+	MSG_CONN    = 0x01 // Connection message
+	MSG_ACK     = 0x02 // Acknowledgement message
+	MSG_CONNACK = 0x03 // Connection acknowledgement message
+	MSG_MSG     = 0x04 // Message
+	MSG_MSGACK  = 0x05 // Message acknowledgement
+
+	MSG_EVENT    = 0x06 // Event pushed to a subscribed module
+	MSG_EVENTACK = 0x07 // Acknowledgement of an event, sent by the module
+
+	MSG_PING = 0x08 // Ping message
+	MSG_PONG = 0x09 // Pong message
+
+	MSG_DISCONNECT = 0xD1 // Disconnect message
+
+	// Error message
+	// The sender is obviously still connected, but something went wrong and the message was not handled
+	MSG_ERROR = 0xEE
+
+	MSG_UNKNOWN = 0xFF // Unknown message - for signifying unknown type, maybe an error, but the receiver will try to wing it
+)
+
+const (
+	DATA_TEXT = 0x01 // Text data
+	DATA_INT  = 0x02 // Integer data
+	DATA_JSON = 0x03 // JSON data	(used for structured data)
+	DATA_YAML = 0x04 // YAML data	(used for configuration files)
+	DATA_BIN  = 0x05 // Binary data	(such as images, files, etc.)
+)
+
+// Payloads larger than the negotiated chunk size are split into a stream of messages sharing the same CorrelationID,
+// CHUNK_BEGIN, zero or more CHUNK_CONTINUE and CHUNK_END. Payloads that fit in a single chunk are sent as CHUNK_NONE.
+const (
+	CHUNK_NONE     = 0x00 // Not chunked
+	CHUNK_BEGIN    = 0x01 // First chunk of a stream
+	CHUNK_CONTINUE = 0x02 // Chunk in the middle of a stream
+	CHUNK_END      = 0x03 // Last chunk of a stream
+)
+
+// Message encodings. ENCODING_NONE leaves the data as is.
+const (
+	ENCODING_NONE = ""
+	ENCODING_GZIP = "gzip"
+	ENCODING_ZSTD = "zstd"
+)
+
+var MSGTYPE = map[string]byte{
+	"conn":       byte(MSG_CONN),
+	"ack":        byte(MSG_ACK),
+	"connack":    byte(MSG_CONNACK),
+	"msg":        byte(MSG_MSG),
+	"msgack":     byte(MSG_MSGACK),
+	"event":      byte(MSG_EVENT),
+	"eventack":   byte(MSG_EVENTACK),
+	"ping":       byte(MSG_PING),
+	"pong":       byte(MSG_PONG),
+	"disconnect": byte(MSG_DISCONNECT),
+	"error":      byte(MSG_ERROR),
+	"unknown":    byte(MSG_UNKNOWN),
+}
+
+// MessageTypeName returns the name of the message type, as in MSGTYPE, or its number if it's unknown
+func MessageTypeName(t byte) string {
+	for name, v := range MSGTYPE {
+		if v == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
+type Metadata struct {
+	Source      string      `json:"source"`          // Source. Ex: sigma
+	Destination Destination `json:"destination"`     // Destination. Ex: { name: database, info: "table=threat_intel" }
+	Method      string      `json:"method"`          // Using HTTP verbs to differentiate between requests (ps: this got nothing to do with actual HTTP)
+	Type        any         `json:"type"`            // Type of the data. A struct or a map
+	Topic       string      `json:"topic,omitempty"` // Topic or pattern of PUBLISH, SUBSCRIBE and UNSUBSCRIBE requests, see events.go
+}
+
+type Destination struct {
+	Object Object `json:"destination" yaml:"destination"` // Object (descriptor of the destination) should unmarsal as Destination
+}
+
+type Object struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Database Database `json:"database"`
+}
+
+type Database struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	RowID string `json:"row_id,omitempty"` // Row ID - fetch anything after this ID
+}
+
+// Handshake is sent as JSON data in a MSG_CONN message when a module connects,
+// and answered by the server with its own Handshake in a MSG_CONNACK message.
+type Handshake struct {
+	Name            string `json:"name"`             // Name of the module (or server)
+	Identifier      string `json:"identifier"`       // 4 character identifier
+	ProtocolVersion int    `json:"protocol_version"` // Version of the IPC protocol the sender speaks
+
+	// Compression encodings the sender accepts, in order of preference.
+	// The server answers with the single encoding it picked, if any.
+	Compression  []string `json:"compression,omitempty"`
+	MaxChunkSize int      `json:"max_chunk_size,omitempty"` // Largest chunk the sender wants to receive, in bytes
+
+	// Result tables the module wants, in addition to those in its manifest. Ignored in the server's answer
+	Schemas []TableSchema `json:"schemas,omitempty"`
+}
+
+func (r *IPCRequest) Stringify() string {
+	h := fmt.Sprintf("HEADER:\n\tIdentifier: %q\n\tMessageType: %s (0x%02x)\n\tCorrelationID: %s\n",
+		r.Header.Identifier[:], MessageTypeName(r.Header.MessageType), r.Header.MessageType, r.CorrelationID)
+	m := fmt.Sprintf("MESSAGE:\n\tDatatype: %d\n\tData: %s\n\tStringData: %v\n", r.Message.Datatype, printableData(r.Message), r.Message.StringData)
+	if r.Message.Encoding != ENCODING_NONE {
+		m += fmt.Sprintf("\tEncoding: %s\n", r.Message.Encoding)
+	}
+	if r.Chunk != CHUNK_NONE {
+		m += fmt.Sprintf("\tChunk: %d\n", r.Chunk)
+	}
+	c := fmt.Sprintf("CHECKSUM: %v\n", r.Checksum32)
+	return h + m + c
+}
+
+// printableData returns the data as text if it is, otherwise as bytes
+func printableData(m IPCMessage) string {
+	if m.Encoding == ENCODING_NONE && utf8.Valid(m.Data) {
+		return string(m.Data)
+	}
+	return fmt.Sprintf("%v", m.Data)
+}